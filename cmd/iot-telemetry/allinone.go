@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log/slog"
+	"os"
+
+	"github.com/RaghibA/iot-telemetry/db"
+	"github.com/RaghibA/iot-telemetry/db/sqlite"
+	"github.com/RaghibA/iot-telemetry/pkg/broker"
+	"github.com/RaghibA/iot-telemetry/pkg/broker/factory"
+	"github.com/RaghibA/iot-telemetry/pkg/config"
+	"github.com/RaghibA/iot-telemetry/pkg/grpcserver"
+	"github.com/RaghibA/iot-telemetry/pkg/httpserver"
+	"github.com/RaghibA/iot-telemetry/pkg/jwt"
+	"github.com/RaghibA/iot-telemetry/pkg/logging"
+	"github.com/RaghibA/iot-telemetry/pkg/tracing"
+	adminservice "github.com/RaghibA/iot-telemetry/services/admin/service"
+	authservice "github.com/RaghibA/iot-telemetry/services/auth/service"
+	consumerservice "github.com/RaghibA/iot-telemetry/services/consumer/service"
+	dataservice "github.com/RaghibA/iot-telemetry/services/data/service"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// allInOneDefaults returns the defaults of the all-in-one command, which listens on
+// port 8080 and uses the in-process broker unless configured otherwise.
+// Params: None
+// Returns:
+// - *config.Config: a pointer to the default configuration
+func allInOneDefaults() *config.Config {
+	cfg := config.Default()
+	cfg.Server.Port = "8080"
+	cfg.Broker.Backend = config.BackendMemory
+	return cfg
+}
+
+// runAllInOne opens the SQLite database, applies its migrations and serves every
+// service from a single HTTP server.
+// Params:
+// - args: []string - the command line arguments after the command name
+// Returns: None
+func runAllInOne(args []string) {
+	logger := logging.New("iot-telemetry")
+	slog.SetDefault(logger)
+
+	cfg, err := config.LoadWithDefaults(allInOneDefaults(), "iot-telemetry all-in-one", args,
+		config.Server, config.SQLite, config.Broker, config.Consumer, config.Ingest, config.JWT)
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
+	if err != nil {
+		fatal(logger, err)
+	}
+	jwt.SetSecret(cfg.JWT.Secret)
+
+	shutdownTracing, err := tracing.Init(context.Background(), "iot-telemetry", cfg.Tracing.OTLPEndpoint)
+	if err != nil {
+		fatal(logger, err)
+	}
+	defer shutdownTracing(context.Background())
+
+	database, err := sqlite.Open(cfg.SQLite.Path)
+	if err != nil {
+		fatal(logger, err)
+	}
+	defer database.Close()
+
+	if err := database.Migrate(); err != nil {
+		fatal(logger, err)
+	}
+	logger.Info("sqlite database ready", "path", cfg.SQLite.Path)
+
+	b, err := factory.New(cfg)
+	if err != nil {
+		fatal(logger, err)
+	}
+	defer b.Close()
+
+	grpcServer, err := grpcserver.New(cfg, logger)
+	if err != nil {
+		fatal(logger, err)
+	}
+	ingestBroker, stopWAL, err := dataservice.StartWAL(b, cfg, logger)
+	if err != nil {
+		fatal(logger, err)
+	}
+	defer stopWAL()
+	router := newRouter(cfg, database, logger, b, ingestBroker, grpcServer)
+	stopCoAP, err := dataservice.StartCoAP(router, cfg, logger)
+	if err != nil {
+		fatal(logger, err)
+	}
+	defer stopCoAP()
+	if err := grpcServer.Start(); err != nil {
+		fatal(logger, err)
+	}
+	defer grpcServer.Stop()
+
+	srv := httpserver.New(cfg, router)
+	logger.Info("all-in-one server running", "addr", srv.Addr, "tls", cfg.TLS.Enabled(), "broker", cfg.Broker.Backend)
+	if err := httpserver.ListenAndServe(cfg, srv); err != nil {
+		fatal(logger, err)
+	}
+}
+
+// newRouter mounts the routes of every service on one router, under the same path
+// prefixes the services use when deployed separately, and their gRPC APIs on grpcServer.
+// Params:
+// - cfg: *config.Config - the configuration
+// - db: db.DB - the database shared by the services
+// - logger: *slog.Logger - the logger instance
+// - b: broker.Broker - the message broker shared by the services
+// - ingestBroker: broker.Broker - the broker the data service publishes to, b or its write-ahead log
+// - grpcServer: *grpcserver.Server - the gRPC server shared by the services
+// Returns:
+// - *mux.Router: the router serving every service
+func newRouter(cfg *config.Config, db db.DB, logger *slog.Logger, b broker.Broker, ingestBroker broker.Broker, grpcServer *grpcserver.Server) *mux.Router {
+	router := mux.NewRouter()
+	router.Use(tracing.Middleware("iot-telemetry"))
+	router.Use(logging.Middleware(logger))
+	router.Use(httpserver.LimitBody(cfg.Limits))
+
+	authservice.Routes(router, cfg, db, logger)
+	adminservice.Routes(router, cfg, db, logger, b)
+	dataservice.Routes(router, grpcServer, cfg, db, logger, ingestBroker)
+	consumerservice.Routes(router, grpcServer, cfg, db, logger, b)
+
+	router.Handle("/metrics", promhttp.Handler()) // Expose metrics at /metrics
+
+	return router
+}
+
+// fatal logs an unrecoverable startup error and exits.
+// Params:
+// - logger: *slog.Logger - the logger
+// - err: error - the error to log
+// Returns: None
+func fatal(logger *slog.Logger, err error) {
+	logger.Error("all-in-one failed", "err", err)
+	os.Exit(1)
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/RaghibA/iot-telemetry/db/sqlite"
+	"github.com/RaghibA/iot-telemetry/pkg/broker/memory"
+	"github.com/RaghibA/iot-telemetry/pkg/grpcserver"
+	"github.com/RaghibA/iot-telemetry/pkg/jwt"
+	"github.com/RaghibA/iot-telemetry/pkg/telemetrypb"
+	"github.com/RaghibA/iot-telemetry/pkg/utils"
+	"github.com/gorilla/websocket"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// newTestServer serves the all-in-one router backed by a fresh SQLite file and a
+// memory broker, and the gRPC APIs on a local port, returning its address.
+func newTestServer(t *testing.T) (*httptest.Server, string) {
+	t.Helper()
+	cfg := allInOneDefaults()
+	cfg.JWT.Secret = "testJwtSecretKey"
+	cfg.Server.GRPCAddr = "127.0.0.1:0"
+	jwt.SetSecret(cfg.JWT.Secret)
+
+	database, err := sqlite.Open(filepath.Join(t.TempDir(), "iot.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { database.Close() })
+	if err := database.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+
+	b := memory.New(memory.DefaultCapacity)
+	t.Cleanup(func() { b.Close() })
+
+	logger := utils.NewTestLogger(new(bytes.Buffer))
+	grpcServer, err := grpcserver.New(cfg, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(newRouter(cfg, database, logger, b, b, grpcServer))
+	t.Cleanup(srv.Close)
+	if err := grpcServer.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(grpcServer.Stop)
+	return srv, grpcServer.Addr().String()
+}
+
+// newDevice registers and logs in a user, then registers a device, returning the user's
+// API key, the Authorization header of an access token and the device ID.
+func newDevice(t *testing.T, srv *httptest.Server) (string, string, string) {
+	t.Helper()
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := srv.Client()
+	client.Jar = jar
+
+	var registered struct {
+		APIKey string `json:"apiKey"`
+	}
+	status := call(t, client, http.MethodPost, srv.URL+"/api/v1/auth/register",
+		map[string]string{"username": "testuser", "password": "password123", "email": "test@example.com"}, nil, &registered)
+	if status != http.StatusOK {
+		t.Fatalf("register: expected 200, got %d", status)
+	}
+
+	status = call(t, client, http.MethodPost, srv.URL+"/api/v1/auth/login",
+		map[string]string{"username": "testuser", "password": "password123"}, nil, nil)
+	if status != http.StatusAccepted {
+		t.Fatalf("login: expected 202, got %d", status)
+	}
+
+	var token struct {
+		AccessToken string `json:"accessToken"`
+	}
+	if status := call(t, client, http.MethodPost, srv.URL+"/api/v1/auth/access-token", nil, nil, &token); status != http.StatusOK {
+		t.Fatalf("access token: expected 200, got %d", status)
+	}
+	authorization := "Bearer " + token.AccessToken
+
+	var device struct {
+		DeviceID string `json:"deviceId"`
+	}
+	status = call(t, client, http.MethodPost, srv.URL+"/api/v1/admin/device", map[string]string{"deviceName": "sensor"}, map[string]string{"Authorization": authorization}, &device)
+	if status != http.StatusOK {
+		t.Fatalf("register device: expected 200, got %d", status)
+	}
+	return registered.APIKey, authorization, device.DeviceID
+}
+
+// call sends a JSON request and decodes a JSON response into out, if given.
+func call(t *testing.T, client *http.Client, method string, url string, body any, headers map[string]string, out any) int {
+	t.Helper()
+	var reader io.Reader
+	if body != nil {
+		marshalled, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader = bytes.NewReader(marshalled)
+	}
+
+	req, err := http.NewRequest(method, url, reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	if out != nil && res.StatusCode < 300 {
+		if err := json.NewDecoder(res.Body).Decode(out); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return res.StatusCode
+}
+
+func TestAllInOne(t *testing.T) {
+	t.Run("should report every service ready", func(t *testing.T) {
+		srv, _ := newTestServer(t)
+
+		for _, prefix := range []string{"auth", "admin", "data", "telemetry"} {
+			status := call(t, srv.Client(), http.MethodGet, srv.URL+"/api/v1/"+prefix+"/health/ready", nil, nil, nil)
+			if status != http.StatusOK {
+				t.Errorf("expected %s to be ready, got %d", prefix, status)
+			}
+		}
+		if status := call(t, srv.Client(), http.MethodGet, srv.URL+"/metrics", nil, nil, nil); status != http.StatusOK {
+			t.Errorf("expected metrics to be served, got %d", status)
+		}
+	})
+
+	t.Run("should deliver ingested telemetry to a websocket consumer", func(t *testing.T) {
+		srv, _ := newTestServer(t)
+		apiKey, authorization, deviceId := newDevice(t, srv)
+		client := srv.Client()
+
+		wsURL := "ws" + strings.TrimPrefix(srv.URL, "http") + "/api/v1/telemetry/ws"
+		conn, _, err := websocket.DefaultDialer.Dial(wsURL, http.Header{
+			"Authorization": {authorization},
+			"X-Device-Id":   {deviceId},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		// the consumer subscribes from the newest message after the upgrade, so events
+		// are sent until one arrives
+		received := make(chan []byte, 1)
+		go func() {
+			_, msg, err := conn.ReadMessage()
+			if err == nil {
+				received <- msg
+			}
+		}()
+
+		event := map[string]any{"deviceId": deviceId, "data": map[string]float64{"temp": 21.5}}
+		deadline := time.After(5 * time.Second)
+		for {
+			status := call(t, client, http.MethodPost, srv.URL+"/api/v1/data/event", event, map[string]string{"x-api-key": apiKey}, nil)
+			if status != http.StatusAccepted {
+				t.Fatalf("send event: expected 202, got %d", status)
+			}
+
+			select {
+			case msg := <-received:
+				if string(msg) != `{"temp":21.5}` {
+					t.Errorf("expected event data, got %s", msg)
+				}
+				return
+			case <-time.After(100 * time.Millisecond):
+			case <-deadline:
+				t.Fatal("no message delivered to the websocket")
+			}
+		}
+	})
+	t.Run("should deliver telemetry sent over gRPC to a gRPC subscriber", func(t *testing.T) {
+		srv, grpcAddr := newTestServer(t)
+		apiKey, authorization, deviceId := newDevice(t, srv)
+
+		conn, err := grpc.NewClient(grpcAddr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		stream, err := telemetrypb.NewStreamServiceClient(conn).Subscribe(
+			metadata.AppendToOutgoingContext(ctx, "authorization", authorization),
+			&telemetrypb.SubscribeRequest{DeviceId: deviceId, Fields: []string{"temp"}},
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// as with the websocket, readings are sent until the subscription receives one
+		received := make(chan *telemetrypb.Event, 1)
+		go func() {
+			if ev, err := stream.Recv(); err == nil {
+				received <- ev
+			}
+		}()
+
+		ingest := telemetrypb.NewIngestServiceClient(conn)
+		sendCtx := metadata.AppendToOutgoingContext(ctx, "x-api-key", apiKey)
+		for {
+			_, err := ingest.Send(sendCtx, &telemetrypb.SendRequest{DeviceId: deviceId, Data: []byte(`{"temp":21.5,"humidity":40}`)})
+			if err != nil {
+				t.Fatalf("send: %v", err)
+			}
+
+			select {
+			case ev := <-received:
+				if ev.DeviceId != deviceId || string(ev.Data) != `{"temp":21.5}` {
+					t.Errorf("expected the filtered reading of %s, got %s from %s", deviceId, ev.Data, ev.DeviceId)
+				}
+				return
+			case <-time.After(100 * time.Millisecond):
+			case <-ctx.Done():
+				t.Fatal("no message delivered to the gRPC subscriber")
+			}
+		}
+	})
+
+	t.Run("should refuse gRPC subscriptions without an access token", func(t *testing.T) {
+		_, grpcAddr := newTestServer(t)
+
+		conn, err := grpc.NewClient(grpcAddr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		stream, err := telemetrypb.NewStreamServiceClient(conn).Subscribe(context.Background(), &telemetrypb.SubscribeRequest{DeviceId: "device"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := stream.Recv(); status.Code(err) != codes.Unauthenticated {
+			t.Errorf("expected Unauthenticated, got %v", err)
+		}
+	})
+}
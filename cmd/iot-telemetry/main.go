@@ -0,0 +1,38 @@
+// Command iot-telemetry runs the platform from a single binary. The all-in-one command
+// serves the auth, admin, data and consumer APIs from one process, backed by an embedded
+// SQLite database and an in-process message broker, for local development and small
+// deployments such as a gateway.
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+const usage = `usage: iot-telemetry <command> [flags]
+
+commands:
+  all-in-one  run every service in one process with SQLite and an in-process broker
+
+Run iot-telemetry <command> -h to list the flags of a command.
+`
+
+// main dispatches to the requested command.
+// Params: None
+// Returns: None
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	switch os.Args[1] {
+	case "all-in-one":
+		runAllInOne(os.Args[2:])
+	case "help", "-h", "-help", "--help":
+		fmt.Print(usage)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", os.Args[1], usage)
+		os.Exit(2)
+	}
+}
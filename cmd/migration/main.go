@@ -4,6 +4,7 @@ import (
 	"database/sql"
 	"fmt"
 	"log"
+	"os"
 
 	_ "github.com/golang-migrate/migrate/v4/source/file"
 	_ "github.com/jackc/pgx/v5/stdlib"
@@ -17,11 +18,11 @@ import (
 // Params: None
 // Returns: None
 func main() {
-	dbConfig, err := config.GetDBConfig()
+	cfg, err := config.Load("migration", os.Args[1:], config.DB)
 	if err != nil {
-		log.Fatal("failed to get db config", err)
+		log.Fatal("failed to get db config: ", err)
 	}
-	dbString := config.GetDBString(dbConfig)
+	dbString := cfg.DB.URL()
 
 	db, err := sql.Open("pgx", dbString)
 	if err != nil {
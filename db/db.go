@@ -2,31 +2,48 @@ package db
 
 import (
 	"context"
-	"fmt"
-	"log"
+	"log/slog"
 
 	"github.com/RaghibA/iot-telemetry/pkg/config"
+	"github.com/exaring/otelpgx"
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
 )
 
-// NewDB creates a new database connection.
+// DB is the subset of *pgxpool.Pool used by the service stores, so stores can also run
+// on the embedded SQLite database. Queries must use $1 style placeholders and return
+// pgx.ErrNoRows when a row is not found.
+type DB interface {
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+	Ping(ctx context.Context) error
+}
+
+// NewDB creates a new database connection pool. Queries are traced with OpenTelemetry.
 // Params:
 // - config: *config.DBConfig - the database configuration
 // Returns:
-// - *pgx.Conn: a pointer to the established database connection
-// - error: error if any occurred during the connection establishment
-func NewDB(config *config.DBConfig) (*pgx.Conn, error) {
-	dsn := fmt.Sprintf("host=postgres-postgresql user=%s password=%s dbname=%s port=%v sslmode=disable TimeZone=UTC",
-		config.PostgresUser,
-		config.PostgresPass,
-		config.PostgresName,
-		config.PostgresPort,
-	)
-	db, err := pgx.Connect(context.Background(), dsn)
+// - *pgxpool.Pool: a pointer to the connection pool
+// - error: error if any occurred while connecting to the database
+func NewDB(config *config.DBConfig) (*pgxpool.Pool, error) {
+	poolConfig, err := pgxpool.ParseConfig(config.URL())
+	if err != nil {
+		return nil, err
+	}
+	poolConfig.ConnConfig.Tracer = otelpgx.NewTracer()
+	poolConfig.ConnConfig.RuntimeParams["timezone"] = "UTC"
+
+	db, err := pgxpool.NewWithConfig(context.Background(), poolConfig)
 	if err != nil {
 		return nil, err
 	}
-	log.Println("DB Connection Established")
+	if err := db.Ping(context.Background()); err != nil {
+		db.Close()
+		return nil, err
+	}
+	slog.Info("DB connection established", "host", config.Host, "database", config.Name)
 
 	return db, nil
 }
@@ -0,0 +1,20 @@
+CREATE TABLE plans (
+    plan_id TEXT PRIMARY KEY,
+    daily_messages BIGINT,
+    daily_bytes BIGINT
+);
+
+CREATE TABLE user_quotas (
+    user_id UUID PRIMARY KEY REFERENCES users(user_id) ON DELETE CASCADE,
+    plan_id TEXT REFERENCES plans(plan_id) ON DELETE SET NULL,
+    daily_messages BIGINT,
+    daily_bytes BIGINT
+);
+
+CREATE TABLE quota_usage (
+    user_id UUID NOT NULL REFERENCES users(user_id) ON DELETE CASCADE,
+    day TEXT NOT NULL,
+    messages BIGINT NOT NULL,
+    bytes BIGINT NOT NULL,
+    PRIMARY KEY (user_id, day)
+);
@@ -0,0 +1 @@
+DROP TABLE device_schemas;
\ No newline at end of file
@@ -0,0 +1,6 @@
+CREATE TABLE device_schemas (
+    device_id UUID PRIMARY KEY REFERENCES devices(device_id) ON DELETE CASCADE,
+    message_type TEXT NOT NULL,
+    descriptor_set BYTEA NOT NULL,
+    updated_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
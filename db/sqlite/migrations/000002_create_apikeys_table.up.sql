@@ -0,0 +1,6 @@
+CREATE TABLE api_keys (
+    user_id TEXT NOT NULL REFERENCES users(user_id) ON DELETE CASCADE,
+    api_key TEXT NOT NULL UNIQUE,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (api_key)
+);
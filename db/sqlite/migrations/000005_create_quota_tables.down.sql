@@ -0,0 +1,3 @@
+DROP TABLE quota_usage;
+DROP TABLE user_quotas;
+DROP TABLE plans;
\ No newline at end of file
@@ -0,0 +1,6 @@
+CREATE TABLE device_schemas (
+    device_id TEXT PRIMARY KEY REFERENCES devices(device_id) ON DELETE CASCADE,
+    message_type TEXT NOT NULL,
+    descriptor_set BLOB NOT NULL,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
@@ -0,0 +1 @@
+ALTER TABLE idempotency_keys ADD COLUMN sent INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,240 @@
+// Package sqlite runs the service stores on an embedded SQLite database, for
+// single-process deployments that do not have a Postgres server.
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/RaghibA/iot-telemetry/db"
+	"github.com/golang-migrate/migrate/v4"
+	migratesqlite "github.com/golang-migrate/migrate/v4/database/sqlite"
+	"github.com/golang-migrate/migrate/v4/source/iofs"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	_ "modernc.org/sqlite"
+)
+
+//go:embed migrations/*.sql
+var migrations embed.FS
+
+var _ db.DB = (*DB)(nil)
+
+// DB is an SQLite backed db.DB. Queries written for Postgres with $1 style placeholders
+// run unchanged as long as they stick to the SQL both databases understand.
+type DB struct {
+	sql *sql.DB
+}
+
+// Open opens, or creates, an SQLite database file with foreign keys enforced and
+// write-ahead logging enabled.
+// Params:
+// - path: string - the path of the database file
+// Returns:
+// - *DB: a pointer to the opened DB
+// - error: error if the file could not be opened
+func Open(path string) (*DB, error) {
+	params := url.Values{}
+	params.Add("_pragma", "foreign_keys(1)")
+	params.Add("_pragma", "journal_mode(WAL)")
+	params.Add("_pragma", "busy_timeout(5000)")
+	params.Set("_time_format", "sqlite")
+
+	sqlDB, err := sql.Open("sqlite", "file:"+path+"?"+params.Encode())
+	if err != nil {
+		return nil, err
+	}
+	if err := sqlDB.Ping(); err != nil {
+		sqlDB.Close()
+		return nil, err
+	}
+
+	return &DB{sql: sqlDB}, nil
+}
+
+// Migrate applies the embedded schema migrations that have not run yet.
+// Params: None
+// Returns:
+// - error: error if a migration failed
+func (d *DB) Migrate() error {
+	source, err := iofs.New(migrations, "migrations")
+	if err != nil {
+		return err
+	}
+	driver, err := migratesqlite.WithInstance(d.sql, &migratesqlite.Config{})
+	if err != nil {
+		return err
+	}
+
+	// closing the migrate instance would close d.sql, so only the source is released
+	m, err := migrate.NewWithInstance("iofs", source, "sqlite", driver)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	if err := m.Up(); err != nil && !errors.Is(err, migrate.ErrNoChange) {
+		return err
+	}
+	return nil
+}
+
+// Exec executes a statement that returns no rows.
+// Params:
+// - ctx: context.Context - the request context
+// - query: string - the SQL statement
+// - args: ...any - the statement arguments
+// Returns:
+// - pgconn.CommandTag: the command tag, carrying the number of rows affected
+// - error: error if the statement failed
+func (d *DB) Exec(ctx context.Context, query string, args ...any) (pgconn.CommandTag, error) {
+	res, err := d.sql.ExecContext(ctx, query, args...)
+	if err != nil {
+		return pgconn.CommandTag{}, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return pgconn.CommandTag{}, err
+	}
+	return commandTag(query, n), nil
+}
+
+// Query executes a query that returns rows.
+// Params:
+// - ctx: context.Context - the request context
+// - query: string - the SQL query
+// - args: ...any - the query arguments
+// Returns:
+// - pgx.Rows: the result rows, which must be closed
+// - error: error if the query failed
+func (d *DB) Query(ctx context.Context, query string, args ...any) (pgx.Rows, error) {
+	rows, err := d.sql.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return &sqlRows{rows: rows}, nil
+}
+
+// QueryRow executes a query expected to return at most one row. Errors are deferred
+// until Scan is called, which returns pgx.ErrNoRows if there was no row.
+// Params:
+// - ctx: context.Context - the request context
+// - query: string - the SQL query
+// - args: ...any - the query arguments
+// Returns:
+// - pgx.Row: the result row
+func (d *DB) QueryRow(ctx context.Context, query string, args ...any) pgx.Row {
+	return sqlRow{row: d.sql.QueryRowContext(ctx, query, args...)}
+}
+
+// Ping checks that the database file is still accessible.
+// Params:
+// - ctx: context.Context - bounds the check
+// Returns:
+// - error: error if the database is not accessible
+func (d *DB) Ping(ctx context.Context) error {
+	return d.sql.PingContext(ctx)
+}
+
+// Close closes the database.
+// Params: None
+// Returns:
+// - error: error if the database could not be closed cleanly
+func (d *DB) Close() error {
+	return d.sql.Close()
+}
+
+// commandTag builds a Postgres style command tag for a statement, e.g. "DELETE 2".
+func commandTag(query string, n int64) pgconn.CommandTag {
+	verb, _, _ := strings.Cut(strings.TrimSpace(query), " ")
+	verb = strings.ToUpper(verb)
+	if verb == "INSERT" {
+		return pgconn.NewCommandTag(fmt.Sprintf("INSERT 0 %d", n))
+	}
+	return pgconn.NewCommandTag(fmt.Sprintf("%s %d", verb, n))
+}
+
+type sqlRow struct {
+	row *sql.Row
+}
+
+// Scan copies the row's columns into dest.
+func (r sqlRow) Scan(dest ...any) error {
+	err := r.row.Scan(dest...)
+	if errors.Is(err, sql.ErrNoRows) {
+		return pgx.ErrNoRows
+	}
+	return err
+}
+
+// sqlRows adapts *sql.Rows to pgx.Rows. Only the methods used by the stores carry data;
+// RawValues and Conn have no database/sql equivalent.
+type sqlRows struct {
+	rows *sql.Rows
+	err  error
+}
+
+func (r *sqlRows) Close() {
+	_ = r.rows.Close()
+}
+
+func (r *sqlRows) Err() error {
+	if r.err != nil {
+		return r.err
+	}
+	return r.rows.Err()
+}
+
+func (r *sqlRows) CommandTag() pgconn.CommandTag {
+	return pgconn.NewCommandTag("SELECT")
+}
+
+func (r *sqlRows) FieldDescriptions() []pgconn.FieldDescription {
+	cols, err := r.rows.Columns()
+	if err != nil {
+		r.err = err
+		return nil
+	}
+	fields := make([]pgconn.FieldDescription, len(cols))
+	for i, col := range cols {
+		fields[i] = pgconn.FieldDescription{Name: col}
+	}
+	return fields
+}
+
+func (r *sqlRows) Next() bool {
+	return r.rows.Next()
+}
+
+func (r *sqlRows) Scan(dest ...any) error {
+	return r.rows.Scan(dest...)
+}
+
+func (r *sqlRows) Values() ([]any, error) {
+	cols, err := r.rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	values := make([]any, len(cols))
+	ptrs := make([]any, len(cols))
+	for i := range values {
+		ptrs[i] = &values[i]
+	}
+	if err := r.rows.Scan(ptrs...); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+func (r *sqlRows) RawValues() [][]byte {
+	return nil
+}
+
+func (r *sqlRows) Conn() *pgx.Conn {
+	return nil
+}
@@ -0,0 +1,130 @@
+package sqlite
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/RaghibA/iot-telemetry/pkg/models"
+	"github.com/jackc/pgx/v5"
+)
+
+func openTestDB(t *testing.T) *DB {
+	t.Helper()
+	d, err := Open(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { d.Close() })
+	if err := d.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func TestDB(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("should apply migrations only once", func(t *testing.T) {
+		d := openTestDB(t)
+		if err := d.Migrate(); err != nil {
+			t.Errorf("expected second migrate to be a no-op, got %v", err)
+		}
+	})
+
+	t.Run("should round trip a user with postgres style placeholders", func(t *testing.T) {
+		d := openTestDB(t)
+
+		_, err := d.Exec(ctx, "INSERT INTO users (user_id, username, password, email) VALUES ($1, $2, $3, $4)",
+			"uid-1", "alice", []byte("hashed"), "alice@example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var user models.User
+		err = d.QueryRow(ctx, "SELECT user_id, username, password, email, created_at FROM users WHERE username=$1", "alice").Scan(
+			&user.UserID, &user.Username, &user.Password, &user.Email, &user.CreatedAt,
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if user.UserID != "uid-1" || string(user.Password) != "hashed" || user.Email != "alice@example.com" {
+			t.Errorf("unexpected user %+v", user)
+		}
+		if time.Since(user.CreatedAt) > time.Minute {
+			t.Errorf("expected created_at to default to now, got %v", user.CreatedAt)
+		}
+	})
+
+	t.Run("should return pgx.ErrNoRows when no row matches", func(t *testing.T) {
+		d := openTestDB(t)
+
+		var id string
+		err := d.QueryRow(ctx, "SELECT user_id FROM users WHERE user_id=$1", "missing").Scan(&id)
+		if !errors.Is(err, pgx.ErrNoRows) {
+			t.Errorf("expected pgx.ErrNoRows, got %v", err)
+		}
+	})
+
+	t.Run("should iterate rows and cascade deletes", func(t *testing.T) {
+		d := openTestDB(t)
+
+		if _, err := d.Exec(ctx, "INSERT INTO users (user_id, username, password, email) VALUES ($1, $2, $3, $4)",
+			"uid-1", "alice", []byte("hashed"), "alice@example.com"); err != nil {
+			t.Fatal(err)
+		}
+		for _, id := range []string{"dev-1", "dev-2"} {
+			if _, err := d.Exec(ctx, "INSERT INTO devices (device_id, user_id, device_name, topic_name) VALUES ($1, $2, $3, $4)",
+				id, "uid-1", "sensor", "topic-"+id); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		rows, err := d.Query(ctx, "SELECT device_id FROM devices WHERE user_id=$1 ORDER BY device_id", "uid-1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []string
+		for rows.Next() {
+			var id string
+			if err := rows.Scan(&id); err != nil {
+				t.Fatal(err)
+			}
+			ids = append(ids, id)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			t.Fatal(err)
+		}
+		if len(ids) != 2 || ids[0] != "dev-1" || ids[1] != "dev-2" {
+			t.Errorf("expected [dev-1 dev-2], got %v", ids)
+		}
+
+		tag, err := d.Exec(ctx, "DELETE FROM users WHERE user_id=$1", "uid-1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !tag.Delete() || tag.RowsAffected() != 1 {
+			t.Errorf("expected DELETE 1, got %s", tag)
+		}
+
+		var count int
+		if err := d.QueryRow(ctx, "SELECT count(*) FROM devices").Scan(&count); err != nil {
+			t.Fatal(err)
+		}
+		if count != 0 {
+			t.Errorf("expected devices to be deleted with their user, %d left", count)
+		}
+	})
+
+	t.Run("should enforce foreign keys", func(t *testing.T) {
+		d := openTestDB(t)
+
+		_, err := d.Exec(ctx, "INSERT INTO api_keys (user_id, api_key) VALUES ($1, $2)", "missing", "key")
+		if err == nil {
+			t.Error("expected insert referencing a missing user to fail")
+		}
+	})
+}
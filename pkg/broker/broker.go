@@ -0,0 +1,90 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+var (
+	// ErrStreamNotFound is returned when a stream does not exist.
+	ErrStreamNotFound = errors.New("broker: stream not found")
+	// ErrStreamExists is returned when creating a stream that already exists.
+	ErrStreamExists = errors.New("broker: stream already exists")
+	// ErrClosed is returned by a subscription or broker after Close, or after its stream was deleted.
+	ErrClosed = errors.New("broker: closed")
+)
+
+// Message is a single record in a stream.
+type Message struct {
+	Stream  string
+	Key     string
+	Value   []byte
+	Headers map[string]string
+	// Offset is assigned by the broker on publish. Offsets start at 0 and increase by
+	// one per message within a stream partition.
+	Offset    uint64
+	Partition int32
+	Timestamp time.Time
+}
+
+// Headers the data service attaches to every ingested message, besides RequestIDHeader.
+const (
+	// ReceivedAtHeader is when the platform received the message, in RFC 3339 UTC.
+	ReceivedAtHeader = "received_at"
+	// EventTimeHeader is the time the device took the reading, if it sent one.
+	EventTimeHeader = "event_time"
+	// APIKeyIDHeader identifies the API key that sent the message without revealing it.
+	APIKeyIDHeader = "api_key_id"
+	// SourceIPHeader is the address of the client that sent the message.
+	SourceIPHeader = "source_ip"
+	// ContentTypeHeader is the media type of the message value.
+	ContentTypeHeader = "content_type"
+	// SchemaVersionHeader is the version of this set of headers.
+	SchemaVersionHeader = "schema_version"
+	// MessageIDHeader is the ID the device gave the message to make retries idempotent,
+	// if it sent one. Backends that deduplicate publishes use it.
+	MessageIDHeader = "message_id"
+)
+
+// StartPosition selects where a new subscription starts reading.
+type StartPosition int
+
+const (
+	// StartNewest delivers only messages published after the subscription is created.
+	StartNewest StartPosition = iota
+	// StartOldest replays every message the broker still retains.
+	StartOldest
+	// StartAtOffset replays from SubscribeOptions.Offset. Offsets older than the
+	// oldest retained message start at the oldest retained message instead.
+	StartAtOffset
+)
+
+// SubscribeOptions configures a subscription.
+type SubscribeOptions struct {
+	Start  StartPosition
+	Offset uint64
+}
+
+// Broker publishes messages to named streams and subscribes to them.
+// Each IoT device owns one stream.
+type Broker interface {
+	// StreamName returns the backend specific stream name for a device.
+	StreamName(deviceName string, deviceID string) string
+	CreateStream(ctx context.Context, stream string) error
+	DeleteStream(ctx context.Context, stream string) error
+	// Publish appends msg to the stream and returns the offset it was assigned.
+	Publish(ctx context.Context, stream string, msg Message) (uint64, error)
+	Subscribe(ctx context.Context, stream string, opts SubscribeOptions) (Subscription, error)
+	// Ping checks that the backend is reachable.
+	Ping(ctx context.Context) error
+	Close() error
+}
+
+// Subscription is an ordered, cancellable cursor over a stream.
+type Subscription interface {
+	// Next blocks until the next message is available, ctx is done or the
+	// subscription is closed, in which case it returns ErrClosed.
+	Next(ctx context.Context) (Message, error)
+	Close() error
+}
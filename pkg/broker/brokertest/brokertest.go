@@ -0,0 +1,281 @@
+// Package brokertest is a conformance suite run against every broker.Broker backend.
+package brokertest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/RaghibA/iot-telemetry/pkg/broker"
+	"github.com/google/uuid"
+)
+
+// timeout bounds every blocking call in the suite.
+const timeout = 10 * time.Second
+
+// Run runs the conformance suite. newBroker is called once per subtest and the
+// returned broker is closed when the subtest ends.
+// Params:
+// - t: *testing.T - the parent test
+// - newBroker: func(t *testing.T) broker.Broker - creates a broker for a subtest
+// Returns: None
+func Run(t *testing.T, newBroker func(t *testing.T) broker.Broker) {
+
+	t.Run("should create and delete streams", func(t *testing.T) {
+		b, stream := setup(t, newBroker)
+		ctx := testContext(t)
+
+		if err := b.CreateStream(ctx, stream); !errors.Is(err, broker.ErrStreamExists) {
+			t.Errorf("expected ErrStreamExists, got %v", err)
+		}
+		if err := b.DeleteStream(ctx, stream); err != nil {
+			t.Fatalf("delete stream: %v", err)
+		}
+		if err := b.DeleteStream(ctx, stream); !errors.Is(err, broker.ErrStreamNotFound) {
+			t.Errorf("expected ErrStreamNotFound, got %v", err)
+		}
+		if _, err := b.Subscribe(ctx, stream, broker.SubscribeOptions{}); !errors.Is(err, broker.ErrStreamNotFound) {
+			t.Errorf("expected ErrStreamNotFound on subscribe, got %v", err)
+		}
+	})
+
+	t.Run("should assign sequential offsets from zero", func(t *testing.T) {
+		b, stream := setup(t, newBroker)
+		ctx := testContext(t)
+
+		for i := 0; i < 3; i++ {
+			offset, err := b.Publish(ctx, stream, broker.Message{Key: "device", Value: []byte(fmt.Sprint(i))})
+			if err != nil {
+				t.Fatalf("publish: %v", err)
+			}
+			if offset != uint64(i) {
+				t.Errorf("expected offset %d, got %d", i, offset)
+			}
+		}
+	})
+
+	t.Run("should replay retained messages in order", func(t *testing.T) {
+		b, stream := setup(t, newBroker)
+		ctx := testContext(t)
+
+		sent := publish(t, b, stream, 5)
+
+		sub, err := b.Subscribe(ctx, stream, broker.SubscribeOptions{Start: broker.StartOldest})
+		if err != nil {
+			t.Fatalf("subscribe: %v", err)
+		}
+		defer sub.Close()
+
+		for _, want := range sent {
+			got, err := sub.Next(ctx)
+			if err != nil {
+				t.Fatalf("next: %v", err)
+			}
+			assertMessage(t, stream, want, got)
+		}
+	})
+
+	t.Run("should start at the requested offset", func(t *testing.T) {
+		b, stream := setup(t, newBroker)
+		ctx := testContext(t)
+
+		sent := publish(t, b, stream, 5)
+
+		sub, err := b.Subscribe(ctx, stream, broker.SubscribeOptions{Start: broker.StartAtOffset, Offset: 3})
+		if err != nil {
+			t.Fatalf("subscribe: %v", err)
+		}
+		defer sub.Close()
+
+		for _, want := range sent[3:] {
+			got, err := sub.Next(ctx)
+			if err != nil {
+				t.Fatalf("next: %v", err)
+			}
+			assertMessage(t, stream, want, got)
+		}
+	})
+
+	t.Run("should deliver only new messages from the newest position", func(t *testing.T) {
+		b, stream := setup(t, newBroker)
+		ctx := testContext(t)
+
+		publish(t, b, stream, 2)
+
+		sub, err := b.Subscribe(ctx, stream, broker.SubscribeOptions{Start: broker.StartNewest})
+		if err != nil {
+			t.Fatalf("subscribe: %v", err)
+		}
+		defer sub.Close()
+
+		want := broker.Message{Key: "device", Value: []byte("live"), Headers: map[string]string{"x-request-id": "req-1"}}
+		offset, err := b.Publish(ctx, stream, want)
+		if err != nil {
+			t.Fatalf("publish: %v", err)
+		}
+		want.Offset = offset
+
+		got, err := sub.Next(ctx)
+		if err != nil {
+			t.Fatalf("next: %v", err)
+		}
+		assertMessage(t, stream, want, got)
+	})
+
+	t.Run("should fan out to every subscriber", func(t *testing.T) {
+		b, stream := setup(t, newBroker)
+		ctx := testContext(t)
+
+		var subs []broker.Subscription
+		for i := 0; i < 3; i++ {
+			sub, err := b.Subscribe(ctx, stream, broker.SubscribeOptions{Start: broker.StartOldest})
+			if err != nil {
+				t.Fatalf("subscribe: %v", err)
+			}
+			defer sub.Close()
+			subs = append(subs, sub)
+		}
+
+		sent := publish(t, b, stream, 2)
+
+		for _, sub := range subs {
+			for _, want := range sent {
+				got, err := sub.Next(ctx)
+				if err != nil {
+					t.Fatalf("next: %v", err)
+				}
+				assertMessage(t, stream, want, got)
+			}
+		}
+	})
+
+	t.Run("should return the context error when no message arrives", func(t *testing.T) {
+		b, stream := setup(t, newBroker)
+
+		sub, err := b.Subscribe(testContext(t), stream, broker.SubscribeOptions{})
+		if err != nil {
+			t.Fatalf("subscribe: %v", err)
+		}
+		defer sub.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		if _, err := sub.Next(ctx); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("expected context.DeadlineExceeded, got %v", err)
+		}
+
+		// the subscription stays usable after a timed out Next
+		want := publish(t, b, stream, 1)[0]
+		got, err := sub.Next(testContext(t))
+		if err != nil {
+			t.Fatalf("next: %v", err)
+		}
+		assertMessage(t, stream, want, got)
+	})
+
+	t.Run("should unblock Next when the subscription is closed", func(t *testing.T) {
+		b, stream := setup(t, newBroker)
+		ctx := testContext(t)
+
+		sub, err := b.Subscribe(ctx, stream, broker.SubscribeOptions{})
+		if err != nil {
+			t.Fatalf("subscribe: %v", err)
+		}
+
+		errCh := make(chan error, 1)
+		go func() {
+			_, err := sub.Next(ctx)
+			errCh <- err
+		}()
+
+		time.Sleep(50 * time.Millisecond)
+		if err := sub.Close(); err != nil {
+			t.Errorf("close: %v", err)
+		}
+
+		select {
+		case err := <-errCh:
+			if !errors.Is(err, broker.ErrClosed) {
+				t.Errorf("expected ErrClosed, got %v", err)
+			}
+		case <-ctx.Done():
+			t.Fatal("Next did not return after Close")
+		}
+	})
+
+	t.Run("should answer pings", func(t *testing.T) {
+		b, _ := setup(t, newBroker)
+
+		if err := b.Ping(testContext(t)); err != nil {
+			t.Errorf("ping: %v", err)
+		}
+	})
+}
+
+// setup creates a broker and a fresh stream that is deleted when the test ends.
+func setup(t *testing.T, newBroker func(t *testing.T) broker.Broker) (broker.Broker, string) {
+	t.Helper()
+	b := newBroker(t)
+	t.Cleanup(func() { _ = b.Close() })
+
+	stream := b.StreamName("conformance device", uuid.NewString())
+	if err := b.CreateStream(testContext(t), stream); err != nil {
+		t.Fatalf("create stream: %v", err)
+	}
+	t.Cleanup(func() { _ = b.DeleteStream(context.Background(), stream) })
+
+	return b, stream
+}
+
+// publish sends n messages with distinct keys, values and headers and returns them with their offsets.
+func publish(t *testing.T, b broker.Broker, stream string, n int) []broker.Message {
+	t.Helper()
+	var sent []broker.Message
+	for i := 0; i < n; i++ {
+		msg := broker.Message{
+			Key:     fmt.Sprintf("key-%d", i),
+			Value:   []byte(fmt.Sprintf(`{"n":%d}`, i)),
+			Headers: map[string]string{"x-index": fmt.Sprint(i)},
+		}
+		offset, err := b.Publish(testContext(t), stream, msg)
+		if err != nil {
+			t.Fatalf("publish: %v", err)
+		}
+		msg.Offset = offset
+		sent = append(sent, msg)
+	}
+	return sent
+}
+
+func assertMessage(t *testing.T, stream string, want broker.Message, got broker.Message) {
+	t.Helper()
+	if got.Stream != stream {
+		t.Errorf("expected stream %s, got %s", stream, got.Stream)
+	}
+	if got.Offset != want.Offset {
+		t.Errorf("expected offset %d, got %d", want.Offset, got.Offset)
+	}
+	if got.Key != want.Key {
+		t.Errorf("expected key %q, got %q", want.Key, got.Key)
+	}
+	if !bytes.Equal(got.Value, want.Value) {
+		t.Errorf("expected value %s, got %s", want.Value, got.Value)
+	}
+	for k, v := range want.Headers {
+		if got.Headers[k] != v {
+			t.Errorf("expected header %s=%q, got %q", k, v, got.Headers[k])
+		}
+	}
+	if got.Timestamp.IsZero() {
+		t.Error("expected a timestamp")
+	}
+}
+
+func testContext(t *testing.T) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	t.Cleanup(cancel)
+	return ctx
+}
@@ -0,0 +1,40 @@
+package factory
+
+import (
+	"fmt"
+
+	"github.com/RaghibA/iot-telemetry/pkg/broker"
+	"github.com/RaghibA/iot-telemetry/pkg/broker/memory"
+	"github.com/RaghibA/iot-telemetry/pkg/broker/nats"
+	"github.com/RaghibA/iot-telemetry/pkg/config"
+	"github.com/RaghibA/iot-telemetry/pkg/kafka"
+)
+
+// New creates the broker backend selected in the configuration, instrumented for tracing.
+// Params:
+// - cfg: *config.Config - the service configuration
+// Returns:
+// - broker.Broker: the broker
+// - error: error if the backend is unknown or could not connect
+func New(cfg *config.Config) (broker.Broker, error) {
+	var b broker.Broker
+	switch cfg.Broker.Backend {
+	case config.BackendKafka:
+		b = kafka.NewKafkaService(cfg.Kafka)
+	case config.BackendNATS:
+		nb, err := nats.New(cfg.NATS.URL, nats.Options{
+			MaxMsgs:  cfg.NATS.MaxMsgs,
+			Replicas: cfg.NATS.Replicas,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("connect to nats: %w", err)
+		}
+		b = nb
+	case config.BackendMemory:
+		b = memory.New(cfg.Broker.MemoryCapacity)
+	default:
+		return nil, fmt.Errorf("unknown broker backend %q", cfg.Broker.Backend)
+	}
+
+	return broker.Instrument(b, cfg.Broker.Backend), nil
+}
@@ -0,0 +1,297 @@
+package memory
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/RaghibA/iot-telemetry/pkg/broker"
+)
+
+// DefaultCapacity is the number of messages retained per stream when no capacity is configured.
+const DefaultCapacity = 1024
+
+// Broker is an in-process broker. Each stream is a ring buffer holding the most recent
+// messages, so subscribers can replay retained messages by offset. It is safe for
+// concurrent use but only shared within one process.
+type Broker struct {
+	capacity int
+
+	mu      sync.RWMutex
+	streams map[string]*stream
+	closed  bool
+}
+
+// stream is a fixed size ring buffer. The message with offset o is stored at buf[o % len(buf)].
+type stream struct {
+	mu      sync.Mutex
+	buf     []broker.Message
+	next    uint64
+	notify  chan struct{}
+	deleted bool
+}
+
+// New creates an in-memory broker.
+// Params:
+// - capacity: int - the number of messages retained per stream, DefaultCapacity if not positive
+// Returns:
+// - *Broker: a pointer to the created Broker
+func New(capacity int) *Broker {
+	if capacity <= 0 {
+		capacity = DefaultCapacity
+	}
+	return &Broker{
+		capacity: capacity,
+		streams:  make(map[string]*stream),
+	}
+}
+
+// StreamName generates a stream name based on the device name and device ID.
+// Params:
+// - deviceName: string - the name of the device
+// - deviceID: string - the ID of the device
+// Returns:
+// - string: the generated stream name
+func (b *Broker) StreamName(deviceName string, deviceID string) string {
+	return fmt.Sprintf("device.%s.%s", strings.ReplaceAll(deviceName, " ", "-"), deviceID)
+}
+
+// CreateStream creates an empty stream.
+// Params:
+// - ctx: context.Context - unused, present to satisfy broker.Broker
+// - name: string - the name of the stream
+// Returns:
+// - error: broker.ErrStreamExists if the stream exists, broker.ErrClosed if the broker is closed
+func (b *Broker) CreateStream(ctx context.Context, name string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return broker.ErrClosed
+	}
+	if _, ok := b.streams[name]; ok {
+		return broker.ErrStreamExists
+	}
+	b.streams[name] = &stream{
+		buf:    make([]broker.Message, b.capacity),
+		notify: make(chan struct{}),
+	}
+	return nil
+}
+
+// DeleteStream deletes a stream. Its subscriptions return broker.ErrClosed.
+// Params:
+// - ctx: context.Context - unused, present to satisfy broker.Broker
+// - name: string - the name of the stream
+// Returns:
+// - error: broker.ErrStreamNotFound if the stream does not exist
+func (b *Broker) DeleteStream(ctx context.Context, name string) error {
+	b.mu.Lock()
+	s, ok := b.streams[name]
+	delete(b.streams, name)
+	b.mu.Unlock()
+
+	if !ok {
+		return broker.ErrStreamNotFound
+	}
+	s.delete()
+	return nil
+}
+
+// Publish appends a message to a stream, overwriting the oldest message once the stream is full.
+// Params:
+// - ctx: context.Context - unused, present to satisfy broker.Broker
+// - name: string - the name of the stream
+// - msg: broker.Message - the message to publish
+// Returns:
+// - uint64: the offset assigned to the message
+// - error: broker.ErrStreamNotFound if the stream does not exist
+func (b *Broker) Publish(ctx context.Context, name string, msg broker.Message) (uint64, error) {
+	s, err := b.stream(name)
+	if err != nil {
+		return 0, err
+	}
+
+	msg.Stream = name
+	msg.Partition = 0
+	msg.Value = append([]byte(nil), msg.Value...)
+	msg.Headers = copyHeaders(msg.Headers)
+	if msg.Timestamp.IsZero() {
+		msg.Timestamp = time.Now().UTC()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.deleted {
+		return 0, broker.ErrStreamNotFound
+	}
+
+	msg.Offset = s.next
+	s.buf[s.next%uint64(len(s.buf))] = msg
+	s.next++
+
+	// wake every waiting subscriber
+	close(s.notify)
+	s.notify = make(chan struct{})
+
+	return msg.Offset, nil
+}
+
+// Subscribe creates a cursor over a stream.
+// Params:
+// - ctx: context.Context - unused, present to satisfy broker.Broker
+// - name: string - the name of the stream
+// - opts: broker.SubscribeOptions - where the subscription starts
+// Returns:
+// - broker.Subscription: the subscription
+// - error: broker.ErrStreamNotFound if the stream does not exist
+func (b *Broker) Subscribe(ctx context.Context, name string, opts broker.SubscribeOptions) (broker.Subscription, error) {
+	s, err := b.stream(name)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var cursor uint64
+	switch opts.Start {
+	case broker.StartOldest:
+		cursor = s.oldest()
+	case broker.StartAtOffset:
+		cursor = min(max(opts.Offset, s.oldest()), s.next)
+	default:
+		cursor = s.next
+	}
+
+	return &subscription{stream: s, cursor: cursor, done: make(chan struct{})}, nil
+}
+
+// Ping reports whether the broker is open.
+// Params:
+// - ctx: context.Context - unused, present to satisfy broker.Broker
+// Returns:
+// - error: broker.ErrClosed if the broker is closed
+func (b *Broker) Ping(ctx context.Context) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if b.closed {
+		return broker.ErrClosed
+	}
+	return nil
+}
+
+// Close deletes every stream and ends their subscriptions.
+// Params: None
+// Returns:
+// - error: always nil
+func (b *Broker) Close() error {
+	b.mu.Lock()
+	streams := b.streams
+	b.streams = make(map[string]*stream)
+	b.closed = true
+	b.mu.Unlock()
+
+	for _, s := range streams {
+		s.delete()
+	}
+	return nil
+}
+
+func (b *Broker) stream(name string) (*stream, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if b.closed {
+		return nil, broker.ErrClosed
+	}
+	s, ok := b.streams[name]
+	if !ok {
+		return nil, broker.ErrStreamNotFound
+	}
+	return s, nil
+}
+
+// oldest returns the offset of the oldest retained message. s.mu must be held.
+func (s *stream) oldest() uint64 {
+	if s.next < uint64(len(s.buf)) {
+		return 0
+	}
+	return s.next - uint64(len(s.buf))
+}
+
+func (s *stream) delete() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.deleted {
+		s.deleted = true
+		close(s.notify)
+	}
+}
+
+type subscription struct {
+	stream    *stream
+	cursor    uint64
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// Next returns the message at the cursor. A subscriber that falls more than the stream
+// capacity behind skips ahead to the oldest retained message.
+func (sub *subscription) Next(ctx context.Context) (broker.Message, error) {
+	for {
+		select {
+		case <-sub.done:
+			return broker.Message{}, broker.ErrClosed
+		default:
+		}
+
+		s := sub.stream
+		s.mu.Lock()
+		if s.deleted {
+			s.mu.Unlock()
+			return broker.Message{}, broker.ErrClosed
+		}
+		if oldest := s.oldest(); sub.cursor < oldest {
+			sub.cursor = oldest
+		}
+		if sub.cursor < s.next {
+			msg := s.buf[sub.cursor%uint64(len(s.buf))]
+			sub.cursor++
+			s.mu.Unlock()
+
+			msg.Value = append([]byte(nil), msg.Value...)
+			msg.Headers = copyHeaders(msg.Headers)
+			return msg, nil
+		}
+		notify := s.notify
+		s.mu.Unlock()
+
+		select {
+		case <-notify:
+		case <-sub.done:
+			return broker.Message{}, broker.ErrClosed
+		case <-ctx.Done():
+			return broker.Message{}, ctx.Err()
+		}
+	}
+}
+
+// Close ends the subscription. It is safe to call more than once.
+func (sub *subscription) Close() error {
+	sub.closeOnce.Do(func() { close(sub.done) })
+	return nil
+}
+
+func copyHeaders(headers map[string]string) map[string]string {
+	if headers == nil {
+		return nil
+	}
+	copied := make(map[string]string, len(headers))
+	for k, v := range headers {
+		copied[k] = v
+	}
+	return copied
+}
@@ -0,0 +1,110 @@
+package memory
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/RaghibA/iot-telemetry/pkg/broker"
+	"github.com/RaghibA/iot-telemetry/pkg/broker/brokertest"
+)
+
+func TestConformance(t *testing.T) {
+	brokertest.Run(t, func(t *testing.T) broker.Broker {
+		return New(16)
+	})
+}
+
+func TestRingBuffer(t *testing.T) {
+	ctx := context.Background()
+
+	setup := func(t *testing.T) (*Broker, string) {
+		b := New(4)
+		stream := b.StreamName("ring", "1")
+		if err := b.CreateStream(ctx, stream); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 10; i++ {
+			if _, err := b.Publish(ctx, stream, broker.Message{Value: []byte(fmt.Sprint(i))}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return b, stream
+	}
+
+	t.Run("should only replay the most recent messages", func(t *testing.T) {
+		b, stream := setup(t)
+
+		sub, err := b.Subscribe(ctx, stream, broker.SubscribeOptions{Start: broker.StartOldest})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		msg, err := sub.Next(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.Offset != 6 || string(msg.Value) != "6" {
+			t.Errorf("expected oldest retained offset 6, got %d (%s)", msg.Offset, msg.Value)
+		}
+	})
+
+	t.Run("should clamp offsets that were overwritten", func(t *testing.T) {
+		b, stream := setup(t)
+
+		sub, err := b.Subscribe(ctx, stream, broker.SubscribeOptions{Start: broker.StartAtOffset, Offset: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		msg, err := sub.Next(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.Offset != 6 {
+			t.Errorf("expected offset 6, got %d", msg.Offset)
+		}
+	})
+
+	t.Run("should skip a lagging subscriber ahead", func(t *testing.T) {
+		b, stream := setup(t)
+
+		sub, err := b.Subscribe(ctx, stream, broker.SubscribeOptions{Start: broker.StartOldest})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 8; i++ {
+			if _, err := b.Publish(ctx, stream, broker.Message{Value: []byte("new")}); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		msg, err := sub.Next(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.Offset != 14 {
+			t.Errorf("expected offset 14, got %d", msg.Offset)
+		}
+	})
+
+	t.Run("should end subscriptions when the stream is deleted", func(t *testing.T) {
+		b, stream := setup(t)
+
+		sub, err := b.Subscribe(ctx, stream, broker.SubscribeOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := b.DeleteStream(ctx, stream); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := sub.Next(ctx); !errors.Is(err, broker.ErrClosed) {
+			t.Errorf("expected ErrClosed, got %v", err)
+		}
+		if _, err := b.Publish(ctx, stream, broker.Message{}); !errors.Is(err, broker.ErrStreamNotFound) {
+			t.Errorf("expected ErrStreamNotFound, got %v", err)
+		}
+	})
+}
@@ -0,0 +1,168 @@
+package broker
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// MockBroker is an in-memory Broker for handler tests. Subscriptions first receive the
+// stream's Backlog, then every message published after they were created.
+type MockBroker struct {
+	Streams  map[string]bool
+	Err      error
+	Messages map[string]Message
+	Backlog  map[string][]Message
+
+	mu   sync.Mutex
+	subs map[string][]*mockSubscription
+}
+
+func NewMockBroker() *MockBroker {
+	return &MockBroker{
+		Streams:  make(map[string]bool),
+		Err:      nil,
+		Messages: make(map[string]Message),
+		Backlog:  make(map[string][]Message),
+		subs:     make(map[string][]*mockSubscription),
+	}
+}
+
+func (b *MockBroker) StreamName(deviceName string, deviceID string) string {
+	return fmt.Sprintf("teststream-%s-%s", deviceName, deviceID)
+}
+
+func (b *MockBroker) CreateStream(ctx context.Context, stream string) error {
+	if b.Err != nil {
+		return b.Err
+	}
+
+	b.Streams[stream] = true
+	return nil
+}
+
+func (b *MockBroker) DeleteStream(ctx context.Context, stream string) error {
+	if b.Err != nil {
+		return b.Err
+	}
+
+	delete(b.Streams, stream)
+	return nil
+}
+
+func (b *MockBroker) Publish(ctx context.Context, stream string, msg Message) (uint64, error) {
+	if b.Err != nil {
+		return 0, b.Err
+	}
+
+	msg.Stream = stream
+	b.Messages[stream] = msg
+
+	b.mu.Lock()
+	subs := b.subs[stream]
+	b.mu.Unlock()
+	for _, sub := range subs {
+		sub.push(msg)
+	}
+	return 0, nil
+}
+
+func (b *MockBroker) Subscribe(ctx context.Context, stream string, opts SubscribeOptions) (Subscription, error) {
+	if b.Err != nil {
+		return nil, b.Err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	sub := &mockSubscription{ready: make(chan struct{}, 1), done: make(chan struct{})}
+	for _, msg := range b.Backlog[stream] {
+		msg.Stream = stream
+		sub.push(msg)
+	}
+	b.subs[stream] = append(b.subs[stream], sub)
+	return sub, nil
+}
+
+// Subscribers returns the number of subscriptions created on a stream.
+func (b *MockBroker) Subscribers(stream string) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return len(b.subs[stream])
+}
+
+// CloseStream ends every subscription on a stream, as when the stream is deleted.
+func (b *MockBroker) CloseStream(stream string) {
+	b.mu.Lock()
+	subs := b.subs[stream]
+	b.mu.Unlock()
+	for _, sub := range subs {
+		sub.Close()
+	}
+}
+
+func (b *MockBroker) Ping(ctx context.Context) error {
+	return b.Err
+}
+
+func (b *MockBroker) Close() error {
+	return nil
+}
+
+// mockSubscription queues delivered messages, Next blocks until one is queued, ctx is
+// done or Close is called.
+type mockSubscription struct {
+	mu     sync.Mutex
+	queue  []Message
+	ready  chan struct{}
+	done   chan struct{}
+	closed bool
+}
+
+func (s *mockSubscription) push(msg Message) {
+	s.mu.Lock()
+	s.queue = append(s.queue, msg)
+	s.mu.Unlock()
+
+	select {
+	case s.ready <- struct{}{}:
+	default:
+	}
+}
+
+func (s *mockSubscription) Next(ctx context.Context) (Message, error) {
+	for {
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			return Message{}, ErrClosed
+		}
+		if len(s.queue) > 0 {
+			msg := s.queue[0]
+			s.queue = s.queue[1:]
+			s.mu.Unlock()
+			return msg, nil
+		}
+		s.mu.Unlock()
+
+		select {
+		case <-s.ready:
+		case <-s.done:
+			return Message{}, ErrClosed
+		case <-ctx.Done():
+			return Message{}, ctx.Err()
+		}
+	}
+}
+
+func (s *mockSubscription) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.closed {
+		s.closed = true
+		close(s.done)
+	}
+	return nil
+}
@@ -0,0 +1,287 @@
+package nats
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/RaghibA/iot-telemetry/pkg/broker"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// keyHeader carries broker.Message.Key, since NATS messages have no key of their own.
+const keyHeader = "Iot-Message-Key"
+
+// invalidNameChars matches characters not allowed in JetStream stream names.
+var invalidNameChars = regexp.MustCompile(`[^A-Za-z0-9_-]+`)
+
+// Options configures the streams created by the broker.
+type Options struct {
+	// MaxMsgs is the number of messages retained per stream, unlimited if not positive.
+	MaxMsgs int64
+	// Replicas is the number of stream replicas in a clustered deployment.
+	Replicas int
+}
+
+// Broker is a NATS JetStream backed broker. Each stream captures a single subject
+// with the same name.
+type Broker struct {
+	nc   *nats.Conn
+	js   jetstream.JetStream
+	opts Options
+}
+
+// New connects to a NATS server with JetStream enabled.
+// Params:
+// - url: string - the NATS server URL(s), comma separated
+// - opts: Options - the stream options
+// Returns:
+// - *Broker: a pointer to the connected Broker
+// - error: error if the connection could not be established
+func New(url string, opts Options) (*Broker, error) {
+	nc, err := nats.Connect(url, nats.Name("iot-telemetry"), nats.MaxReconnects(-1))
+	if err != nil {
+		return nil, err
+	}
+
+	js, err := jetstream.New(nc)
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+
+	return &Broker{nc: nc, js: js, opts: opts}, nil
+}
+
+// StreamName generates a stream name based on the device name and device ID.
+// Params:
+// - deviceName: string - the name of the device
+// - deviceID: string - the ID of the device
+// Returns:
+// - string: the generated stream name
+func (b *Broker) StreamName(deviceName string, deviceID string) string {
+	return fmt.Sprintf("device_%s_%s", invalidNameChars.ReplaceAllString(deviceName, "-"), deviceID)
+}
+
+// CreateStream creates a stream capturing the subject of the same name.
+// Params:
+// - ctx: context.Context - the request context
+// - name: string - the name of the stream
+// Returns:
+// - error: broker.ErrStreamExists if the stream exists, or the JetStream error
+func (b *Broker) CreateStream(ctx context.Context, name string) error {
+	cfg := jetstream.StreamConfig{
+		Name:      name,
+		Subjects:  []string{name},
+		Storage:   jetstream.FileStorage,
+		Retention: jetstream.LimitsPolicy,
+		Discard:   jetstream.DiscardOld,
+		MaxMsgs:   -1,
+		Replicas:  max(b.opts.Replicas, 1),
+	}
+	if b.opts.MaxMsgs > 0 {
+		cfg.MaxMsgs = b.opts.MaxMsgs
+	}
+
+	// creating a stream with an identical config is a no-op in JetStream
+	if _, err := b.js.Stream(ctx, name); err == nil {
+		return broker.ErrStreamExists
+	} else if !errors.Is(err, jetstream.ErrStreamNotFound) {
+		return err
+	}
+
+	_, err := b.js.CreateStream(ctx, cfg)
+	if errors.Is(err, jetstream.ErrStreamNameAlreadyInUse) {
+		return broker.ErrStreamExists
+	}
+	return err
+}
+
+// DeleteStream deletes a stream and the messages it holds.
+// Params:
+// - ctx: context.Context - the request context
+// - name: string - the name of the stream
+// Returns:
+// - error: broker.ErrStreamNotFound if the stream does not exist, or the JetStream error
+func (b *Broker) DeleteStream(ctx context.Context, name string) error {
+	err := b.js.DeleteStream(ctx, name)
+	if errors.Is(err, jetstream.ErrStreamNotFound) {
+		return broker.ErrStreamNotFound
+	}
+	return err
+}
+
+// Publish publishes a message and waits for the stream to acknowledge it.
+// Params:
+// - ctx: context.Context - the request context
+// - name: string - the name of the stream
+// - msg: broker.Message - the message to publish
+// Returns:
+// - uint64: the offset assigned to the message
+// - error: broker.ErrStreamNotFound if no stream captured the message, or the JetStream error
+func (b *Broker) Publish(ctx context.Context, name string, msg broker.Message) (uint64, error) {
+	natsMsg := nats.NewMsg(name)
+	natsMsg.Data = msg.Value
+	for k, v := range msg.Headers {
+		natsMsg.Header.Set(k, v)
+	}
+	if msg.Key != "" {
+		natsMsg.Header.Set(keyHeader, msg.Key)
+	}
+	if id := msg.Headers[broker.MessageIDHeader]; id != "" {
+		// JetStream drops publishes repeating a message ID within the stream's duplicate window
+		natsMsg.Header.Set(jetstream.MsgIDHeader, id)
+	}
+
+	ack, err := b.js.PublishMsg(ctx, natsMsg)
+	if errors.Is(err, jetstream.ErrNoStreamResponse) {
+		return 0, broker.ErrStreamNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	// JetStream sequences start at 1
+	return ack.Sequence - 1, nil
+}
+
+// Subscribe creates an ordered, ephemeral consumer on a stream.
+// Params:
+// - ctx: context.Context - the request context
+// - name: string - the name of the stream
+// - opts: broker.SubscribeOptions - where the subscription starts
+// Returns:
+// - broker.Subscription: the subscription
+// - error: broker.ErrStreamNotFound if the stream does not exist, or the JetStream error
+func (b *Broker) Subscribe(ctx context.Context, name string, opts broker.SubscribeOptions) (broker.Subscription, error) {
+	stream, err := b.js.Stream(ctx, name)
+	if errors.Is(err, jetstream.ErrStreamNotFound) {
+		return nil, broker.ErrStreamNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := jetstream.OrderedConsumerConfig{DeliverPolicy: jetstream.DeliverNewPolicy}
+	switch opts.Start {
+	case broker.StartOldest:
+		cfg.DeliverPolicy = jetstream.DeliverAllPolicy
+	case broker.StartAtOffset:
+		cfg.DeliverPolicy = jetstream.DeliverByStartSequencePolicy
+		cfg.OptStartSeq = opts.Offset + 1
+	}
+
+	consumer, err := stream.OrderedConsumer(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	iter, err := consumer.Messages()
+	if err != nil {
+		return nil, err
+	}
+
+	sub := &subscription{
+		stream:   name,
+		iter:     iter,
+		messages: make(chan broker.Message),
+		done:     make(chan struct{}),
+	}
+	go sub.pump()
+
+	return sub, nil
+}
+
+// Ping checks the connection with a JetStream account info round trip.
+// Params:
+// - ctx: context.Context - bounds the round trip
+// Returns:
+// - error: error if JetStream did not answer
+func (b *Broker) Ping(ctx context.Context) error {
+	if status := b.nc.Status(); status != nats.CONNECTED {
+		return fmt.Errorf("nats connection is %s", status)
+	}
+	_, err := b.js.AccountInfo(ctx)
+	return err
+}
+
+// Close closes the NATS connection.
+// Params: None
+// Returns:
+// - error: always nil
+func (b *Broker) Close() error {
+	b.nc.Close()
+	return nil
+}
+
+type subscription struct {
+	stream    string
+	iter      jetstream.MessagesContext
+	messages  chan broker.Message
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// pump moves messages from the JetStream iterator to the messages channel until the
+// subscription is closed, so Next can honour its context.
+func (sub *subscription) pump() {
+	defer close(sub.messages)
+	for {
+		natsMsg, err := sub.iter.Next()
+		if err != nil {
+			return
+		}
+
+		msg := broker.Message{
+			Stream:  sub.stream,
+			Value:   natsMsg.Data(),
+			Headers: make(map[string]string, len(natsMsg.Headers())),
+		}
+		for k := range natsMsg.Headers() {
+			if k == keyHeader {
+				msg.Key = natsMsg.Headers().Get(k)
+				continue
+			}
+			msg.Headers[k] = natsMsg.Headers().Get(k)
+		}
+		if meta, err := natsMsg.Metadata(); err == nil {
+			msg.Offset = meta.Sequence.Stream - 1
+			msg.Timestamp = meta.Timestamp
+		} else {
+			msg.Timestamp = time.Now().UTC()
+		}
+
+		select {
+		case sub.messages <- msg:
+		case <-sub.done:
+			return
+		}
+	}
+}
+
+// Next returns the next message from the stream.
+func (sub *subscription) Next(ctx context.Context) (broker.Message, error) {
+	select {
+	case msg, ok := <-sub.messages:
+		if !ok {
+			return broker.Message{}, broker.ErrClosed
+		}
+		return msg, nil
+	case <-sub.done:
+		return broker.Message{}, broker.ErrClosed
+	case <-ctx.Done():
+		return broker.Message{}, ctx.Err()
+	}
+}
+
+// Close stops the consumer. It is safe to call more than once.
+func (sub *subscription) Close() error {
+	sub.closeOnce.Do(func() {
+		close(sub.done)
+		sub.iter.Stop()
+	})
+	return nil
+}
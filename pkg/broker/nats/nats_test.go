@@ -0,0 +1,52 @@
+package nats
+
+import (
+	"testing"
+	"time"
+
+	"github.com/RaghibA/iot-telemetry/pkg/broker"
+	"github.com/RaghibA/iot-telemetry/pkg/broker/brokertest"
+	"github.com/nats-io/nats-server/v2/server"
+)
+
+// runServer starts an embedded NATS server with JetStream enabled.
+func runServer(t *testing.T) *server.Server {
+	t.Helper()
+	srv, err := server.NewServer(&server.Options{
+		Host:      "127.0.0.1",
+		Port:      -1,
+		JetStream: true,
+		StoreDir:  t.TempDir(),
+		NoSigs:    true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Start()
+	if !srv.ReadyForConnections(10 * time.Second) {
+		t.Fatal("nats server did not start")
+	}
+	t.Cleanup(srv.Shutdown)
+	return srv
+}
+
+func TestConformance(t *testing.T) {
+	srv := runServer(t)
+
+	brokertest.Run(t, func(t *testing.T) broker.Broker {
+		b, err := New(srv.ClientURL(), Options{MaxMsgs: 100})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	})
+}
+
+func TestStreamName(t *testing.T) {
+	b := &Broker{}
+
+	got := b.StreamName("kitchen sensor.v2/*", "1234")
+	if want := "device_kitchen-sensor-v2-_1234"; got != want {
+		t.Errorf("expected %s, got %s", want, got)
+	}
+}
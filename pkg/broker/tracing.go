@@ -0,0 +1,117 @@
+package broker
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/RaghibA/iot-telemetry/pkg/logging"
+	"github.com/RaghibA/iot-telemetry/pkg/tracing"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// RequestIDHeader is the message header carrying the ID of the request that produced the message.
+const RequestIDHeader = "x-request-id"
+
+type instrumented struct {
+	Broker
+	system string
+}
+
+// Instrument wraps a broker so every publish is traced in a producer span, and the
+// request ID and trace context from the publishing context are carried in the message headers.
+// Params:
+// - b: Broker - the broker to wrap
+// - system: string - the messaging system name reported on spans, e.g. "kafka"
+// Returns:
+// - Broker: the instrumented broker
+func Instrument(b Broker, system string) Broker {
+	return &instrumented{Broker: b, system: system}
+}
+
+// Publish traces the publish and injects the request ID and trace context into msg.Headers.
+func (b *instrumented) Publish(ctx context.Context, stream string, msg Message) (uint64, error) {
+	ctx, span := tracing.Tracer().Start(ctx, "publish "+stream,
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(
+			semconv.MessagingSystemKey.String(b.system),
+			semconv.MessagingOperationTypePublish,
+			semconv.MessagingDestinationName(stream),
+			attribute.String("messaging.message.key", msg.Key),
+		),
+	)
+	defer span.End()
+
+	msg.Headers = InjectHeaders(ctx, msg.Headers)
+
+	offset, err := b.Broker.Publish(ctx, stream, msg)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "publish failed")
+		return 0, err
+	}
+	span.SetAttributes(semconv.MessagingMessageID(fmt.Sprint(offset)))
+
+	return offset, nil
+}
+
+// StartDeliverSpan starts a consumer span for delivering msg to a client. The span starts
+// a new trace linked to the publishing trace carried in the message headers, so
+// long-lived subscriptions do not produce unbounded traces.
+// Params:
+// - msg: Message - the message being delivered
+// - attrs: ...attribute.KeyValue - extra span attributes
+// Returns:
+// - context.Context: the context carrying the span
+// - trace.Span: the started span, which the caller must end
+func StartDeliverSpan(msg Message, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	producerCtx := otel.GetTextMapPropagator().Extract(context.Background(), propagation.MapCarrier(msg.Headers))
+
+	return tracing.Tracer().Start(context.Background(), "deliver "+msg.Stream,
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithLinks(trace.LinkFromContext(producerCtx)),
+		trace.WithAttributes(
+			semconv.MessagingOperationTypeDeliver,
+			semconv.MessagingDestinationName(msg.Stream),
+			semconv.MessagingDestinationPartitionID(fmt.Sprint(msg.Partition)),
+			semconv.MessagingMessageID(fmt.Sprint(msg.Offset)),
+		),
+		trace.WithAttributes(attrs...),
+	)
+}
+
+// InjectHeaders returns a copy of headers carrying the request ID and trace context of ctx.
+// Params:
+// - ctx: context.Context - the publishing context
+// - headers: map[string]string - the message headers, left unchanged
+// Returns:
+// - map[string]string: the headers with the request ID and trace context
+func InjectHeaders(ctx context.Context, headers map[string]string) map[string]string {
+	out := make(map[string]string, len(headers)+3)
+	for k, v := range headers {
+		out[k] = v
+	}
+	if requestID := logging.RequestID(ctx); requestID != "" {
+		out[RequestIDHeader] = requestID
+	}
+	otel.GetTextMapPropagator().Inject(ctx, propagation.MapCarrier(out))
+	return out
+}
+
+// ContextFromHeaders returns ctx with the request ID and trace context carried in headers
+// by InjectHeaders, for publishing a message again outside the request that produced it.
+// Params:
+// - ctx: context.Context - the parent context
+// - headers: map[string]string - the message headers
+// Returns:
+// - context.Context: the context carrying the request ID and remote span context
+func ContextFromHeaders(ctx context.Context, headers map[string]string) context.Context {
+	if requestID := headers[RequestIDHeader]; requestID != "" {
+		ctx = logging.WithRequestID(ctx, requestID)
+	}
+	return otel.GetTextMapPropagator().Extract(ctx, propagation.MapCarrier(headers))
+}
@@ -0,0 +1,71 @@
+package broker_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/RaghibA/iot-telemetry/pkg/broker"
+	"github.com/RaghibA/iot-telemetry/pkg/broker/memory"
+	"github.com/RaghibA/iot-telemetry/pkg/logging"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestInstrument(t *testing.T) {
+	otel.SetTracerProvider(sdktrace.NewTracerProvider())
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	ctx := context.Background()
+	b := broker.Instrument(memory.New(8), "memory")
+	stream := b.StreamName("device", "1")
+	if err := b.CreateStream(ctx, stream); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("should carry the request id and trace context to subscribers", func(t *testing.T) {
+		sub, err := b.Subscribe(ctx, stream, broker.SubscribeOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer sub.Close()
+
+		pubCtx := logging.WithRequestID(ctx, "req-123")
+		pubCtx, span := otel.Tracer("test").Start(pubCtx, "request")
+		defer span.End()
+
+		if _, err := b.Publish(pubCtx, stream, broker.Message{Key: "1", Value: []byte("{}")}); err != nil {
+			t.Fatal(err)
+		}
+
+		msg, err := sub.Next(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.Headers[broker.RequestIDHeader] != "req-123" {
+			t.Errorf("expected request id header, got %v", msg.Headers)
+		}
+
+		deliverCtx, deliverSpan := broker.StartDeliverSpan(msg)
+		defer deliverSpan.End()
+
+		links := deliverSpan.(sdktrace.ReadOnlySpan).Links()
+		if len(links) != 1 || links[0].SpanContext.TraceID() != span.SpanContext().TraceID() {
+			t.Errorf("expected a link to the publishing trace, got %v", links)
+		}
+		if trace.SpanContextFromContext(deliverCtx).TraceID() == span.SpanContext().TraceID() {
+			t.Error("expected delivery to start a new trace")
+		}
+	})
+
+	t.Run("should not modify the caller's headers", func(t *testing.T) {
+		headers := map[string]string{"content-type": "application/json"}
+		if _, err := b.Publish(ctx, stream, broker.Message{Headers: headers}); err != nil {
+			t.Fatal(err)
+		}
+		if len(headers) != 1 {
+			t.Errorf("expected caller headers untouched, got %v", headers)
+		}
+	})
+}
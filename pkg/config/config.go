@@ -1,134 +1,379 @@
 package config
 
-import "github.com/RaghibA/iot-telemetry/pkg/utils"
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
 
-type AuthConfig struct {
-	HOST      string
-	PORT      string
-	JWTSECRET string
+// Config is the typed configuration shared by every service.
+//
+// Values are resolved in order of increasing precedence: built-in defaults,
+// a YAML or TOML config file, environment variables (with _FILE variants for
+// secrets), and command line flags. Each leaf field declares its file key,
+// environment variable and flag name in struct tags.
+type Config struct {
+	Server   ServerConfig   `yaml:"server" toml:"server"`
+	DB       DBConfig       `yaml:"db" toml:"db"`
+	SQLite   SQLiteConfig   `yaml:"sqlite" toml:"sqlite"`
+	Broker   BrokerConfig   `yaml:"broker" toml:"broker"`
+	Kafka    KafkaConfig    `yaml:"kafka" toml:"kafka"`
+	NATS     NATSConfig     `yaml:"nats" toml:"nats"`
+	Consumer ConsumerConfig `yaml:"consumer" toml:"consumer"`
+	Ingest   IngestConfig   `yaml:"ingest" toml:"ingest"`
+	JWT      JWTConfig      `yaml:"jwt" toml:"jwt"`
+	TLS      TLSConfig      `yaml:"tls" toml:"tls"`
+	Timeouts TimeoutConfig  `yaml:"timeouts" toml:"timeouts"`
+	Limits   LimitsConfig   `yaml:"limits" toml:"limits"`
+	Tracing  TracingConfig  `yaml:"tracing" toml:"tracing"`
 }
 
-type AdminConfig struct {
-	HOST      string
-	PORT      string
-	JWTSECRET string
+type ServerConfig struct {
+	Host string `yaml:"host" toml:"host" env:"HOST" flag:"host" usage:"interface the HTTP server listens on"`
+	Port string `yaml:"port" toml:"port" env:"PORT" flag:"port" usage:"port the HTTP server listens on"`
+	// GRPCAddr is where the gRPC API of the data and consumer services listens.
+	GRPCAddr string `yaml:"grpcAddr" toml:"grpcAddr" env:"GRPC_ADDR" flag:"grpc-addr" usage:"address the gRPC server listens on, e.g. :50051, disabled if empty"`
+
+	TrustedProxies []string `yaml:"trustedProxies" toml:"trustedProxies" env:"TRUSTED_PROXIES" flag:"trusted-proxies" usage:"comma separated addresses or CIDR ranges of reverse proxies whose X-Forwarded-For and X-Real-IP headers are trusted"`
+}
+
+type SQLiteConfig struct {
+	Path string `yaml:"path" toml:"path" env:"SQLITE_PATH" flag:"sqlite-path" usage:"SQLite database file used by the all-in-one command"`
+}
+
+// Broker backends selectable with BrokerConfig.Backend.
+const (
+	BackendKafka  = "kafka"
+	BackendNATS   = "nats"
+	BackendMemory = "memory"
+)
+
+type BrokerConfig struct {
+	Backend        string `yaml:"backend" toml:"backend" env:"BROKER_BACKEND" flag:"broker-backend" usage:"message broker backend: kafka, nats or memory"`
+	MemoryCapacity int    `yaml:"memoryCapacity" toml:"memoryCapacity" env:"BROKER_MEMORY_CAPACITY" flag:"broker-memory-capacity" usage:"messages retained per stream by the memory backend"`
+}
+
+// Kafka producer compression codecs selectable with KafkaConfig.Compression.
+const (
+	CompressionNone   = "none"
+	CompressionGzip   = "gzip"
+	CompressionSnappy = "snappy"
+	CompressionLZ4    = "lz4"
+	CompressionZstd   = "zstd"
+)
+
+type KafkaConfig struct {
+	Brokers           []string `yaml:"brokers" toml:"brokers" env:"KAFKA_BROKERS" flag:"kafka-brokers" usage:"comma separated list of Kafka broker addresses"`
+	Host              string   `yaml:"host" toml:"host" env:"KAFKA_HOST" flag:"kafka-host" usage:"Kafka broker host, used when no broker list is set"`
+	Port              string   `yaml:"port" toml:"port" env:"KAFKA_PORT" flag:"kafka-port" usage:"Kafka broker port, used when no broker list is set"`
+	ReplicationFactor int      `yaml:"replicationFactor" toml:"replicationFactor" env:"KAFKA_TOPIC_REPLICATION_FACTOR" flag:"kafka-topic-replication-factor" usage:"replication factor for new device topics"`
+	Compression       string   `yaml:"compression" toml:"compression" env:"KAFKA_COMPRESSION" flag:"kafka-compression" usage:"compression of produced message batches: none, gzip, snappy, lz4 or zstd"`
+	CompressionLevel  int      `yaml:"compressionLevel" toml:"compressionLevel" env:"KAFKA_COMPRESSION_LEVEL" flag:"kafka-compression-level" usage:"gzip (1-9) or zstd (1-22) compression level, 0 for the codec default"`
 }
 
-type DataConfig struct {
-	HOST      string
-	PORT      string
-	JWTSECRET string
+type NATSConfig struct {
+	URL      string `yaml:"url" toml:"url" env:"NATS_URL" flag:"nats-url" usage:"NATS server URL, comma separated for a cluster"`
+	MaxMsgs  int64  `yaml:"maxMsgs" toml:"maxMsgs" env:"NATS_STREAM_MAX_MSGS" flag:"nats-stream-max-msgs" usage:"messages retained per device stream, unlimited if 0"`
+	Replicas int    `yaml:"replicas" toml:"replicas" env:"NATS_STREAM_REPLICAS" flag:"nats-stream-replicas" usage:"replicas for new device streams"`
 }
 
+// Slow consumer policies selectable with ConsumerConfig.SlowPolicy.
+const (
+	PolicyDropOldest = "drop-oldest"
+	PolicyDropNewest = "drop-newest"
+	PolicyDisconnect = "disconnect"
+)
+
 type ConsumerConfig struct {
-	HOST      string
-	PORT      string
-	JWTSECRET string
+	BufferSize int    `yaml:"bufferSize" toml:"bufferSize" env:"CONSUMER_BUFFER_SIZE" flag:"consumer-buffer-size" usage:"messages buffered per stream client"`
+	SlowPolicy string `yaml:"slowPolicy" toml:"slowPolicy" env:"CONSUMER_SLOW_POLICY" flag:"consumer-slow-policy" usage:"what to do when a client's buffer is full: drop-oldest, drop-newest or disconnect"`
+
+	PingInterval time.Duration `yaml:"pingInterval" toml:"pingInterval" env:"CONSUMER_WS_PING_INTERVAL" flag:"consumer-ws-ping-interval" usage:"time between websocket pings"`
+	PongTimeout  time.Duration `yaml:"pongTimeout" toml:"pongTimeout" env:"CONSUMER_WS_PONG_TIMEOUT" flag:"consumer-ws-pong-timeout" usage:"time without a pong after which a websocket client is disconnected"`
+	WriteTimeout time.Duration `yaml:"writeTimeout" toml:"writeTimeout" env:"CONSUMER_WS_WRITE_TIMEOUT" flag:"consumer-ws-write-timeout" usage:"maximum time to write a websocket message"`
+	TicketTTL    time.Duration `yaml:"ticketTTL" toml:"ticketTTL" env:"CONSUMER_WS_TICKET_TTL" flag:"consumer-ws-ticket-ttl" usage:"time within which a websocket ticket must be redeemed"`
+
+	AllowedOrigins  []string `yaml:"allowedOrigins" toml:"allowedOrigins" env:"CONSUMER_WS_ALLOWED_ORIGINS" flag:"consumer-ws-allowed-origins" usage:"comma separated list of origins allowed to open websockets besides the server's own, e.g. https://*.example.com"`
+	Compression     bool     `yaml:"compression" toml:"compression" env:"CONSUMER_WS_COMPRESSION" flag:"consumer-ws-compression" usage:"negotiate permessage-deflate compression"`
+	ReadBufferSize  int      `yaml:"readBufferSize" toml:"readBufferSize" env:"CONSUMER_WS_READ_BUFFER_SIZE" flag:"consumer-ws-read-buffer-size" usage:"websocket read buffer size in bytes"`
+	WriteBufferSize int      `yaml:"writeBufferSize" toml:"writeBufferSize" env:"CONSUMER_WS_WRITE_BUFFER_SIZE" flag:"consumer-ws-write-buffer-size" usage:"websocket write buffer size in bytes"`
+	MaxMessageSize  int64    `yaml:"maxMessageSize" toml:"maxMessageSize" env:"CONSUMER_WS_MAX_MESSAGE_SIZE" flag:"consumer-ws-max-message-size" usage:"largest message in bytes a websocket client may send"`
 }
 
-// GetAuthConfig retrieves the authentication configuration from environment variables.
-// Params: None
-// Returns:
-// - *AuthConfig: a pointer to the AuthConfig struct containing the configuration
-// - error: error if any occurred during the retrieval of environment variables
-func GetAuthConfig() (*AuthConfig, error) {
-	host, err := utils.GetEnv("HOST", "")
-	if err != nil {
-		return nil, err
-	}
+// Idempotency stores selectable with IngestConfig.IdempotencyStore.
+const (
+	IdempotencyMemory = "memory"
+	IdempotencyDB     = "db"
+	IdempotencyRedis  = "redis"
+)
 
-	port, err := utils.GetEnv("PORT", "")
-	if err != nil {
-		return nil, err
-	}
+// Rate limit stores selectable with IngestConfig.RateLimitStore.
+const (
+	RateLimitMemory = "memory"
+	RateLimitRedis  = "redis"
+)
 
-	jwtSecret, err := utils.GetEnv("JWT_SECRET", "")
-	if err != nil {
-		return nil, err
-	}
+// Write-ahead log sync policies selectable with IngestConfig.WALSync.
+const (
+	WALSyncAlways   = "always"
+	WALSyncInterval = "interval"
+	WALSyncNone     = "none"
+)
+
+type IngestConfig struct {
+	MaxFutureSkew time.Duration `yaml:"maxFutureSkew" toml:"maxFutureSkew" env:"INGEST_MAX_FUTURE_SKEW" flag:"ingest-max-future-skew" usage:"how far ahead of the server clock a device timestamp may be, 0 for no limit"`
+	MaxEventAge   time.Duration `yaml:"maxEventAge" toml:"maxEventAge" env:"INGEST_MAX_EVENT_AGE" flag:"ingest-max-event-age" usage:"how far behind the server clock a device timestamp may be, 0 for no limit"`
+	MaxDepth      int           `yaml:"maxDepth" toml:"maxDepth" env:"INGEST_MAX_DEPTH" flag:"ingest-max-depth" usage:"deepest nesting of objects and arrays in a telemetry payload, 0 for no limit"`
+	MaxKeys       int           `yaml:"maxKeys" toml:"maxKeys" env:"INGEST_MAX_KEYS" flag:"ingest-max-keys" usage:"most object keys in a telemetry payload, 0 for no limit"`
+
+	SenMLMaxMeasurements int    `yaml:"senmlMaxMeasurements" toml:"senmlMaxMeasurements" env:"INGEST_SENML_MAX_MEASUREMENTS" flag:"ingest-senml-max-measurements" usage:"most measurements in a SenML pack, 0 for no limit"`
+	InfluxMaxLines       int    `yaml:"influxMaxLines" toml:"influxMaxLines" env:"INGEST_INFLUX_MAX_LINES" flag:"ingest-influx-max-lines" usage:"most lines in a line protocol write, 0 for no limit"`
+	InfluxDeviceTag      string `yaml:"influxDeviceTag" toml:"influxDeviceTag" env:"INGEST_INFLUX_DEVICE_TAG" flag:"ingest-influx-device-tag" usage:"line protocol tag holding the device ID of writes to /write"`
+	OTLPMaxDataPoints    int    `yaml:"otlpMaxDataPoints" toml:"otlpMaxDataPoints" env:"INGEST_OTLP_MAX_DATA_POINTS" flag:"ingest-otlp-max-data-points" usage:"most data points in an OTLP metrics export, 0 for no limit"`
+	MaxDecompressedBytes int64  `yaml:"maxDecompressedBytes" toml:"maxDecompressedBytes" env:"INGEST_MAX_DECOMPRESSED_BYTES" flag:"ingest-max-decompressed-bytes" usage:"largest size in bytes a gzip, deflate or zstd request body may decompress to"`
+
+	CoAPAddr             string        `yaml:"coapAddr" toml:"coapAddr" env:"INGEST_COAP_ADDR" flag:"ingest-coap-addr" usage:"UDP address of the CoAP listener, e.g. :5683, disabled if empty"`
+	CoAPMaxBodyBytes     int64         `yaml:"coapMaxBodyBytes" toml:"coapMaxBodyBytes" env:"INGEST_COAP_MAX_BODY_BYTES" flag:"ingest-coap-max-body-bytes" usage:"largest CoAP payload in bytes, reassembled from its blocks"`
+	CoAPBlockwiseTimeout time.Duration `yaml:"coapBlockwiseTimeout" toml:"coapBlockwiseTimeout" env:"INGEST_COAP_BLOCKWISE_TIMEOUT" flag:"ingest-coap-blockwise-timeout" usage:"how long the blocks of a CoAP payload are kept waiting for the rest"`
 
-	return &AuthConfig{
-		HOST:      host,
-		PORT:      port,
-		JWTSECRET: jwtSecret,
-	}, nil
+	IdempotencyWindow    time.Duration `yaml:"idempotencyWindow" toml:"idempotencyWindow" env:"INGEST_IDEMPOTENCY_WINDOW" flag:"ingest-idempotency-window" usage:"how long a message ID is remembered to detect retries"`
+	IdempotencyCacheSize int           `yaml:"idempotencyCacheSize" toml:"idempotencyCacheSize" env:"INGEST_IDEMPOTENCY_CACHE_SIZE" flag:"ingest-idempotency-cache-size" usage:"message IDs remembered in memory"`
+	IdempotencyStore     string        `yaml:"idempotencyStore" toml:"idempotencyStore" env:"INGEST_IDEMPOTENCY_STORE" flag:"ingest-idempotency-store" usage:"where message IDs are shared between replicas: memory for none, db or redis"`
+	IdempotencyRedisURL  string        `yaml:"idempotencyRedisURL" toml:"idempotencyRedisURL" env:"INGEST_IDEMPOTENCY_REDIS_URL" flag:"ingest-idempotency-redis-url" usage:"Redis URL of the redis idempotency store, e.g. redis://redis:6379/0"`
+
+	KeyRate           float64 `yaml:"keyRate" toml:"keyRate" env:"INGEST_KEY_RATE" flag:"ingest-key-rate" usage:"messages per second allowed per API key, unlimited if 0"`
+	KeyBurst          int     `yaml:"keyBurst" toml:"keyBurst" env:"INGEST_KEY_BURST" flag:"ingest-key-burst" usage:"messages an API key may send at once above its rate"`
+	DeviceRate        float64 `yaml:"deviceRate" toml:"deviceRate" env:"INGEST_DEVICE_RATE" flag:"ingest-device-rate" usage:"messages per second allowed per device, unlimited if 0"`
+	DeviceBurst       int     `yaml:"deviceBurst" toml:"deviceBurst" env:"INGEST_DEVICE_BURST" flag:"ingest-device-burst" usage:"messages a device may send at once above its rate"`
+	RateLimitStore    string  `yaml:"rateLimitStore" toml:"rateLimitStore" env:"INGEST_RATE_LIMIT_STORE" flag:"ingest-rate-limit-store" usage:"where rate limits are counted: memory, per replica, or redis, shared between replicas"`
+	RateLimitRedisURL string  `yaml:"rateLimitRedisURL" toml:"rateLimitRedisURL" env:"INGEST_RATE_LIMIT_REDIS_URL" flag:"ingest-rate-limit-redis-url" usage:"Redis URL of the redis rate limit store, e.g. redis://redis:6379/0"`
+
+	WALDir          string        `yaml:"walDir" toml:"walDir" env:"INGEST_WAL_DIR" flag:"ingest-wal-dir" usage:"directory of the write-ahead log buffering telemetry while the broker is unavailable, disabled if empty"`
+	WALSync         string        `yaml:"walSync" toml:"walSync" env:"INGEST_WAL_SYNC" flag:"ingest-wal-sync" usage:"when the write-ahead log is flushed to disk: always, before acknowledging each message, interval or none, leaving it to the OS"`
+	WALSyncInterval time.Duration `yaml:"walSyncInterval" toml:"walSyncInterval" env:"INGEST_WAL_SYNC_INTERVAL" flag:"ingest-wal-sync-interval" usage:"time between flushes of the write-ahead log with the interval policy"`
+	WALSegmentBytes int64         `yaml:"walSegmentBytes" toml:"walSegmentBytes" env:"INGEST_WAL_SEGMENT_BYTES" flag:"ingest-wal-segment-bytes" usage:"size in bytes at which the write-ahead log starts a new segment file"`
+	WALMaxBytes     int64         `yaml:"walMaxBytes" toml:"walMaxBytes" env:"INGEST_WAL_MAX_BYTES" flag:"ingest-wal-max-bytes" usage:"largest size in bytes of the write-ahead log, telemetry is refused once it is full"`
+
+	Quotas        bool  `yaml:"quotas" toml:"quotas" env:"INGEST_QUOTAS" flag:"ingest-quotas" usage:"enforce daily message and byte quotas per user, counted in the database"`
+	DailyMessages int64 `yaml:"dailyMessages" toml:"dailyMessages" env:"INGEST_DAILY_MESSAGES" flag:"ingest-daily-messages" usage:"default daily message quota of users without a plan, unlimited if 0"`
+	DailyBytes    int64 `yaml:"dailyBytes" toml:"dailyBytes" env:"INGEST_DAILY_BYTES" flag:"ingest-daily-bytes" usage:"default daily payload byte quota of users without a plan, unlimited if 0"`
 }
 
-// GetAdminConfig retrieves the admin api configuration from environment variables.
+type JWTConfig struct {
+	Secret string `yaml:"secret" toml:"secret" env:"JWT_SECRET" flag:"jwt-secret" usage:"secret used to sign and verify tokens"`
+}
+
+type TLSConfig struct {
+	CertFile string `yaml:"certFile" toml:"certFile" env:"TLS_CERT_FILE" flag:"tls-cert-file" usage:"PEM certificate file, enables HTTPS together with the key file"`
+	KeyFile  string `yaml:"keyFile" toml:"keyFile" env:"TLS_KEY_FILE" flag:"tls-key-file" usage:"PEM private key file, enables HTTPS together with the certificate file"`
+}
+
+type TimeoutConfig struct {
+	ReadHeader time.Duration `yaml:"readHeader" toml:"readHeader" env:"HTTP_READ_HEADER_TIMEOUT" flag:"http-read-header-timeout" usage:"maximum time to read request headers"`
+	Read       time.Duration `yaml:"read" toml:"read" env:"HTTP_READ_TIMEOUT" flag:"http-read-timeout" usage:"maximum time to read a full request"`
+	Write      time.Duration `yaml:"write" toml:"write" env:"HTTP_WRITE_TIMEOUT" flag:"http-write-timeout" usage:"maximum time to write a response"`
+	Idle       time.Duration `yaml:"idle" toml:"idle" env:"HTTP_IDLE_TIMEOUT" flag:"http-idle-timeout" usage:"maximum time to keep idle connections open"`
+	Shutdown   time.Duration `yaml:"shutdown" toml:"shutdown" env:"HTTP_SHUTDOWN_TIMEOUT" flag:"http-shutdown-timeout" usage:"maximum time to drain requests on shutdown"`
+	Readiness  time.Duration `yaml:"readiness" toml:"readiness" env:"READINESS_TIMEOUT" flag:"readiness-timeout" usage:"maximum time for readiness dependency checks"`
+}
+
+type LimitsConfig struct {
+	MaxHeaderBytes int   `yaml:"maxHeaderBytes" toml:"maxHeaderBytes" env:"HTTP_MAX_HEADER_BYTES" flag:"http-max-header-bytes" usage:"maximum size of request headers"`
+	MaxBodyBytes   int64 `yaml:"maxBodyBytes" toml:"maxBodyBytes" env:"HTTP_MAX_BODY_BYTES" flag:"http-max-body-bytes" usage:"maximum size of request bodies"`
+	// RouteBodyBytes are path-prefix=bytes entries overriding MaxBodyBytes for the routes
+	// under a path. The longest matching prefix wins.
+	RouteBodyBytes []string `yaml:"routeBodyBytes" toml:"routeBodyBytes" env:"HTTP_ROUTE_MAX_BODY_BYTES" flag:"http-route-max-body-bytes" usage:"maximum size of request bodies per route, as path-prefix=bytes entries"`
+}
+
+// BodyLimit is the maximum body size of the routes under a path.
+type BodyLimit struct {
+	Prefix   string
+	MaxBytes int64
+}
+
+type TracingConfig struct {
+	OTLPEndpoint string `yaml:"otlpEndpoint" toml:"otlpEndpoint" env:"OTEL_EXPORTER_OTLP_ENDPOINT" flag:"otlp-endpoint" usage:"OTLP/HTTP collector URL, span export is disabled when empty"`
+}
+
+// Default returns the configuration used before any file, environment variable or flag is applied.
 // Params: None
 // Returns:
-// - *AdminConfig: a pointer to the AdminConfig struct containing the configuration
-// - error: error if any occurred during the retrieval of environment variables
-func GetAdminConfig() (*AdminConfig, error) {
-	host, err := utils.GetEnv("HOST", "")
-	if err != nil {
-		return nil, err
-	}
+// - *Config: a pointer to the default configuration
+func Default() *Config {
+	return &Config{
+		Server: ServerConfig{
+			Host: "0.0.0.0",
+		},
+		DB: DBConfig{
+			Host:    "localhost",
+			Port:    "5432",
+			SSLMode: "disable",
+		},
+		SQLite: SQLiteConfig{
+			Path: "iot-telemetry.db",
+		},
+		Broker: BrokerConfig{
+			Backend:        BackendKafka,
+			MemoryCapacity: 1024,
+		},
+		Kafka: KafkaConfig{
+			ReplicationFactor: 1,
+			Compression:       CompressionNone,
+		},
+		NATS: NATSConfig{
+			URL:      "nats://localhost:4222",
+			Replicas: 1,
+		},
+		Consumer: ConsumerConfig{
+			BufferSize:   256,
+			SlowPolicy:   PolicyDropOldest,
+			PingInterval: 30 * time.Second,
+			PongTimeout:  60 * time.Second,
+			WriteTimeout: 10 * time.Second,
+			TicketTTL:    30 * time.Second,
 
-	port, err := utils.GetEnv("PORT", "")
-	if err != nil {
-		return nil, err
-	}
+			Compression:     true,
+			ReadBufferSize:  1024,
+			WriteBufferSize: 1024,
+			MaxMessageSize:  4096,
+		},
+		Ingest: IngestConfig{
+			MaxFutureSkew: 5 * time.Minute,
+			MaxEventAge:   7 * 24 * time.Hour,
+			MaxDepth:      32,
+			MaxKeys:       1024,
 
-	jwtSecret, err := utils.GetEnv("JWT_SECRET", "")
-	if err != nil {
-		return nil, err
+			SenMLMaxMeasurements: 256,
+			InfluxMaxLines:       5000,
+			InfluxDeviceTag:      "device_id",
+			OTLPMaxDataPoints:    1000,
+			MaxDecompressedBytes: 1 << 20,
+
+			CoAPMaxBodyBytes:     64 << 10,
+			CoAPBlockwiseTimeout: 30 * time.Second,
+
+			IdempotencyWindow:    24 * time.Hour,
+			IdempotencyCacheSize: 100000,
+			IdempotencyStore:     IdempotencyMemory,
+
+			KeyRate:        50,
+			KeyBurst:       100,
+			DeviceRate:     10,
+			DeviceBurst:    20,
+			RateLimitStore: RateLimitMemory,
+
+			WALSync:         WALSyncInterval,
+			WALSyncInterval: time.Second,
+			WALSegmentBytes: 16 << 20,
+			WALMaxBytes:     1 << 30,
+		},
+		Timeouts: TimeoutConfig{
+			ReadHeader: 5 * time.Second,
+			Read:       15 * time.Second,
+			Write:      30 * time.Second,
+			Idle:       60 * time.Second,
+			Shutdown:   10 * time.Second,
+			Readiness:  2 * time.Second,
+		},
+		Limits: LimitsConfig{
+			MaxHeaderBytes: 1 << 20,
+			MaxBodyBytes:   1 << 20,
+			// credentials, device names and tickets are small, Protobuf schemas less so
+			RouteBodyBytes: []string{"/api/v1/auth=16384", "/api/v1/admin=16384", "/api/v1/admin/device/schema=262144", "/api/v1/telemetry=16384"},
+		},
 	}
+}
 
-	return &AdminConfig{
-		HOST:      host,
-		PORT:      port,
-		JWTSECRET: jwtSecret,
-	}, nil
+// Addr returns the host:port address the HTTP server listens on.
+// Params: None
+// Returns:
+// - string: the listen address
+func (c *ServerConfig) Addr() string {
+	return net.JoinHostPort(c.Host, c.Port)
 }
 
-// GetDataConfig retrieves the data api configuration from environment variables.
+// TrustedProxyPrefixes returns the trusted proxies as address ranges. Single addresses
+// become ranges of one address and invalid entries, rejected by Validate, are skipped.
 // Params: None
 // Returns:
-// - *DataConfig: a pointer to the DataConfig struct containing the configuration
-// - error: error if any occurred during the retrieval of environment variables
-func GetDataConfig() (*DataConfig, error) {
-	host, err := utils.GetEnv("HOST", "")
-	if err != nil {
-		return nil, err
+// - []netip.Prefix: the trusted proxy ranges
+func (c *ServerConfig) TrustedProxyPrefixes() []netip.Prefix {
+	prefixes := make([]netip.Prefix, 0, len(c.TrustedProxies))
+	for _, proxy := range c.TrustedProxies {
+		if prefix, err := parsePrefix(proxy); err == nil {
+			prefixes = append(prefixes, prefix)
+		}
 	}
+	return prefixes
+}
 
-	port, err := utils.GetEnv("PORT", "")
-	if err != nil {
-		return nil, err
+// BodyLimits returns the per route body limits, longest prefix first. Invalid entries,
+// rejected by Validate, are skipped.
+// Params: None
+// Returns:
+// - []BodyLimit: the body limits
+func (c *LimitsConfig) BodyLimits() []BodyLimit {
+	limits := make([]BodyLimit, 0, len(c.RouteBodyBytes))
+	for _, entry := range c.RouteBodyBytes {
+		if limit, err := parseBodyLimit(entry); err == nil {
+			limits = append(limits, limit)
+		}
 	}
+	sort.SliceStable(limits, func(i, j int) bool {
+		return len(limits[i].Prefix) > len(limits[j].Prefix)
+	})
+	return limits
+}
 
-	jwtSecret, err := utils.GetEnv("JWT_SECRET", "")
-	if err != nil {
-		return nil, err
+// parseBodyLimit parses a path-prefix=bytes entry.
+func parseBodyLimit(s string) (BodyLimit, error) {
+	prefix, size, ok := strings.Cut(s, "=")
+	if !ok || !strings.HasPrefix(prefix, "/") {
+		return BodyLimit{}, errors.New("must be a path-prefix=bytes entry")
 	}
-
-	return &DataConfig{
-		HOST:      host,
-		PORT:      port,
-		JWTSECRET: jwtSecret,
-	}, nil
+	maxBytes, err := strconv.ParseInt(size, 10, 64)
+	if err != nil || maxBytes <= 0 {
+		return BodyLimit{}, errors.New("must have a positive size in bytes")
+	}
+	return BodyLimit{Prefix: strings.TrimSuffix(prefix, "/"), MaxBytes: maxBytes}, nil
 }
 
-func GetConsumerConfig() (*ConsumerConfig, error) {
-	host, err := utils.GetEnv("HOST", "")
-	if err != nil {
-		return nil, err
+// parsePrefix parses a CIDR range or a single address.
+func parsePrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		prefix, err := netip.ParsePrefix(s)
+		return prefix.Masked(), err
 	}
-
-	port, err := utils.GetEnv("PORT", "")
+	addr, err := netip.ParseAddr(s)
 	if err != nil {
-		return nil, err
+		return netip.Prefix{}, err
 	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
 
-	jwtSecret, err := utils.GetEnv("JWT_SECRET", "")
-	if err != nil {
-		return nil, err
+// BrokerAddrs returns the Kafka broker addresses, falling back to host and port
+// when no broker list is configured.
+// Params: None
+// Returns:
+// - []string: the broker addresses
+func (c *KafkaConfig) BrokerAddrs() []string {
+	if len(c.Brokers) > 0 {
+		return c.Brokers
 	}
+	if c.Host == "" && c.Port == "" {
+		return nil
+	}
+	return []string{net.JoinHostPort(c.Host, c.Port)}
+}
 
-	return &ConsumerConfig{
-		HOST:      host,
-		PORT:      port,
-		JWTSECRET: jwtSecret,
-	}, nil
+// Enabled reports whether both a certificate and a key are configured.
+// Params: None
+// Returns:
+// - bool: true if the server should serve HTTPS
+func (c *TLSConfig) Enabled() bool {
+	return c.CertFile != "" && c.KeyFile != ""
 }
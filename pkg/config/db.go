@@ -1,63 +1,31 @@
 package config
 
 import (
-    "fmt"
-
-    "github.com/RaghibA/iot-telemetry/pkg/utils"
+	"fmt"
+	"net"
+	"net/url"
 )
 
 type DBConfig struct {
-    PostgresUser string
-    PostgresPass string
-    PostgresName string
-    PostgresPort string
-}
-
-// GetDBString constructs the database connection string from the given DBConfig.
-// Params:
-// - config: *DBConfig - a pointer to the DBConfig struct containing the database configuration
-// Returns:
-// - string: the constructed database connection string
-func GetDBString(config *DBConfig) string {
-    return fmt.Sprintf("postgres://%v:%v@%v:%v/%v?sslmode=disable",
-        config.PostgresUser,
-        config.PostgresPass,
-        "db",
-        config.PostgresPort,
-        config.PostgresName,
-    )
+	Host     string `yaml:"host" toml:"host" env:"DB_HOST" flag:"db-host" usage:"Postgres host"`
+	Port     string `yaml:"port" toml:"port" env:"DB_PORT" flag:"db-port" usage:"Postgres port"`
+	User     string `yaml:"user" toml:"user" env:"DB_USER" flag:"db-user" usage:"Postgres user"`
+	Password string `yaml:"password" toml:"password" env:"DB_PASS" flag:"db-pass" usage:"Postgres password"`
+	Name     string `yaml:"name" toml:"name" env:"DB_NAME" flag:"db-name" usage:"Postgres database name"`
+	SSLMode  string `yaml:"sslMode" toml:"sslMode" env:"DB_SSLMODE" flag:"db-sslmode" usage:"Postgres sslmode (disable, require, verify-ca, verify-full)"`
 }
 
-// GetDBConfig retrieves the database configuration from environment variables.
+// URL constructs the database connection URL from the given DBConfig.
 // Params: None
 // Returns:
-// - *DBConfig: a pointer to the DBConfig struct containing the database configuration
-// - error: error if any occurred during the retrieval of environment variables
-func GetDBConfig() (*DBConfig, error) {
-    user, err := utils.GetEnv("DB_USER", "")
-    if err != nil {
-        return nil, err
-    }
-
-    pass, err := utils.GetEnv("DB_PASS", "")
-    if err != nil {
-        return nil, err
-    }
-
-    name, err := utils.GetEnv("DB_NAME", "")
-    if err != nil {
-        return nil, err
-    }
-
-    port, err := utils.GetEnv("DB_PORT", "")
-    if err != nil {
-        return nil, err
-    }
-
-    return &DBConfig{
-        PostgresUser: user,
-        PostgresPass: pass,
-        PostgresName: name,
-        PostgresPort: port,
-    }, nil
+// - string: the constructed database connection URL
+func (c *DBConfig) URL() string {
+	u := url.URL{
+		Scheme:   "postgres",
+		User:     url.UserPassword(c.User, c.Password),
+		Host:     net.JoinHostPort(c.Host, c.Port),
+		Path:     c.Name,
+		RawQuery: fmt.Sprintf("sslmode=%s", url.QueryEscape(c.SSLMode)),
+	}
+	return u.String()
 }
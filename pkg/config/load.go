@@ -0,0 +1,265 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// fileSuffix is appended to an environment variable name to read its value from a file,
+// e.g. JWT_SECRET_FILE=/run/secrets/jwt_secret.
+const fileSuffix = "_FILE"
+
+// Load resolves the configuration for a service from defaults, the config file,
+// environment variables and command line flags, then validates the requested sections.
+// The config file is read from the -config flag or the CONFIG_FILE environment variable.
+// Params:
+// - service: string - the name of the service, used for flag usage output
+// - args: []string - the command line arguments, without the program name
+// - sections: ...Section - the sections the service needs, validated after loading
+// Returns:
+// - *Config: a pointer to the loaded configuration
+// - error: error if the configuration could not be loaded or is invalid
+func Load(service string, args []string, sections ...Section) (*Config, error) {
+	return LoadWithDefaults(Default(), service, args, sections...)
+}
+
+// LoadWithDefaults works like Load, starting from the given defaults instead of Default().
+// Params:
+// - cfg: *Config - the defaults, overwritten with the loaded values
+// - service: string - the name of the service, used for flag usage output
+// - args: []string - the command line arguments, without the program name
+// - sections: ...Section - the sections the service needs, validated after loading
+// Returns:
+// - *Config: cfg, holding the loaded configuration
+// - error: error if the configuration could not be loaded or is invalid
+func LoadWithDefaults(cfg *Config, service string, args []string, sections ...Section) (*Config, error) {
+	fields := leafFields(reflect.ValueOf(cfg).Elem(), "")
+
+	fs := flag.NewFlagSet(service, flag.ContinueOnError)
+	configFile := fs.String("config", os.Getenv("CONFIG_FILE"), "path to a YAML or TOML config file")
+	flagValues := make(map[string]*string, len(fields))
+	for _, f := range fields {
+		if f.flag != "" {
+			flagValues[f.flag] = fs.String(f.flag, "", fmt.Sprintf("%s (env %s)", f.usage, f.env))
+		}
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if *configFile != "" {
+		if err := loadFile(cfg, *configFile); err != nil {
+			return nil, err
+		}
+	}
+
+	var problems []string
+	for _, f := range fields {
+		if f.env == "" {
+			continue
+		}
+		raw, ok, err := lookupEnv(f.env)
+		if err != nil {
+			problems = append(problems, err.Error())
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if err := setValue(f.value, raw); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: invalid value in %s: %v", f.path, f.env, err))
+		}
+	}
+
+	fs.Visit(func(fl *flag.Flag) {
+		raw, ok := flagValues[fl.Name]
+		if !ok {
+			return
+		}
+		for _, f := range fields {
+			if f.flag == fl.Name {
+				if err := setValue(f.value, *raw); err != nil {
+					problems = append(problems, fmt.Sprintf("%s: invalid value in -%s: %v", f.path, f.flag, err))
+				}
+			}
+		}
+	})
+
+	if len(problems) > 0 {
+		return nil, &ValidationError{Problems: problems}
+	}
+
+	if err := cfg.Validate(sections...); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// field describes one configurable leaf value of the Config struct.
+type field struct {
+	path  string
+	env   string
+	flag  string
+	usage string
+	value reflect.Value
+}
+
+// leafFields walks the Config struct and returns every field with an env or flag tag.
+func leafFields(v reflect.Value, prefix string) []field {
+	var fields []field
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		name := sf.Tag.Get("yaml")
+		if name == "" {
+			name = strings.ToLower(sf.Name)
+		}
+		path := name
+		if prefix != "" {
+			path = prefix + "." + name
+		}
+
+		fv := v.Field(i)
+		if sf.Type.Kind() == reflect.Struct {
+			fields = append(fields, leafFields(fv, path)...)
+			continue
+		}
+
+		fields = append(fields, field{
+			path:  path,
+			env:   sf.Tag.Get("env"),
+			flag:  sf.Tag.Get("flag"),
+			usage: sf.Tag.Get("usage"),
+			value: fv,
+		})
+	}
+	return fields
+}
+
+// lookupEnv reads an environment variable, or the file named by its _FILE variant.
+// Params:
+// - key: string - the environment variable name
+// Returns:
+// - string: the value
+// - bool: true if either the variable or its _FILE variant is set
+// - error: error if both are set or the file cannot be read
+func lookupEnv(key string) (string, bool, error) {
+	val, ok := os.LookupEnv(key)
+	ok = ok && val != ""
+	path, fileOk := os.LookupEnv(key + fileSuffix)
+	fileOk = fileOk && path != ""
+	if ok && fileOk {
+		return "", false, fmt.Errorf("both %s and %s%s are set, use only one", key, key, fileSuffix)
+	}
+	if !fileOk {
+		return val, ok, nil
+	}
+
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return "", false, fmt.Errorf("%s%s: %v", key, fileSuffix, err)
+	}
+	return strings.TrimRight(string(contents), "\r\n"), true, nil
+}
+
+// loadFile decodes a YAML or TOML config file into cfg. Unknown keys are rejected.
+// Params:
+// - cfg: *Config - the configuration to decode into
+// - path: string - the path of the config file
+// Returns:
+// - error: error if the file cannot be read or decoded
+func loadFile(cfg *Config, path string) error {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("config file: %w", err)
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		decoder := yaml.NewDecoder(bytes.NewReader(contents))
+		decoder.KnownFields(true)
+		if err := decoder.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+			return fmt.Errorf("config file %s: %w", path, err)
+		}
+	case ".toml":
+		md, err := toml.Decode(string(contents), cfg)
+		if err != nil {
+			return fmt.Errorf("config file %s: %w", path, err)
+		}
+		if undecoded := md.Undecoded(); len(undecoded) > 0 {
+			keys := make([]string, 0, len(undecoded))
+			for _, k := range undecoded {
+				keys = append(keys, k.String())
+			}
+			return fmt.Errorf("config file %s: unknown keys: %s", path, strings.Join(keys, ", "))
+		}
+	default:
+		return fmt.Errorf("config file %s: unsupported extension, use .yaml, .yml or .toml", path)
+	}
+
+	return nil
+}
+
+// setValue parses raw into the field according to its type.
+// Params:
+// - v: reflect.Value - the settable field value
+// - raw: string - the raw string value
+// Returns:
+// - error: error if raw cannot be parsed for the field type
+func setValue(v reflect.Value, raw string) error {
+	if v.Type() == reflect.TypeOf(time.Duration(0)) {
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(raw)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Slice:
+		var items []string
+		for _, item := range strings.Split(raw, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		v.Set(reflect.ValueOf(items))
+	default:
+		return fmt.Errorf("unsupported config type %s", v.Type())
+	}
+	return nil
+}
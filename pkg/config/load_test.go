@@ -0,0 +1,450 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeFile(t *testing.T, name string, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// clearEnv blanks every config variable so tests don't depend on the caller's environment.
+func clearEnv(t *testing.T) {
+	t.Helper()
+	t.Setenv("CONFIG_FILE", "")
+	for _, f := range leafFields(reflect.ValueOf(Default()).Elem(), "") {
+		if f.env != "" {
+			t.Setenv(f.env, "")
+			t.Setenv(f.env+fileSuffix, "")
+		}
+	}
+}
+
+func TestLoad(t *testing.T) {
+
+	t.Run("should apply file, env and flags in order of precedence", func(t *testing.T) {
+		clearEnv(t)
+		path := writeFile(t, "config.yaml", `
+server:
+  port: "8000"
+db:
+  host: file-db
+  user: file-user
+  password: file-pass
+  name: iot
+timeouts:
+  read: 3s
+`)
+		t.Setenv("DB_HOST", "env-db")
+		t.Setenv("PORT", "8001")
+
+		cfg, err := Load("test", []string{"-config", path, "-port", "8002"}, Server, DB)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if cfg.Server.Port != "8002" {
+			t.Errorf("expected flag to override env, got port %s", cfg.Server.Port)
+		}
+		if cfg.DB.Host != "env-db" {
+			t.Errorf("expected env to override file, got db host %s", cfg.DB.Host)
+		}
+		if cfg.DB.User != "file-user" {
+			t.Errorf("expected file value, got db user %s", cfg.DB.User)
+		}
+		if cfg.Timeouts.Read != 3*time.Second {
+			t.Errorf("expected read timeout from file, got %s", cfg.Timeouts.Read)
+		}
+		if cfg.Timeouts.Write != Default().Timeouts.Write {
+			t.Errorf("expected default write timeout, got %s", cfg.Timeouts.Write)
+		}
+	})
+
+	t.Run("should load toml files", func(t *testing.T) {
+		clearEnv(t)
+		path := writeFile(t, "config.toml", `
+[kafka]
+brokers = ["kafka-1:9092", "kafka-2:9092"]
+`)
+
+		cfg, err := Load("test", []string{"-config", path}, Kafka)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(cfg.Kafka.BrokerAddrs()) != 2 {
+			t.Errorf("expected 2 brokers, got %v", cfg.Kafka.BrokerAddrs())
+		}
+	})
+
+	t.Run("should reject unknown keys in the config file", func(t *testing.T) {
+		clearEnv(t)
+		path := writeFile(t, "config.yaml", "db:\n  hostname: db\n")
+
+		if _, err := Load("test", []string{"-config", path}); err == nil {
+			t.Error("expected error for unknown key")
+		}
+	})
+
+	t.Run("should read secrets from _FILE variables", func(t *testing.T) {
+		clearEnv(t)
+		secretPath := writeFile(t, "jwt_secret", "from-file\n")
+		t.Setenv("JWT_SECRET_FILE", secretPath)
+
+		cfg, err := Load("test", nil, JWT)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if cfg.JWT.Secret != "from-file" {
+			t.Errorf("expected secret from file, got %q", cfg.JWT.Secret)
+		}
+	})
+
+	t.Run("should fail if a variable and its _FILE variant are both set", func(t *testing.T) {
+		clearEnv(t)
+		t.Setenv("JWT_SECRET", "from-env")
+		t.Setenv("JWT_SECRET_FILE", writeFile(t, "jwt_secret", "from-file"))
+
+		if _, err := Load("test", nil, JWT); err == nil {
+			t.Error("expected error when both JWT_SECRET and JWT_SECRET_FILE are set")
+		}
+	})
+
+	t.Run("should derive brokers from kafka host and port", func(t *testing.T) {
+		clearEnv(t)
+		t.Setenv("KAFKA_HOST", "kafka")
+		t.Setenv("KAFKA_PORT", "9092")
+
+		cfg, err := Load("test", nil, Kafka)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := cfg.Kafka.BrokerAddrs(); len(got) != 1 || got[0] != "kafka:9092" {
+			t.Errorf("expected kafka:9092, got %v", got)
+		}
+	})
+
+	t.Run("should report every validation problem at once", func(t *testing.T) {
+		clearEnv(t)
+		t.Setenv("PORT", "99999")
+		t.Setenv("TLS_CERT_FILE", "/does/not/exist.pem")
+
+		_, err := Load("test", nil, Server, DB, JWT)
+
+		var verr *ValidationError
+		if !errors.As(err, &verr) {
+			t.Fatalf("expected *ValidationError, got %v", err)
+		}
+
+		for _, want := range []string{"server.port", "db.user", "db.password", "db.name", "jwt.secret", "tls.certFile and tls.keyFile"} {
+			if !strings.Contains(err.Error(), want) {
+				t.Errorf("expected %q in error, got:\n%s", want, err)
+			}
+		}
+	})
+
+	t.Run("should validate the selected broker backend", func(t *testing.T) {
+		clearEnv(t)
+		t.Setenv("BROKER_BACKEND", BackendNATS)
+		t.Setenv("NATS_STREAM_REPLICAS", "0")
+
+		_, err := Load("test", nil, Broker)
+		if err == nil || !strings.Contains(err.Error(), "nats.replicas") {
+			t.Errorf("expected nats.replicas error, got %v", err)
+		}
+		if err != nil && strings.Contains(err.Error(), "kafka") {
+			t.Errorf("expected kafka settings to be ignored, got %v", err)
+		}
+
+		t.Setenv("BROKER_BACKEND", "rabbitmq")
+		if _, err := Load("test", nil, Broker); err == nil || !strings.Contains(err.Error(), "broker.backend") {
+			t.Errorf("expected broker.backend error, got %v", err)
+		}
+	})
+
+	t.Run("should require the pong timeout to be longer than the ping interval", func(t *testing.T) {
+		clearEnv(t)
+		t.Setenv("CONSUMER_WS_PING_INTERVAL", "1m")
+		t.Setenv("CONSUMER_WS_PONG_TIMEOUT", "30s")
+
+		_, err := Load("test", nil, Consumer)
+		if err == nil || !strings.Contains(err.Error(), "consumer.pongTimeout") {
+			t.Errorf("expected consumer.pongTimeout error, got %v", err)
+		}
+	})
+
+	t.Run("should validate websocket origins", func(t *testing.T) {
+		clearEnv(t)
+		t.Setenv("CONSUMER_WS_ALLOWED_ORIGINS", "https://dashboard.example.com, *, dashboard.example.com")
+
+		_, err := Load("test", nil, Consumer)
+		if err == nil || !strings.Contains(err.Error(), `"dashboard.example.com"`) {
+			t.Errorf("expected an error for the origin without a scheme, got %v", err)
+		}
+		if err != nil && strings.Contains(err.Error(), `entry "*"`) {
+			t.Errorf("expected the wildcard to be accepted, got %v", err)
+		}
+	})
+
+	t.Run("should parse trusted proxy addresses and ranges", func(t *testing.T) {
+		clearEnv(t)
+		t.Setenv("PORT", "8080")
+		t.Setenv("TRUSTED_PROXIES", "10.0.0.0/8, 192.168.1.10, proxy.local")
+
+		_, err := Load("test", nil, Server)
+		if err == nil || !strings.Contains(err.Error(), `"proxy.local"`) {
+			t.Errorf("expected an error for the host name, got %v", err)
+		}
+
+		cfg := ServerConfig{TrustedProxies: []string{"10.1.2.3/8", "192.168.1.10"}}
+		got := fmt.Sprint(cfg.TrustedProxyPrefixes())
+		if got != "[10.0.0.0/8 192.168.1.10/32]" {
+			t.Errorf("expected [10.0.0.0/8 192.168.1.10/32], got %s", got)
+		}
+	})
+
+	t.Run("should check the gRPC address", func(t *testing.T) {
+		clearEnv(t)
+		t.Setenv("PORT", "8080")
+		t.Setenv("GRPC_ADDR", "50051")
+
+		if _, err := Load("test", nil, Server); err == nil || !strings.Contains(err.Error(), "server.grpcAddr") {
+			t.Errorf("expected server.grpcAddr error, got %v", err)
+		}
+
+		t.Setenv("GRPC_ADDR", ":50051")
+		cfg, err := Load("test", nil, Server)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cfg.Server.GRPCAddr != ":50051" {
+			t.Errorf("expected :50051, got %q", cfg.Server.GRPCAddr)
+		}
+	})
+
+	t.Run("should require a redis url for the redis idempotency store", func(t *testing.T) {
+		clearEnv(t)
+		t.Setenv("INGEST_IDEMPOTENCY_STORE", IdempotencyRedis)
+
+		_, err := Load("test", nil, Ingest)
+		if err == nil || !strings.Contains(err.Error(), "ingest.idempotencyRedisURL") {
+			t.Errorf("expected ingest.idempotencyRedisURL error, got %v", err)
+		}
+
+		t.Setenv("INGEST_IDEMPOTENCY_REDIS_URL", "http://redis:6379")
+		if _, err := Load("test", nil, Ingest); err == nil || !strings.Contains(err.Error(), "redis:// or rediss://") {
+			t.Errorf("expected a scheme error, got %v", err)
+		}
+	})
+
+	t.Run("should validate rate limits and quotas", func(t *testing.T) {
+		clearEnv(t)
+		t.Setenv("INGEST_DEVICE_RATE", "0.5")
+		t.Setenv("INGEST_DEVICE_BURST", "0")
+		t.Setenv("INGEST_DAILY_BYTES", "-1")
+
+		_, err := Load("test", nil, Ingest)
+		for _, want := range []string{"ingest.deviceBurst", "ingest.dailyBytes"} {
+			if err == nil || !strings.Contains(err.Error(), want) {
+				t.Errorf("expected %s error, got %v", want, err)
+			}
+		}
+
+		t.Setenv("INGEST_DEVICE_BURST", "1")
+		t.Setenv("INGEST_DAILY_BYTES", "0")
+		cfg, err := Load("test", nil, Ingest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cfg.Ingest.DeviceRate != 0.5 {
+			t.Errorf("expected a device rate of 0.5, got %v", cfg.Ingest.DeviceRate)
+		}
+	})
+
+	t.Run("should validate kafka compression and its level", func(t *testing.T) {
+		clearEnv(t)
+		t.Setenv("KAFKA_BROKERS", "kafka:9092")
+		for _, tc := range []struct {
+			compression string
+			level       string
+			problem     string
+		}{
+			{"zstd", "22", ""},
+			{"gzip", "0", ""},
+			{"lz4", "0", ""},
+			{"brotli", "0", "kafka.compression"},
+			{"gzip", "10", "between 1 and 9"},
+			{"snappy", "1", "must be 0 with snappy"},
+			{"none", "3", "must be 0 with none"},
+		} {
+			t.Setenv("KAFKA_COMPRESSION", tc.compression)
+			t.Setenv("KAFKA_COMPRESSION_LEVEL", tc.level)
+			_, err := Load("test", nil, Kafka)
+			if tc.problem == "" && err != nil {
+				t.Errorf("%s level %s: expected no error, got %v", tc.compression, tc.level, err)
+			}
+			if tc.problem != "" && (err == nil || !strings.Contains(err.Error(), tc.problem)) {
+				t.Errorf("%s level %s: expected a %q error, got %v", tc.compression, tc.level, tc.problem, err)
+			}
+		}
+	})
+
+	t.Run("should require a positive decompressed body limit", func(t *testing.T) {
+		clearEnv(t)
+		t.Setenv("INGEST_MAX_DECOMPRESSED_BYTES", "0")
+
+		if _, err := Load("test", nil, Ingest); err == nil || !strings.Contains(err.Error(), "ingest.maxDecompressedBytes") {
+			t.Errorf("expected ingest.maxDecompressedBytes error, got %v", err)
+		}
+	})
+
+	t.Run("should check the line protocol limits", func(t *testing.T) {
+		clearEnv(t)
+		t.Setenv("INGEST_INFLUX_MAX_LINES", "-1")
+		path := writeFile(t, "config.yaml", `
+ingest:
+  influxDeviceTag: ""
+`)
+
+		_, err := Load("test", []string{"-config", path}, Ingest)
+		for _, want := range []string{"ingest.influxMaxLines", "ingest.influxDeviceTag"} {
+			if err == nil || !strings.Contains(err.Error(), want) {
+				t.Errorf("expected an error for %s, got %v", want, err)
+			}
+		}
+	})
+
+	t.Run("should not accept a negative OTLP data point limit", func(t *testing.T) {
+		clearEnv(t)
+		t.Setenv("INGEST_OTLP_MAX_DATA_POINTS", "-1")
+
+		if _, err := Load("test", nil, Ingest); err == nil || !strings.Contains(err.Error(), "ingest.otlpMaxDataPoints") {
+			t.Errorf("expected ingest.otlpMaxDataPoints error, got %v", err)
+		}
+	})
+
+	t.Run("should check the CoAP listener settings", func(t *testing.T) {
+		clearEnv(t)
+		t.Setenv("INGEST_COAP_ADDR", "5683")
+		t.Setenv("INGEST_COAP_MAX_BODY_BYTES", "0")
+		t.Setenv("INGEST_COAP_BLOCKWISE_TIMEOUT", "0s")
+
+		_, err := Load("test", nil, Ingest)
+		for _, want := range []string{"ingest.coapAddr", "ingest.coapMaxBodyBytes", "ingest.coapBlockwiseTimeout"} {
+			if err == nil || !strings.Contains(err.Error(), want) {
+				t.Errorf("expected an error for %s, got %v", want, err)
+			}
+		}
+
+		t.Setenv("INGEST_COAP_ADDR", ":5683")
+		t.Setenv("INGEST_COAP_MAX_BODY_BYTES", "1024")
+		t.Setenv("INGEST_COAP_BLOCKWISE_TIMEOUT", "1m")
+		cfg, err := Load("test", nil, Ingest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cfg.Ingest.CoAPAddr != ":5683" || cfg.Ingest.CoAPMaxBodyBytes != 1024 || cfg.Ingest.CoAPBlockwiseTimeout != time.Minute {
+			t.Errorf("unexpected CoAP settings %+v", cfg.Ingest)
+		}
+	})
+
+	t.Run("should check the write-ahead log settings", func(t *testing.T) {
+		clearEnv(t)
+		t.Setenv("INGEST_WAL_SYNC", "sometimes")
+		t.Setenv("INGEST_WAL_SEGMENT_BYTES", "2048")
+		t.Setenv("INGEST_WAL_MAX_BYTES", "1024")
+
+		if _, err := Load("test", nil, Ingest); err != nil {
+			t.Errorf("expected the settings to be ignored without a directory, got %v", err)
+		}
+
+		t.Setenv("INGEST_WAL_DIR", t.TempDir())
+		_, err := Load("test", nil, Ingest)
+		for _, want := range []string{"ingest.walSync", "ingest.walMaxBytes"} {
+			if err == nil || !strings.Contains(err.Error(), want) {
+				t.Errorf("expected an error for %s, got %v", want, err)
+			}
+		}
+
+		t.Setenv("INGEST_WAL_SYNC", "interval")
+		t.Setenv("INGEST_WAL_SYNC_INTERVAL", "0s")
+		t.Setenv("INGEST_WAL_MAX_BYTES", "4096")
+		if _, err := Load("test", nil, Ingest); err == nil || !strings.Contains(err.Error(), "ingest.walSyncInterval") {
+			t.Errorf("expected an error for ingest.walSyncInterval, got %v", err)
+		}
+
+		t.Setenv("INGEST_WAL_SYNC", "always")
+		cfg, err := Load("test", nil, Ingest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cfg.Ingest.WALSync != WALSyncAlways || cfg.Ingest.WALSegmentBytes != 2048 || cfg.Ingest.WALMaxBytes != 4096 {
+			t.Errorf("unexpected write-ahead log settings %+v", cfg.Ingest)
+		}
+	})
+
+	t.Run("should parse per route body limits", func(t *testing.T) {
+		clearEnv(t)
+		t.Setenv("HTTP_ROUTE_MAX_BODY_BYTES", "/api/v1/auth=1024,api/v1/admin=10,/api/v1/data=-1")
+
+		_, err := Load("test", nil)
+		for _, want := range []string{`"api/v1/admin=10"`, `"/api/v1/data=-1"`} {
+			if err == nil || !strings.Contains(err.Error(), want) {
+				t.Errorf("expected an error for %s, got %v", want, err)
+			}
+		}
+
+		cfg := LimitsConfig{RouteBodyBytes: []string{"/api=100", "/api/v1/auth/=10"}}
+		got := fmt.Sprint(cfg.BodyLimits())
+		if got != "[{/api/v1/auth 10} {/api 100}]" {
+			t.Errorf("expected the longest prefix first, got %s", got)
+		}
+	})
+
+	t.Run("should start from the given defaults", func(t *testing.T) {
+		clearEnv(t)
+		defaults := Default()
+		defaults.Server.Port = "8080"
+		defaults.Broker.Backend = BackendMemory
+
+		cfg, err := LoadWithDefaults(defaults, "test", []string{"-sqlite-path", "/var/lib/iot.db"}, Server, SQLite, Broker)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cfg.Server.Port != "8080" || cfg.Broker.Backend != BackendMemory || cfg.SQLite.Path != "/var/lib/iot.db" {
+			t.Errorf("unexpected config %+v", cfg)
+		}
+	})
+
+	t.Run("should reject malformed values", func(t *testing.T) {
+		clearEnv(t)
+		t.Setenv("HTTP_READ_TIMEOUT", "soon")
+
+		if _, err := Load("test", nil); err == nil || !strings.Contains(err.Error(), "HTTP_READ_TIMEOUT") {
+			t.Errorf("expected error naming HTTP_READ_TIMEOUT, got %v", err)
+		}
+	})
+}
+
+func TestDBConfigURL(t *testing.T) {
+	cfg := DBConfig{Host: "db", Port: "5432", User: "admin", Password: "p@ss word", Name: "iot", SSLMode: "disable"}
+
+	want := "postgres://admin:p%40ss%20word@db:5432/iot?sslmode=disable"
+	if got := cfg.URL(); got != want {
+		t.Errorf("expected %s, got %s", want, got)
+	}
+}
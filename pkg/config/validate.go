@@ -0,0 +1,295 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Section names a part of the configuration a service depends on.
+type Section string
+
+const (
+	Server Section = "server"
+	DB     Section = "db"
+	SQLite Section = "sqlite"
+	Kafka  Section = "kafka"
+	// Broker validates the section of the selected broker backend.
+	Broker Section = "broker"
+	// Consumer validates the stream delivery settings of the consumer service.
+	Consumer Section = "consumer"
+	// Ingest validates the device timestamp bounds of the data service.
+	Ingest Section = "ingest"
+	JWT    Section = "jwt"
+)
+
+// ValidationError lists every problem found in a configuration.
+type ValidationError struct {
+	Problems []string
+}
+
+// Error reports all configuration problems, one per line.
+func (e *ValidationError) Error() string {
+	return "invalid configuration:\n  - " + strings.Join(e.Problems, "\n  - ")
+}
+
+// Validate checks the requested sections plus the TLS, timeout and limit settings
+// shared by every service, and reports all problems at once.
+// Params:
+// - sections: ...Section - the sections the service needs
+// Returns:
+// - error: a *ValidationError if any problem was found
+func (c *Config) Validate(sections ...Section) error {
+	var problems []string
+	require := func(path string, env string, value string) {
+		if value == "" {
+			problems = append(problems, fmt.Sprintf("%s is required (set %s or %s%s)", path, env, env, fileSuffix))
+		}
+	}
+
+	for _, section := range sections {
+		switch section {
+		case Server:
+			require("server.port", "PORT", c.Server.Port)
+			if c.Server.Port != "" {
+				if port, err := strconv.Atoi(c.Server.Port); err != nil || port < 1 || port > 65535 {
+					problems = append(problems, fmt.Sprintf("server.port %q must be a number between 1 and 65535", c.Server.Port))
+				}
+			}
+			if c.Server.GRPCAddr != "" {
+				if _, _, err := net.SplitHostPort(c.Server.GRPCAddr); err != nil {
+					problems = append(problems, fmt.Sprintf("server.grpcAddr %q must be a host:port address, e.g. :50051", c.Server.GRPCAddr))
+				}
+			}
+			for _, proxy := range c.Server.TrustedProxies {
+				if _, err := parsePrefix(proxy); err != nil {
+					problems = append(problems, fmt.Sprintf("server.trustedProxies entry %q must be an IP address or CIDR range", proxy))
+				}
+			}
+		case DB:
+			require("db.host", "DB_HOST", c.DB.Host)
+			require("db.port", "DB_PORT", c.DB.Port)
+			require("db.user", "DB_USER", c.DB.User)
+			require("db.password", "DB_PASS", c.DB.Password)
+			require("db.name", "DB_NAME", c.DB.Name)
+			switch c.DB.SSLMode {
+			case "disable", "allow", "prefer", "require", "verify-ca", "verify-full":
+			default:
+				problems = append(problems, fmt.Sprintf("db.sslMode %q is not a valid Postgres sslmode", c.DB.SSLMode))
+			}
+		case SQLite:
+			require("sqlite.path", "SQLITE_PATH", c.SQLite.Path)
+		case Kafka:
+			problems = append(problems, c.validateKafka()...)
+		case Broker:
+			switch c.Broker.Backend {
+			case BackendKafka:
+				problems = append(problems, c.validateKafka()...)
+			case BackendNATS:
+				require("nats.url", "NATS_URL", c.NATS.URL)
+				if c.NATS.MaxMsgs < 0 {
+					problems = append(problems, "nats.maxMsgs must not be negative")
+				}
+				if c.NATS.Replicas < 1 {
+					problems = append(problems, "nats.replicas must be at least 1")
+				}
+			case BackendMemory:
+				if c.Broker.MemoryCapacity < 1 {
+					problems = append(problems, "broker.memoryCapacity must be at least 1")
+				}
+			default:
+				problems = append(problems, fmt.Sprintf("broker.backend %q must be one of %s, %s or %s", c.Broker.Backend, BackendKafka, BackendNATS, BackendMemory))
+			}
+		case Consumer:
+			if c.Consumer.BufferSize < 1 {
+				problems = append(problems, "consumer.bufferSize must be at least 1")
+			}
+			switch c.Consumer.SlowPolicy {
+			case PolicyDropOldest, PolicyDropNewest, PolicyDisconnect:
+			default:
+				problems = append(problems, fmt.Sprintf("consumer.slowPolicy %q must be one of %s, %s or %s", c.Consumer.SlowPolicy, PolicyDropOldest, PolicyDropNewest, PolicyDisconnect))
+			}
+			if c.Consumer.PingInterval <= 0 || c.Consumer.WriteTimeout <= 0 || c.Consumer.TicketTTL <= 0 {
+				problems = append(problems, "consumer.pingInterval, consumer.writeTimeout and consumer.ticketTTL must be positive")
+			}
+			if c.Consumer.PongTimeout <= c.Consumer.PingInterval {
+				problems = append(problems, "consumer.pongTimeout must be longer than consumer.pingInterval")
+			}
+			if c.Consumer.ReadBufferSize < 1 || c.Consumer.WriteBufferSize < 1 || c.Consumer.MaxMessageSize < 1 {
+				problems = append(problems, "consumer.readBufferSize, consumer.writeBufferSize and consumer.maxMessageSize must be at least 1")
+			}
+			for _, origin := range c.Consumer.AllowedOrigins {
+				if origin == "*" {
+					continue
+				}
+				if u, err := url.Parse(origin); err != nil || u.Scheme == "" || u.Host == "" || (u.Path != "" && u.Path != "/") {
+					problems = append(problems, fmt.Sprintf("consumer.allowedOrigins entry %q must be \"*\" or an origin like https://example.com", origin))
+				}
+			}
+		case Ingest:
+			if c.Ingest.MaxDepth < 0 || c.Ingest.MaxKeys < 0 || c.Ingest.SenMLMaxMeasurements < 0 || c.Ingest.InfluxMaxLines < 0 || c.Ingest.OTLPMaxDataPoints < 0 {
+				problems = append(problems, "ingest.maxDepth, ingest.maxKeys, ingest.senmlMaxMeasurements, ingest.influxMaxLines and ingest.otlpMaxDataPoints must not be negative")
+			}
+			if c.Ingest.InfluxDeviceTag == "" {
+				problems = append(problems, "ingest.influxDeviceTag must be set")
+			}
+			if c.Ingest.MaxDecompressedBytes < 1 {
+				problems = append(problems, "ingest.maxDecompressedBytes must be at least 1")
+			}
+			if c.Ingest.CoAPAddr != "" {
+				if _, _, err := net.SplitHostPort(c.Ingest.CoAPAddr); err != nil {
+					problems = append(problems, fmt.Sprintf("ingest.coapAddr %q must be a host:port address, e.g. :5683", c.Ingest.CoAPAddr))
+				}
+			}
+			if c.Ingest.CoAPMaxBodyBytes < 1 {
+				problems = append(problems, "ingest.coapMaxBodyBytes must be at least 1")
+			}
+			if c.Ingest.CoAPBlockwiseTimeout <= 0 {
+				problems = append(problems, "ingest.coapBlockwiseTimeout must be positive")
+			}
+			if c.Ingest.MaxFutureSkew < 0 || c.Ingest.MaxEventAge < 0 {
+				problems = append(problems, "ingest.maxFutureSkew and ingest.maxEventAge must not be negative")
+			}
+			if c.Ingest.IdempotencyWindow <= 0 {
+				problems = append(problems, "ingest.idempotencyWindow must be positive")
+			}
+			if c.Ingest.IdempotencyCacheSize < 1 {
+				problems = append(problems, "ingest.idempotencyCacheSize must be at least 1")
+			}
+			switch c.Ingest.IdempotencyStore {
+			case IdempotencyMemory, IdempotencyDB:
+			case IdempotencyRedis:
+				problems = append(problems, validateRedisURL("ingest.idempotencyRedisURL", "INGEST_IDEMPOTENCY_REDIS_URL", c.Ingest.IdempotencyRedisURL)...)
+			default:
+				problems = append(problems, fmt.Sprintf("ingest.idempotencyStore %q must be one of %s, %s or %s", c.Ingest.IdempotencyStore, IdempotencyMemory, IdempotencyDB, IdempotencyRedis))
+			}
+			if c.Ingest.KeyRate < 0 || c.Ingest.DeviceRate < 0 {
+				problems = append(problems, "ingest.keyRate and ingest.deviceRate must not be negative")
+			}
+			if (c.Ingest.KeyRate > 0 && c.Ingest.KeyBurst < 1) || (c.Ingest.DeviceRate > 0 && c.Ingest.DeviceBurst < 1) {
+				problems = append(problems, "ingest.keyBurst and ingest.deviceBurst must be at least 1 when their rate is set")
+			}
+			switch c.Ingest.RateLimitStore {
+			case RateLimitMemory:
+			case RateLimitRedis:
+				problems = append(problems, validateRedisURL("ingest.rateLimitRedisURL", "INGEST_RATE_LIMIT_REDIS_URL", c.Ingest.RateLimitRedisURL)...)
+			default:
+				problems = append(problems, fmt.Sprintf("ingest.rateLimitStore %q must be one of %s or %s", c.Ingest.RateLimitStore, RateLimitMemory, RateLimitRedis))
+			}
+			if c.Ingest.DailyMessages < 0 || c.Ingest.DailyBytes < 0 {
+				problems = append(problems, "ingest.dailyMessages and ingest.dailyBytes must not be negative")
+			}
+			if c.Ingest.WALDir != "" {
+				switch c.Ingest.WALSync {
+				case WALSyncAlways, WALSyncNone:
+				case WALSyncInterval:
+					if c.Ingest.WALSyncInterval <= 0 {
+						problems = append(problems, "ingest.walSyncInterval must be positive")
+					}
+				default:
+					problems = append(problems, fmt.Sprintf("ingest.walSync %q must be one of %s, %s or %s", c.Ingest.WALSync, WALSyncAlways, WALSyncInterval, WALSyncNone))
+				}
+				if c.Ingest.WALSegmentBytes < 1 {
+					problems = append(problems, "ingest.walSegmentBytes must be at least 1")
+				}
+				if c.Ingest.WALMaxBytes < c.Ingest.WALSegmentBytes {
+					problems = append(problems, "ingest.walMaxBytes must be at least ingest.walSegmentBytes")
+				}
+			}
+		case JWT:
+			require("jwt.secret", "JWT_SECRET", c.JWT.Secret)
+		}
+	}
+
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		problems = append(problems, "tls.certFile and tls.keyFile must be set together")
+	}
+	for path, file := range map[string]string{"tls.certFile": c.TLS.CertFile, "tls.keyFile": c.TLS.KeyFile} {
+		if file == "" {
+			continue
+		}
+		if _, err := os.Stat(file); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", path, err))
+		}
+	}
+
+	timeouts := []struct {
+		path  string
+		value int64
+	}{
+		{"timeouts.readHeader", int64(c.Timeouts.ReadHeader)},
+		{"timeouts.read", int64(c.Timeouts.Read)},
+		{"timeouts.write", int64(c.Timeouts.Write)},
+		{"timeouts.idle", int64(c.Timeouts.Idle)},
+		{"timeouts.shutdown", int64(c.Timeouts.Shutdown)},
+	}
+	for _, t := range timeouts {
+		if t.value < 0 {
+			problems = append(problems, fmt.Sprintf("%s must not be negative", t.path))
+		}
+	}
+
+	if c.Timeouts.Readiness <= 0 {
+		problems = append(problems, "timeouts.readiness must be positive")
+	}
+
+	if c.Limits.MaxHeaderBytes <= 0 {
+		problems = append(problems, "limits.maxHeaderBytes must be positive")
+	}
+	if c.Limits.MaxBodyBytes <= 0 {
+		problems = append(problems, "limits.maxBodyBytes must be positive")
+	}
+	for _, entry := range c.Limits.RouteBodyBytes {
+		if _, err := parseBodyLimit(entry); err != nil {
+			problems = append(problems, fmt.Sprintf("limits.routeBodyBytes entry %q %s", entry, err))
+		}
+	}
+
+	if len(problems) > 0 {
+		return &ValidationError{Problems: problems}
+	}
+	return nil
+}
+
+// validateRedisURL checks a required Redis URL.
+func validateRedisURL(path string, env string, value string) []string {
+	if value == "" {
+		return []string{fmt.Sprintf("%s is required (set %s or %s%s)", path, env, env, fileSuffix)}
+	}
+	if u, err := url.Parse(value); err != nil || (u.Scheme != "redis" && u.Scheme != "rediss") {
+		return []string{fmt.Sprintf("%s must be a redis:// or rediss:// URL", path)}
+	}
+	return nil
+}
+
+// validateKafka checks the Kafka section.
+func (c *Config) validateKafka() []string {
+	var problems []string
+	if len(c.Kafka.BrokerAddrs()) == 0 {
+		problems = append(problems, "kafka.brokers is required (set KAFKA_BROKERS, or KAFKA_HOST and KAFKA_PORT)")
+	}
+	if c.Kafka.ReplicationFactor < 1 {
+		problems = append(problems, "kafka.replicationFactor must be at least 1")
+	}
+	maxLevel := 0
+	switch c.Kafka.Compression {
+	case CompressionNone, CompressionSnappy, CompressionLZ4:
+	case CompressionGzip:
+		maxLevel = 9
+	case CompressionZstd:
+		maxLevel = 22
+	default:
+		problems = append(problems, fmt.Sprintf("kafka.compression %q must be one of %s, %s, %s, %s or %s", c.Kafka.Compression, CompressionNone, CompressionGzip, CompressionSnappy, CompressionLZ4, CompressionZstd))
+	}
+	if c.Kafka.CompressionLevel != 0 && (c.Kafka.CompressionLevel < 1 || c.Kafka.CompressionLevel > maxLevel) {
+		if maxLevel == 0 {
+			problems = append(problems, fmt.Sprintf("kafka.compressionLevel must be 0 with %s compression", c.Kafka.Compression))
+		} else {
+			problems = append(problems, fmt.Sprintf("kafka.compressionLevel must be between 1 and %d with %s compression", maxLevel, c.Kafka.Compression))
+		}
+	}
+	return problems
+}
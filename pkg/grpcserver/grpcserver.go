@@ -0,0 +1,203 @@
+// Package grpcserver serves a service's gRPC API next to its HTTP server, with the same
+// TLS certificate, body size limit, logging and tracing, and authentication chosen per
+// gRPC service, as HTTP routes choose their middleware.
+package grpcserver
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/RaghibA/iot-telemetry/pkg/config"
+	"github.com/RaghibA/iot-telemetry/pkg/logging"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+)
+
+// AuthFunc authenticates a call from its metadata, returning the context the call is
+// served with, or the status refusing it.
+type AuthFunc func(ctx context.Context) (context.Context, error)
+
+// Server is a gRPC server listening on server.grpcAddr.
+type Server struct {
+	cfg    *config.Config
+	logger *slog.Logger
+	srv    *grpc.Server
+	// auth holds the AuthFunc of each registered service by full service name
+	auth map[string]AuthFunc
+	lis  net.Listener
+}
+
+// New creates a gRPC server configured like the HTTP server: TLS when a certificate is
+// set, messages limited to limits.maxBodyBytes, calls logged and traced.
+// Params:
+// - cfg: *config.Config - the service configuration
+// - logger: *slog.Logger - the logger instance
+// Returns:
+// - *Server: the server, started with Start
+// - error: error if the TLS certificate cannot be loaded
+func New(cfg *config.Config, logger *slog.Logger) (*Server, error) {
+	s := &Server{cfg: cfg, logger: logger, auth: map[string]AuthFunc{}}
+	opts := []grpc.ServerOption{
+		grpc.MaxRecvMsgSize(int(cfg.Limits.MaxBodyBytes)),
+		grpc.StatsHandler(otelgrpc.NewServerHandler()),
+		grpc.ChainUnaryInterceptor(logging.UnaryServerInterceptor(logger), s.unaryAuth),
+		grpc.ChainStreamInterceptor(logging.StreamServerInterceptor(logger), s.streamAuth),
+	}
+	if cfg.TLS.Enabled() {
+		creds, err := credentials.NewServerTLSFromFile(cfg.TLS.CertFile, cfg.TLS.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("grpc tls: %w", err)
+		}
+		opts = append(opts, grpc.Creds(creds))
+	}
+	s.srv = grpc.NewServer(opts...)
+	return s, nil
+}
+
+// Register serves a gRPC service, authenticating each of its calls with auth.
+// Params:
+// - desc: *grpc.ServiceDesc - the generated service description
+// - impl: any - the service implementation
+// - auth: AuthFunc - authenticates the service's calls
+// Returns: None
+func (s *Server) Register(desc *grpc.ServiceDesc, impl any, auth AuthFunc) {
+	s.auth[desc.ServiceName] = auth
+	s.srv.RegisterService(desc, impl)
+}
+
+// Start listens on server.grpcAddr and serves calls until Stop is called. It does nothing
+// if no address is configured.
+// Params: None
+// Returns:
+// - error: error if the address cannot be listened on
+func (s *Server) Start() error {
+	if s.cfg.Server.GRPCAddr == "" {
+		return nil
+	}
+	lis, err := net.Listen("tcp", s.cfg.Server.GRPCAddr)
+	if err != nil {
+		return fmt.Errorf("grpc listen %s: %w", s.cfg.Server.GRPCAddr, err)
+	}
+	s.lis = lis
+	go func() {
+		if err := s.srv.Serve(lis); err != nil {
+			s.logger.Error("grpc server failed", "err", err)
+		}
+	}()
+	s.logger.Info("grpc server running", "addr", lis.Addr(), "tls", s.cfg.TLS.Enabled())
+	return nil
+}
+
+// Addr returns the address the server listens on, nil before Start.
+func (s *Server) Addr() net.Addr {
+	if s.lis == nil {
+		return nil
+	}
+	return s.lis.Addr()
+}
+
+// Stop drains calls in flight for up to the shutdown timeout, then closes the remaining
+// ones, such as subscriptions, which only end with the client.
+// Params: None
+// Returns: None
+func (s *Server) Stop() {
+	done := make(chan struct{})
+	go func() {
+		s.srv.GracefulStop()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(s.cfg.Timeouts.Shutdown):
+		s.srv.Stop()
+	}
+}
+
+// authenticate runs the AuthFunc of the service a method belongs to.
+func (s *Server) authenticate(ctx context.Context, fullMethod string) (context.Context, error) {
+	service, _, _ := strings.Cut(strings.TrimPrefix(fullMethod, "/"), "/")
+	auth, ok := s.auth[service]
+	if !ok || auth == nil {
+		return ctx, nil
+	}
+	return auth(ctx)
+}
+
+func (s *Server) unaryAuth(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	ctx, err := s.authenticate(ctx, info.FullMethod)
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func (s *Server) streamAuth(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, err := s.authenticate(ss.Context(), info.FullMethod)
+	if err != nil {
+		return err
+	}
+	return handler(srv, &serverStream{ServerStream: ss, ctx: ctx})
+}
+
+// serverStream replaces the context of a stream with the authenticated one.
+type serverStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *serverStream) Context() context.Context {
+	return s.ctx
+}
+
+// HTTPError converts the error status of a handler shared with the HTTP routes to a gRPC
+// status, keeping its message.
+// Params:
+// - code: int - the HTTP status, 400 or above
+// - msg: string - the error message
+// Returns:
+// - error: the gRPC status
+func HTTPError(code int, msg string) error {
+	return status.Error(Code(code), strings.TrimSpace(msg))
+}
+
+// Code maps an HTTP error status to the gRPC code with the same meaning.
+// Params:
+// - code: int - the HTTP status, 400 or above
+// Returns:
+// - codes.Code: the gRPC code
+func Code(code int) codes.Code {
+	switch code {
+	case http.StatusBadRequest, http.StatusRequestEntityTooLarge, http.StatusUnsupportedMediaType:
+		return codes.InvalidArgument
+	case http.StatusUnauthorized:
+		return codes.Unauthenticated
+	case http.StatusForbidden:
+		return codes.PermissionDenied
+	case http.StatusNotFound:
+		return codes.NotFound
+	case http.StatusConflict:
+		return codes.Aborted
+	case http.StatusUnprocessableEntity:
+		return codes.AlreadyExists
+	case http.StatusTooManyRequests:
+		return codes.ResourceExhausted
+	case http.StatusNotImplemented:
+		return codes.Unimplemented
+	case http.StatusBadGateway, http.StatusServiceUnavailable:
+		return codes.Unavailable
+	case http.StatusGatewayTimeout:
+		return codes.DeadlineExceeded
+	}
+	if code < http.StatusInternalServerError {
+		return codes.FailedPrecondition
+	}
+	return codes.Internal
+}
@@ -0,0 +1,141 @@
+package grpcserver
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"testing"
+
+	"github.com/RaghibA/iot-telemetry/pkg/config"
+	"github.com/RaghibA/iot-telemetry/pkg/telemetrypb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+var testLogger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+type userKey struct{}
+
+// testIngest answers Send with the user the call was authenticated as.
+type testIngest struct {
+	telemetrypb.UnimplementedIngestServiceServer
+}
+
+func (testIngest) Send(ctx context.Context, req *telemetrypb.SendRequest) (*telemetrypb.SendResponse, error) {
+	if ctx.Value(userKey{}) != "user-1" {
+		return nil, status.Error(codes.Internal, "no user in context")
+	}
+	return &telemetrypb.SendResponse{}, nil
+}
+
+// authenticate accepts calls with the x-user metadata set to user-1.
+func authenticate(ctx context.Context) (context.Context, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if users := md.Get("x-user"); len(users) == 0 || users[0] != "user-1" {
+		return nil, status.Error(codes.Unauthenticated, "unknown user")
+	}
+	return context.WithValue(ctx, userKey{}, "user-1"), nil
+}
+
+// newTestClient serves testIngest on a local port and dials it.
+func newTestClient(t *testing.T, maxBodyBytes int64) telemetrypb.IngestServiceClient {
+	t.Helper()
+	cfg := config.Default()
+	cfg.Server.GRPCAddr = "127.0.0.1:0"
+	cfg.Limits.MaxBodyBytes = maxBodyBytes
+
+	srv, err := New(cfg, testLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Register(&telemetrypb.IngestService_ServiceDesc, testIngest{}, authenticate)
+	if err := srv.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(srv.Stop)
+
+	conn, err := grpc.NewClient(srv.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return telemetrypb.NewIngestServiceClient(conn)
+}
+
+func TestServer(t *testing.T) {
+
+	t.Run("should not listen without an address", func(t *testing.T) {
+		srv, err := New(config.Default(), testLogger)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := srv.Start(); err != nil {
+			t.Fatal(err)
+		}
+		defer srv.Stop()
+		if srv.Addr() != nil {
+			t.Errorf("expected no listener, got %v", srv.Addr())
+		}
+	})
+
+	t.Run("should authenticate calls with the service's AuthFunc", func(t *testing.T) {
+		client := newTestClient(t, 1<<20)
+
+		_, err := client.Send(context.Background(), &telemetrypb.SendRequest{})
+		if status.Code(err) != codes.Unauthenticated {
+			t.Errorf("expected Unauthenticated, got %v", err)
+		}
+
+		ctx := metadata.AppendToOutgoingContext(context.Background(), "x-user", "user-1")
+		if _, err := client.Send(ctx, &telemetrypb.SendRequest{}); err != nil {
+			t.Errorf("expected the call to be authenticated, got %v", err)
+		}
+	})
+
+	t.Run("should reject messages over the body limit", func(t *testing.T) {
+		client := newTestClient(t, 64)
+
+		ctx := metadata.AppendToOutgoingContext(context.Background(), "x-user", "user-1")
+		_, err := client.Send(ctx, &telemetrypb.SendRequest{Data: make([]byte, 128)})
+		if status.Code(err) != codes.ResourceExhausted {
+			t.Errorf("expected ResourceExhausted, got %v", err)
+		}
+	})
+}
+
+func TestCode(t *testing.T) {
+
+	t.Run("should map HTTP statuses to gRPC codes", func(t *testing.T) {
+		cases := map[int]codes.Code{
+			http.StatusBadRequest:              codes.InvalidArgument,
+			http.StatusUnsupportedMediaType:    codes.InvalidArgument,
+			http.StatusUnauthorized:            codes.Unauthenticated,
+			http.StatusForbidden:               codes.PermissionDenied,
+			http.StatusNotFound:                codes.NotFound,
+			http.StatusConflict:                codes.Aborted,
+			http.StatusUnprocessableEntity:     codes.AlreadyExists,
+			http.StatusTooManyRequests:         codes.ResourceExhausted,
+			http.StatusGone:                    codes.FailedPrecondition,
+			http.StatusServiceUnavailable:      codes.Unavailable,
+			http.StatusGatewayTimeout:          codes.DeadlineExceeded,
+			http.StatusInternalServerError:     codes.Internal,
+			http.StatusHTTPVersionNotSupported: codes.Internal,
+		}
+		for httpStatus, want := range cases {
+			if got := Code(httpStatus); got != want {
+				t.Errorf("expected %d to map to %v, got %v", httpStatus, want, got)
+			}
+		}
+	})
+
+	t.Run("should keep the message of HTTP errors", func(t *testing.T) {
+		err := HTTPError(http.StatusNotFound, "Device not found\n")
+		if s := status.Convert(err); s.Code() != codes.NotFound || s.Message() != "Device not found" {
+			t.Errorf("expected NotFound with the trimmed message, got %v", err)
+		}
+	})
+}
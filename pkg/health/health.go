@@ -0,0 +1,147 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	StatusOK          = "ok"
+	StatusUnavailable = "unavailable"
+)
+
+// CheckFunc reports whether a dependency is usable. It must return once ctx is done.
+type CheckFunc func(ctx context.Context) error
+
+// CheckResult is the outcome of a single dependency check.
+type CheckResult struct {
+	Status    string  `json:"status"`
+	LatencyMS float64 `json:"latency_ms"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// Report is the readiness response body.
+type Report struct {
+	Status string                 `json:"status"`
+	Checks map[string]CheckResult `json:"checks"`
+}
+
+type check struct {
+	name string
+	fn   CheckFunc
+}
+
+// Checker runs dependency checks for the readiness endpoint.
+type Checker struct {
+	timeout time.Duration
+	checks  []check
+}
+
+// NewChecker creates a checker whose checks are cancelled after timeout.
+// Params:
+// - timeout: time.Duration - the maximum time allowed for all checks
+// Returns:
+// - *Checker: a pointer to the created Checker
+func NewChecker(timeout time.Duration) *Checker {
+	return &Checker{timeout: timeout}
+}
+
+// Add registers a dependency check.
+// Params:
+// - name: string - the dependency name, used as the key in the report
+// - fn: CheckFunc - the check to run
+// Returns: None
+func (c *Checker) Add(name string, fn CheckFunc) {
+	c.checks = append(c.checks, check{name: name, fn: fn})
+}
+
+// Check runs every registered check concurrently and collects the results.
+// Params:
+// - ctx: context.Context - the parent context
+// Returns:
+// - Report: the status of each dependency, unavailable if any check failed
+func (c *Checker) Check(ctx context.Context) Report {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	report := Report{Status: StatusOK, Checks: make(map[string]CheckResult, len(c.checks))}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, chk := range c.checks {
+		wg.Add(1)
+		go func(chk check) {
+			defer wg.Done()
+			result := run(ctx, chk.fn)
+
+			mu.Lock()
+			defer mu.Unlock()
+			report.Checks[chk.name] = result
+			if result.Status != StatusOK {
+				report.Status = StatusUnavailable
+			}
+		}(chk)
+	}
+	wg.Wait()
+
+	return report
+}
+
+// run executes a single check, treating a check that outlives ctx as failed.
+func run(ctx context.Context, fn CheckFunc) CheckResult {
+	start := time.Now()
+	errCh := make(chan error, 1)
+	go func() { errCh <- fn(ctx) }()
+
+	var err error
+	select {
+	case err = <-errCh:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	result := CheckResult{
+		Status:    StatusOK,
+		LatencyMS: float64(time.Since(start).Microseconds()) / 1000,
+	}
+	if err != nil {
+		result.Status = StatusUnavailable
+		result.Error = err.Error()
+	}
+	return result
+}
+
+// LiveHandler reports that the process is running. It never checks dependencies,
+// so an orchestrator does not restart a service because Postgres or Kafka is down.
+// Params:
+// - w: http.ResponseWriter - the HTTP response writer
+// - r: *http.Request - the HTTP request
+// Returns: None
+func (c *Checker) LiveHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status": StatusOK,
+	})
+}
+
+// ReadyHandler runs the dependency checks and responds 503 if any of them failed.
+// Params:
+// - w: http.ResponseWriter - the HTTP response writer
+// - r: *http.Request - the HTTP request
+// Returns: None
+func (c *Checker) ReadyHandler(w http.ResponseWriter, r *http.Request) {
+	report := c.Check(r.Context())
+
+	status := http.StatusOK
+	if report.Status != StatusOK {
+		status = http.StatusServiceUnavailable
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	w.Header().Add("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(report)
+}
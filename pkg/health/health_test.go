@@ -0,0 +1,89 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestChecker(t *testing.T) {
+
+	t.Run("should report ready when every check passes", func(t *testing.T) {
+		c := NewChecker(time.Second)
+		c.Add("db", func(ctx context.Context) error { return nil })
+		c.Add("kafka", func(ctx context.Context) error { return nil })
+
+		rr := httptest.NewRecorder()
+		c.ReadyHandler(rr, httptest.NewRequest(http.MethodGet, "/health/ready", nil))
+
+		if rr.Code != http.StatusOK {
+			t.Errorf("expected status %d, got %d", http.StatusOK, rr.Code)
+		}
+
+		var report Report
+		if err := json.NewDecoder(rr.Body).Decode(&report); err != nil {
+			t.Fatal(err)
+		}
+		if report.Status != StatusOK || len(report.Checks) != 2 {
+			t.Errorf("unexpected report %+v", report)
+		}
+	})
+
+	t.Run("should return 503 and the failing dependency", func(t *testing.T) {
+		c := NewChecker(time.Second)
+		c.Add("db", func(ctx context.Context) error { return nil })
+		c.Add("kafka", func(ctx context.Context) error { return errors.New("no brokers available") })
+
+		rr := httptest.NewRecorder()
+		c.ReadyHandler(rr, httptest.NewRequest(http.MethodGet, "/health/ready", nil))
+
+		if rr.Code != http.StatusServiceUnavailable {
+			t.Errorf("expected status %d, got %d", http.StatusServiceUnavailable, rr.Code)
+		}
+
+		var report Report
+		if err := json.NewDecoder(rr.Body).Decode(&report); err != nil {
+			t.Fatal(err)
+		}
+		if report.Checks["db"].Status != StatusOK {
+			t.Errorf("expected db ok, got %+v", report.Checks["db"])
+		}
+		if report.Checks["kafka"].Error != "no brokers available" {
+			t.Errorf("expected kafka error, got %+v", report.Checks["kafka"])
+		}
+	})
+
+	t.Run("should fail checks that exceed the timeout", func(t *testing.T) {
+		c := NewChecker(20 * time.Millisecond)
+		c.Add("db", func(ctx context.Context) error {
+			time.Sleep(time.Second)
+			return nil
+		})
+
+		start := time.Now()
+		report := c.Check(context.Background())
+
+		if time.Since(start) > 500*time.Millisecond {
+			t.Errorf("expected check to be cut off at the timeout")
+		}
+		if report.Status != StatusUnavailable || report.Checks["db"].Error != context.DeadlineExceeded.Error() {
+			t.Errorf("unexpected report %+v", report)
+		}
+	})
+
+	t.Run("should report live without running checks", func(t *testing.T) {
+		c := NewChecker(time.Second)
+		c.Add("db", func(ctx context.Context) error { return errors.New("down") })
+
+		rr := httptest.NewRecorder()
+		c.LiveHandler(rr, httptest.NewRequest(http.MethodGet, "/health/live", nil))
+
+		if rr.Code != http.StatusOK {
+			t.Errorf("expected status %d, got %d", http.StatusOK, rr.Code)
+		}
+	})
+}
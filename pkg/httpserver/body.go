@@ -0,0 +1,167 @@
+package httpserver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// BodyError is a request body that was rejected. Msg is safe to show to the client.
+type BodyError struct {
+	// Status is 413 for a body over its size limit and 400 otherwise.
+	Status int
+	Msg    string
+	Err    error
+}
+
+// Error returns the client message and the underlying error.
+// Params: None
+// Returns:
+// - string: the error message
+func (e *BodyError) Error() string {
+	if e.Err == nil {
+		return e.Msg
+	}
+	return e.Msg + ": " + e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+// Params: None
+// Returns:
+// - error: the underlying error
+func (e *BodyError) Unwrap() error {
+	return e.Err
+}
+
+// DecodeJSON decodes a JSON request body into v. Unknown fields and anything after the
+// JSON value are rejected. An empty body is an error wrapping io.EOF.
+// Params:
+// - r: *http.Request - the HTTP request
+// - v: any - a pointer to the value to decode into
+// Returns:
+// - error: a *BodyError if the body is rejected
+func DecodeJSON(r *http.Request, v any) error {
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+
+	if err := decoder.Decode(v); err != nil {
+		return bodyError(err)
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		if err == nil {
+			return &BodyError{Status: http.StatusBadRequest, Msg: "Request body has data after the JSON value"}
+		}
+		return bodyError(err)
+	}
+	return nil
+}
+
+// ReadBody reads a request body that is not JSON. An empty body is an error wrapping
+// io.EOF.
+// Params:
+// - r: *http.Request - the HTTP request
+// Returns:
+// - []byte: the body
+// - error: a *BodyError if the body is rejected
+func ReadBody(r *http.Request) ([]byte, error) {
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, bodyError(err)
+	}
+	if len(data) == 0 {
+		return nil, bodyError(io.EOF)
+	}
+	return data, nil
+}
+
+// bodyError describes a decoding error for the client.
+func bodyError(err error) *BodyError {
+	var bodyErr *BodyError
+	var maxBytesErr *http.MaxBytesError
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+
+	switch {
+	case errors.As(err, &bodyErr):
+		// the body could not be read, e.g. it failed to decompress
+		return bodyErr
+	case errors.As(err, &maxBytesErr):
+		return &BodyError{Status: http.StatusRequestEntityTooLarge, Msg: fmt.Sprintf("Request body is larger than %d bytes", maxBytesErr.Limit), Err: err}
+	case errors.Is(err, io.EOF):
+		return &BodyError{Status: http.StatusBadRequest, Msg: "Request body is empty", Err: err}
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return &BodyError{Status: http.StatusBadRequest, Msg: "Request body is incomplete JSON", Err: err}
+	case errors.As(err, &syntaxErr):
+		return &BodyError{Status: http.StatusBadRequest, Msg: fmt.Sprintf("Request body has invalid JSON at byte %d", syntaxErr.Offset), Err: err}
+	case errors.As(err, &typeErr) && typeErr.Field != "":
+		return &BodyError{Status: http.StatusBadRequest, Msg: fmt.Sprintf("Request body field %q must be %s", typeErr.Field, typeErr.Type), Err: err}
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		// encoding/json has no error type for unknown fields
+		return &BodyError{Status: http.StatusBadRequest, Msg: "Request body has " + strings.TrimPrefix(err.Error(), "json: "), Err: err}
+	default:
+		return &BodyError{Status: http.StatusBadRequest, Msg: "Invalid request body", Err: err}
+	}
+}
+
+// WriteBodyError responds with the status and message of a rejected body.
+// Params:
+// - w: http.ResponseWriter - the HTTP response writer
+// - err: error - the error from DecodeJSON, ReadBody or CheckJSONLimits
+// Returns: None
+func WriteBodyError(w http.ResponseWriter, err error) {
+	var bodyErr *BodyError
+	if errors.As(err, &bodyErr) {
+		http.Error(w, bodyErr.Msg, bodyErr.Status)
+		return
+	}
+	http.Error(w, "Invalid request body", http.StatusBadRequest)
+}
+
+// CheckJSONLimits rejects JSON nesting objects and arrays deeper than maxDepth or having
+// more than maxKeys object keys in total. data must be valid JSON, as decoded into a
+// json.RawMessage.
+// Params:
+// - data: []byte - the JSON value
+// - maxDepth: int - the deepest nesting allowed, 0 for no limit
+// - maxKeys: int - the most keys allowed, 0 for no limit
+// Returns:
+// - error: a *BodyError if a limit is exceeded
+func CheckJSONLimits(data []byte, maxDepth int, maxKeys int) error {
+	depth, keys := 0, 0
+	inString, escaped := false, false
+	for _, c := range data {
+		if inString {
+			switch {
+			case escaped:
+				escaped = false
+			case c == '\\':
+				escaped = true
+			case c == '"':
+				inString = false
+			}
+			continue
+		}
+
+		switch c {
+		case '"':
+			inString = true
+		case '{', '[':
+			depth++
+			if maxDepth > 0 && depth > maxDepth {
+				return &BodyError{Status: http.StatusBadRequest, Msg: fmt.Sprintf("Payload is nested deeper than %d levels", maxDepth)}
+			}
+		case '}', ']':
+			depth--
+		case ':':
+			// outside strings, colons only separate keys from values
+			keys++
+			if maxKeys > 0 && keys > maxKeys {
+				return &BodyError{Status: http.StatusBadRequest, Msg: fmt.Sprintf("Payload has more than %d keys", maxKeys)}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,248 @@
+package httpserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/RaghibA/iot-telemetry/pkg/config"
+)
+
+type testBody struct {
+	Name  string          `json:"name"`
+	Count int             `json:"count"`
+	Data  json.RawMessage `json:"data"`
+}
+
+func TestDecodeJSON(t *testing.T) {
+	cases := []struct {
+		name   string
+		body   string
+		status int
+		msg    string
+	}{
+		{"should decode a valid body", `{"name":"a","count":1,"data":{"x":[1]}}`, 0, ""},
+		{"should reject an empty body", ``, http.StatusBadRequest, "Request body is empty"},
+		{"should reject unknown fields", `{"name":"a","admin":true}`, http.StatusBadRequest, `Request body has unknown field "admin"`},
+		{"should reject wrong types", `{"count":"1"}`, http.StatusBadRequest, `Request body field "count" must be int`},
+		{"should reject invalid JSON", `{"name":}`, http.StatusBadRequest, "Request body has invalid JSON at byte 9"},
+		{"should reject incomplete JSON", `{"name":"a"`, http.StatusBadRequest, "Request body is incomplete JSON"},
+		{"should reject data after the value", `{"name":"a"}{"name":"b"}`, http.StatusBadRequest, "Request body has data after the JSON value"},
+		{"should reject garbage after the value", `{"name":"a"} x`, http.StatusBadRequest, "Request body has invalid JSON at byte 14"},
+		{"should reject bodies over the limit with 413", `{"name":"` + strings.Repeat("a", 100) + `"}`, http.StatusRequestEntityTooLarge, "Request body is larger than 64 bytes"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tc.body))
+			r.Body = http.MaxBytesReader(rr, r.Body, 64)
+
+			var v testBody
+			err := DecodeJSON(r, &v)
+			if tc.status == 0 {
+				if err != nil {
+					t.Fatalf("expected no error, got %v", err)
+				}
+				return
+			}
+
+			WriteBodyError(rr, err)
+			if rr.Code != tc.status {
+				t.Errorf("expected status %d, got %d", tc.status, rr.Code)
+			}
+			if got := strings.TrimSpace(rr.Body.String()); got != tc.msg {
+				t.Errorf("expected message %q, got %q", tc.msg, got)
+			}
+		})
+	}
+
+	t.Run("should wrap io.EOF for an empty body", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodPost, "/", http.NoBody)
+		var v testBody
+		if err := DecodeJSON(r, &v); !errors.Is(err, io.EOF) {
+			t.Errorf("expected io.EOF, got %v", err)
+		}
+	})
+}
+
+func TestReadBody(t *testing.T) {
+	t.Run("should read the body", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader([]byte{0xa1, 0x00}))
+		data, err := ReadBody(r)
+		if err != nil || !bytes.Equal(data, []byte{0xa1, 0x00}) {
+			t.Errorf("expected the body, got %x %v", data, err)
+		}
+	})
+
+	t.Run("should reject empty bodies and bodies over the limit", func(t *testing.T) {
+		for _, tc := range []struct {
+			body   string
+			status int
+		}{{"", http.StatusBadRequest}, {strings.Repeat("a", 100), http.StatusRequestEntityTooLarge}} {
+			rr := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tc.body))
+			r.Body = http.MaxBytesReader(rr, r.Body, 64)
+
+			_, err := ReadBody(r)
+			WriteBodyError(rr, err)
+			if rr.Code != tc.status {
+				t.Errorf("expected status %d for %d bytes, got %d", tc.status, len(tc.body), rr.Code)
+			}
+		}
+	})
+}
+
+func TestCheckJSONLimits(t *testing.T) {
+	cases := []struct {
+		name     string
+		data     string
+		maxDepth int
+		maxKeys  int
+		ok       bool
+	}{
+		{"should accept a payload within the limits", `{"a":{"b":[1,2]},"c":3}`, 3, 3, true},
+		{"should reject a payload nested too deep", `{"a":{"b":[1,2]}}`, 2, 0, false},
+		{"should reject a payload with too many keys", `{"a":1,"b":2,"c":3}`, 0, 2, false},
+		{"should ignore brackets and colons in strings", `{"a":"{[:\"{[:"}`, 1, 1, true},
+		{"should accept anything without limits", `[[[[{"a":1,"b":2}]]]]`, 0, 0, true},
+		{"should accept scalars", `"x"`, 1, 1, true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := CheckJSONLimits([]byte(tc.data), tc.maxDepth, tc.maxKeys)
+			if tc.ok && err != nil {
+				t.Errorf("expected no error, got %v", err)
+			}
+			if !tc.ok && err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestLimitBody(t *testing.T) {
+	limits := config.LimitsConfig{MaxBodyBytes: 100, RouteBodyBytes: []string{"/api/v1/auth=10"}}
+	handler := LimitBody(limits)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var v any
+		if err := DecodeJSON(r, &v); err != nil {
+			WriteBodyError(w, err)
+		}
+	}))
+
+	cases := []struct {
+		name   string
+		path   string
+		body   string
+		status int
+	}{
+		{"should apply the route limit", "/api/v1/auth/login", `"` + strings.Repeat("a", 20) + `"`, http.StatusRequestEntityTooLarge},
+		{"should apply the default limit to other routes", "/api/v1/authz", `"` + strings.Repeat("a", 20) + `"`, http.StatusOK},
+		{"should apply the default limit", "/api/v1/data/event", `"` + strings.Repeat("a", 200) + `"`, http.StatusRequestEntityTooLarge},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, tc.path, strings.NewReader(tc.body)))
+			if rr.Code != tc.status {
+				t.Errorf("expected status %d, got %d", tc.status, rr.Code)
+			}
+		})
+	}
+
+	t.Run("should reject chunked bodies over the limit while reading", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodPost, "/api/v1/auth/login", strings.NewReader(`"`+strings.Repeat("a", 20)+`"`))
+		r.ContentLength = -1
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, r)
+		if rr.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("expected status 413, got %d", rr.Code)
+		}
+	})
+}
+
+// jsonShape returns the nesting depth and key count of valid JSON the slow way.
+func jsonShape(data []byte) (depth int, keys int) {
+	type frame struct {
+		object bool
+		tokens int
+	}
+	var stack []*frame
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return depth, keys
+		}
+		if delim, ok := token.(json.Delim); ok && (delim == '}' || delim == ']') {
+			stack = stack[:len(stack)-1]
+			continue
+		}
+		if len(stack) > 0 {
+			top := stack[len(stack)-1]
+			if top.object && top.tokens%2 == 0 {
+				keys++
+			}
+			top.tokens++
+		}
+		if delim, ok := token.(json.Delim); ok {
+			stack = append(stack, &frame{object: delim == '{'})
+			depth = max(depth, len(stack))
+		}
+	}
+}
+
+func FuzzCheckJSONLimits(f *testing.F) {
+	for _, seed := range []string{`{}`, `[]`, `"a"`, `{"a":{"b":[1,{"c":"\"}:"}]}}`, `[[[[]]],{"x":{"y":null}}]`, `{"a":1,"a":2}`} {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		if !json.Valid(data) {
+			t.Skip()
+		}
+		depth, keys := jsonShape(data)
+		if err := CheckJSONLimits(data, depth, keys); err != nil {
+			t.Errorf("expected %q to be within depth %d and %d keys, got %v", data, depth, keys, err)
+		}
+		if depth > 1 && CheckJSONLimits(data, depth-1, 0) == nil {
+			t.Errorf("expected %q to be deeper than %d", data, depth-1)
+		}
+		if keys > 1 && CheckJSONLimits(data, 0, keys-1) == nil {
+			t.Errorf("expected %q to have more than %d keys", data, keys-1)
+		}
+	})
+}
+
+func FuzzDecodeJSON(f *testing.F) {
+	for _, seed := range []string{``, `{}`, `{"name":"a","count":1,"data":[1]}`, `{"name":1}`, `{"x":1}`, `{} {}`, `{"data":{"a":`} {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, body []byte) {
+		rr := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body))
+		r.Body = http.MaxBytesReader(rr, r.Body, 1024)
+
+		var v testBody
+		err := DecodeJSON(r, &v)
+		if err == nil {
+			if !json.Valid(body) {
+				t.Errorf("expected %q to be rejected as invalid JSON", body)
+			}
+			return
+		}
+		var bodyErr *BodyError
+		if !errors.As(err, &bodyErr) {
+			t.Fatalf("expected a *BodyError, got %T", err)
+		}
+		if bodyErr.Status != http.StatusBadRequest && bodyErr.Status != http.StatusRequestEntityTooLarge {
+			t.Errorf("expected status 400 or 413, got %d", bodyErr.Status)
+		}
+		if bodyErr.Status == http.StatusRequestEntityTooLarge && len(body) <= 1024 {
+			t.Errorf("expected %d bytes to be within the limit", len(body))
+		}
+	})
+}
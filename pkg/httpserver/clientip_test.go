@@ -0,0 +1,40 @@
+package httpserver
+
+import (
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	trusted := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}
+
+	cases := []struct {
+		name      string
+		remote    string
+		forwarded string
+		realIP    string
+		want      string
+	}{
+		{"should use the peer address without a proxy", "203.0.113.7:5000", "", "", "203.0.113.7"},
+		{"should ignore forwarding headers from untrusted peers", "203.0.113.7:5000", "198.51.100.1", "198.51.100.1", "203.0.113.7"},
+		{"should use the right-most untrusted forwarded address", "10.0.0.2:5000", "198.51.100.1, 203.0.113.9, 10.0.0.3", "", "203.0.113.9"},
+		{"should fall back to X-Real-IP", "10.0.0.2:5000", "", "203.0.113.9", "203.0.113.9"},
+		{"should use the peer if every hop is trusted", "10.0.0.2:5000", "10.0.0.3", "", "10.0.0.2"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/", nil)
+			r.RemoteAddr = tc.remote
+			if tc.forwarded != "" {
+				r.Header.Set("X-Forwarded-For", tc.forwarded)
+			}
+			if tc.realIP != "" {
+				r.Header.Set("X-Real-IP", tc.realIP)
+			}
+			if got := ClientIP(r, trusted); got != tc.want {
+				t.Errorf("expected %s, got %s", tc.want, got)
+			}
+		})
+	}
+}
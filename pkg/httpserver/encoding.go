@@ -0,0 +1,154 @@
+package httpserver
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// AcceptedEncodings are the request Content-Encodings Decompress decodes.
+const AcceptedEncodings = "gzip, deflate, zstd"
+
+// zstdMaxWindow bounds the memory a zstd frame may make the decoder allocate. 8 MiB is
+// the window the zstd format asks every decoder to support.
+const zstdMaxWindow = 8 << 20
+
+// decoders open a reader decompressing a request body, by Content-Encoding.
+var decoders = map[string]func(io.Reader) (io.ReadCloser, error){
+	"gzip":    newGzipReader,
+	"x-gzip":  newGzipReader,
+	"deflate": newDeflateReader,
+	"zstd":    newZstdReader,
+}
+
+// Decompress decodes request bodies sent with a gzip, deflate or zstd Content-Encoding.
+// Bodies decompressing to more than maxBytes fail with a *http.MaxBytesError, which
+// DecodeJSON and ReadBody report as 413, and malformed streams fail with a *BodyError.
+// Other encodings are rejected with 415. The compressed body is still subject to
+// LimitBody.
+// Params:
+// - maxBytes: int64 - the largest size a body may decompress to
+// Returns:
+// - func(http.Handler) http.Handler: the middleware
+func Decompress(maxBytes int64) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			values := r.Header.Values("Content-Encoding")
+			if len(values) == 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+			encoding := strings.ToLower(strings.TrimSpace(strings.Join(values, ",")))
+			if encoding == "identity" || encoding == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			open, ok := decoders[encoding]
+			if !ok {
+				// stacked encodings such as "gzip, gzip" only serve to multiply the ratio
+				w.Header().Set("Accept-Encoding", AcceptedEncodings)
+				http.Error(w, fmt.Sprintf("Content-Encoding %q is not supported", encoding), http.StatusUnsupportedMediaType)
+				return
+			}
+			if r.Body != nil && r.Body != http.NoBody {
+				r.Body = http.MaxBytesReader(w, &decompressor{encoding: encoding, src: r.Body, open: open}, maxBytes)
+			}
+			// the handler sees the decoded body, whose length is unknown
+			r.Header.Del("Content-Encoding")
+			r.Header.Del("Content-Length")
+			r.ContentLength = -1
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// decompressor decodes a request body, opening the decoder on the first read so a
+// malformed header is reported like the rest of the stream.
+type decompressor struct {
+	encoding string
+	src      io.ReadCloser
+	open     func(io.Reader) (io.ReadCloser, error)
+	dec      io.ReadCloser
+}
+
+// Read reads decompressed bytes.
+// Params:
+// - p: []byte - the buffer to read into
+// Returns:
+// - int: the number of bytes read
+// - error: io.EOF at the end of the stream, or a *BodyError if it is malformed
+func (d *decompressor) Read(p []byte) (int, error) {
+	if d.dec == nil {
+		dec, err := d.open(d.src)
+		if err != nil {
+			return 0, d.error(err)
+		}
+		d.dec = dec
+	}
+	n, err := d.dec.Read(p)
+	if err != nil && err != io.EOF {
+		err = d.error(err)
+	}
+	return n, err
+}
+
+// Close releases the decoder and closes the request body.
+// Params: None
+// Returns:
+// - error: the error closing the request body
+func (d *decompressor) Close() error {
+	if d.dec != nil {
+		_ = d.dec.Close()
+	}
+	return d.src.Close()
+}
+
+// error describes a decoding error for the client. An empty body and the compressed
+// size limit are reported as they would be without compression.
+func (d *decompressor) error(err error) error {
+	var maxBytesErr *http.MaxBytesError
+	if err == io.EOF || errors.As(err, &maxBytesErr) {
+		return err
+	}
+	return &BodyError{Status: http.StatusBadRequest, Msg: fmt.Sprintf("Request body is not valid %s", d.encoding), Err: err}
+}
+
+func newGzipReader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+// newDeflateReader decodes zlib streams, as HTTP defines deflate, and the raw deflate
+// streams some clients send instead.
+func newDeflateReader(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	header, err := br.Peek(2)
+	switch {
+	case len(header) == 2:
+	case err == io.EOF && len(header) == 1:
+		return nil, io.ErrUnexpectedEOF
+	default:
+		return nil, err
+	}
+	// a zlib header names the deflate method and is a multiple of 31
+	if header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 {
+		return zlib.NewReader(br)
+	}
+	return flate.NewReader(br), nil
+}
+
+func newZstdReader(r io.Reader) (io.ReadCloser, error) {
+	dec, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxWindow(zstdMaxWindow), zstd.WithDecoderLowmem(true))
+	if err != nil {
+		return nil, err
+	}
+	return dec.IOReadCloser(), nil
+}
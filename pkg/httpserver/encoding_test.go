@@ -0,0 +1,204 @@
+package httpserver
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// compress encodes data with a Content-Encoding.
+func compress(t *testing.T, encoding string, data []byte) []byte {
+	t.Helper()
+	var b bytes.Buffer
+	var w io.WriteCloser
+	switch encoding {
+	case "gzip":
+		w = gzip.NewWriter(&b)
+	case "zlib":
+		w = zlib.NewWriter(&b)
+	case "deflate":
+		w, _ = flate.NewWriter(&b, flate.DefaultCompression)
+	case "zstd":
+		var err error
+		if w, err = zstd.NewWriter(&b); err != nil {
+			t.Fatal(err)
+		}
+	default:
+		t.Fatalf("unknown encoding %s", encoding)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func TestDecompress(t *testing.T) {
+	handler := Decompress(64)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, err := ReadBody(r)
+		if err != nil {
+			WriteBodyError(w, err)
+			return
+		}
+		if r.Header.Get("Content-Encoding") != "" || r.ContentLength != -1 {
+			http.Error(w, "encoding headers left on the request", http.StatusInternalServerError)
+			return
+		}
+		_, _ = w.Write(data)
+	}))
+	send := func(encoding string, body []byte) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body))
+		if encoding != "" {
+			r.Header.Set("Content-Encoding", encoding)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, r)
+		return rr
+	}
+	body := []byte(`{"temperature":21.5}`)
+
+	t.Run("should decode gzip, deflate and zstd bodies", func(t *testing.T) {
+		for _, tc := range []struct{ header, encoding string }{
+			{"gzip", "gzip"},
+			{"x-gzip", "gzip"},
+			{"GZIP", "gzip"},
+			{"deflate", "zlib"},
+			{"deflate", "deflate"},
+			{"zstd", "zstd"},
+		} {
+			rr := send(tc.header, compress(t, tc.encoding, body))
+			if rr.Code != http.StatusOK || rr.Body.String() != string(body) {
+				t.Errorf("%s as %s: expected the decoded body, got %d %q", tc.encoding, tc.header, rr.Code, rr.Body.String())
+			}
+		}
+	})
+
+	t.Run("should pass identity and unencoded bodies through", func(t *testing.T) {
+		for _, encoding := range []string{"", "identity"} {
+			r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body))
+			if encoding != "" {
+				r.Header.Set("Content-Encoding", encoding)
+			}
+			rr := httptest.NewRecorder()
+			Decompress(64)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				data, _ := io.ReadAll(r.Body)
+				_, _ = w.Write(data)
+			})).ServeHTTP(rr, r)
+			if rr.Body.String() != string(body) {
+				t.Errorf("%q: expected the body as sent, got %q", encoding, rr.Body.String())
+			}
+		}
+	})
+
+	t.Run("should reject unsupported and stacked encodings with 415", func(t *testing.T) {
+		for _, encoding := range []string{"br", "compress", "gzip, gzip"} {
+			rr := send(encoding, body)
+			if rr.Code != http.StatusUnsupportedMediaType {
+				t.Errorf("%q: expected status 415, got %d", encoding, rr.Code)
+			}
+			if got := rr.Header().Get("Accept-Encoding"); got != AcceptedEncodings {
+				t.Errorf("%q: expected Accept-Encoding %q, got %q", encoding, AcceptedEncodings, got)
+			}
+		}
+	})
+
+	t.Run("should reject bodies decompressing past the limit with 413", func(t *testing.T) {
+		bomb := bytes.Repeat([]byte("0"), 1<<20)
+		for _, encoding := range []string{"gzip", "deflate", "zstd"} {
+			data := compress(t, encoding, bomb)
+			if len(data) > 64*1024 {
+				t.Fatalf("%s: expected the bomb to compress well, got %d bytes", encoding, len(data))
+			}
+			rr := send(encoding, data)
+			if rr.Code != http.StatusRequestEntityTooLarge || strings.TrimSpace(rr.Body.String()) != "Request body is larger than 64 bytes" {
+				t.Errorf("%s: expected status 413, got %d %q", encoding, rr.Code, rr.Body.String())
+			}
+		}
+	})
+
+	t.Run("should reject malformed and truncated streams with 400", func(t *testing.T) {
+		for _, tc := range []struct {
+			encoding string
+			data     []byte
+			msg      string
+		}{
+			{"gzip", body, "Request body is not valid gzip"},
+			{"gzip", compress(t, "gzip", body)[:15], "Request body is not valid gzip"},
+			{"gzip", append(compress(t, "gzip", body), "garbage"...), "Request body is not valid gzip"},
+			{"deflate", []byte{0x78}, "Request body is not valid deflate"},
+			{"deflate", compress(t, "zlib", body)[:8], "Request body is not valid deflate"},
+			{"zstd", body, "Request body is not valid zstd"},
+			{"gzip", nil, "Request body is empty"},
+			{"zstd", compress(t, "zstd", nil), "Request body is empty"},
+		} {
+			rr := send(tc.encoding, tc.data)
+			if rr.Code != http.StatusBadRequest || strings.TrimSpace(rr.Body.String()) != tc.msg {
+				t.Errorf("%s %x: expected 400 %q, got %d %q", tc.encoding, tc.data, tc.msg, rr.Code, rr.Body.String())
+			}
+		}
+	})
+
+	t.Run("should report the compressed body limit as without compression", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(compress(t, "gzip", body)))
+		r.Header.Set("Content-Encoding", "gzip")
+		rr := httptest.NewRecorder()
+		r.Body = http.MaxBytesReader(rr, r.Body, 10)
+		handler.ServeHTTP(rr, r)
+		if rr.Code != http.StatusRequestEntityTooLarge || strings.TrimSpace(rr.Body.String()) != "Request body is larger than 10 bytes" {
+			t.Errorf("expected status 413 for 10 bytes, got %d %q", rr.Code, rr.Body.String())
+		}
+	})
+}
+
+func FuzzDecompress(f *testing.F) {
+	body := []byte(`{"a":[1,2,3]}`)
+	for _, seed := range []struct {
+		encoding string
+		data     []byte
+	}{{"gzip", body}, {"deflate", body}, {"zstd", body}, {"deflate", []byte{0x78, 0x9c}}} {
+		f.Add(seed.encoding, seed.data)
+	}
+	var b bytes.Buffer
+	gz := gzip.NewWriter(&b)
+	_, _ = gz.Write(bytes.Repeat(body, 20))
+	_ = gz.Close()
+	f.Add("gzip", b.Bytes())
+
+	f.Fuzz(func(t *testing.T, encoding string, data []byte) {
+		if _, ok := decoders[encoding]; !ok {
+			t.Skip()
+		}
+		var got []byte
+		rr := httptest.NewRecorder()
+		Decompress(128)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var err error
+			if got, err = ReadBody(r); err != nil {
+				WriteBodyError(w, err)
+			}
+		})).ServeHTTP(rr, func() *http.Request {
+			r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(data))
+			r.Header.Set("Content-Encoding", encoding)
+			return r
+		}())
+
+		switch rr.Code {
+		case http.StatusOK:
+			if len(got) > 128 {
+				t.Errorf("expected at most 128 decompressed bytes, got %d", len(got))
+			}
+		case http.StatusBadRequest, http.StatusRequestEntityTooLarge:
+		default:
+			t.Errorf("expected status 200, 400 or 413, got %d", rr.Code)
+		}
+	})
+}
@@ -0,0 +1,104 @@
+package httpserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/RaghibA/iot-telemetry/pkg/config"
+)
+
+// New creates an HTTP server with the configured address, timeouts and header limit.
+// Params:
+// - cfg: *config.Config - the service configuration
+// - handler: http.Handler - the root handler
+// Returns:
+// - *http.Server: the configured server
+func New(cfg *config.Config, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              cfg.Server.Addr(),
+		Handler:           handler,
+		ReadHeaderTimeout: cfg.Timeouts.ReadHeader,
+		ReadTimeout:       cfg.Timeouts.Read,
+		WriteTimeout:      cfg.Timeouts.Write,
+		IdleTimeout:       cfg.Timeouts.Idle,
+		MaxHeaderBytes:    cfg.Limits.MaxHeaderBytes,
+	}
+}
+
+// ListenAndServe starts the server, serving HTTPS when TLS is configured. On SIGINT or
+// SIGTERM it stops accepting connections and drains in-flight requests for up to the
+// configured shutdown timeout.
+// Params:
+// - cfg: *config.Config - the service configuration
+// - srv: *http.Server - the server to start
+// Returns:
+// - error: error if the server failed, nil after a graceful shutdown
+func ListenAndServe(cfg *config.Config, srv *http.Server) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	errCh := make(chan error, 1)
+	go func() {
+		if cfg.TLS.Enabled() {
+			errCh <- srv.ListenAndServeTLS(cfg.TLS.CertFile, cfg.TLS.KeyFile)
+			return
+		}
+		errCh <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.Timeouts.Shutdown)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		return err
+	}
+	if err := <-errCh; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// LimitBody caps the size of request bodies, at the limit of the longest matching route
+// prefix or the default limit. Bodies declared larger are rejected with 413 and reads
+// past the limit fail, which DecodeJSON reports as 413.
+// Params:
+// - limits: config.LimitsConfig - the default and per route body limits
+// Returns:
+// - func(http.Handler) http.Handler: the middleware
+func LimitBody(limits config.LimitsConfig) func(http.Handler) http.Handler {
+	routes := limits.BodyLimits()
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			maxBytes := bodyLimit(r.URL.Path, limits.MaxBodyBytes, routes)
+			if r.ContentLength > maxBytes {
+				http.Error(w, fmt.Sprintf("Request body is larger than %d bytes", maxBytes), http.StatusRequestEntityTooLarge)
+				return
+			}
+			if r.Body != nil {
+				r.Body = http.MaxBytesReader(w, r.Body, maxBytes)
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// bodyLimit returns the body limit of the first route whose prefix matches path.
+func bodyLimit(path string, maxBytes int64, routes []config.BodyLimit) int64 {
+	for _, route := range routes {
+		if path == route.Prefix || strings.HasPrefix(path, route.Prefix+"/") {
+			return route.MaxBytes
+		}
+	}
+	return maxBytes
+}
@@ -0,0 +1,41 @@
+package httpserver
+
+import (
+	"bytes"
+	"net/http"
+)
+
+// Recorder is an http.ResponseWriter keeping the response in memory, so that handlers can
+// serve requests arriving over other protocols, such as CoAP or gRPC.
+type Recorder struct {
+	// Status is the response status, 0 until the handler writes.
+	Status int
+	Body   bytes.Buffer
+	header http.Header
+}
+
+// NewRecorder creates an empty Recorder.
+// Params: None
+// Returns:
+// - *Recorder: the recorder
+func NewRecorder() *Recorder {
+	return &Recorder{header: http.Header{}}
+}
+
+// Header returns the response headers.
+func (r *Recorder) Header() http.Header {
+	return r.header
+}
+
+// WriteHeader records the first status written.
+func (r *Recorder) WriteHeader(status int) {
+	if r.Status == 0 {
+		r.Status = status
+	}
+}
+
+// Write records body bytes, with status 200 if none was written.
+func (r *Recorder) Write(p []byte) (int, error) {
+	r.WriteHeader(http.StatusOK)
+	return r.Body.Write(p)
+}
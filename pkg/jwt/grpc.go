@@ -0,0 +1,56 @@
+package jwt
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+
+	"github.com/RaghibA/iot-telemetry/pkg/logging"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// AuthenticateGRPC is the gRPC counterpart of AuthWithAccessToken. It checks the bearer
+// token in the authorization metadata of a call and returns a context carrying the user ID
+// and token expiry under UserKey and ExpiresKey.
+// Params:
+// - ctx: context.Context - the call context
+// Returns:
+// - context.Context: the authenticated context
+// - error: an UNAUTHENTICATED status if the token is missing or rejected, INVALID_ARGUMENT if
+// it is malformed
+func AuthenticateGRPC(ctx context.Context) (context.Context, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	values := md.Get("authorization")
+	if len(values) == 0 {
+		slog.WarnContext(ctx, "no access token provided")
+		return nil, status.Error(codes.Unauthenticated, "Provide bearer token in authorization metadata")
+	}
+	token, ok := BearerToken(values[0])
+	if !ok {
+		slog.WarnContext(ctx, "authorization metadata is not a bearer token")
+		return nil, status.Error(codes.Unauthenticated, "Invalid access token")
+	}
+
+	userId, expires, err := ValidateAccessToken(token)
+	switch {
+	case errors.Is(err, ErrTokenExpired):
+		slog.WarnContext(ctx, "token expired", "err", err)
+		return nil, status.Error(codes.Unauthenticated, "Token expired, log in to account.")
+	case errors.Is(err, ErrMalformedToken):
+		slog.WarnContext(ctx, "malformed token", "err", err)
+		return nil, status.Error(codes.InvalidArgument, "Malformed access token")
+	case errors.Is(err, ErrInvalidToken):
+		slog.WarnContext(ctx, "invalid token", "err", err)
+		return nil, status.Error(codes.Unauthenticated, "Invalid Token")
+	case err != nil:
+		slog.ErrorContext(ctx, "jwt secret not configured", "err", err)
+		return nil, status.Error(codes.Internal, "Internal Server Error")
+	}
+
+	logging.SetUserID(ctx, userId)
+	ctx = context.WithValue(ctx, UserKey, userId)
+	ctx = context.WithValue(ctx, ExpiresKey, expires)
+	return ctx, nil
+}
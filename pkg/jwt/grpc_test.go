@@ -0,0 +1,70 @@
+package jwt
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestAuthenticateGRPC(t *testing.T) {
+
+	incoming := func(authorization string) context.Context {
+		return metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", authorization))
+	}
+
+	t.Run("should fail if no token is provided", func(t *testing.T) {
+		_, err := AuthenticateGRPC(context.Background())
+		if status.Code(err) != codes.Unauthenticated {
+			t.Errorf("expected Unauthenticated, got %v", err)
+		}
+	})
+
+	t.Run("should fail if the metadata is not a bearer token", func(t *testing.T) {
+		_, err := AuthenticateGRPC(incoming("Basic dXNlcjpwYXNz"))
+		if status.Code(err) != codes.Unauthenticated {
+			t.Errorf("expected Unauthenticated, got %v", err)
+		}
+	})
+
+	t.Run("should fail if token is expired", func(t *testing.T) {
+		tokenString, err := GenerateAccessToken("1234", time.Now().Add(-time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = AuthenticateGRPC(incoming("Bearer " + tokenString))
+		if status.Code(err) != codes.Unauthenticated || status.Convert(err).Message() != "Token expired, log in to account." {
+			t.Errorf("expected expired token status, got %v", err)
+		}
+	})
+
+	t.Run("should fail with invalid argument if the token is malformed", func(t *testing.T) {
+		_, err := AuthenticateGRPC(incoming("Bearer not.a.token"))
+		if status.Code(err) != codes.InvalidArgument {
+			t.Errorf("expected InvalidArgument, got %v", err)
+		}
+	})
+
+	t.Run("should authorize calls with a valid token", func(t *testing.T) {
+		exp := time.Now().Add(time.Hour).Truncate(time.Second)
+		tokenString, err := GenerateAccessToken("1234", exp)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ctx, err := AuthenticateGRPC(incoming("Bearer " + tokenString))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ctx.Value(UserKey) != "1234" {
+			t.Errorf("expected user id in context, got %v", ctx.Value(UserKey))
+		}
+		if got, _ := ctx.Value(ExpiresKey).(time.Time); !got.Equal(exp) {
+			t.Errorf("expected expiry %v in context, got %v", exp, got)
+		}
+	})
+}
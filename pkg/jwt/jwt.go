@@ -3,11 +3,14 @@ package jwt
 import (
 	"context"
 	"errors"
-	"log"
+	"fmt"
+	"log/slog"
 	"net/http"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/RaghibA/iot-telemetry/pkg/logging"
 	"github.com/RaghibA/iot-telemetry/pkg/utils"
 	"github.com/golang-jwt/jwt/v5"
 )
@@ -16,6 +19,51 @@ type contextKey string
 
 const UserKey contextKey = "userId"
 
+// ExpiresKey holds the expiry time of the access token that authenticated a request.
+const ExpiresKey contextKey = "expires"
+
+var (
+	// ErrTokenExpired is returned by ValidateAccessToken for expired tokens.
+	ErrTokenExpired = errors.New("token expired")
+	// ErrInvalidToken is returned by ValidateAccessToken for badly signed or otherwise
+	// rejected tokens.
+	ErrInvalidToken = errors.New("invalid token")
+	// ErrMalformedToken is returned by ValidateAccessToken for tokens that cannot be parsed
+	// or miss the sub or exp claims. It wraps ErrInvalidToken.
+	ErrMalformedToken = fmt.Errorf("malformed %w", ErrInvalidToken)
+)
+
+var (
+	secretMu      sync.RWMutex
+	signingSecret string
+)
+
+// SetSecret sets the secret used to sign and verify tokens.
+// Services call it at startup with the configured secret; until then the
+// JWT_SECRET environment variable is used.
+// Params:
+// - s: string - the signing secret
+// Returns: None
+func SetSecret(s string) {
+	secretMu.Lock()
+	defer secretMu.Unlock()
+	signingSecret = s
+}
+
+// getSecret returns the configured signing secret, falling back to JWT_SECRET.
+// Params: None
+// Returns:
+// - string: the signing secret
+// - error: error if no secret is configured
+func getSecret() (string, error) {
+	secretMu.RLock()
+	defer secretMu.RUnlock()
+	if signingSecret != "" {
+		return signingSecret, nil
+	}
+	return utils.GetEnv("JWT_SECRET", "")
+}
+
 // GenerateCookie generates a JWT token string for a given user ID and expiration time.
 // Params:
 // - userId: string - the ID of the user
@@ -24,7 +72,7 @@ const UserKey contextKey = "userId"
 // - string: the generated JWT token string
 // - error: error if any occurred during token generation
 func GenerateCookie(userId string, exp time.Time) (string, error) {
-	jwtSecret, err := utils.GetEnv("JWT_SECRET", "")
+	jwtSecret, err := getSecret()
 	if err != nil {
 		return "", err
 	}
@@ -57,7 +105,7 @@ func GenerateCookie(userId string, exp time.Time) (string, error) {
 // - string: the generated JWT access token string
 // - error: error if any occurred during token generation
 func GenerateAccessToken(userId string, exp time.Time) (string, error) {
-	jwtSecret, err := utils.GetEnv("JWT_SECRET", "")
+	jwtSecret, err := getSecret()
 	if err != nil {
 		return "", err
 	}
@@ -92,15 +140,15 @@ func AuthWithCookie(handlerFunc http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		cookie, err := r.Cookie("refresh_token")
 		if err != nil {
-			log.Println(err)
+			slog.WarnContext(r.Context(), "no refresh token cookie", "err", err)
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
 			return
 		}
 		tokenString := cookie.Value
 
-		secret, err := utils.GetEnv("JWT_SECRET", "")
+		secret, err := getSecret()
 		if err != nil {
-			log.Println(err)
+			slog.ErrorContext(r.Context(), "jwt secret not configured", "err", err)
 			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 			return
 		}
@@ -114,15 +162,15 @@ func AuthWithCookie(handlerFunc http.HandlerFunc) http.HandlerFunc {
 		})
 		if err != nil {
 			if err == jwt.ErrTokenExpired {
-				log.Println(err)
+				slog.WarnContext(r.Context(), "token expired", "err", err)
 				http.Error(w, "Token expired, log in to account.", http.StatusUnauthorized)
 				return
 			} else if !token.Valid {
-				log.Println(err)
+				slog.WarnContext(r.Context(), "invalid token", "err", err)
 				http.Error(w, "Invalid Token", http.StatusUnauthorized)
 				return
 			} else {
-				log.Println(err)
+				slog.WarnContext(r.Context(), "token error", "err", err)
 				http.Error(w, "Token error", http.StatusBadRequest)
 				return
 			}
@@ -132,22 +180,26 @@ func AuthWithCookie(handlerFunc http.HandlerFunc) http.HandlerFunc {
 		if ok {
 			expTime := time.Unix(int64(exp), 0)
 			if expTime.Before(time.Now()) {
-				log.Println("Token Expired")
+				slog.WarnContext(r.Context(), "token expired")
 				http.Error(w, "Cookie Expired", http.StatusUnauthorized)
 				return
 			}
 		} else {
-			log.Println("no exp claim")
+			slog.WarnContext(r.Context(), "no exp claim")
 			http.Error(w, "Invalid cookie", http.StatusBadRequest)
 			return
 		}
 		userId, ok := claims["sub"]
 		if !ok {
-			log.Println("No user id in claims")
+			slog.WarnContext(r.Context(), "no user id in claims")
 			http.Error(w, "Missing Claims", http.StatusBadRequest)
 			return
 		}
 
+		if id, ok := userId.(string); ok {
+			logging.SetUserID(r.Context(), id)
+		}
+
 		ctx := r.Context()
 		ctx = context.WithValue(ctx, UserKey, userId)
 		r = r.WithContext(ctx)
@@ -164,82 +216,98 @@ func AuthWithCookie(handlerFunc http.HandlerFunc) http.HandlerFunc {
 // - http.HandlerFunc: the wrapped HTTP handler function
 func AuthWithAccessToken(handlerFunc http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		var tokenString string
 		authToken := r.Header.Get("Authorization")
 		if authToken == "" {
-			log.Println("No access token provided")
+			slog.WarnContext(r.Context(), "no access token provided")
 			http.Error(w, "Provide bearer token in Authorization header", http.StatusUnauthorized)
 			return
 		}
-		const prefix = "Bearer "
-		if strings.HasPrefix(authToken, prefix) {
-			tokenString = strings.TrimPrefix(authToken, prefix)
-		} else {
+		tokenString, ok := BearerToken(authToken)
+		if !ok {
+			slog.WarnContext(r.Context(), "authorization header is not a bearer token")
 			http.Error(w, "Invalid access token", http.StatusUnauthorized)
-		}
-
-		// validate token from header
-		secret, err := utils.GetEnv("JWT_SECRET", "")
-		if err != nil {
-			log.Println(err)
-			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 			return
 		}
 
-		claims := jwt.MapClaims{}
-		token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
-			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, errors.New("unexpected signing method")
-			}
-			return []byte(secret), nil
-		})
-
-		if token == nil {
-			log.Fatal("Token is nil")
-			http.Error(w, "No access token provided", http.StatusBadRequest)
+		userId, expires, err := ValidateAccessToken(tokenString)
+		switch {
+		case errors.Is(err, ErrTokenExpired):
+			slog.WarnContext(r.Context(), "token expired", "err", err)
+			http.Error(w, "Token expired, log in to account.", http.StatusUnauthorized)
 			return
-		}
-
-		if err != nil {
-			if err == jwt.ErrTokenExpired {
-				log.Println(err)
-				http.Error(w, "Token expired, log in to account.", http.StatusUnauthorized)
-				return
-			} else if !token.Valid {
-				log.Println(err)
-				http.Error(w, "Invalid Token", http.StatusUnauthorized)
-				return
-			} else {
-				log.Println(err)
-				http.Error(w, "Token error", http.StatusBadRequest)
-				return
-			}
-		}
-
-		exp, ok := claims["exp"].(float64)
-		if ok {
-			expTime := time.Unix(int64(exp), 0)
-			if expTime.Before(time.Now()) {
-				log.Println("Token Expired")
-				http.Error(w, "Cookie Expired", http.StatusUnauthorized)
-				return
-			}
-		} else {
-			log.Println("no exp claim")
-			http.Error(w, "Invalid cookie", http.StatusBadRequest)
+		case errors.Is(err, ErrMalformedToken):
+			slog.WarnContext(r.Context(), "malformed token", "err", err)
+			http.Error(w, "Malformed access token", http.StatusBadRequest)
 			return
-		}
-		userId, ok := claims["sub"]
-		if !ok {
-			log.Println("No user id in claims")
-			http.Error(w, "Missing Claims", http.StatusBadRequest)
+		case errors.Is(err, ErrInvalidToken):
+			slog.WarnContext(r.Context(), "invalid token", "err", err)
+			http.Error(w, "Invalid Token", http.StatusUnauthorized)
+			return
+		case err != nil:
+			slog.ErrorContext(r.Context(), "jwt secret not configured", "err", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 			return
 		}
 
+		logging.SetUserID(r.Context(), userId)
+
 		ctx := r.Context()
 		ctx = context.WithValue(ctx, UserKey, userId)
+		ctx = context.WithValue(ctx, ExpiresKey, expires)
 		r = r.WithContext(ctx)
 
 		handlerFunc(w, r)
 	}
 }
+
+// BearerToken returns the token of a "Bearer <token>" Authorization value.
+// Params:
+// - authorization: string - the Authorization header or metadata value
+// Returns:
+// - string: the token
+// - bool: false if the value is not a bearer token
+func BearerToken(authorization string) (string, bool) {
+	return strings.CutPrefix(authorization, "Bearer ")
+}
+
+// ValidateAccessToken checks an access token. It is shared by the HTTP middleware, the gRPC
+// interceptors and websockets, which map its errors to their own statuses.
+// Params:
+// - tokenString: string - the signed access token
+// Returns:
+// - string: the user ID in the sub claim
+// - time.Time: the expiry time of the token
+// - error: ErrTokenExpired, ErrMalformedToken, ErrInvalidToken or an error if no secret is
+// configured
+func ValidateAccessToken(tokenString string) (string, time.Time, error) {
+	secret, err := getSecret()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	claims := jwt.MapClaims{}
+	_, err = jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, errors.New("unexpected signing method")
+		}
+		return []byte(secret), nil
+	})
+	switch {
+	case errors.Is(err, jwt.ErrTokenExpired):
+		return "", time.Time{}, ErrTokenExpired
+	case errors.Is(err, jwt.ErrTokenMalformed):
+		return "", time.Time{}, fmt.Errorf("%w: %w", ErrMalformedToken, err)
+	case err != nil:
+		return "", time.Time{}, fmt.Errorf("%w: %w", ErrInvalidToken, err)
+	}
+
+	exp, err := claims.GetExpirationTime()
+	if err != nil || exp == nil {
+		return "", time.Time{}, fmt.Errorf("%w: no exp claim", ErrMalformedToken)
+	}
+	userId, _ := claims["sub"].(string)
+	if userId == "" {
+		return "", time.Time{}, fmt.Errorf("%w: no sub claim", ErrMalformedToken)
+	}
+	return userId, exp.Time, nil
+}
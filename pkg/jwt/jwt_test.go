@@ -246,4 +246,98 @@ func TestAccessTokenMiddleware(t *testing.T) {
 			t.Errorf("expected status code %v, got %v", http.StatusOK, rr.Code)
 		}
 	})
+
+	t.Run("should map rejected tokens to their status", func(t *testing.T) {
+		otherSecret, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"sub": "1234", "exp": time.Now().Add(time.Hour).Unix()}).SignedString([]byte("otherSecret"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		secret, err := getSecret()
+		if err != nil {
+			t.Fatal(err)
+		}
+		noSub, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"exp": time.Now().Add(time.Hour).Unix()}).SignedString([]byte(secret))
+		if err != nil {
+			t.Fatal(err)
+		}
+		expired, err := GenerateAccessToken("1234", time.Now().Add(-time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for token, want := range map[string]int{
+			"not.a.token": http.StatusBadRequest,
+			noSub:         http.StatusBadRequest,
+			otherSecret:   http.StatusUnauthorized,
+			expired:       http.StatusUnauthorized,
+		} {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Add("Authorization", "Bearer "+token)
+			rr := httptest.NewRecorder()
+			AuthWithAccessToken(mockHandler)(rr, req)
+
+			if rr.Code != want {
+				t.Errorf("expected status code %v for %s, got %v", want, token, rr.Code)
+			}
+		}
+	})
+}
+
+func TestValidateAccessToken(t *testing.T) {
+
+	t.Run("should return the user id and expiry of a valid token", func(t *testing.T) {
+		exp := time.Now().Add(time.Hour).Truncate(time.Second)
+		tokenString, err := GenerateAccessToken("1234", exp)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		userId, gotExp, err := ValidateAccessToken(tokenString)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if userId != "1234" || !gotExp.Equal(exp) {
+			t.Errorf("expected 1234 expiring at %v, got %s expiring at %v", exp, userId, gotExp)
+		}
+	})
+
+	t.Run("should reject expired tokens", func(t *testing.T) {
+		tokenString, err := GenerateAccessToken("1234", time.Now().Add(-time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, _, err := ValidateAccessToken(tokenString); !errors.Is(err, ErrTokenExpired) {
+			t.Errorf("expected ErrTokenExpired, got %v", err)
+		}
+	})
+
+	t.Run("should reject tokens signed with another secret", func(t *testing.T) {
+		token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"sub": "1234", "exp": time.Now().Add(time.Hour).Unix()})
+		tokenString, err := token.SignedString([]byte("otherSecret"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, _, err := ValidateAccessToken(tokenString); !errors.Is(err, ErrInvalidToken) || errors.Is(err, ErrMalformedToken) {
+			t.Errorf("expected ErrInvalidToken, got %v", err)
+		}
+	})
+
+	t.Run("should reject malformed tokens and tokens missing claims", func(t *testing.T) {
+		secret, err := getSecret()
+		if err != nil {
+			t.Fatal(err)
+		}
+		noExp, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"sub": "1234"}).SignedString([]byte(secret))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, tokenString := range []string{"not.a.token", noExp} {
+			if _, _, err := ValidateAccessToken(tokenString); !errors.Is(err, ErrMalformedToken) {
+				t.Errorf("expected ErrMalformedToken for %s, got %v", tokenString, err)
+			}
+		}
+	})
 }
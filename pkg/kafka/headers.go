@@ -0,0 +1,29 @@
+package kafka
+
+import (
+	"github.com/IBM/sarama"
+)
+
+// recordHeaders converts broker message headers to Kafka record headers.
+func recordHeaders(headers map[string]string) []sarama.RecordHeader {
+	if len(headers) == 0 {
+		return nil
+	}
+	records := make([]sarama.RecordHeader, 0, len(headers))
+	for k, v := range headers {
+		records = append(records, sarama.RecordHeader{Key: []byte(k), Value: []byte(v)})
+	}
+	return records
+}
+
+// headerMap converts consumed Kafka record headers to broker message headers.
+// If a key repeats, the last value wins.
+func headerMap(records []*sarama.RecordHeader) map[string]string {
+	headers := make(map[string]string, len(records))
+	for _, h := range records {
+		if h != nil {
+			headers[string(h.Key)] = string(h.Value)
+		}
+	}
+	return headers
+}
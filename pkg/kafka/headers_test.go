@@ -0,0 +1,57 @@
+package kafka
+
+import (
+	"context"
+	"testing"
+
+	"github.com/IBM/sarama"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestHeaders(t *testing.T) {
+
+	t.Run("should carry trace context from producer to consumer headers", func(t *testing.T) {
+		tp := sdktrace.NewTracerProvider()
+		propagator := propagation.TraceContext{}
+
+		ctx, span := tp.Tracer("test").Start(context.Background(), "publish")
+		defer span.End()
+
+		headers := map[string]string{}
+		propagator.Inject(ctx, propagation.MapCarrier(headers))
+
+		produced := recordHeaders(headers)
+		if len(produced) == 0 {
+			t.Fatal("expected trace headers on producer message")
+		}
+
+		consumed := &sarama.ConsumerMessage{Topic: "topic.test"}
+		for i := range produced {
+			consumed.Headers = append(consumed.Headers, &produced[i])
+		}
+
+		extracted := trace.SpanContextFromContext(
+			propagator.Extract(context.Background(), propagation.MapCarrier(headerMap(consumed.Headers))),
+		)
+		if extracted.TraceID() != span.SpanContext().TraceID() {
+			t.Errorf("expected trace id %s, got %s", span.SpanContext().TraceID(), extracted.TraceID())
+		}
+		if extracted.SpanID() != span.SpanContext().SpanID() {
+			t.Errorf("expected span id %s, got %s", span.SpanContext().SpanID(), extracted.SpanID())
+		}
+	})
+
+	t.Run("should keep the last value of a repeated header", func(t *testing.T) {
+		headers := headerMap([]*sarama.RecordHeader{
+			{Key: []byte("traceparent"), Value: []byte("a")},
+			nil,
+			{Key: []byte("traceparent"), Value: []byte("b")},
+		})
+
+		if len(headers) != 1 || headers["traceparent"] != "b" {
+			t.Errorf("expected a single replaced header, got %v", headers)
+		}
+	})
+}
@@ -1,155 +1,335 @@
 package kafka
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
-	"log"
-	"os"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/IBM/sarama"
-	"github.com/gorilla/websocket"
+	"github.com/RaghibA/iot-telemetry/pkg/broker"
+	"github.com/RaghibA/iot-telemetry/pkg/config"
 )
 
-// KafkaClient defines the interface for Kafka operations.
-type KafkaClient interface {
-	GenerateTopicName(deviceName string, deviceId string) string
-	CreateTopic(topicName string) error
-	DeleteTopic(topicName string) error
-	SendTelemetry(payload json.RawMessage, topic string, deviceID string) error
-	ConsumeFromTopic(topic string, deviceID string, conn *websocket.Conn)
+// partition is the only partition read and written. Device topics are created with a
+// single partition so messages for a device stay ordered.
+const partition int32 = 0
+
+// KafkaService is a Kafka backed broker.Broker. Each stream is a topic.
+type KafkaService struct {
+	brokers           []string
+	replicationFactor int16
+	compression       sarama.CompressionCodec
+	compressionLevel  int
+
+	mu       sync.Mutex
+	producer sarama.SyncProducer
+}
+
+// NewKafkaService creates a Kafka client for the configured brokers.
+// Params:
+// - cfg: config.KafkaConfig - the Kafka configuration
+// Returns:
+// - *KafkaService: a pointer to the created KafkaService
+func NewKafkaService(cfg config.KafkaConfig) *KafkaService {
+	// the codec was validated with the config, unset means none
+	var compression sarama.CompressionCodec
+	_ = compression.UnmarshalText([]byte(cfg.Compression))
+	level := cfg.CompressionLevel
+	if level == 0 {
+		level = sarama.CompressionLevelDefault
+	}
+	return &KafkaService{
+		brokers:           cfg.BrokerAddrs(),
+		replicationFactor: int16(cfg.ReplicationFactor),
+		compression:       compression,
+		compressionLevel:  level,
+	}
 }
 
-type KafkaService struct{}
+// newConfig returns the sarama configuration shared by every client.
+func newConfig() *sarama.Config {
+	cfg := sarama.NewConfig()
+	cfg.Version = sarama.V3_0_0_0
+	return cfg
+}
 
-// GenerateTopicName generates a topic name based on the device name and device ID.
+// newProducerConfig returns the configuration of the shared producer. The producer is
+// idempotent, so the retries it makes after a lost acknowledgement are not written twice.
+// Batches are compressed with codec, which brokers store as they are unless the topic
+// sets its own compression.
+func newProducerConfig(codec sarama.CompressionCodec, level int) *sarama.Config {
+	cfg := newConfig()
+	cfg.Producer.Compression = codec
+	cfg.Producer.CompressionLevel = level
+	cfg.Producer.RequiredAcks = sarama.WaitForAll
+	cfg.Producer.Retry.Max = 3
+	cfg.Producer.Return.Successes = true
+	cfg.Producer.Idempotent = true
+	// idempotence needs requests to a broker to be sent one at a time to keep their order
+	cfg.Net.MaxOpenRequests = 1
+	// messages are sent to the single device partition
+	cfg.Producer.Partitioner = sarama.NewManualPartitioner
+	return cfg
+}
+
+// StreamName generates a topic name based on the device name and device ID.
 // Params:
 // - deviceName: string - the name of the device
-// - deviceId: string - the ID of the device
+// - deviceID: string - the ID of the device
 // Returns:
 // - string: the generated topic name
-func (k *KafkaService) GenerateTopicName(deviceName string, deviceId string) string {
-	return fmt.Sprintf("topic.%s.%s.read", strings.ReplaceAll(deviceName, " ", "-"), deviceId)
+func (k *KafkaService) StreamName(deviceName string, deviceID string) string {
+	return fmt.Sprintf("topic.%s.%s.read", strings.ReplaceAll(deviceName, " ", "-"), deviceID)
 }
 
-// CreateTopic creates a new topic in Kafka.
+// CreateStream creates a new single partition topic in Kafka.
 // Params:
+// - ctx: context.Context - unused, sarama admin requests are bounded by the client timeouts
 // - topicName: string - the name of the topic to create
 // Returns:
-// - error: error if any occurred during the topic creation
-func (k *KafkaService) CreateTopic(topicName string) error {
-	broker := []string{fmt.Sprintf("%s:%s", os.Getenv("KAFKA_HOST"), os.Getenv("KAFKA_PORT"))}
-
-	config := sarama.NewConfig()
-	config.Version = sarama.V3_0_0_0
-
-	admin, err := sarama.NewClusterAdmin(broker, config)
+// - error: broker.ErrStreamExists if the topic exists, or the Kafka error
+func (k *KafkaService) CreateStream(ctx context.Context, topicName string) error {
+	admin, err := sarama.NewClusterAdmin(k.brokers, newConfig())
 	if err != nil {
-		log.Println("error creating client:", err)
 		return err
 	}
-
 	defer func() { _ = admin.Close() }()
+
 	err = admin.CreateTopic(topicName, &sarama.TopicDetail{
 		NumPartitions:     1,
-		ReplicationFactor: 1,
+		ReplicationFactor: k.replicationFactor,
 	}, false)
-	if err != nil {
-		log.Println(err)
-		return err
+	if errors.Is(err, sarama.ErrTopicAlreadyExists) {
+		return broker.ErrStreamExists
 	}
-
-	return nil
+	return err
 }
 
-// DeleteTopic deletes a topic in Kafka.
+// DeleteStream deletes a topic in Kafka.
 // Params:
+// - ctx: context.Context - unused, sarama admin requests are bounded by the client timeouts
 // - topicName: string - the name of the topic to delete
 // Returns:
-// - error: error if any occurred during the topic deletion
-func (k *KafkaService) DeleteTopic(topicName string) error {
-	broker := []string{fmt.Sprintf("%s:%s", os.Getenv("KAFKA_HOST"), os.Getenv("KAFKA_PORT"))}
-
-	config := sarama.NewConfig()
-	config.Version = sarama.V3_0_0_0
-
-	admin, err := sarama.NewClusterAdmin(broker, config)
+// - error: broker.ErrStreamNotFound if the topic does not exist, or the Kafka error
+func (k *KafkaService) DeleteStream(ctx context.Context, topicName string) error {
+	admin, err := sarama.NewClusterAdmin(k.brokers, newConfig())
 	if err != nil {
-		log.Println(err)
 		return err
 	}
-
 	defer func() { _ = admin.Close() }()
+
 	err = admin.DeleteTopic(topicName)
-	if err != nil {
-		log.Println(err)
-		return err
+	if errors.Is(err, sarama.ErrUnknownTopicOrPartition) {
+		return broker.ErrStreamNotFound
 	}
-
-	return nil
+	return err
 }
 
-func (k *KafkaService) SendTelemetry(payload json.RawMessage, topic string, deviceID string) error {
-	broker := []string{fmt.Sprintf("%s:%s", os.Getenv("KAFKA_HOST"), os.Getenv("KAFKA_PORT"))}
+// Publish sends a message to a topic and waits for all in-sync replicas to acknowledge it.
+// Params:
+// - ctx: context.Context - unused, the producer is bounded by the client timeouts
+// - topicName: string - the topic to publish to
+// - msg: broker.Message - the message to publish
+// Returns:
+// - uint64: the offset assigned to the message
+// - error: broker.ErrStreamNotFound if the topic does not exist, or the Kafka error
+func (k *KafkaService) Publish(ctx context.Context, topicName string, msg broker.Message) (uint64, error) {
+	producer, err := k.syncProducer()
+	if err != nil {
+		return 0, err
+	}
 
-	config := sarama.NewConfig()
-	config.Version = sarama.V3_0_0_0
-	config.Producer.RequiredAcks = sarama.WaitForAll
-	config.Producer.Retry.Max = 3
-	config.Producer.Return.Successes = true
+	producerMsg := &sarama.ProducerMessage{
+		Topic:     topicName,
+		Partition: partition,
+		Value:     sarama.ByteEncoder(msg.Value),
+		Headers:   recordHeaders(msg.Headers),
+		Timestamp: msg.Timestamp,
+	}
+	if msg.Key != "" {
+		producerMsg.Key = sarama.StringEncoder(msg.Key)
+	}
 
-	producer, err := sarama.NewSyncProducer(broker, config)
+	_, offset, err := producer.SendMessage(producerMsg)
+	if errors.Is(err, sarama.ErrUnknownTopicOrPartition) {
+		return 0, broker.ErrStreamNotFound
+	}
 	if err != nil {
-		log.Println("failed to create producer", err)
-		return err
+		return 0, err
 	}
 
-	defer producer.Close()
+	return uint64(offset), nil
+}
+
+// syncProducer returns the shared producer, creating it on first use.
+func (k *KafkaService) syncProducer() (sarama.SyncProducer, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
 
-	msg := sarama.ProducerMessage{
-		Topic: topic,
-		Key:   sarama.StringEncoder(deviceID),
-		Value: sarama.ByteEncoder(payload),
+	if k.producer != nil {
+		return k.producer, nil
 	}
 
-	partition, offset, err := producer.SendMessage(&msg)
+	producer, err := sarama.NewSyncProducer(k.brokers, newProducerConfig(k.compression, k.compressionLevel))
 	if err != nil {
-		log.Println(err)
-		return err
+		return nil, err
 	}
-
-	log.Printf("Message Sent to producer %d offset %d", partition, offset)
-
-	return nil
+	k.producer = producer
+	return producer, nil
 }
 
-func (k *KafkaService) ConsumeFromTopic(topic string, deviceID string, conn *websocket.Conn) {
-	broker := fmt.Sprintf("%s:%s", os.Getenv("KAFKA_HOST"), os.Getenv("KAFKA_PORT"))
-	consumer, err := sarama.NewConsumer([]string{broker}, nil)
+// Subscribe consumes a topic's partition from the requested position.
+// Params:
+// - ctx: context.Context - unused, sarama requests are bounded by the client timeouts
+// - topicName: string - the topic to consume from
+// - opts: broker.SubscribeOptions - where the subscription starts
+// Returns:
+// - broker.Subscription: the subscription
+// - error: broker.ErrStreamNotFound if the topic does not exist, or the Kafka error
+func (k *KafkaService) Subscribe(ctx context.Context, topicName string, opts broker.SubscribeOptions) (broker.Subscription, error) {
+	client, err := sarama.NewClient(k.brokers, newConfig())
 	if err != nil {
-		log.Println("error creating kafka consumer", err)
-		return
+		return nil, err
 	}
-	defer consumer.Close()
 
-	partitions, err := consumer.Partitions(topic)
+	sub, err := subscribe(client, topicName, opts)
 	if err != nil {
-		log.Println("error getting partitions", err)
-		return
+		_ = client.Close()
+		if errors.Is(err, sarama.ErrUnknownTopicOrPartition) {
+			return nil, broker.ErrStreamNotFound
+		}
+		return nil, err
 	}
+	return sub, nil
+}
 
-	pConsumer, err := consumer.ConsumePartition(topic, partitions[0], sarama.OffsetNewest)
+func subscribe(client sarama.Client, topicName string, opts broker.SubscribeOptions) (*subscription, error) {
+	var offset int64
+	switch opts.Start {
+	case broker.StartOldest:
+		offset = sarama.OffsetOldest
+	case broker.StartAtOffset:
+		oldest, err := client.GetOffset(topicName, partition, sarama.OffsetOldest)
+		if err != nil {
+			return nil, err
+		}
+		newest, err := client.GetOffset(topicName, partition, sarama.OffsetNewest)
+		if err != nil {
+			return nil, err
+		}
+		offset = min(max(int64(opts.Offset), oldest), newest)
+	default:
+		offset = sarama.OffsetNewest
+	}
+
+	consumer, err := sarama.NewConsumerFromClient(client)
+	if err != nil {
+		return nil, err
+	}
+	pc, err := consumer.ConsumePartition(topicName, partition, offset)
 	if err != nil {
-		log.Println("failed to consume messages", err)
-		return
+		_ = consumer.Close()
+		return nil, err
+	}
+
+	return &subscription{client: client, consumer: consumer, pc: pc, done: make(chan struct{})}, nil
+}
+
+// Ping checks that the cluster is reachable by fetching broker metadata.
+// Params:
+// - ctx: context.Context - bounds the dial and metadata request
+// Returns:
+// - error: error if no broker answered before ctx was done
+func (k *KafkaService) Ping(ctx context.Context) error {
+	cfg := newConfig()
+	cfg.Metadata.Retry.Max = 0
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout := time.Until(deadline)
+		cfg.Net.DialTimeout = timeout
+		cfg.Net.ReadTimeout = timeout
+		cfg.Net.WriteTimeout = timeout
 	}
-	defer pConsumer.Close()
 
-	for message := range pConsumer.Messages() {
-		err := conn.WriteMessage(websocket.TextMessage, message.Value)
+	errCh := make(chan error, 1)
+	go func() {
+		client, err := sarama.NewClient(k.brokers, cfg)
 		if err != nil {
-			log.Println("failed to write message to ws writer", err)
+			errCh <- err
 			return
 		}
+		defer client.Close()
+
+		if len(client.Brokers()) == 0 {
+			errCh <- errors.New("no brokers in cluster metadata")
+			return
+		}
+		errCh <- nil
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close closes the shared producer.
+// Params: None
+// Returns:
+// - error: error if the producer failed to flush
+func (k *KafkaService) Close() error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if k.producer == nil {
+		return nil
 	}
+	err := k.producer.Close()
+	k.producer = nil
+	return err
+}
+
+type subscription struct {
+	client    sarama.Client
+	consumer  sarama.Consumer
+	pc        sarama.PartitionConsumer
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// Next returns the next message from the partition.
+func (sub *subscription) Next(ctx context.Context) (broker.Message, error) {
+	select {
+	case msg, ok := <-sub.pc.Messages():
+		if !ok {
+			return broker.Message{}, broker.ErrClosed
+		}
+		return broker.Message{
+			Stream:    msg.Topic,
+			Key:       string(msg.Key),
+			Value:     msg.Value,
+			Headers:   headerMap(msg.Headers),
+			Offset:    uint64(msg.Offset),
+			Partition: msg.Partition,
+			Timestamp: msg.Timestamp,
+		}, nil
+	case <-sub.done:
+		return broker.Message{}, broker.ErrClosed
+	case <-ctx.Done():
+		return broker.Message{}, ctx.Err()
+	}
+}
+
+// Close stops the partition consumer and closes its client. It is safe to call more than once.
+func (sub *subscription) Close() error {
+	var err error
+	sub.closeOnce.Do(func() {
+		close(sub.done)
+		err = errors.Join(sub.pc.Close(), sub.consumer.Close(), sub.client.Close())
+	})
+	return err
 }
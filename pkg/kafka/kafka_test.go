@@ -0,0 +1,64 @@
+package kafka
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/IBM/sarama"
+	"github.com/RaghibA/iot-telemetry/pkg/broker"
+	"github.com/RaghibA/iot-telemetry/pkg/broker/brokertest"
+	"github.com/RaghibA/iot-telemetry/pkg/config"
+)
+
+// TestConformance needs a running cluster, e.g. KAFKA_TEST_BROKERS=localhost:9092.
+func TestConformance(t *testing.T) {
+	brokers := os.Getenv("KAFKA_TEST_BROKERS")
+	if brokers == "" {
+		t.Skip("KAFKA_TEST_BROKERS not set")
+	}
+
+	brokertest.Run(t, func(t *testing.T) broker.Broker {
+		return NewKafkaService(config.KafkaConfig{
+			Brokers:           strings.Split(brokers, ","),
+			ReplicationFactor: 1,
+		})
+	})
+}
+
+func TestProducerConfig(t *testing.T) {
+	t.Run("should configure a valid idempotent producer", func(t *testing.T) {
+		cfg := newProducerConfig(sarama.CompressionNone, sarama.CompressionLevelDefault)
+		if !cfg.Producer.Idempotent {
+			t.Error("expected an idempotent producer")
+		}
+		if err := cfg.Validate(); err != nil {
+			t.Errorf("expected a valid config, got %v", err)
+		}
+	})
+
+	t.Run("should compress with the configured codec and level", func(t *testing.T) {
+		for _, tc := range []struct {
+			compression string
+			level       int
+			codec       sarama.CompressionCodec
+			wantLevel   int
+		}{
+			{"", 0, sarama.CompressionNone, sarama.CompressionLevelDefault},
+			{config.CompressionNone, 0, sarama.CompressionNone, sarama.CompressionLevelDefault},
+			{config.CompressionSnappy, 0, sarama.CompressionSnappy, sarama.CompressionLevelDefault},
+			{config.CompressionLZ4, 0, sarama.CompressionLZ4, sarama.CompressionLevelDefault},
+			{config.CompressionGzip, 9, sarama.CompressionGZIP, 9},
+			{config.CompressionZstd, 3, sarama.CompressionZSTD, 3},
+		} {
+			k := NewKafkaService(config.KafkaConfig{Brokers: []string{"kafka:9092"}, ReplicationFactor: 1, Compression: tc.compression, CompressionLevel: tc.level})
+			cfg := newProducerConfig(k.compression, k.compressionLevel)
+			if cfg.Producer.Compression != tc.codec || cfg.Producer.CompressionLevel != tc.wantLevel {
+				t.Errorf("%q level %d: expected %s level %d, got %s level %d", tc.compression, tc.level, tc.codec, tc.wantLevel, cfg.Producer.Compression, cfg.Producer.CompressionLevel)
+			}
+			if err := cfg.Validate(); err != nil {
+				t.Errorf("%q level %d: expected a valid config, got %v", tc.compression, tc.level, err)
+			}
+		}
+	})
+}
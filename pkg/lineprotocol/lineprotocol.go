@@ -0,0 +1,288 @@
+// Package lineprotocol parses the InfluxDB line protocol written by Telegraf and InfluxDB
+// clients: one point per line, with a measurement, tags, fields and an optional timestamp.
+package lineprotocol
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Point is a parsed line.
+type Point struct {
+	Measurement string            `json:"measurement"`
+	Tags        map[string]string `json:"tags,omitempty"`
+	// Fields hold float64, int64, uint64, string and bool values.
+	Fields map[string]any `json:"fields"`
+	// Time is the line's timestamp, nil if it has none.
+	Time *time.Time `json:"time,omitempty"`
+}
+
+// ParsePrecision returns the unit of timestamps for a precision query parameter, as
+// accepted by the InfluxDB 1.x and 2.x write APIs. An empty precision is nanoseconds.
+// Params:
+// - precision: string - the precision, e.g. ns, us, ms or s
+// Returns:
+// - time.Duration: the timestamp unit
+// - error: error if the precision is unknown
+func ParsePrecision(precision string) (time.Duration, error) {
+	switch precision {
+	case "", "n", "ns":
+		return time.Nanosecond, nil
+	case "u", "us", "µ", "µs":
+		return time.Microsecond, nil
+	case "ms":
+		return time.Millisecond, nil
+	case "s":
+		return time.Second, nil
+	case "m":
+		return time.Minute, nil
+	case "h":
+		return time.Hour, nil
+	}
+	return 0, fmt.Errorf("unknown precision %q, use ns, us, ms or s", precision)
+}
+
+// Parse parses the points of a write request. Blank lines and comments are skipped.
+// Params:
+// - data: []byte - the request body
+// - precision: time.Duration - the unit of the timestamps
+// Returns:
+// - []Point: the points, in order
+// - error: error naming the first malformed line
+func Parse(data []byte, precision time.Duration) ([]Point, error) {
+	p := &parser{data: string(data), line: 1, precision: precision}
+	var points []Point
+	for {
+		p.skipBlank()
+		if p.eof() {
+			break
+		}
+		point, err := p.point()
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", p.line, err)
+		}
+		points = append(points, point)
+	}
+	if len(points) == 0 {
+		return nil, errors.New("no points")
+	}
+	return points, nil
+}
+
+// parser reads points from data, pos being the next byte.
+type parser struct {
+	data      string
+	pos       int
+	line      int
+	precision time.Duration
+}
+
+func (p *parser) eof() bool {
+	return p.pos >= len(p.data)
+}
+
+func (p *parser) peek() byte {
+	if p.eof() {
+		return '\n'
+	}
+	return p.data[p.pos]
+}
+
+// skipBlank skips blank lines and comment lines.
+func (p *parser) skipBlank() {
+	for !p.eof() {
+		switch p.data[p.pos] {
+		case '\n':
+			p.line++
+			p.pos++
+		case ' ', '\t', '\r':
+			p.pos++
+		case '#':
+			for !p.eof() && p.data[p.pos] != '\n' {
+				p.pos++
+			}
+		default:
+			return
+		}
+	}
+}
+
+// point reads a line, leaving pos at its end.
+func (p *parser) point() (Point, error) {
+	measurement, err := p.token(", \n", ", ", "measurement")
+	if err != nil {
+		return Point{}, err
+	}
+	point := Point{Measurement: measurement, Fields: map[string]any{}}
+
+	for p.peek() == ',' {
+		p.pos++
+		key, err := p.token("= ,\n", ",= ", "tag key")
+		if err != nil {
+			return Point{}, err
+		}
+		if p.peek() != '=' {
+			return Point{}, fmt.Errorf("tag %q has no value", key)
+		}
+		p.pos++
+		value, err := p.token(", \n", ",= ", "tag value")
+		if err != nil {
+			return Point{}, err
+		}
+		if point.Tags == nil {
+			point.Tags = map[string]string{}
+		}
+		point.Tags[key] = value
+	}
+
+	if p.peek() != ' ' {
+		return Point{}, errors.New("missing fields")
+	}
+	p.skipSpaces()
+	for {
+		key, err := p.token("= ,\n", ",= ", "field key")
+		if err != nil {
+			return Point{}, err
+		}
+		if p.peek() != '=' {
+			return Point{}, fmt.Errorf("field %q has no value", key)
+		}
+		p.pos++
+		value, err := p.fieldValue()
+		if err != nil {
+			return Point{}, fmt.Errorf("field %q: %w", key, err)
+		}
+		point.Fields[key] = value
+		if p.peek() != ',' {
+			break
+		}
+		p.pos++
+	}
+
+	p.skipSpaces()
+	if c := p.peek(); c != '\n' && c != '\r' {
+		start := p.pos
+		for !p.eof() && p.data[p.pos] != '\n' && p.data[p.pos] != ' ' && p.data[p.pos] != '\r' {
+			p.pos++
+		}
+		t, err := p.timestamp(p.data[start:p.pos])
+		if err != nil {
+			return Point{}, err
+		}
+		point.Time = &t
+		p.skipSpaces()
+	}
+	if p.peek() == '\r' {
+		p.pos++
+	}
+	if p.peek() != '\n' {
+		return Point{}, errors.New("unexpected data after the timestamp")
+	}
+	return point, nil
+}
+
+func (p *parser) skipSpaces() {
+	for p.peek() == ' ' {
+		p.pos++
+	}
+}
+
+// token reads a measurement, tag key or value or field key up to an unescaped stop byte.
+// A backslash escapes the bytes in escapable and is kept before any other byte.
+func (p *parser) token(stop string, escapable string, what string) (string, error) {
+	var b strings.Builder
+	for !p.eof() {
+		c := p.data[p.pos]
+		if c == '\\' && p.pos+1 < len(p.data) && strings.IndexByte(escapable, p.data[p.pos+1]) >= 0 {
+			b.WriteByte(p.data[p.pos+1])
+			p.pos += 2
+			continue
+		}
+		if strings.IndexByte(stop, c) >= 0 {
+			break
+		}
+		b.WriteByte(c)
+		p.pos++
+	}
+	if b.Len() == 0 {
+		return "", fmt.Errorf("missing %s", what)
+	}
+	return b.String(), nil
+}
+
+// fieldValue reads a quoted string, an integer with an i suffix, an unsigned integer with
+// a u suffix, a boolean or a float.
+func (p *parser) fieldValue() (any, error) {
+	if p.peek() == '"' {
+		p.pos++
+		var b strings.Builder
+		for !p.eof() {
+			c := p.data[p.pos]
+			switch {
+			case c == '\\' && p.pos+1 < len(p.data) && (p.data[p.pos+1] == '"' || p.data[p.pos+1] == '\\'):
+				b.WriteByte(p.data[p.pos+1])
+				p.pos += 2
+			case c == '"':
+				p.pos++
+				return b.String(), nil
+			default:
+				if c == '\n' {
+					p.line++
+				}
+				b.WriteByte(c)
+				p.pos++
+			}
+		}
+		return nil, errors.New("unterminated string")
+	}
+
+	start := p.pos
+	for !p.eof() && strings.IndexByte(", \n\r", p.data[p.pos]) < 0 {
+		p.pos++
+	}
+	raw := p.data[start:p.pos]
+	switch raw {
+	case "":
+		return nil, errors.New("missing value")
+	case "t", "T", "true", "True", "TRUE":
+		return true, nil
+	case "f", "F", "false", "False", "FALSE":
+		return false, nil
+	}
+	switch raw[len(raw)-1] {
+	case 'i':
+		v, err := strconv.ParseInt(raw[:len(raw)-1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid integer %q", raw)
+		}
+		return v, nil
+	case 'u':
+		v, err := strconv.ParseUint(raw[:len(raw)-1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid unsigned integer %q", raw)
+		}
+		return v, nil
+	}
+	v, err := strconv.ParseFloat(raw, 64)
+	if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+		return nil, fmt.Errorf("invalid number %q", raw)
+	}
+	return v, nil
+}
+
+// timestamp converts a timestamp in units of the precision to a time.
+func (p *parser) timestamp(raw string) (time.Time, error) {
+	v, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid timestamp %q", raw)
+	}
+	unit := int64(p.precision)
+	if v > math.MaxInt64/unit || v < math.MinInt64/unit {
+		return time.Time{}, fmt.Errorf("timestamp %q is out of range", raw)
+	}
+	return time.Unix(0, v*unit).UTC(), nil
+}
@@ -0,0 +1,162 @@
+package lineprotocol
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func at(ns int64) *time.Time {
+	t := time.Unix(0, ns).UTC()
+	return &t
+}
+
+func TestParse(t *testing.T) {
+	t.Run("should parse measurements, tags, fields and timestamps", func(t *testing.T) {
+		data := "# telegraf\n" +
+			"cpu,host=gw-1,region=eu-west usage_idle=98.5,cores=4i,uptime=3600u,online=true,state=\"ok\" 1772366400000000000\n" +
+			"\n" +
+			"mem free=1024i\r\n" +
+			"disk,path=/var used_percent=71.25,ro=F   1772366401000000000  \n"
+		got, err := Parse([]byte(data), time.Nanosecond)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := []Point{
+			{
+				Measurement: "cpu",
+				Tags:        map[string]string{"host": "gw-1", "region": "eu-west"},
+				Fields:      map[string]any{"usage_idle": 98.5, "cores": int64(4), "uptime": uint64(3600), "online": true, "state": "ok"},
+				Time:        at(1772366400000000000),
+			},
+			{Measurement: "mem", Fields: map[string]any{"free": int64(1024)}},
+			{
+				Measurement: "disk",
+				Tags:        map[string]string{"path": "/var"},
+				Fields:      map[string]any{"used_percent": 71.25, "ro": false},
+				Time:        at(1772366401000000000),
+			},
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("expected\n%+v\ngot\n%+v", want, got)
+		}
+	})
+
+	t.Run("should unescape names, tags and strings", func(t *testing.T) {
+		data := `my\ weather\,station,loc\=ation=San\ Jose\,\ CA,a=b=c temp\ C=21.5,note="say \"hi\" C:\\temp\n",path="C:\dir"`
+		got, err := Parse([]byte(data), time.Nanosecond)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := Point{
+			Measurement: "my weather,station",
+			Tags:        map[string]string{"loc=ation": "San Jose, CA", "a": "b=c"},
+			Fields:      map[string]any{"temp C": 21.5, "note": `say "hi" C:\temp\n`, "path": `C:\dir`},
+		}
+		if len(got) != 1 || !reflect.DeepEqual(got[0], want) {
+			t.Errorf("expected %+v, got %+v", want, got)
+		}
+	})
+
+	t.Run("should apply the precision", func(t *testing.T) {
+		for _, tc := range []struct {
+			precision string
+			timestamp string
+		}{{"", "1772366400000000000"}, {"ns", "1772366400000000000"}, {"u", "1772366400000000"}, {"ms", "1772366400000"}, {"s", "1772366400"}, {"h", "492324"}} {
+			unit, err := ParsePrecision(tc.precision)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := Parse([]byte("cpu usage=1 "+tc.timestamp), unit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := time.Unix(1772366400, 0); !got[0].Time.Equal(want) {
+				t.Errorf("precision %q: expected %s, got %s", tc.precision, want, got[0].Time)
+			}
+		}
+
+		if _, err := ParsePrecision("d"); err == nil {
+			t.Error("expected an error for an unknown precision")
+		}
+	})
+
+	t.Run("should encode points as JSON events", func(t *testing.T) {
+		got, err := Parse([]byte("cpu,host=a usage=0.5,cores=4i,big=18446744073709551615u,state=\"ok\" 1772366400000000000"), time.Nanosecond)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := json.Marshal(got[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := `{"measurement":"cpu","tags":{"host":"a"},"fields":{"big":18446744073709551615,"cores":4,"state":"ok","usage":0.5},"time":"2026-03-01T12:00:00Z"}`
+		if string(data) != want {
+			t.Errorf("expected %s, got %s", want, data)
+		}
+	})
+
+	t.Run("should reject malformed lines", func(t *testing.T) {
+		for _, tc := range []struct {
+			name string
+			data string
+			err  string
+		}{
+			{"an empty body", "\n# nothing\n", "no points"},
+			{"a line without fields", "cpu,host=a", "line 1: missing fields"},
+			{"a line with an empty field set", "cpu ", "line 1: missing field key"},
+			{"a tag without a value", "cpu,host usage=1", `tag "host" has no value`},
+			{"an empty tag value", "cpu,host= usage=1", "missing tag value"},
+			{"a field without a value", "ok v=1\ncpu usage", `line 2: field "usage" has no value`},
+			{"an empty field value", "cpu usage=", "missing value"},
+			{"an invalid integer", "cpu usage=1.5i", `invalid integer "1.5i"`},
+			{"a negative unsigned integer", "cpu usage=-1u", "invalid unsigned integer"},
+			{"an invalid number", "cpu usage=fast", `invalid number "fast"`},
+			{"NaN", "cpu usage=NaN", `invalid number "NaN"`},
+			{"an unterminated string", `cpu note="open`, "unterminated string"},
+			{"an invalid timestamp", "cpu usage=1 soon", `invalid timestamp "soon"`},
+			{"a timestamp out of range", "cpu usage=1 9223372036854775807", "out of range"},
+			{"data after the timestamp", "cpu usage=1 1 2", "unexpected data after the timestamp"},
+			{"a missing measurement", ",host=a usage=1", "missing measurement"},
+		} {
+			t.Run("should reject "+tc.name, func(t *testing.T) {
+				unit := time.Nanosecond
+				if tc.name == "a timestamp out of range" {
+					unit = time.Second
+				}
+				_, err := Parse([]byte(tc.data), unit)
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Errorf("expected an error containing %q, got %v", tc.err, err)
+				}
+			})
+		}
+	})
+}
+
+func FuzzParse(f *testing.F) {
+	for _, seed := range []string{
+		"cpu,host=a usage=1.5,cores=4i,up=true,s=\"x\" 1772366400000000000",
+		`m\ 1,t\,k=v\=1 f\ 1="a\"b",g=2u`,
+		"# comment\n\nmem free=1i\r\ndisk used=1 1\n",
+	} {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		points, err := Parse(data, time.Nanosecond)
+		if err != nil {
+			return
+		}
+		for _, p := range points {
+			if p.Measurement == "" || len(p.Fields) == 0 {
+				t.Errorf("expected a measurement and fields, got %+v", p)
+			}
+			if _, err := json.Marshal(p); err != nil {
+				t.Errorf("expected %+v to encode as JSON, got %v", p, err)
+			}
+		}
+	})
+}
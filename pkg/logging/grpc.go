@@ -0,0 +1,84 @@
+package logging
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// UnaryServerInterceptor is the gRPC counterpart of Middleware: it assigns or propagates
+// the x-request-id metadata, stores the request fields in the call context and logs a line
+// for each completed call.
+// Params:
+// - logger: *slog.Logger - the logger used for call completion lines
+// Returns:
+// - grpc.UnaryServerInterceptor: the interceptor
+func UnaryServerInterceptor(logger *slog.Logger) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		start := time.Now()
+		ctx = withCallFields(ctx, info.FullMethod)
+		resp, err := handler(ctx, req)
+		logCall(ctx, logger, start, err)
+		return resp, err
+	}
+}
+
+// StreamServerInterceptor is the streaming counterpart of UnaryServerInterceptor. The line
+// is logged when the stream ends.
+// Params:
+// - logger: *slog.Logger - the logger used for call completion lines
+// Returns:
+// - grpc.StreamServerInterceptor: the interceptor
+func StreamServerInterceptor(logger *slog.Logger) grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		start := time.Now()
+		ctx := withCallFields(ss.Context(), info.FullMethod)
+		err := handler(srv, &serverStream{ServerStream: ss, ctx: ctx})
+		logCall(ctx, logger, start, err)
+		return err
+	}
+}
+
+// withCallFields returns a context carrying the request fields of a call, and sends its
+// request ID back in the response header.
+func withCallFields(ctx context.Context, method string) context.Context {
+	var requestID string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if ids := md.Get(strings.ToLower(RequestIDHeader)); len(ids) > 0 {
+			requestID = ids[0]
+		}
+	}
+	if !validRequestID(requestID) {
+		requestID = uuid.New().String()
+	}
+	// fails only outside of a gRPC server, or once the header was sent
+	_ = grpc.SetHeader(ctx, metadata.Pairs(strings.ToLower(RequestIDHeader), requestID))
+
+	ctx = WithRequestID(ctx, requestID)
+	setRoute(ctx, method)
+	return ctx
+}
+
+func logCall(ctx context.Context, logger *slog.Logger, start time.Time, err error) {
+	logger.InfoContext(ctx, "request completed",
+		"method", "grpc",
+		"code", status.Code(err).String(),
+		"duration_ms", time.Since(start).Milliseconds(),
+	)
+}
+
+// serverStream replaces the context of a stream.
+type serverStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *serverStream) Context() context.Context {
+	return s.ctx
+}
@@ -0,0 +1,66 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestUnaryServerInterceptor(t *testing.T) {
+
+	info := &grpc.UnaryServerInfo{FullMethod: "/iot.telemetry.v1.IngestService/Send"}
+
+	t.Run("should propagate a client request id", func(t *testing.T) {
+		buf := new(bytes.Buffer)
+		interceptor := UnaryServerInterceptor(NewWithWriter("test", buf))
+
+		ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("x-request-id", "abc-123"))
+		_, err := interceptor(ctx, nil, info, func(ctx context.Context, req any) (any, error) {
+			if got := RequestID(ctx); got != "abc-123" {
+				t.Errorf("expected request id in context, got %q", got)
+			}
+			SetUserID(ctx, "user-1")
+			return nil, status.Error(codes.NotFound, "not found")
+		})
+		if status.Code(err) != codes.NotFound {
+			t.Fatalf("expected the handler's error, got %v", err)
+		}
+
+		var line map[string]interface{}
+		if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+			t.Fatal(err)
+		}
+		if line["request_id"] != "abc-123" {
+			t.Errorf("expected request_id in log line, got %v", line["request_id"])
+		}
+		if line["route"] != info.FullMethod {
+			t.Errorf("expected method as route in log line, got %v", line["route"])
+		}
+		if line["user_id"] != "user-1" {
+			t.Errorf("expected user_id in log line, got %v", line["user_id"])
+		}
+		if line["code"] != "NotFound" {
+			t.Errorf("expected status code in log line, got %v", line["code"])
+		}
+	})
+
+	t.Run("should generate a request id when none is provided", func(t *testing.T) {
+		interceptor := UnaryServerInterceptor(NewWithWriter("test", new(bytes.Buffer)))
+
+		_, err := interceptor(context.Background(), nil, info, func(ctx context.Context, req any) (any, error) {
+			if RequestID(ctx) == "" {
+				t.Error("expected a generated request id")
+			}
+			return nil, nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+}
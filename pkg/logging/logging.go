@@ -0,0 +1,164 @@
+package logging
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+type contextKey string
+
+const fieldsKey contextKey = "logFields"
+
+// requestFields holds the per-request values attached to every log line.
+// Values are filled in as the request moves through middleware and handlers,
+// so the struct is shared by pointer and guarded by a mutex.
+type requestFields struct {
+	mu        sync.Mutex
+	requestID string
+	userID    string
+	deviceID  string
+	route     string
+}
+
+// New creates a JSON logger for a service that writes to stdout.
+// Params:
+// - service: string - the name of the service, added to every log line
+// Returns:
+// - *slog.Logger: the created logger
+func New(service string) *slog.Logger {
+	return NewWithWriter(service, os.Stdout)
+}
+
+// NewWithWriter creates a JSON logger for a service that writes to the provided writer.
+// Params:
+// - service: string - the name of the service, added to every log line
+// - w: io.Writer - the destination for log output
+// Returns:
+// - *slog.Logger: the created logger
+func NewWithWriter(service string, w io.Writer) *slog.Logger {
+	handler := NewContextHandler(slog.NewJSONHandler(w, nil))
+	return slog.New(handler).With("service", service)
+}
+
+// ContextHandler is a slog.Handler that adds request context fields to each record.
+type ContextHandler struct {
+	slog.Handler
+}
+
+// NewContextHandler wraps a slog.Handler so records logged with a request
+// context carry the request ID, user ID, device ID, route and trace ID.
+// Params:
+// - h: slog.Handler - the handler to wrap
+// Returns:
+// - *ContextHandler: the wrapping handler
+func NewContextHandler(h slog.Handler) *ContextHandler {
+	return &ContextHandler{Handler: h}
+}
+
+// Handle adds the request fields found in ctx to the record before passing it on.
+// Params:
+// - ctx: context.Context - the context the record was logged with
+// - rec: slog.Record - the log record
+// Returns:
+// - error: error returned by the wrapped handler
+func (h *ContextHandler) Handle(ctx context.Context, rec slog.Record) error {
+	if f, ok := ctx.Value(fieldsKey).(*requestFields); ok {
+		f.mu.Lock()
+		if f.requestID != "" {
+			rec.AddAttrs(slog.String("request_id", f.requestID))
+		}
+		if f.userID != "" {
+			rec.AddAttrs(slog.String("user_id", f.userID))
+		}
+		if f.deviceID != "" {
+			rec.AddAttrs(slog.String("device_id", f.deviceID))
+		}
+		if f.route != "" {
+			rec.AddAttrs(slog.String("route", f.route))
+		}
+		f.mu.Unlock()
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		rec.AddAttrs(
+			slog.String("trace_id", sc.TraceID().String()),
+			slog.String("span_id", sc.SpanID().String()),
+		)
+	}
+	return h.Handler.Handle(ctx, rec)
+}
+
+// WithAttrs returns a ContextHandler whose wrapped handler has the given attributes.
+func (h *ContextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &ContextHandler{Handler: h.Handler.WithAttrs(attrs)}
+}
+
+// WithGroup returns a ContextHandler whose wrapped handler uses the given group.
+func (h *ContextHandler) WithGroup(name string) slog.Handler {
+	return &ContextHandler{Handler: h.Handler.WithGroup(name)}
+}
+
+// WithRequestID returns a context carrying the request ID for logging.
+// Params:
+// - ctx: context.Context - the parent context
+// - requestID: string - the request ID
+// Returns:
+// - context.Context: the derived context
+func WithRequestID(ctx context.Context, requestID string) context.Context {
+	f := &requestFields{requestID: requestID}
+	return context.WithValue(ctx, fieldsKey, f)
+}
+
+// RequestID returns the request ID stored in ctx, or an empty string.
+// Params:
+// - ctx: context.Context - the request context
+// Returns:
+// - string: the request ID
+func RequestID(ctx context.Context) string {
+	f, ok := ctx.Value(fieldsKey).(*requestFields)
+	if !ok {
+		return ""
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.requestID
+}
+
+// SetUserID records the authenticated user ID for the request in ctx.
+// Params:
+// - ctx: context.Context - the request context
+// - userID: string - the user ID
+// Returns: None
+func SetUserID(ctx context.Context, userID string) {
+	if f, ok := ctx.Value(fieldsKey).(*requestFields); ok {
+		f.mu.Lock()
+		f.userID = userID
+		f.mu.Unlock()
+	}
+}
+
+// SetDeviceID records the device ID the request operates on in ctx.
+// Params:
+// - ctx: context.Context - the request context
+// - deviceID: string - the device ID
+// Returns: None
+func SetDeviceID(ctx context.Context, deviceID string) {
+	if f, ok := ctx.Value(fieldsKey).(*requestFields); ok {
+		f.mu.Lock()
+		f.deviceID = deviceID
+		f.mu.Unlock()
+	}
+}
+
+// setRoute records the matched route template for the request in ctx.
+func setRoute(ctx context.Context, route string) {
+	if f, ok := ctx.Value(fieldsKey).(*requestFields); ok {
+		f.mu.Lock()
+		f.route = route
+		f.mu.Unlock()
+	}
+}
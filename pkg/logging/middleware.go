@@ -0,0 +1,111 @@
+package logging
+
+import (
+	"bufio"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// RequestIDHeader is the header used to propagate request IDs between services.
+const RequestIDHeader = "X-Request-ID"
+
+const maxRequestIDLength = 128
+
+type responseRecorder struct {
+	http.ResponseWriter
+	statusCode int
+}
+
+// WriteHeader captures the status code for the response.
+// Params:
+// - code: int - the HTTP status code
+// Returns: None
+func (rr *responseRecorder) WriteHeader(code int) {
+	rr.statusCode = code
+	rr.ResponseWriter.WriteHeader(code)
+}
+
+// Hijack lets websocket upgrades take over the underlying connection.
+// Params: None
+// Returns:
+// - net.Conn: the hijacked connection
+// - *bufio.ReadWriter: the buffered reader/writer for the connection
+// - error: error if the response writer does not support hijacking
+func (rr *responseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := rr.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer does not implement http.Hijacker")
+	}
+	rr.statusCode = http.StatusSwitchingProtocols
+	return h.Hijack()
+}
+
+// Flush sends buffered data to the client if the underlying writer supports it.
+// Params: None
+// Returns: None
+func (rr *responseRecorder) Flush() {
+	if f, ok := rr.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap returns the underlying response writer for http.ResponseController.
+func (rr *responseRecorder) Unwrap() http.ResponseWriter {
+	return rr.ResponseWriter
+}
+
+// Middleware assigns or propagates the X-Request-ID header, stores the request
+// fields in the request context and logs a line for each completed request.
+// Params:
+// - logger: *slog.Logger - the logger used for request completion lines
+// Returns:
+// - func(http.Handler) http.Handler: the middleware
+func Middleware(logger *slog.Logger) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+
+			requestID := r.Header.Get(RequestIDHeader)
+			if !validRequestID(requestID) {
+				requestID = uuid.New().String()
+			}
+			w.Header().Set(RequestIDHeader, requestID)
+
+			ctx := WithRequestID(r.Context(), requestID)
+			if route := mux.CurrentRoute(r); route != nil {
+				if tmpl, err := route.GetPathTemplate(); err == nil {
+					setRoute(ctx, tmpl)
+				}
+			}
+			r = r.WithContext(ctx)
+
+			rw := &responseRecorder{ResponseWriter: w, statusCode: http.StatusOK}
+			next.ServeHTTP(rw, r)
+
+			logger.InfoContext(ctx, "request completed",
+				"method", r.Method,
+				"status", rw.statusCode,
+				"duration_ms", time.Since(start).Milliseconds(),
+			)
+		})
+	}
+}
+
+// validRequestID reports whether a client supplied request ID is safe to reuse.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		if c < 0x21 || c > 0x7e {
+			return false
+		}
+	}
+	return true
+}
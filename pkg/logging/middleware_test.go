@@ -0,0 +1,103 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestMiddleware(t *testing.T) {
+
+	t.Run("should propagate a client request id", func(t *testing.T) {
+		buf := new(bytes.Buffer)
+		logger := NewWithWriter("test", buf)
+
+		router := mux.NewRouter()
+		router.Use(Middleware(logger))
+		router.HandleFunc("/device/{id}", func(w http.ResponseWriter, r *http.Request) {
+			if got := RequestID(r.Context()); got != "abc-123" {
+				t.Errorf("expected request id in context, got %q", got)
+			}
+			w.WriteHeader(http.StatusAccepted)
+		})
+
+		req, err := http.NewRequest(http.MethodGet, "/device/1", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(RequestIDHeader, "abc-123")
+
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		if rr.Header().Get(RequestIDHeader) != "abc-123" {
+			t.Errorf("expected response header abc-123, got %q", rr.Header().Get(RequestIDHeader))
+		}
+
+		var line map[string]interface{}
+		if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+			t.Fatal(err)
+		}
+		if line["request_id"] != "abc-123" {
+			t.Errorf("expected request_id in log line, got %v", line["request_id"])
+		}
+		if line["route"] != "/device/{id}" {
+			t.Errorf("expected route template in log line, got %v", line["route"])
+		}
+		if line["status"] != float64(http.StatusAccepted) {
+			t.Errorf("expected status %d in log line, got %v", http.StatusAccepted, line["status"])
+		}
+	})
+
+	t.Run("should generate a request id when none is provided", func(t *testing.T) {
+		buf := new(bytes.Buffer)
+		logger := NewWithWriter("test", buf)
+
+		router := mux.NewRouter()
+		router.Use(Middleware(logger))
+		router.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {})
+
+		req, err := http.NewRequest(http.MethodGet, "/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(RequestIDHeader, "bad id\n")
+
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		id := rr.Header().Get(RequestIDHeader)
+		if id == "" || strings.Contains(id, " ") {
+			t.Errorf("expected a generated request id, got %q", id)
+		}
+	})
+
+	t.Run("should attach user and device ids set by handlers", func(t *testing.T) {
+		buf := new(bytes.Buffer)
+		logger := NewWithWriter("test", buf)
+
+		router := mux.NewRouter()
+		router.Use(Middleware(logger))
+		router.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+			SetUserID(r.Context(), "user-1")
+			SetDeviceID(r.Context(), "device-1")
+			buf.Reset()
+			logger.InfoContext(r.Context(), "handler line")
+			if !strings.Contains(buf.String(), `"user_id":"user-1"`) || !strings.Contains(buf.String(), `"device_id":"device-1"`) {
+				t.Errorf("expected user and device ids in log line, got %s", buf.String())
+			}
+		})
+
+		req, err := http.NewRequest(http.MethodGet, "/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		router.ServeHTTP(httptest.NewRecorder(), req)
+	})
+}
@@ -0,0 +1,7 @@
+package models
+
+// Quota is how much telemetry a user may send per UTC day. A zero field is unlimited.
+type Quota struct {
+	DailyMessages int64
+	DailyBytes    int64
+}
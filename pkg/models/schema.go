@@ -0,0 +1,12 @@
+package models
+
+import "time"
+
+// DeviceSchema is the Protobuf message type a device's payloads are encoded with, and the
+// serialized FileDescriptorSet defining it.
+type DeviceSchema struct {
+	DeviceID      string
+	MessageType   string
+	DescriptorSet []byte
+	UpdatedAt     time.Time
+}
@@ -0,0 +1,365 @@
+// Package otlp decodes OTLP/HTTP metrics exports, in Protobuf or JSON, and flattens the
+// data points of their gauges, sums and histograms into one self-contained point each,
+// with the metric's name, unit and type and the attributes of the point and its resource.
+package otlp
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// Media types of OTLP/HTTP requests.
+const (
+	Protobuf = "application/x-protobuf"
+	JSON     = "application/json"
+)
+
+// DeviceAttribute is the resource attribute naming the device that sent a resource's metrics.
+const DeviceAttribute = "device.id"
+
+// maxAttributeDepth bounds the nesting of array and key-value list attributes.
+const maxAttributeDepth = 16
+
+// ErrUnsupported is returned for a media type that is not an OTLP encoding.
+var ErrUnsupported = errors.New("unsupported OTLP encoding")
+
+// Metric types of Point.Type.
+const (
+	Gauge     = "gauge"
+	Sum       = "sum"
+	Histogram = "histogram"
+)
+
+// Point is a flattened data point.
+type Point struct {
+	// DeviceID is the device.id attribute of the point's resource, empty if it has none.
+	DeviceID string `json:"-"`
+
+	Name string `json:"name"`
+	Unit string `json:"unit,omitempty"`
+	// Type is Gauge, Sum or Histogram.
+	Type string `json:"type"`
+	// Temporality is delta or cumulative, for sums and histograms.
+	Temporality string `json:"temporality,omitempty"`
+	// Monotonic is set for sums.
+	Monotonic *bool `json:"monotonic,omitempty"`
+	// Resource holds the resource's attributes other than device.id.
+	Resource map[string]any `json:"resource,omitempty"`
+	// Scope is the name of the instrumentation scope that recorded the metric.
+	Scope      string         `json:"scope,omitempty"`
+	Attributes map[string]any `json:"attributes,omitempty"`
+
+	// Value is the float64 or int64 value of gauges and sums.
+	Value any `json:"value,omitempty"`
+
+	// Count, Sum, Min, Max, Bounds and BucketCounts describe histograms. BucketCounts
+	// has one more entry than Bounds, the last bucket having no upper bound.
+	Count        *uint64   `json:"count,omitempty"`
+	Sum          *float64  `json:"sum,omitempty"`
+	Min          *float64  `json:"min,omitempty"`
+	Max          *float64  `json:"max,omitempty"`
+	Bounds       []float64 `json:"bounds,omitempty"`
+	BucketCounts []uint64  `json:"bucket_counts,omitempty"`
+
+	// StartTime is when a cumulative or delta series started, nil if unknown.
+	StartTime *time.Time `json:"start_time,omitempty"`
+	// Time is when the point was recorded, nil if the exporter did not set it.
+	Time *time.Time `json:"time,omitempty"`
+}
+
+// Metrics are the flattened points of an export.
+type Metrics struct {
+	Points []Point
+	// Rejected counts the data points that could not be flattened, and Reason says why
+	// the first of them was rejected. Points without a recorded value are skipped
+	// without being rejected.
+	Rejected int64
+	Reason   string
+}
+
+// reject counts a rejected data point.
+func (m *Metrics) reject(reason string) {
+	if m.Rejected == 0 {
+		m.Reason = reason
+	}
+	m.Rejected++
+}
+
+// Supported reports whether a media type is an OTLP/HTTP encoding.
+// Params:
+// - contentType: string - the media type, without parameters
+// Returns:
+// - bool: true for Protobuf and JSON
+func Supported(contentType string) bool {
+	return contentType == Protobuf || contentType == JSON
+}
+
+// Parse decodes an export request and flattens its data points. Exponential histograms,
+// summaries and points with values that are not finite are counted as rejected.
+// Params:
+// - contentType: string - the media type of the request
+// - data: []byte - the request body
+// Returns:
+// - *Metrics: the flattened points, in order, and the rejected ones
+// - error: error if the request is malformed
+func Parse(contentType string, data []byte) (*Metrics, error) {
+	req := &colmetricspb.ExportMetricsServiceRequest{}
+	switch contentType {
+	case Protobuf:
+		if err := proto.Unmarshal(data, req); err != nil {
+			return nil, fmt.Errorf("invalid OTLP Protobuf: %w", err)
+		}
+	case JSON:
+		// receivers must ignore fields added by newer versions of OTLP
+		if err := (protojson.UnmarshalOptions{DiscardUnknown: true}).Unmarshal(data, req); err != nil {
+			return nil, fmt.Errorf("invalid OTLP JSON: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("%w %q", ErrUnsupported, contentType)
+	}
+
+	m := &Metrics{}
+	for _, rm := range req.GetResourceMetrics() {
+		var deviceId string
+		resource := map[string]any{}
+		for _, kv := range rm.GetResource().GetAttributes() {
+			if kv.GetKey() == DeviceAttribute {
+				deviceId = kv.GetValue().GetStringValue()
+				continue
+			}
+			v, err := attribute(kv.GetValue(), 0)
+			if err != nil {
+				return nil, fmt.Errorf("resource attribute %q: %w", kv.GetKey(), err)
+			}
+			resource[kv.GetKey()] = v
+		}
+		if len(resource) == 0 {
+			resource = nil
+		}
+
+		for _, sm := range rm.GetScopeMetrics() {
+			for _, metric := range sm.GetMetrics() {
+				base := Point{DeviceID: deviceId, Name: metric.GetName(), Unit: metric.GetUnit(), Resource: resource, Scope: sm.GetScope().GetName()}
+				if base.Name == "" {
+					return nil, errors.New("metric has no name")
+				}
+				if err := m.flatten(base, metric); err != nil {
+					return nil, fmt.Errorf("metric %q: %w", base.Name, err)
+				}
+			}
+		}
+	}
+	if len(m.Points) == 0 && m.Rejected == 0 {
+		return nil, errors.New("export has no data points")
+	}
+	return m, nil
+}
+
+// flatten adds the points of a metric to m.
+func (m *Metrics) flatten(base Point, metric *metricspb.Metric) error {
+	switch data := metric.GetData().(type) {
+	case *metricspb.Metric_Gauge:
+		base.Type = Gauge
+		return m.numbers(base, data.Gauge.GetDataPoints())
+	case *metricspb.Metric_Sum:
+		base.Type = Sum
+		base.Temporality = temporality(data.Sum.GetAggregationTemporality())
+		monotonic := data.Sum.GetIsMonotonic()
+		base.Monotonic = &monotonic
+		return m.numbers(base, data.Sum.GetDataPoints())
+	case *metricspb.Metric_Histogram:
+		base.Type = Histogram
+		base.Temporality = temporality(data.Histogram.GetAggregationTemporality())
+		return m.histograms(base, data.Histogram.GetDataPoints())
+	case *metricspb.Metric_ExponentialHistogram:
+		for range data.ExponentialHistogram.GetDataPoints() {
+			m.reject(fmt.Sprintf("metric %q: exponential histograms are not supported", base.Name))
+		}
+	case *metricspb.Metric_Summary:
+		for range data.Summary.GetDataPoints() {
+			m.reject(fmt.Sprintf("metric %q: summaries are not supported", base.Name))
+		}
+	}
+	return nil
+}
+
+func (m *Metrics) numbers(base Point, points []*metricspb.NumberDataPoint) error {
+	for _, dp := range points {
+		if dp.GetFlags()&uint32(metricspb.DataPointFlags_DATA_POINT_FLAGS_NO_RECORDED_VALUE_MASK) != 0 {
+			continue
+		}
+		p, err := withTimes(base, dp.GetAttributes(), dp.GetStartTimeUnixNano(), dp.GetTimeUnixNano())
+		if err != nil {
+			return err
+		}
+		switch v := dp.GetValue().(type) {
+		case *metricspb.NumberDataPoint_AsInt:
+			p.Value = v.AsInt
+		case *metricspb.NumberDataPoint_AsDouble:
+			if !finite(v.AsDouble) {
+				m.reject(fmt.Sprintf("metric %q: value %v is not finite", base.Name, v.AsDouble))
+				continue
+			}
+			p.Value = v.AsDouble
+		default:
+			m.reject(fmt.Sprintf("metric %q: data point has no value", base.Name))
+			continue
+		}
+		m.Points = append(m.Points, p)
+	}
+	return nil
+}
+
+func (m *Metrics) histograms(base Point, points []*metricspb.HistogramDataPoint) error {
+	for _, dp := range points {
+		if dp.GetFlags()&uint32(metricspb.DataPointFlags_DATA_POINT_FLAGS_NO_RECORDED_VALUE_MASK) != 0 {
+			continue
+		}
+		p, err := withTimes(base, dp.GetAttributes(), dp.GetStartTimeUnixNano(), dp.GetTimeUnixNano())
+		if err != nil {
+			return err
+		}
+		count := dp.GetCount()
+		p.Count = &count
+		p.Sum, p.Min, p.Max = dp.Sum, dp.Min, dp.Max
+		p.Bounds, p.BucketCounts = dp.GetExplicitBounds(), dp.GetBucketCounts()
+		if len(p.BucketCounts) > 0 && len(p.BucketCounts) != len(p.Bounds)+1 {
+			m.reject(fmt.Sprintf("metric %q: %d bucket counts for %d bounds", base.Name, len(p.BucketCounts), len(p.Bounds)))
+			continue
+		}
+		if !finite(p.Bounds...) || p.Sum != nil && !finite(*p.Sum) || p.Min != nil && !finite(*p.Min) || p.Max != nil && !finite(*p.Max) {
+			m.reject(fmt.Sprintf("metric %q: histogram has values that are not finite", base.Name))
+			continue
+		}
+		m.Points = append(m.Points, p)
+	}
+	return nil
+}
+
+// withTimes returns base with a data point's attributes and times.
+func withTimes(base Point, attributes []*commonpb.KeyValue, start uint64, at uint64) (Point, error) {
+	if len(attributes) > 0 {
+		base.Attributes = make(map[string]any, len(attributes))
+		for _, kv := range attributes {
+			v, err := attribute(kv.GetValue(), 0)
+			if err != nil {
+				return Point{}, fmt.Errorf("attribute %q: %w", kv.GetKey(), err)
+			}
+			base.Attributes[kv.GetKey()] = v
+		}
+	}
+	var err error
+	if base.StartTime, err = unixNano(start); err != nil {
+		return Point{}, err
+	}
+	if base.Time, err = unixNano(at); err != nil {
+		return Point{}, err
+	}
+	return base, nil
+}
+
+// unixNano converts an OTLP timestamp to a time, nil for 0, which means unset.
+func unixNano(ns uint64) (*time.Time, error) {
+	if ns == 0 {
+		return nil, nil
+	}
+	if ns > math.MaxInt64 {
+		return nil, fmt.Errorf("time %d is out of range", ns)
+	}
+	t := time.Unix(0, int64(ns)).UTC()
+	return &t, nil
+}
+
+// attribute converts an attribute value to a string, bool, int64, float64, base64 string,
+// []any or map[string]any.
+func attribute(v *commonpb.AnyValue, depth int) (any, error) {
+	if depth > maxAttributeDepth {
+		return nil, errors.New("nested too deeply")
+	}
+	switch v := v.GetValue().(type) {
+	case *commonpb.AnyValue_StringValue:
+		return v.StringValue, nil
+	case *commonpb.AnyValue_BoolValue:
+		return v.BoolValue, nil
+	case *commonpb.AnyValue_IntValue:
+		return v.IntValue, nil
+	case *commonpb.AnyValue_DoubleValue:
+		if !finite(v.DoubleValue) {
+			return nil, fmt.Errorf("value %v is not finite", v.DoubleValue)
+		}
+		return v.DoubleValue, nil
+	case *commonpb.AnyValue_BytesValue:
+		return base64.StdEncoding.EncodeToString(v.BytesValue), nil
+	case *commonpb.AnyValue_ArrayValue:
+		values := make([]any, len(v.ArrayValue.GetValues()))
+		for i, item := range v.ArrayValue.GetValues() {
+			var err error
+			if values[i], err = attribute(item, depth+1); err != nil {
+				return nil, err
+			}
+		}
+		return values, nil
+	case *commonpb.AnyValue_KvlistValue:
+		values := make(map[string]any, len(v.KvlistValue.GetValues()))
+		for _, kv := range v.KvlistValue.GetValues() {
+			var err error
+			if values[kv.GetKey()], err = attribute(kv.GetValue(), depth+1); err != nil {
+				return nil, err
+			}
+		}
+		return values, nil
+	}
+	// an empty value
+	return nil, nil
+}
+
+func temporality(t metricspb.AggregationTemporality) string {
+	switch t {
+	case metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_DELTA:
+		return "delta"
+	case metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE:
+		return "cumulative"
+	}
+	return ""
+}
+
+func finite(values ...float64) bool {
+	for _, v := range values {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return false
+		}
+	}
+	return true
+}
+
+// Response encodes the response to an export, reporting the rejected data points as a
+// partial success.
+// Params:
+// - contentType: string - the media type of the request, which the response uses
+// - rejected: int64 - the number of rejected data points
+// - reason: string - why data points were rejected
+// Returns:
+// - []byte: the response body
+// - error: error if the media type is not an OTLP encoding
+func Response(contentType string, rejected int64, reason string) ([]byte, error) {
+	resp := &colmetricspb.ExportMetricsServiceResponse{}
+	if rejected > 0 {
+		resp.PartialSuccess = &colmetricspb.ExportMetricsPartialSuccess{RejectedDataPoints: rejected, ErrorMessage: reason}
+	}
+	switch contentType {
+	case Protobuf:
+		return proto.Marshal(resp)
+	case JSON:
+		return protojson.Marshal(resp)
+	}
+	return nil, fmt.Errorf("%w %q", ErrUnsupported, contentType)
+}
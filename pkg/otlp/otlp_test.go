@@ -0,0 +1,196 @@
+package otlp
+
+import (
+	"encoding/json"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+const testTime = 1772366400000000000
+
+func str(key, value string) *commonpb.KeyValue {
+	return &commonpb.KeyValue{Key: key, Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: value}}}
+}
+
+func float(f float64) *float64 {
+	return &f
+}
+
+// testExport exports a gauge, a sum and a histogram from device1.
+func testExport() *colmetricspb.ExportMetricsServiceRequest {
+	return &colmetricspb.ExportMetricsServiceRequest{ResourceMetrics: []*metricspb.ResourceMetrics{{
+		Resource: &resourcepb.Resource{Attributes: []*commonpb.KeyValue{str("device.id", "device1"), str("host.name", "gw-1")}},
+		ScopeMetrics: []*metricspb.ScopeMetrics{{
+			Scope: &commonpb.InstrumentationScope{Name: "hostmetrics"},
+			Metrics: []*metricspb.Metric{
+				{Name: "cpu.utilization", Unit: "1", Data: &metricspb.Metric_Gauge{Gauge: &metricspb.Gauge{DataPoints: []*metricspb.NumberDataPoint{
+					{Attributes: []*commonpb.KeyValue{str("cpu", "0")}, TimeUnixNano: testTime, Value: &metricspb.NumberDataPoint_AsDouble{AsDouble: 0.25}},
+					{Flags: uint32(metricspb.DataPointFlags_DATA_POINT_FLAGS_NO_RECORDED_VALUE_MASK), TimeUnixNano: testTime},
+				}}}},
+				{Name: "packets", Data: &metricspb.Metric_Sum{Sum: &metricspb.Sum{
+					AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE,
+					IsMonotonic:            true,
+					DataPoints:             []*metricspb.NumberDataPoint{{StartTimeUnixNano: testTime - 60e9, TimeUnixNano: testTime, Value: &metricspb.NumberDataPoint_AsInt{AsInt: 42}}},
+				}}},
+				{Name: "latency", Unit: "ms", Data: &metricspb.Metric_Histogram{Histogram: &metricspb.Histogram{
+					AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_DELTA,
+					DataPoints: []*metricspb.HistogramDataPoint{{
+						TimeUnixNano: testTime, Count: 3, Sum: float(17.5), Min: float(1), Max: float(12),
+						ExplicitBounds: []float64{5, 10}, BucketCounts: []uint64{1, 1, 1},
+					}},
+				}}},
+			},
+		}},
+	}}}
+}
+
+func TestParse(t *testing.T) {
+	t.Run("should flatten gauges, sums and histograms", func(t *testing.T) {
+		data, err := proto.Marshal(testExport())
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := Parse(Protobuf, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Rejected != 0 || len(got.Points) != 3 {
+			t.Fatalf("expected 3 points, got %+v", got)
+		}
+
+		var events []string
+		for _, p := range got.Points {
+			if p.DeviceID != "device1" {
+				t.Errorf("expected device1, got %q", p.DeviceID)
+			}
+			event, err := json.Marshal(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			events = append(events, string(event))
+		}
+		want := []string{
+			`{"name":"cpu.utilization","unit":"1","type":"gauge","resource":{"host.name":"gw-1"},"scope":"hostmetrics","attributes":{"cpu":"0"},"value":0.25,"time":"2026-03-01T12:00:00Z"}`,
+			`{"name":"packets","type":"sum","temporality":"cumulative","monotonic":true,"resource":{"host.name":"gw-1"},"scope":"hostmetrics","value":42,"start_time":"2026-03-01T11:59:00Z","time":"2026-03-01T12:00:00Z"}`,
+			`{"name":"latency","unit":"ms","type":"histogram","temporality":"delta","resource":{"host.name":"gw-1"},"scope":"hostmetrics","count":3,"sum":17.5,"min":1,"max":12,"bounds":[5,10],"bucket_counts":[1,1,1],"time":"2026-03-01T12:00:00Z"}`,
+		}
+		if !reflect.DeepEqual(events, want) {
+			t.Errorf("expected\n%s\ngot\n%s", strings.Join(want, "\n"), strings.Join(events, "\n"))
+		}
+	})
+
+	t.Run("should decode OTLP JSON", func(t *testing.T) {
+		data := `{"resourceMetrics":[{"resource":{"attributes":[{"key":"device.id","value":{"stringValue":"device1"}}]},
+			"scopeMetrics":[{"metrics":[{"name":"temp","unit":"Cel","gauge":{"dataPoints":[
+				{"timeUnixNano":"1772366400000000000","asInt":"21","attributes":[{"key":"tags","value":{"arrayValue":{"values":[{"intValue":"1"},{"boolValue":true}]}}}]}
+			]},"futureField":1}]}]}]}`
+		got, err := Parse(JSON, []byte(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := got.Points[0]
+		if p.DeviceID != "device1" || p.Name != "temp" || p.Value != int64(21) || !reflect.DeepEqual(p.Attributes["tags"], []any{int64(1), true}) {
+			t.Errorf("unexpected point %+v", p)
+		}
+	})
+
+	t.Run("should reject data points that cannot be flattened", func(t *testing.T) {
+		export := testExport()
+		metrics := export.ResourceMetrics[0].ScopeMetrics[0].Metrics
+		metrics[0].GetGauge().DataPoints[0].Value = &metricspb.NumberDataPoint_AsDouble{AsDouble: math.NaN()}
+		metrics[2].GetHistogram().DataPoints[0].BucketCounts = []uint64{3}
+		metrics = append(metrics,
+			&metricspb.Metric{Name: "summary", Data: &metricspb.Metric_Summary{Summary: &metricspb.Summary{DataPoints: []*metricspb.SummaryDataPoint{{}, {}}}}},
+			&metricspb.Metric{Name: "exp", Data: &metricspb.Metric_ExponentialHistogram{ExponentialHistogram: &metricspb.ExponentialHistogram{DataPoints: []*metricspb.ExponentialHistogramDataPoint{{}}}}},
+		)
+		export.ResourceMetrics[0].ScopeMetrics[0].Metrics = metrics
+		data, err := proto.Marshal(export)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := Parse(Protobuf, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got.Points) != 1 || got.Points[0].Name != "packets" {
+			t.Errorf("expected only packets to be flattened, got %+v", got.Points)
+		}
+		if got.Rejected != 5 || !strings.Contains(got.Reason, `"cpu.utilization": value NaN is not finite`) {
+			t.Errorf("expected 5 points rejected for a NaN first, got %d: %s", got.Rejected, got.Reason)
+		}
+	})
+
+	t.Run("should reject malformed exports", func(t *testing.T) {
+		for _, tc := range []struct {
+			name        string
+			contentType string
+			data        string
+			err         string
+		}{
+			{"an empty export", JSON, `{}`, "no data points"},
+			{"malformed JSON", JSON, `{"resourceMetrics":`, "invalid OTLP JSON"},
+			{"malformed Protobuf", Protobuf, "\xff\xff", "invalid OTLP Protobuf"},
+			{"a metric without a name", JSON, `{"resourceMetrics":[{"scopeMetrics":[{"metrics":[{"gauge":{"dataPoints":[{"asInt":"1"}]}}]}]}]}`, "metric has no name"},
+			{"a time out of range", JSON, `{"resourceMetrics":[{"scopeMetrics":[{"metrics":[{"name":"a","gauge":{"dataPoints":[{"asInt":"1","timeUnixNano":"18446744073709551615"}]}}]}]}]}`, "out of range"},
+			{"another media type", "application/cbor", `{}`, "unsupported OTLP encoding"},
+		} {
+			t.Run("should reject "+tc.name, func(t *testing.T) {
+				_, err := Parse(tc.contentType, []byte(tc.data))
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Errorf("expected an error containing %q, got %v", tc.err, err)
+				}
+			})
+		}
+	})
+}
+
+func TestResponse(t *testing.T) {
+	t.Run("should report rejected points as a partial success", func(t *testing.T) {
+		data, err := Response(JSON, 2, "summaries are not supported")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp := &colmetricspb.ExportMetricsServiceResponse{}
+		if err := protojson.Unmarshal(data, resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.GetPartialSuccess().GetRejectedDataPoints() != 2 || resp.GetPartialSuccess().GetErrorMessage() != "summaries are not supported" {
+			t.Errorf("unexpected response %s", data)
+		}
+
+		if data, err := Response(Protobuf, 0, ""); err != nil || len(data) != 0 {
+			t.Errorf("expected an empty Protobuf response, got %x, %v", data, err)
+		}
+	})
+}
+
+func FuzzParse(f *testing.F) {
+	data, _ := proto.Marshal(testExport())
+	f.Add(Protobuf, data)
+	data, _ = protojson.Marshal(testExport())
+	f.Add(JSON, data)
+	f.Fuzz(func(t *testing.T, contentType string, data []byte) {
+		metrics, err := Parse(contentType, data)
+		if err != nil {
+			return
+		}
+		for _, p := range metrics.Points {
+			if p.Name == "" {
+				t.Errorf("expected a name, got %+v", p)
+			}
+			if _, err := json.Marshal(p); err != nil {
+				t.Errorf("expected %+v to encode as JSON, got %v", p, err)
+			}
+		}
+	})
+}
@@ -0,0 +1,133 @@
+package payload
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+var errTruncated = errors.New("truncated")
+
+// checkMsgPack walks the structure of a MessagePack value without decoding it, since the
+// decoder has no nesting limit and recurses once per level.
+// Params:
+// - data: []byte - the MessagePack value
+// - maxDepth: int - the deepest nesting of arrays and maps allowed
+// Returns:
+// - error: error if the value is malformed, too deep or followed by other data
+func checkMsgPack(data []byte, maxDepth int) error {
+	// remaining holds the number of items left in each open array or map, after the
+	// single top level value
+	remaining := []uint64{1}
+	pos := 0
+
+	// length reads a big endian length of size bytes
+	length := func(size int) (uint64, error) {
+		if len(data)-pos < size {
+			return 0, errTruncated
+		}
+		var n uint64
+		switch size {
+		case 1:
+			n = uint64(data[pos])
+		case 2:
+			n = uint64(binary.BigEndian.Uint16(data[pos:]))
+		case 4:
+			n = uint64(binary.BigEndian.Uint32(data[pos:]))
+		}
+		pos += size
+		return n, nil
+	}
+
+	for len(remaining) > 0 {
+		top := len(remaining) - 1
+		if remaining[top] == 0 {
+			remaining = remaining[:top]
+			continue
+		}
+		remaining[top]--
+
+		if pos >= len(data) {
+			return errTruncated
+		}
+		b := data[pos]
+		pos++
+
+		var skip, items uint64
+		var err error
+		container := false
+		switch {
+		case b <= 0x7f || b >= 0xe0: // fixint
+		case b <= 0x8f: // fixmap
+			items, container = 2*uint64(b&0x0f), true
+		case b <= 0x9f: // fixarray
+			items, container = uint64(b&0x0f), true
+		case b <= 0xbf: // fixstr
+			skip = uint64(b & 0x1f)
+		case b == 0xc0, b == 0xc2, b == 0xc3: // nil, false, true
+		case b == 0xc4, b == 0xd9: // bin8, str8
+			skip, err = length(1)
+		case b == 0xc5, b == 0xda: // bin16, str16
+			skip, err = length(2)
+		case b == 0xc6, b == 0xdb: // bin32, str32
+			skip, err = length(4)
+		case b == 0xc7: // ext8
+			skip, err = length(1)
+			skip++
+		case b == 0xc8: // ext16
+			skip, err = length(2)
+			skip++
+		case b == 0xc9: // ext32
+			skip, err = length(4)
+			skip++
+		case b == 0xca: // float32
+			skip = 4
+		case b == 0xcb: // float64
+			skip = 8
+		case b == 0xcc, b == 0xd0: // uint8, int8
+			skip = 1
+		case b == 0xcd, b == 0xd1: // uint16, int16
+			skip = 2
+		case b == 0xce, b == 0xd2: // uint32, int32
+			skip = 4
+		case b == 0xcf, b == 0xd3: // uint64, int64
+			skip = 8
+		case b >= 0xd4 && b <= 0xd8: // fixext1 to fixext16
+			skip = 1 + 1<<(b-0xd4)
+		case b == 0xdc: // array16
+			items, err = length(2)
+			container = true
+		case b == 0xdd: // array32
+			items, err = length(4)
+			container = true
+		case b == 0xde: // map16
+			items, err = length(2)
+			items, container = 2*items, true
+		case b == 0xdf: // map32
+			items, err = length(4)
+			items, container = 2*items, true
+		default:
+			return fmt.Errorf("invalid type byte 0x%x", b)
+		}
+		if err != nil {
+			return err
+		}
+
+		if container {
+			remaining = append(remaining, items)
+			if len(remaining)-1 > maxDepth {
+				return fmt.Errorf("nested deeper than %d levels", maxDepth)
+			}
+			continue
+		}
+		if uint64(len(data)-pos) < skip {
+			return errTruncated
+		}
+		pos += int(skip)
+	}
+
+	if pos != len(data) {
+		return fmt.Errorf("%d bytes of data after the value", len(data)-pos)
+	}
+	return nil
+}
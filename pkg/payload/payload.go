@@ -0,0 +1,200 @@
+// Package payload handles the formats devices may send telemetry in: JSON, CBOR,
+// MessagePack and Protobuf. Payloads are stored as sent, with their media type, and
+// transcoded to JSON to validate them and for consumers that ask for JSON.
+package payload
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// Media types of the accepted payload formats.
+const (
+	JSON     = "application/json"
+	CBOR     = "application/cbor"
+	MsgPack  = "application/x-msgpack"
+	Protobuf = "application/x-protobuf"
+)
+
+// maxDepth bounds the nesting of binary payloads while decoding them. Tighter limits are
+// applied to the JSON they transcode to.
+const maxDepth = 1000
+
+// ErrUnsupported is returned for a media type that is not a payload format.
+var ErrUnsupported = errors.New("unsupported payload format")
+
+// cborDecMode decodes CBOR into the types closest to JSON.
+var cborDecMode = mustCBORDecMode()
+
+func mustCBORDecMode() cbor.DecMode {
+	mode, err := cbor.DecOptions{
+		MaxNestedLevels: maxDepth,
+		DupMapKey:       cbor.DupMapKeyEnforcedAPF,
+		TimeTag:         cbor.DecTagOptional,
+	}.DecMode()
+	if err != nil {
+		panic(err)
+	}
+	return mode
+}
+
+// Supported reports whether a media type is an accepted payload format.
+// Params:
+// - contentType: string - the media type, without parameters
+// Returns:
+// - bool: true if payloads of the type are accepted
+func Supported(contentType string) bool {
+	switch contentType {
+	case JSON, CBOR, MsgPack, Protobuf:
+		return true
+	}
+	return false
+}
+
+// Binary reports whether payloads of a media type are binary rather than text.
+// Params:
+// - contentType: string - the media type, without parameters
+// Returns:
+// - bool: true for CBOR, MessagePack and Protobuf
+func Binary(contentType string) bool {
+	return Supported(contentType) && contentType != JSON
+}
+
+// ToJSON transcodes a payload to JSON. JSON payloads are returned as they are. Byte
+// strings become base64 strings and map keys that are not strings are formatted as
+// strings, so some payloads cannot be transcoded back.
+// Params:
+// - contentType: string - the media type of the payload
+// - data: []byte - the payload
+// - desc: protoreflect.MessageDescriptor - the message type of Protobuf payloads, nil otherwise
+// Returns:
+// - []byte: the JSON payload
+// - error: error if the payload is malformed or its type unsupported
+func ToJSON(contentType string, data []byte, desc protoreflect.MessageDescriptor) ([]byte, error) {
+	switch contentType {
+	case JSON:
+		return data, nil
+	case CBOR:
+		var v any
+		if err := cborDecMode.Unmarshal(data, &v); err != nil {
+			return nil, fmt.Errorf("invalid CBOR: %w", err)
+		}
+		return marshalJSON(v)
+	case MsgPack:
+		if err := checkMsgPack(data, maxDepth); err != nil {
+			return nil, fmt.Errorf("invalid MessagePack: %w", err)
+		}
+		decoder := msgpack.NewDecoder(bytes.NewReader(data))
+		// maps may have keys other than strings
+		decoder.SetMapDecoder(func(d *msgpack.Decoder) (any, error) {
+			return d.DecodeUntypedMap()
+		})
+		var v any
+		if err := decoder.Decode(&v); err != nil {
+			return nil, fmt.Errorf("invalid MessagePack: %w", err)
+		}
+		return marshalJSON(v)
+	case Protobuf:
+		if desc == nil {
+			return nil, errors.New("no Protobuf message type")
+		}
+		msg := dynamicpb.NewMessage(desc)
+		if err := proto.Unmarshal(data, msg); err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", desc.FullName(), err)
+		}
+		return protojson.Marshal(msg)
+	}
+	return nil, fmt.Errorf("%w %q", ErrUnsupported, contentType)
+}
+
+// marshalJSON encodes a decoded CBOR or MessagePack value as JSON.
+func marshalJSON(v any) ([]byte, error) {
+	v, err := jsonValue(v)
+	if err != nil {
+		return nil, err
+	}
+	var b bytes.Buffer
+	encoder := json.NewEncoder(&b)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(b.Bytes(), []byte("\n")), nil
+}
+
+// jsonValue converts the values decoders produce that encoding/json cannot encode.
+func jsonValue(v any) (any, error) {
+	switch v := v.(type) {
+	case map[any]any:
+		m := make(map[string]any, len(v))
+		for key, value := range v {
+			value, err := jsonValue(value)
+			if err != nil {
+				return nil, err
+			}
+			m[jsonKey(key)] = value
+		}
+		return m, nil
+	case map[string]any:
+		for key, value := range v {
+			value, err := jsonValue(value)
+			if err != nil {
+				return nil, err
+			}
+			v[key] = value
+		}
+		return v, nil
+	case []any:
+		for i, value := range v {
+			value, err := jsonValue(value)
+			if err != nil {
+				return nil, err
+			}
+			v[i] = value
+		}
+		return v, nil
+	case float32:
+		return jsonValue(float64(v))
+	case float64:
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return nil, fmt.Errorf("%v cannot be represented in JSON", v)
+		}
+		return v, nil
+	case cbor.Tag:
+		return jsonValue(v.Content)
+	case cbor.ByteString:
+		return []byte(v), nil
+	case cbor.SimpleValue:
+		return uint8(v), nil
+	case big.Int:
+		return &v, nil
+	case time.Time:
+		return v.UTC().Format(time.RFC3339Nano), nil
+	}
+	return v, nil
+}
+
+// jsonKey formats a map key as a JSON object key.
+func jsonKey(key any) string {
+	switch key := key.(type) {
+	case string:
+		return key
+	case cbor.ByteString:
+		return string(key)
+	case []byte:
+		return string(key)
+	}
+	return fmt.Sprint(key)
+}
@@ -0,0 +1,236 @@
+package payload
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// testDescriptorSet defines sensors.v1.Reading with a temperature and a name.
+func testDescriptorSet(t testing.TB) []byte {
+	t.Helper()
+	set := &descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{{
+		Name:    proto.String("reading.proto"),
+		Package: proto.String("sensors.v1"),
+		Syntax:  proto.String("proto3"),
+		MessageType: []*descriptorpb.DescriptorProto{{
+			Name: proto.String("Reading"),
+			Field: []*descriptorpb.FieldDescriptorProto{
+				{Name: proto.String("temperature"), JsonName: proto.String("temperature"), Number: proto.Int32(1), Type: descriptorpb.FieldDescriptorProto_TYPE_DOUBLE.Enum(), Label: descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum()},
+				{Name: proto.String("name"), JsonName: proto.String("name"), Number: proto.Int32(2), Type: descriptorpb.FieldDescriptorProto_TYPE_STRING.Enum(), Label: descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum()},
+			},
+		}},
+	}}}
+	b, err := proto.Marshal(set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func equalJSON(t *testing.T, got []byte, want string) {
+	t.Helper()
+	var g, w any
+	if err := json.Unmarshal(got, &g); err != nil {
+		t.Fatalf("expected valid JSON, got %q: %v", got, err)
+	}
+	if err := json.Unmarshal([]byte(want), &w); err != nil {
+		t.Fatal(err)
+	}
+	gb, _ := json.Marshal(g)
+	wb, _ := json.Marshal(w)
+	if !bytes.Equal(gb, wb) {
+		t.Errorf("expected %s, got %s", want, got)
+	}
+}
+
+func TestToJSON(t *testing.T) {
+	value := map[string]any{"temperature": 21.5, "tags": []any{"a", "b"}, "ok": true}
+	want := `{"temperature":21.5,"tags":["a","b"],"ok":true}`
+
+	t.Run("should transcode CBOR", func(t *testing.T) {
+		data, err := cbor.Marshal(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ToJSON(CBOR, data, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		equalJSON(t, got, want)
+	})
+
+	t.Run("should transcode MessagePack", func(t *testing.T) {
+		data, err := msgpack.Marshal(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ToJSON(MsgPack, data, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		equalJSON(t, got, want)
+	})
+
+	t.Run("should format keys that are not strings", func(t *testing.T) {
+		data, err := msgpack.Marshal(map[int]string{1: "a"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ToJSON(MsgPack, data, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		equalJSON(t, got, `{"1":"a"}`)
+
+		data, err = cbor.Marshal(map[int]any{2: []byte("hi")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err = ToJSON(CBOR, data, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		equalJSON(t, got, `{"2":"aGk="}`)
+	})
+
+	t.Run("should transcode Protobuf with its schema", func(t *testing.T) {
+		desc, err := ParseSchema(testDescriptorSet(t), "sensors.v1.Reading")
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg := dynamicpb.NewMessage(desc)
+		msg.Set(desc.Fields().ByName("temperature"), protoreflect.ValueOfFloat64(21.5))
+		msg.Set(desc.Fields().ByName("name"), protoreflect.ValueOfString("probe"))
+		data, err := proto.Marshal(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := ToJSON(Protobuf, data, desc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		equalJSON(t, got, `{"temperature":21.5,"name":"probe"}`)
+
+		if _, err := ToJSON(Protobuf, data, nil); err == nil {
+			t.Error("expected an error without a schema")
+		}
+		if _, err := ToJSON(Protobuf, []byte{0xff}, desc); err == nil {
+			t.Error("expected an error for a malformed message")
+		}
+	})
+
+	t.Run("should return JSON as it is", func(t *testing.T) {
+		got, err := ToJSON(JSON, []byte(want), nil)
+		if err != nil || string(got) != want {
+			t.Errorf("expected %s, got %s %v", want, got, err)
+		}
+	})
+
+	t.Run("should reject malformed payloads", func(t *testing.T) {
+		nan, err := cbor.Marshal(math.NaN())
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, tc := range []struct {
+			name        string
+			contentType string
+			data        []byte
+		}{
+			{"truncated CBOR", CBOR, []byte{0xa1, 0x61}},
+			{"CBOR NaN", CBOR, nan},
+			{"CBOR with trailing data", CBOR, []byte{0x01, 0x02}},
+			{"truncated MessagePack", MsgPack, []byte{0x92, 0x01}},
+			{"MessagePack with trailing data", MsgPack, []byte{0x01, 0x02}},
+			{"invalid MessagePack type", MsgPack, []byte{0xc1}},
+			{"deep MessagePack", MsgPack, bytes.Repeat([]byte{0x91}, maxDepth+1)},
+			{"unsupported type", "text/plain", []byte("x")},
+		} {
+			if _, err := ToJSON(tc.contentType, tc.data, nil); err == nil {
+				t.Errorf("expected an error for %s", tc.name)
+			}
+		}
+	})
+}
+
+func TestParseSchema(t *testing.T) {
+	set := testDescriptorSet(t)
+
+	t.Run("should find the message type", func(t *testing.T) {
+		desc, err := ParseSchema(set, "sensors.v1.Reading")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if desc.Fields().Len() != 2 {
+			t.Errorf("expected 2 fields, got %d", desc.Fields().Len())
+		}
+	})
+
+	t.Run("should reject unknown message types and invalid sets", func(t *testing.T) {
+		if _, err := ParseSchema(set, "sensors.v1.Missing"); err == nil || !strings.Contains(err.Error(), "not found") {
+			t.Errorf("expected a not found error, got %v", err)
+		}
+		if _, err := ParseSchema(set, "sensors.v1"); err == nil {
+			t.Error("expected an error for a package name")
+		}
+		if _, err := ParseSchema([]byte{0xff, 0xff}, "sensors.v1.Reading"); err == nil {
+			t.Error("expected an error for an invalid set")
+		}
+	})
+}
+
+func TestCheckMsgPack(t *testing.T) {
+	t.Run("should accept every kind of value", func(t *testing.T) {
+		value := map[string]any{
+			"int8": int8(-100), "int64": int64(math.MinInt64), "uint64": uint64(math.MaxUint64),
+			"float32": float32(1.5), "float64": 2.5, "nil": nil, "bool": true,
+			"str": strings.Repeat("s", 300), "bin": bytes.Repeat([]byte{1}, 70000),
+			"array": make([]any, 20), "map": map[string]any{"a": []any{map[string]any{}}},
+		}
+		data, err := msgpack.Marshal(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := checkMsgPack(data, 4); err != nil {
+			t.Error(err)
+		}
+		if err := checkMsgPack(data, 3); err == nil {
+			t.Error("expected an error for depth 3")
+		}
+	})
+}
+
+func FuzzToJSON(f *testing.F) {
+	for _, seed := range []struct {
+		contentType string
+		data        []byte
+	}{
+		{CBOR, []byte{0xa1, 0x61, 0x61, 0x01}},
+		{CBOR, []byte{0xc1, 0x1a, 0x5f, 0x00, 0x00, 0x00}},
+		{MsgPack, []byte{0x81, 0xa1, 0x61, 0x01}},
+		{MsgPack, []byte{0x81, 0x01, 0xc4, 0x01, 0x00}},
+		{Protobuf, []byte{0x09, 0, 0, 0, 0, 0, 0, 0x35, 0x40}},
+	} {
+		f.Add(seed.contentType, seed.data)
+	}
+	desc, err := ParseSchema(testDescriptorSet(f), "sensors.v1.Reading")
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Fuzz(func(t *testing.T, contentType string, data []byte) {
+		got, err := ToJSON(contentType, data, desc)
+		if err == nil && !json.Valid(got) {
+			t.Errorf("expected valid JSON for %s %x, got %q", contentType, data, got)
+		}
+	})
+}
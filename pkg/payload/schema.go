@@ -0,0 +1,78 @@
+package payload
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"sync"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// maxCachedSchemas bounds the parsed schemas kept in memory. The cache is emptied when it
+// fills up, since schemas rarely change and are cheap to parse again.
+const maxCachedSchemas = 256
+
+var schemaCache = struct {
+	sync.Mutex
+	schemas map[[sha256.Size]byte]protoreflect.MessageDescriptor
+}{schemas: make(map[[sha256.Size]byte]protoreflect.MessageDescriptor)}
+
+// ParseSchema finds a Protobuf message type in a serialized FileDescriptorSet, as written
+// by protoc --descriptor_set_out --include_imports. Parsed schemas are cached.
+// Params:
+// - descriptorSet: []byte - the serialized FileDescriptorSet
+// - messageType: string - the full name of the message type, e.g. "sensors.v1.Reading"
+// Returns:
+// - protoreflect.MessageDescriptor: the message type
+// - error: error if the set is invalid or does not define the message type
+func ParseSchema(descriptorSet []byte, messageType string) (protoreflect.MessageDescriptor, error) {
+	h := sha256.New()
+	h.Write([]byte(messageType))
+	h.Write([]byte{0})
+	h.Write(descriptorSet)
+	var key [sha256.Size]byte
+	h.Sum(key[:0])
+
+	schemaCache.Lock()
+	desc, ok := schemaCache.schemas[key]
+	schemaCache.Unlock()
+	if ok {
+		return desc, nil
+	}
+
+	desc, err := parseSchema(descriptorSet, messageType)
+	if err != nil {
+		return nil, err
+	}
+
+	schemaCache.Lock()
+	if len(schemaCache.schemas) >= maxCachedSchemas {
+		clear(schemaCache.schemas)
+	}
+	schemaCache.schemas[key] = desc
+	schemaCache.Unlock()
+	return desc, nil
+}
+
+func parseSchema(descriptorSet []byte, messageType string) (protoreflect.MessageDescriptor, error) {
+	var set descriptorpb.FileDescriptorSet
+	if err := proto.Unmarshal(descriptorSet, &set); err != nil {
+		return nil, fmt.Errorf("invalid descriptor set: %w", err)
+	}
+	files, err := protodesc.NewFiles(&set)
+	if err != nil {
+		return nil, fmt.Errorf("invalid descriptor set: %w", err)
+	}
+	d, err := files.FindDescriptorByName(protoreflect.FullName(messageType))
+	if err != nil {
+		return nil, fmt.Errorf("message type %q not found in descriptor set", messageType)
+	}
+	desc, ok := d.(protoreflect.MessageDescriptor)
+	if !ok {
+		return nil, fmt.Errorf("%q is not a message type", messageType)
+	}
+	return desc, nil
+}
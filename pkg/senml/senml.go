@@ -0,0 +1,372 @@
+// Package senml decodes Sensor Measurement Lists (RFC 8428) in JSON and CBOR and resolves
+// their records into one self-contained measurement each, with the base name, time, unit,
+// value and sum applied.
+package senml
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// Media types of SenML packs.
+const (
+	JSON = "application/senml+json"
+	CBOR = "application/senml+cbor"
+)
+
+// Version is the highest SenML version accepted in bver.
+const Version = 10
+
+// relativeTime is the resolved time below which times are relative to the time the pack
+// was received, 2**28 seconds.
+const relativeTime = 1 << 28
+
+// maxTime bounds resolved times, in seconds, so they convert to a time.Duration.
+const maxTime = 1 << 33
+
+// ErrUnsupported is returned for a media type that is not a SenML format.
+var ErrUnsupported = errors.New("unsupported SenML format")
+
+// labels are the names of the integer labels of SenML CBOR.
+var labels = map[int64]string{
+	-1: "bver", -2: "bn", -3: "bt", -4: "bu", -5: "bv", -16: "bs",
+	0: "n", 1: "u", 2: "v", 3: "vs", 4: "vb", 5: "s", 6: "t", 7: "ut", 8: "vd",
+}
+
+// cborDecMode decodes SenML CBOR, whose records are flat maps.
+var cborDecMode = mustCBORDecMode()
+
+func mustCBORDecMode() cbor.DecMode {
+	mode, err := cbor.DecOptions{
+		MaxNestedLevels: 16,
+		DupMapKey:       cbor.DupMapKeyEnforcedAPF,
+	}.DecMode()
+	if err != nil {
+		panic(err)
+	}
+	return mode
+}
+
+// Measurement is a resolved SenML record.
+type Measurement struct {
+	// Name is the record's name prefixed with the base name.
+	Name string `json:"name"`
+	// Unit is a unit of the SenML units registry, empty if the record has none.
+	Unit string `json:"unit,omitempty"`
+	// Value is a float64, string, bool or, for data values, []byte. It is nil for records
+	// with only a sum.
+	Value any `json:"value,omitempty"`
+	// Sum is the integrated value, nil if the record has none.
+	Sum *float64 `json:"sum,omitempty"`
+	// Time is when the measurement was taken, in UTC.
+	Time time.Time `json:"time"`
+}
+
+// Supported reports whether a media type is a SenML format.
+// Params:
+// - contentType: string - the media type, without parameters
+// Returns:
+// - bool: true for SenML JSON and CBOR
+func Supported(contentType string) bool {
+	return contentType == JSON || contentType == CBOR
+}
+
+// Parse decodes a SenML pack and resolves its records. Records carrying only base fields
+// set them for the records after them and are not returned.
+// Params:
+// - contentType: string - the media type of the pack
+// - data: []byte - the pack
+// - now: time.Time - the time relative times are resolved against
+// Returns:
+// - []Measurement: the resolved records, in order
+// - error: error if the pack is malformed or uses a unit outside the registry
+func Parse(contentType string, data []byte, now time.Time) ([]Measurement, error) {
+	pack, err := decode(contentType, data)
+	if err != nil {
+		return nil, err
+	}
+	return resolve(pack, now)
+}
+
+// decode decodes a pack into its records' fields, keyed by label name.
+func decode(contentType string, data []byte) ([]map[string]any, error) {
+	switch contentType {
+	case JSON:
+		var pack []map[string]any
+		if err := json.Unmarshal(data, &pack); err != nil {
+			return nil, fmt.Errorf("invalid SenML JSON: %w", err)
+		}
+		return pack, nil
+	case CBOR:
+		var pack []map[any]any
+		if err := cborDecMode.Unmarshal(data, &pack); err != nil {
+			return nil, fmt.Errorf("invalid SenML CBOR: %w", err)
+		}
+		records := make([]map[string]any, len(pack))
+		for i, fields := range pack {
+			records[i] = make(map[string]any, len(fields))
+			for key, value := range fields {
+				switch key := key.(type) {
+				case string:
+					records[i][key] = value
+				case int64:
+					if name, ok := labels[key]; ok {
+						records[i][name] = value
+					}
+				case uint64:
+					if name, ok := labels[int64(min(key, math.MaxInt64))]; ok {
+						records[i][name] = value
+					}
+				default:
+					return nil, fmt.Errorf("record %d has a %T label", i, key)
+				}
+			}
+		}
+		return records, nil
+	}
+	return nil, fmt.Errorf("%w %q", ErrUnsupported, contentType)
+}
+
+// record is a decoded SenML record. Fields absent from the record are nil.
+type record struct {
+	baseName, baseUnit *string
+	baseTime           *float64
+	baseValue, baseSum *float64
+	baseVersion        *float64
+	name, unit         *string
+	value, sum, time   *float64
+	stringValue        *string
+	boolValue          *bool
+	dataValue          []byte
+	values             int
+}
+
+// newRecord reads a record's fields, checking their types.
+func newRecord(fields map[string]any) (*record, error) {
+	rec := &record{}
+	for key, value := range fields {
+		var err error
+		switch key {
+		case "bn":
+			rec.baseName, err = stringField(key, value)
+		case "bu":
+			rec.baseUnit, err = stringField(key, value)
+		case "bt":
+			rec.baseTime, err = numberField(key, value)
+		case "bv":
+			rec.baseValue, err = numberField(key, value)
+		case "bs":
+			rec.baseSum, err = numberField(key, value)
+		case "bver":
+			rec.baseVersion, err = numberField(key, value)
+		case "n":
+			rec.name, err = stringField(key, value)
+		case "u":
+			rec.unit, err = stringField(key, value)
+		case "v":
+			rec.value, err = numberField(key, value)
+			rec.values++
+		case "vs":
+			rec.stringValue, err = stringField(key, value)
+			rec.values++
+		case "vb":
+			b, ok := value.(bool)
+			if !ok {
+				return nil, errors.New("field vb must be a boolean")
+			}
+			rec.boolValue = &b
+			rec.values++
+		case "vd":
+			rec.dataValue, err = dataField(value)
+			rec.values++
+		case "s":
+			rec.sum, err = numberField(key, value)
+		case "t":
+			rec.time, err = numberField(key, value)
+		case "ut":
+			_, err = numberField(key, value)
+		default:
+			// fields ending in _ change the meaning of the record
+			if strings.HasSuffix(key, "_") {
+				return nil, fmt.Errorf("unsupported field %q", key)
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return rec, nil
+}
+
+func stringField(key string, value any) (*string, error) {
+	s, ok := value.(string)
+	if !ok {
+		return nil, fmt.Errorf("field %s must be a string", key)
+	}
+	return &s, nil
+}
+
+func numberField(key string, value any) (*float64, error) {
+	var f float64
+	switch value := value.(type) {
+	case float64:
+		f = value
+	case float32:
+		f = float64(value)
+	case int64:
+		f = float64(value)
+	case uint64:
+		f = float64(value)
+	default:
+		return nil, fmt.Errorf("field %s must be a number", key)
+	}
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return nil, fmt.Errorf("field %s must be finite", key)
+	}
+	return &f, nil
+}
+
+// dataField reads a data value, base64url encoded in JSON and a byte string in CBOR.
+func dataField(value any) ([]byte, error) {
+	switch value := value.(type) {
+	case []byte:
+		return value, nil
+	case string:
+		data, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(value, "="))
+		if err != nil {
+			return nil, fmt.Errorf("field vd must be base64url: %w", err)
+		}
+		return data, nil
+	}
+	return nil, errors.New("field vd must be base64url or a byte string")
+}
+
+// resolve applies each record's base fields to it and the records after it.
+func resolve(pack []map[string]any, now time.Time) ([]Measurement, error) {
+	if len(pack) == 0 {
+		return nil, errors.New("pack has no records")
+	}
+	var baseName, baseUnit string
+	var baseTime, baseValue, baseSum float64
+	measurements := make([]Measurement, 0, len(pack))
+	for i, fields := range pack {
+		rec, err := newRecord(fields)
+		if err != nil {
+			return nil, fmt.Errorf("record %d: %w", i, err)
+		}
+		if rec.baseVersion != nil && (*rec.baseVersion < 1 || *rec.baseVersion > Version || *rec.baseVersion != math.Trunc(*rec.baseVersion)) {
+			return nil, fmt.Errorf("record %d: unsupported SenML version %v", i, *rec.baseVersion)
+		}
+		if rec.baseName != nil {
+			baseName = *rec.baseName
+		}
+		if rec.baseUnit != nil {
+			baseUnit = *rec.baseUnit
+		}
+		if rec.baseTime != nil {
+			baseTime = *rec.baseTime
+		}
+		if rec.baseValue != nil {
+			baseValue = *rec.baseValue
+		}
+		if rec.baseSum != nil {
+			baseSum = *rec.baseSum
+		}
+
+		if rec.values == 0 && rec.sum == nil {
+			if rec.name == nil && rec.unit == nil && rec.time == nil {
+				continue
+			}
+			return nil, fmt.Errorf("record %d has no value or sum", i)
+		}
+		if rec.values > 1 {
+			return nil, fmt.Errorf("record %d has more than one value", i)
+		}
+
+		m, err := rec.resolve(baseName, baseUnit, baseTime, baseValue, baseSum, now)
+		if err != nil {
+			return nil, fmt.Errorf("record %d: %w", i, err)
+		}
+		measurements = append(measurements, m)
+	}
+	if len(measurements) == 0 {
+		return nil, errors.New("pack has no measurements")
+	}
+	return measurements, nil
+}
+
+// resolve returns the measurement of a record with a value or sum, given the base fields
+// in effect.
+func (rec *record) resolve(baseName, baseUnit string, baseTime, baseValue, baseSum float64, now time.Time) (Measurement, error) {
+	m := Measurement{Name: baseName, Unit: baseUnit}
+	if rec.name != nil {
+		m.Name += *rec.name
+	}
+	if err := checkName(m.Name); err != nil {
+		return Measurement{}, err
+	}
+	if rec.unit != nil {
+		m.Unit = *rec.unit
+	}
+	if m.Unit != "" && !units[m.Unit] {
+		return Measurement{}, fmt.Errorf("unit %q is not in the SenML units registry", m.Unit)
+	}
+
+	t := baseTime
+	if rec.time != nil {
+		t += *rec.time
+	}
+	if math.Abs(t) >= maxTime {
+		return Measurement{}, fmt.Errorf("time %v is out of range", t)
+	}
+	if t < relativeTime {
+		m.Time = now.Add(time.Duration(t * float64(time.Second))).UTC()
+	} else {
+		sec, frac := math.Modf(t)
+		m.Time = time.Unix(int64(sec), int64(frac*float64(time.Second))).UTC()
+	}
+
+	switch {
+	case rec.value != nil:
+		v := baseValue + *rec.value
+		if math.IsInf(v, 0) {
+			return Measurement{}, errors.New("value is out of range")
+		}
+		m.Value = v
+	case rec.stringValue != nil:
+		m.Value = *rec.stringValue
+	case rec.boolValue != nil:
+		m.Value = *rec.boolValue
+	case rec.dataValue != nil:
+		m.Value = rec.dataValue
+	}
+	if rec.sum != nil {
+		s := baseSum + *rec.sum
+		if math.IsInf(s, 0) {
+			return Measurement{}, errors.New("sum is out of range")
+		}
+		m.Sum = &s
+	}
+	return m, nil
+}
+
+// checkName checks a resolved name against the characters SenML allows.
+func checkName(name string) error {
+	if name == "" {
+		return errors.New("name is empty")
+	}
+	for i, c := range name {
+		alnum := 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9'
+		if !alnum && (i == 0 || !strings.ContainsRune("-:./_", c)) {
+			return fmt.Errorf("name %q must start with a letter or digit and contain only letters, digits and -:./_", name)
+		}
+	}
+	return nil
+}
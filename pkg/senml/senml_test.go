@@ -0,0 +1,201 @@
+package senml
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+var testNow = time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+
+func float(f float64) *float64 {
+	return &f
+}
+
+func TestParse(t *testing.T) {
+	t.Run("should resolve base name, time, unit and value", func(t *testing.T) {
+		pack := `[
+			{"bn":"urn:dev:ow:10e2073a01080063:","bt":1.772366e+09,"bu":"A","bver":5,"n":"voltage","u":"V","v":120.1},
+			{"n":"current","t":-5,"v":1.2},
+			{"n":"current","t":-4,"v":1.3},
+			{"bn":"urn:dev:ow:10e2073a01080064:","bv":100,"n":"current","t":10,"v":-0.5},
+			{"n":"label","vs":"kitchen"},
+			{"n":"open","vb":false},
+			{"n":"blob","vd":"AQID"},
+			{"n":"energy","u":"J","bs":1000,"s":25}
+		]`
+		got, err := Parse(JSON, []byte(pack), testNow)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		base := time.Unix(1772366000, 0).UTC()
+		want := []Measurement{
+			{Name: "urn:dev:ow:10e2073a01080063:voltage", Unit: "V", Value: 120.1, Time: base},
+			{Name: "urn:dev:ow:10e2073a01080063:current", Unit: "A", Value: 1.2, Time: base.Add(-5 * time.Second)},
+			{Name: "urn:dev:ow:10e2073a01080063:current", Unit: "A", Value: 1.3, Time: base.Add(-4 * time.Second)},
+			{Name: "urn:dev:ow:10e2073a01080064:current", Unit: "A", Value: 99.5, Time: base.Add(10 * time.Second)},
+			{Name: "urn:dev:ow:10e2073a01080064:label", Unit: "A", Value: "kitchen", Time: base},
+			{Name: "urn:dev:ow:10e2073a01080064:open", Unit: "A", Value: false, Time: base},
+			{Name: "urn:dev:ow:10e2073a01080064:blob", Unit: "A", Value: []byte{1, 2, 3}, Time: base},
+			{Name: "urn:dev:ow:10e2073a01080064:energy", Unit: "J", Sum: float(1025), Time: base},
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("expected\n%+v\ngot\n%+v", want, got)
+		}
+	})
+
+	t.Run("should resolve times below 2**28 relative to now", func(t *testing.T) {
+		got, err := Parse(JSON, []byte(`[{"n":"a","v":1},{"n":"b","t":-60,"v":2},{"bt":10,"n":"c","t":5,"v":3}]`), testNow)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, want := range []time.Time{testNow, testNow.Add(-time.Minute), testNow.Add(15 * time.Second)} {
+			if !got[i].Time.Equal(want) {
+				t.Errorf("record %d: expected %s, got %s", i, want, got[i].Time)
+			}
+		}
+	})
+
+	t.Run("should skip records with only base fields", func(t *testing.T) {
+		got, err := Parse(JSON, []byte(`[{"bn":"dev1/","bu":"Cel"},{"n":"temp","v":21.5}]`), testNow)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != 1 || got[0].Name != "dev1/temp" || got[0].Unit != "Cel" {
+			t.Errorf("expected a single dev1/temp measurement in Cel, got %+v", got)
+		}
+	})
+
+	t.Run("should decode CBOR with integer labels", func(t *testing.T) {
+		data, err := cbor.Marshal([]map[any]any{
+			{-2: "dev1/", -3: 1772366000, -4: "Cel", 0: "temp", 2: 21.5},
+			{0: "raw", 8: []byte{0xff}, 6: 1},
+			{"n": "humidity", "u": "%RH", "v": 40},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := Parse(CBOR, data, testNow)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		base := time.Unix(1772366000, 0).UTC()
+		want := []Measurement{
+			{Name: "dev1/temp", Unit: "Cel", Value: 21.5, Time: base},
+			{Name: "dev1/raw", Unit: "Cel", Value: []byte{0xff}, Time: base.Add(time.Second)},
+			{Name: "dev1/humidity", Unit: "%RH", Value: float64(40), Time: base},
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("expected\n%+v\ngot\n%+v", want, got)
+		}
+	})
+
+	t.Run("should encode measurements as canonical JSON events", func(t *testing.T) {
+		got, err := Parse(JSON, []byte(`[{"bn":"dev1/","bt":1772366000.25,"n":"temp","u":"Cel","v":21.5},{"n":"count","s":3}]`), testNow)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var events []string
+		for _, m := range got {
+			data, err := json.Marshal(m)
+			if err != nil {
+				t.Fatal(err)
+			}
+			events = append(events, string(data))
+		}
+		want := []string{
+			`{"name":"dev1/temp","unit":"Cel","value":21.5,"time":"2026-03-01T11:53:20.25Z"}`,
+			`{"name":"dev1/count","sum":3,"time":"2026-03-01T11:53:20.25Z"}`,
+		}
+		if !reflect.DeepEqual(events, want) {
+			t.Errorf("expected %s, got %s", want, events)
+		}
+	})
+
+	t.Run("should reject malformed packs", func(t *testing.T) {
+		for _, tc := range []struct {
+			name string
+			pack string
+			err  string
+		}{
+			{"an empty pack", `[]`, "no records"},
+			{"a pack of base fields only", `[{"bn":"dev1/"}]`, "no measurements"},
+			{"an object", `{"n":"a","v":1}`, "invalid SenML JSON"},
+			{"a record without a value", `[{"n":"a","u":"V"}]`, "has no value or sum"},
+			{"a record with two values", `[{"n":"a","v":1,"vs":"1"}]`, "more than one value"},
+			{"a unit outside the registry", `[{"n":"a","u":"degC","v":1}]`, `unit "degC"`},
+			{"an empty name", `[{"v":1}]`, "name is empty"},
+			{"a name with invalid characters", `[{"n":"temp erature","v":1}]`, "must start with a letter"},
+			{"a name starting with punctuation", `[{"bn":"/dev1","n":"a","v":1}]`, "must start with a letter"},
+			{"a must-understand field", `[{"n":"a","v":1,"rt_":5}]`, `unsupported field "rt_"`},
+			{"a newer version", `[{"bver":11,"n":"a","v":1}]`, "unsupported SenML version 11"},
+			{"a string value that is not a string", `[{"n":"a","vs":1}]`, "field vs must be a string"},
+			{"a numeric value that is a string", `[{"n":"a","v":"1"}]`, "field v must be a number"},
+			{"a data value that is not base64url", `[{"n":"a","vd":"a+b/"}]`, "field vd must be base64url"},
+			{"a time out of range", `[{"n":"a","t":1e12,"v":1}]`, "out of range"},
+		} {
+			t.Run("should reject "+tc.name, func(t *testing.T) {
+				_, err := Parse(JSON, []byte(tc.pack), testNow)
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Errorf("expected an error containing %q, got %v", tc.err, err)
+				}
+			})
+		}
+	})
+
+	t.Run("should ignore unknown fields and labels", func(t *testing.T) {
+		data, err := cbor.Marshal([]map[any]any{{0: "a", 2: 1, 99: "x", "foo": 1}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := Parse(CBOR, data, testNow); err != nil {
+			t.Errorf("expected unknown CBOR labels to be ignored, got %v", err)
+		}
+		if _, err := Parse(JSON, []byte(`[{"n":"a","v":1,"foo":{"bar":[1]}}]`), testNow); err != nil {
+			t.Errorf("expected unknown JSON fields to be ignored, got %v", err)
+		}
+	})
+
+	t.Run("should reject other media types", func(t *testing.T) {
+		if _, err := Parse("application/json", []byte(`[{"n":"a","v":1}]`), testNow); err == nil {
+			t.Error("expected an error")
+		}
+	})
+}
+
+func FuzzParse(f *testing.F) {
+	for _, seed := range []string{
+		`[{"bn":"dev1/","bt":1.772366e+09,"n":"temp","u":"Cel","v":21.5}]`,
+		`[{"n":"a","vd":"AQID"},{"n":"b","vb":true,"t":-1}]`,
+		`[{"bn":"x"},{"n":"y","s":1,"bs":2}]`,
+	} {
+		f.Add(JSON, []byte(seed))
+		var pack []map[string]any
+		_ = json.Unmarshal([]byte(seed), &pack)
+		data, _ := cbor.Marshal(pack)
+		f.Add(CBOR, data)
+	}
+	f.Fuzz(func(t *testing.T, contentType string, data []byte) {
+		measurements, err := Parse(contentType, data, testNow)
+		if err != nil {
+			return
+		}
+		for _, m := range measurements {
+			if err := checkName(m.Name); err != nil {
+				t.Errorf("expected a valid name, got %v", err)
+			}
+			if m.Unit != "" && !units[m.Unit] {
+				t.Errorf("expected a registered unit, got %q", m.Unit)
+			}
+			if _, err := json.Marshal(m); err != nil {
+				t.Errorf("expected %+v to encode as JSON, got %v", m, err)
+			}
+		}
+	})
+}
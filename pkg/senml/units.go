@@ -0,0 +1,19 @@
+package senml
+
+// units is the SenML units registry, from RFC 8428 and the additions of RFC 8798. Units
+// the registry marks as not recommended are still accepted.
+var units = map[string]bool{
+	// RFC 8428
+	"m": true, "kg": true, "g": true, "s": true, "A": true, "K": true, "cd": true,
+	"mol": true, "Hz": true, "rad": true, "sr": true, "N": true, "Pa": true, "J": true,
+	"W": true, "C": true, "V": true, "F": true, "Ohm": true, "S": true, "Wb": true,
+	"T": true, "H": true, "Cel": true, "lm": true, "lx": true, "Bq": true, "Gy": true,
+	"Sv": true, "kat": true, "m2": true, "m3": true, "l": true, "m/s": true, "m/s2": true,
+	"m3/s": true, "l/s": true, "W/m2": true, "cd/m2": true, "bit": true, "bit/s": true,
+	"lat": true, "lon": true, "pH": true, "dB": true, "dBW": true, "Bspl": true,
+	"count": true, "/": true, "%": true, "%RH": true, "%EL": true, "EL": true,
+	"1/s": true, "1/min": true, "beat/min": true, "beats": true, "S/m": true,
+	// RFC 8798
+	"B": true, "VA": true, "VAs": true, "var": true, "vars": true, "J/m": true,
+	"kg/m3": true, "deg": true,
+}
@@ -0,0 +1,4 @@
+// Package telemetrypb holds the gRPC API of the data and consumer services, generated
+// from telemetry.proto with `make proto`. Clients import it to send readings with
+// IngestServiceClient and to subscribe to devices with StreamServiceClient.
+package telemetrypb
@@ -0,0 +1,87 @@
+package tracing
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// InstrumentationName identifies spans created by this module.
+const InstrumentationName = "github.com/RaghibA/iot-telemetry"
+
+// Init installs the global tracer provider and W3C trace context propagator.
+// Spans are exported over OTLP/HTTP when endpoint is set. Otherwise spans are
+// still created, so trace context keeps flowing through HTTP and Kafka, but
+// they are not exported anywhere.
+// Params:
+// - ctx: context.Context - the context used to create the exporter
+// - serviceName: string - the service name reported on every span
+// - endpoint: string - the OTLP/HTTP collector URL, e.g. http://otel-collector:4318
+// Returns:
+// - func(context.Context) error: flushes and stops the tracer provider
+// - error: error if any occurred while creating the exporter
+func Init(ctx context.Context, serviceName string, endpoint string) (func(context.Context) error, error) {
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(
+		semconv.SchemaURL,
+		semconv.ServiceName(serviceName),
+	))
+	if err != nil {
+		return nil, err
+	}
+
+	opts := []sdktrace.TracerProviderOption{sdktrace.WithResource(res)}
+	if endpoint != "" {
+		exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(endpoint))
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, sdktrace.WithBatcher(exporter))
+		slog.Info("OTLP trace exporter configured", "endpoint", endpoint)
+	}
+
+	tp := sdktrace.NewTracerProvider(opts...)
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+
+	return tp.Shutdown, nil
+}
+
+// Tracer returns the module tracer from the global tracer provider.
+// Params: None
+// Returns:
+// - trace.Tracer: the tracer
+func Tracer() trace.Tracer {
+	return otel.Tracer(InstrumentationName)
+}
+
+// Middleware creates an HTTP server span for every request, continuing any
+// trace context sent by the client. Spans are named after the matched route.
+// Params:
+// - serviceName: string - the service handling the requests
+// Returns:
+// - func(http.Handler) http.Handler: the middleware
+func Middleware(serviceName string) func(http.Handler) http.Handler {
+	return otelhttp.NewMiddleware(serviceName,
+		otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+			if route := mux.CurrentRoute(r); route != nil {
+				if tmpl, err := route.GetPathTemplate(); err == nil {
+					return r.Method + " " + tmpl
+				}
+			}
+			return r.Method
+		}),
+	)
+}
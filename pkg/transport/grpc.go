@@ -0,0 +1,47 @@
+package transport
+
+import (
+	"context"
+	"maps"
+
+	"github.com/RaghibA/iot-telemetry/pkg/broker"
+	"github.com/RaghibA/iot-telemetry/pkg/telemetrypb"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// GRPC sends messages as telemetrypb.Event messages on a server stream.
+type GRPC struct {
+	stream grpc.ServerStreamingServer[telemetrypb.Event]
+}
+
+// NewGRPC returns a Sender streaming to a gRPC call.
+// Params:
+// - stream: grpc.ServerStreamingServer[telemetrypb.Event] - the call's stream
+// Returns:
+// - *GRPC: a pointer to the created GRPC
+func NewGRPC(stream grpc.ServerStreamingServer[telemetrypb.Event]) *GRPC {
+	return &GRPC{stream: stream}
+}
+
+// Send sends the message as an event, with its content type taken out of the headers.
+// Params:
+// - ctx: context.Context - unused, sends are bounded by the call
+// - msg: broker.Message - the message to send
+// Returns:
+// - error: error if the call has ended
+func (g *GRPC) Send(ctx context.Context, msg broker.Message) error {
+	headers := maps.Clone(msg.Headers)
+	contentType := headers[broker.ContentTypeHeader]
+	delete(headers, broker.ContentTypeHeader)
+
+	return g.stream.Send(&telemetrypb.Event{
+		DeviceId:    msg.Key,
+		Data:        msg.Value,
+		ContentType: contentType,
+		Headers:     headers,
+		Offset:      msg.Offset,
+		Partition:   msg.Partition,
+		Time:        timestamppb.New(msg.Timestamp),
+	})
+}
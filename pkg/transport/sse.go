@@ -0,0 +1,86 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/RaghibA/iot-telemetry/pkg/broker"
+)
+
+// LastEventIDHeader is sent by server-sent events clients when they reconnect.
+const LastEventIDHeader = "Last-Event-ID"
+
+// SSE sends messages as server-sent events. The event ID is the message offset, so a
+// reconnecting client can resume with SSEResumeOptions.
+type SSE struct {
+	w  http.ResponseWriter
+	rc *http.ResponseController
+}
+
+// NewSSE writes the event stream headers and returns a Sender streaming to w.
+// Params:
+// - w: http.ResponseWriter - the response writer, which must support flushing
+// Returns:
+// - *SSE: a pointer to the created SSE
+// - error: error if the response could not be flushed
+func NewSSE(w http.ResponseWriter) (*SSE, error) {
+	rc := http.NewResponseController(w)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") // disable nginx response buffering
+
+	// the stream outlives the server write timeout
+	_ = rc.SetWriteDeadline(time.Time{})
+
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		return nil, err
+	}
+	return &SSE{w: w, rc: rc}, nil
+}
+
+// Send writes the message as an event and flushes it to the client.
+// Params:
+// - ctx: context.Context - unused, writes are bounded by the connection
+// - msg: broker.Message - the message to send
+// Returns:
+// - error: error if the write failed
+func (s *SSE) Send(ctx context.Context, msg broker.Message) error {
+	if _, err := s.w.Write(formatEvent(msg)); err != nil {
+		return err
+	}
+	return s.rc.Flush()
+}
+
+// formatEvent encodes a message as an event. Each line of the value becomes a data
+// field, since a data field cannot contain line breaks.
+func formatEvent(msg broker.Message) []byte {
+	var b bytes.Buffer
+	b.WriteString("id: ")
+	b.WriteString(strconv.FormatUint(msg.Offset, 10))
+	b.WriteByte('\n')
+	for _, line := range bytes.Split(msg.Value, []byte("\n")) {
+		b.WriteString("data: ")
+		b.Write(bytes.TrimSuffix(line, []byte("\r")))
+		b.WriteByte('\n')
+	}
+	b.WriteByte('\n')
+	return b.Bytes()
+}
+
+// SSEResumeOptions returns where a server-sent events subscription starts: after the
+// last event the client received if it sent a Last-Event-ID, otherwise at the newest message.
+// Params:
+// - r: *http.Request - the event stream request
+// Returns:
+// - broker.SubscribeOptions: the subscription options
+func SSEResumeOptions(r *http.Request) broker.SubscribeOptions {
+	if id, err := strconv.ParseUint(r.Header.Get(LastEventIDHeader), 10, 64); err == nil {
+		return broker.SubscribeOptions{Start: broker.StartAtOffset, Offset: id + 1}
+	}
+	return broker.SubscribeOptions{Start: broker.StartNewest}
+}
@@ -0,0 +1,53 @@
+// Package transport delivers broker subscriptions to clients. A Sender adapts one
+// delivery mechanism, such as a websocket or a server-sent events stream, and Forward
+// pumps a subscription into it, so the broker code stays independent of transports.
+package transport
+
+import (
+	"context"
+
+	"github.com/RaghibA/iot-telemetry/pkg/broker"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+)
+
+// Sender delivers messages to a single client.
+type Sender interface {
+	// Send delivers msg, returning an error if the client can no longer receive messages.
+	Send(ctx context.Context, msg broker.Message) error
+}
+
+// Forward delivers messages from sub to sender until ctx is done, the subscription ends
+// or a send fails. Each delivery is traced in a span linked to the trace that published
+// the message.
+// Params:
+// - ctx: context.Context - the context bounding the delivery
+// - sub: broker.Subscription - the subscription to read from
+// - sender: Sender - the transport to deliver to
+// - attrs: ...attribute.KeyValue - attributes added to every delivery span
+// Returns:
+// - error: the error that stopped the delivery, never nil
+func Forward(ctx context.Context, sub broker.Subscription, sender Sender, attrs ...attribute.KeyValue) error {
+	for {
+		msg, err := sub.Next(ctx)
+		if err != nil {
+			return err
+		}
+		if err := deliver(ctx, sender, msg, attrs); err != nil {
+			return err
+		}
+	}
+}
+
+// deliver sends one message inside a delivery span.
+func deliver(ctx context.Context, sender Sender, msg broker.Message, attrs []attribute.KeyValue) error {
+	_, span := broker.StartDeliverSpan(msg, attrs...)
+	defer span.End()
+
+	if err := sender.Send(ctx, msg); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "send failed")
+		return err
+	}
+	return nil
+}
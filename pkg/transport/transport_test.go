@@ -0,0 +1,104 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/RaghibA/iot-telemetry/pkg/broker"
+)
+
+var errStop = errors.New("stop")
+
+// recordingSender records messages and fails once it has received limit of them.
+type recordingSender struct {
+	sent  []broker.Message
+	limit int
+}
+
+func (s *recordingSender) Send(ctx context.Context, msg broker.Message) error {
+	if len(s.sent) == s.limit {
+		return errStop
+	}
+	s.sent = append(s.sent, msg)
+	return nil
+}
+
+func TestForward(t *testing.T) {
+	t.Run("should deliver messages in order until a send fails", func(t *testing.T) {
+		mb := broker.NewMockBroker()
+		mb.Backlog["stream"] = []broker.Message{{Value: []byte("1")}, {Value: []byte("2")}}
+		sub, err := mb.Subscribe(context.Background(), "stream", broker.SubscribeOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, v := range []string{"3", "4"} {
+			if _, err := mb.Publish(context.Background(), "stream", broker.Message{Value: []byte(v)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		sender := &recordingSender{limit: 3}
+		if err := Forward(context.Background(), sub, sender); !errors.Is(err, errStop) {
+			t.Errorf("expected the send error, got %v", err)
+		}
+		if len(sender.sent) != 3 {
+			t.Fatalf("expected 3 messages, got %d", len(sender.sent))
+		}
+		for i, want := range []string{"1", "2", "3"} {
+			if got := string(sender.sent[i].Value); got != want {
+				t.Errorf("expected message %d to be %s, got %s", i, want, got)
+			}
+		}
+	})
+
+	t.Run("should stop when the context is done", func(t *testing.T) {
+		mb := broker.NewMockBroker()
+		sub, err := mb.Subscribe(context.Background(), "stream", broker.SubscribeOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if err := Forward(ctx, sub, &recordingSender{limit: 1}); !errors.Is(err, context.Canceled) {
+			t.Errorf("expected context.Canceled, got %v", err)
+		}
+	})
+}
+
+func TestSSE(t *testing.T) {
+	t.Run("should write events with the offset as id", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		sse, err := NewSSE(rec)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := sse.Send(context.Background(), broker.Message{Offset: 7, Value: []byte("{\r\n\"temp\": 21\n}")}); err != nil {
+			t.Fatal(err)
+		}
+
+		if got := rec.Header().Get("Content-Type"); got != "text/event-stream" {
+			t.Errorf("expected text/event-stream, got %s", got)
+		}
+		want := "id: 7\ndata: {\ndata: \"temp\": 21\ndata: }\n\n"
+		if got := rec.Body.String(); got != want {
+			t.Errorf("expected %q, got %q", want, got)
+		}
+	})
+
+	t.Run("should resume after the last event id", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/events", nil)
+		if opts := SSEResumeOptions(req); opts.Start != broker.StartNewest {
+			t.Errorf("expected to start at the newest message, got %+v", opts)
+		}
+
+		req.Header.Set(LastEventIDHeader, "41")
+		if opts := SSEResumeOptions(req); opts.Start != broker.StartAtOffset || opts.Offset != 42 {
+			t.Errorf("expected to start at offset 42, got %+v", opts)
+		}
+	})
+}
@@ -0,0 +1,206 @@
+package transport
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/RaghibA/iot-telemetry/pkg/broker"
+	"github.com/RaghibA/iot-telemetry/pkg/payload"
+	"github.com/gorilla/websocket"
+)
+
+// maxCloseReason is the longest reason that fits in a close frame.
+const maxCloseReason = 123
+
+// WebSocketOptions configures the handshake, buffering and keepalive of websocket
+// connections.
+type WebSocketOptions struct {
+	// PingInterval is the time between pings sent to the client.
+	PingInterval time.Duration
+	// PongTimeout is how long the client may stay silent before it is considered gone.
+	// It must be longer than PingInterval.
+	PongTimeout time.Duration
+	// WriteTimeout bounds every write to the client.
+	WriteTimeout time.Duration
+
+	// AllowedOrigins lists the origins, besides the server's own, that browsers may open
+	// a websocket from, e.g. https://dashboard.example.com. An entry may use a wildcard
+	// subdomain, https://*.example.com, and "*" allows every origin.
+	AllowedOrigins []string
+	// Compression negotiates permessage-deflate with clients that support it.
+	Compression bool
+	// ReadBufferSize and WriteBufferSize are the connection I/O buffer sizes in bytes.
+	ReadBufferSize  int
+	WriteBufferSize int
+	// MaxMessageSize is the largest message in bytes a client may send. Larger messages
+	// close the connection with 1009.
+	MaxMessageSize int64
+}
+
+// Upgrader creates a websocket upgrader enforcing the origin policy, buffer sizes and
+// compression of the options.
+// Params:
+// - subprotocols: ...string - the subprotocols the server supports, in order of preference
+// Returns:
+// - *websocket.Upgrader: the upgrader
+func (o WebSocketOptions) Upgrader(subprotocols ...string) *websocket.Upgrader {
+	return &websocket.Upgrader{
+		ReadBufferSize:    o.ReadBufferSize,
+		WriteBufferSize:   o.WriteBufferSize,
+		Subprotocols:      subprotocols,
+		EnableCompression: o.Compression,
+		CheckOrigin:       CheckOrigin(o.AllowedOrigins),
+	}
+}
+
+// CheckOrigin returns an origin check accepting requests without an Origin header, such
+// as those from non-browser clients, same origin requests and the allowed origins.
+// Params:
+// - allowed: []string - the allowed origins, see WebSocketOptions.AllowedOrigins
+// Returns:
+// - func(*http.Request) bool: reports whether the request's origin is allowed
+func CheckOrigin(allowed []string) func(*http.Request) bool {
+	return func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			return true
+		}
+		u, err := url.Parse(origin)
+		if err != nil || u.Host == "" {
+			return false
+		}
+		if strings.EqualFold(u.Host, r.Host) {
+			return true
+		}
+
+		for _, a := range allowed {
+			if a == "*" {
+				return true
+			}
+			want, err := url.Parse(a)
+			if err != nil || !strings.EqualFold(want.Scheme, u.Scheme) {
+				continue
+			}
+			if suffix, ok := strings.CutPrefix(want.Host, "*"); ok {
+				if len(u.Host) > len(suffix) && strings.HasSuffix(strings.ToLower(u.Host), strings.ToLower(suffix)) {
+					return true
+				}
+				continue
+			}
+			if strings.EqualFold(want.Host, u.Host) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// WebSocket sends each message value as a websocket text message.
+type WebSocket struct {
+	conn *websocket.Conn
+	opts WebSocketOptions
+}
+
+// NewWebSocket creates a Sender writing to an upgraded websocket connection.
+// Params:
+// - conn: *websocket.Conn - the websocket connection
+// - opts: WebSocketOptions - the connection options
+// Returns:
+// - *WebSocket: a pointer to the created WebSocket
+func NewWebSocket(conn *websocket.Conn, opts WebSocketOptions) *WebSocket {
+	if opts.MaxMessageSize > 0 {
+		conn.SetReadLimit(opts.MaxMessageSize)
+	}
+	conn.EnableWriteCompression(opts.Compression)
+	return &WebSocket{conn: conn, opts: opts}
+}
+
+// Run starts the read pump and the heartbeat. The read pump passes client text and
+// binary messages to onMessage, if set, and answers control frames. The heartbeat pings
+// the client every PingInterval. The returned context is cancelled once the client closes
+// the connection, stops answering pings for PongTimeout, onMessage returns an error, or
+// ctx is done; context.Cause reports which.
+// Params:
+// - ctx: context.Context - the parent context
+// - onMessage: func([]byte) error - handles client messages, nil discards them
+// Returns:
+// - context.Context: a context cancelled when the client is gone
+func (ws *WebSocket) Run(ctx context.Context, onMessage func([]byte) error) context.Context {
+	ctx, cancel := context.WithCancelCause(ctx)
+
+	_ = ws.conn.SetReadDeadline(time.Now().Add(ws.opts.PongTimeout))
+	ws.conn.SetPongHandler(func(string) error {
+		return ws.conn.SetReadDeadline(time.Now().Add(ws.opts.PongTimeout))
+	})
+
+	go func() {
+		for {
+			_, data, err := ws.conn.ReadMessage()
+			if err != nil {
+				cancel(err)
+				return
+			}
+			if onMessage == nil {
+				continue
+			}
+			if err := onMessage(data); err != nil {
+				cancel(err)
+				return
+			}
+		}
+	}()
+
+	go func() {
+		ticker := time.NewTicker(ws.opts.PingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				err := ws.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(ws.opts.WriteTimeout))
+				if err != nil {
+					cancel(err)
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return ctx
+}
+
+// Send writes the message value as a text message, or as a binary message if its
+// content_type header names a binary payload format.
+// Params:
+// - ctx: context.Context - unused, writes are bounded by WriteTimeout
+// - msg: broker.Message - the message to send
+// Returns:
+// - error: error if the write failed
+func (ws *WebSocket) Send(ctx context.Context, msg broker.Message) error {
+	if err := ws.conn.SetWriteDeadline(time.Now().Add(ws.opts.WriteTimeout)); err != nil {
+		return err
+	}
+	messageType := websocket.TextMessage
+	if payload.Binary(msg.Headers[broker.ContentTypeHeader]) {
+		messageType = websocket.BinaryMessage
+	}
+	return ws.conn.WriteMessage(messageType, msg.Value)
+}
+
+// Close sends a close frame with a code and reason, then closes the connection.
+// Params:
+// - code: int - the close code
+// - reason: string - the reason shown to the client, truncated to fit the frame
+// Returns:
+// - error: error if the connection could not be closed
+func (ws *WebSocket) Close(code int, reason string) error {
+	if len(reason) > maxCloseReason {
+		reason = reason[:maxCloseReason]
+	}
+	_ = ws.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(ws.opts.WriteTimeout))
+	return ws.conn.Close()
+}
@@ -0,0 +1,279 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/RaghibA/iot-telemetry/pkg/broker"
+	"github.com/gorilla/websocket"
+)
+
+// newWebSocketServer serves websockets that run with opts, and reports on the returned
+// channel when a connection's context is cancelled. Connections are closed with code
+// 4000 and reason "bye" after hold, if hold is positive.
+func newWebSocketServer(t *testing.T, opts WebSocketOptions, hold time.Duration) (string, <-chan struct{}) {
+	t.Helper()
+	gone := make(chan struct{}, 1)
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		ws := NewWebSocket(conn, opts)
+		ctx := ws.Run(context.Background(), nil)
+
+		if hold > 0 {
+			select {
+			case <-time.After(hold):
+				_ = ws.Close(4000, "bye")
+				return
+			case <-ctx.Done():
+			}
+		}
+		<-ctx.Done()
+		gone <- struct{}{}
+		_ = conn.Close()
+	}))
+	t.Cleanup(srv.Close)
+	return "ws" + strings.TrimPrefix(srv.URL, "http"), gone
+}
+
+func TestWebSocket(t *testing.T) {
+	opts := WebSocketOptions{PingInterval: 20 * time.Millisecond, PongTimeout: 100 * time.Millisecond, WriteTimeout: time.Second}
+
+	t.Run("should cancel when the client disconnects", func(t *testing.T) {
+		url, gone := newWebSocketServer(t, opts, 0)
+		conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+
+		select {
+		case <-gone:
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected the context to be cancelled")
+		}
+	})
+
+	t.Run("should cancel when the client stops answering pings", func(t *testing.T) {
+		url, gone := newWebSocketServer(t, opts, 0)
+		// the client never reads, so pings go unanswered
+		conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		select {
+		case <-gone:
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected the context to be cancelled")
+		}
+	})
+
+	t.Run("should stay open while the client answers pings", func(t *testing.T) {
+		url, gone := newWebSocketServer(t, opts, 500*time.Millisecond)
+		conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		// reading answers pings until the server closes the connection
+		_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, _, err = conn.ReadMessage()
+		var closeErr *websocket.CloseError
+		if !errors.As(err, &closeErr) {
+			t.Fatalf("expected a close frame, got %v", err)
+		}
+		if closeErr.Code != 4000 || closeErr.Text != "bye" {
+			t.Errorf("expected 4000 bye, got %d %s", closeErr.Code, closeErr.Text)
+		}
+		select {
+		case <-gone:
+			t.Error("expected the connection to outlive the pong timeout")
+		default:
+		}
+	})
+	t.Run("should send binary payloads as binary messages", func(t *testing.T) {
+		upgrader := websocket.Upgrader{}
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			conn, err := upgrader.Upgrade(w, r, nil)
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			ws := NewWebSocket(conn, opts)
+			_ = ws.Send(context.Background(), broker.Message{Value: []byte(`{"temp":1}`), Headers: map[string]string{broker.ContentTypeHeader: "application/json"}})
+			_ = ws.Send(context.Background(), broker.Message{Value: []byte{0xa1, 0x01}, Headers: map[string]string{broker.ContentTypeHeader: "application/cbor"}})
+			_ = ws.Close(websocket.CloseNormalClosure, "")
+		}))
+		defer srv.Close()
+
+		conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		for _, want := range []int{websocket.TextMessage, websocket.BinaryMessage} {
+			messageType, _, err := conn.ReadMessage()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if messageType != want {
+				t.Errorf("expected message type %d, got %d", want, messageType)
+			}
+		}
+	})
+
+	t.Run("should cancel with the error returned for a client message", func(t *testing.T) {
+		errRejected := errors.New("rejected")
+		cause := make(chan error, 1)
+		upgrader := websocket.Upgrader{}
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			conn, err := upgrader.Upgrade(w, r, nil)
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			ctx := NewWebSocket(conn, opts).Run(context.Background(), func(data []byte) error {
+				if string(data) == "stop" {
+					return errRejected
+				}
+				return nil
+			})
+			<-ctx.Done()
+			cause <- context.Cause(ctx)
+		}))
+		defer srv.Close()
+
+		conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		for _, msg := range []string{"go", "stop"} {
+			if err := conn.WriteMessage(websocket.TextMessage, []byte(msg)); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		select {
+		case err := <-cause:
+			if !errors.Is(err, errRejected) {
+				t.Errorf("expected the onMessage error as cause, got %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected the context to be cancelled")
+		}
+	})
+}
+
+func TestCheckOrigin(t *testing.T) {
+	allowed := []string{"https://dashboard.example.com", "https://*.iot.example.com"}
+
+	cases := []struct {
+		name   string
+		origin string
+		want   bool
+	}{
+		{"should accept requests without an origin", "", true},
+		{"should accept the server's own origin", "http://telemetry.local", true},
+		{"should accept an allowed origin", "https://dashboard.example.com", true},
+		{"should accept a subdomain of a wildcard origin", "https://eu.iot.example.com", true},
+		{"should reject the bare domain of a wildcard origin", "https://.iot.example.com", false},
+		{"should reject an allowed host with another scheme", "http://dashboard.example.com", false},
+		{"should reject other origins", "https://evil.example.net", false},
+		{"should reject malformed origins", "null", false},
+	}
+	check := CheckOrigin(allowed)
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "http://telemetry.local/ws", nil)
+			if tc.origin != "" {
+				r.Header.Set("Origin", tc.origin)
+			}
+			if got := check(r); got != tc.want {
+				t.Errorf("expected %v for origin %q, got %v", tc.want, tc.origin, got)
+			}
+		})
+	}
+
+	t.Run("should accept every origin with a wildcard", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "http://telemetry.local/ws", nil)
+		r.Header.Set("Origin", "https://evil.example.net")
+		if !CheckOrigin([]string{"*"})(r) {
+			t.Error("expected the origin to be accepted")
+		}
+	})
+}
+
+func TestUpgrader(t *testing.T) {
+	opts := WebSocketOptions{
+		PingInterval:    time.Second,
+		PongTimeout:     5 * time.Second,
+		WriteTimeout:    time.Second,
+		Compression:     true,
+		ReadBufferSize:  512,
+		WriteBufferSize: 512,
+		MaxMessageSize:  16,
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := opts.Upgrader("bearer").Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		ctx := NewWebSocket(conn, opts).Run(context.Background(), nil)
+		<-ctx.Done()
+	}))
+	defer srv.Close()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http")
+
+	t.Run("should negotiate permessage-deflate", func(t *testing.T) {
+		dialer := websocket.Dialer{EnableCompression: true}
+		conn, res, err := dialer.Dial(url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		if ext := res.Header.Get("Sec-WebSocket-Extensions"); !strings.Contains(ext, "permessage-deflate") {
+			t.Errorf("expected permessage-deflate, got %q", ext)
+		}
+	})
+
+	t.Run("should close with 1009 when a client message is too large", func(t *testing.T) {
+		conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(strings.Repeat("x", 17))); err != nil {
+			t.Fatal(err)
+		}
+
+		_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, _, err = conn.ReadMessage()
+		var closeErr *websocket.CloseError
+		if !errors.As(err, &closeErr) || closeErr.Code != websocket.CloseMessageTooBig {
+			t.Errorf("expected close code 1009, got %v", err)
+		}
+	})
+
+	t.Run("should refuse the handshake from a foreign origin", func(t *testing.T) {
+		_, res, err := websocket.DefaultDialer.Dial(url, http.Header{"Origin": {"https://evil.example.net"}})
+		if err == nil {
+			t.Fatal("expected the handshake to fail")
+		}
+		if res == nil || res.StatusCode != http.StatusForbidden {
+			t.Errorf("expected status 403, got %v", res)
+		}
+	})
+}
@@ -3,7 +3,7 @@ package utils
 import (
 	"bytes"
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
 )
 
@@ -32,7 +32,7 @@ func GetEnv(key string, overrideValue string) (string, error) {
 // Params:
 // - buf: *bytes.Buffer - the buffer to write logs to
 // Returns:
-// - *log.Logger: the created logger
-func NewTestLogger(buf *bytes.Buffer) *log.Logger {
-	return log.New(buf, "TEST: ", log.LstdFlags) // Logs are written to buffer
+// - *slog.Logger: the created logger
+func NewTestLogger(buf *bytes.Buffer) *slog.Logger {
+	return slog.New(slog.NewTextHandler(buf, nil)).With("service", "test") // Logs are written to buffer
 }
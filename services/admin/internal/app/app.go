@@ -1,37 +1,67 @@
 package app
 
 import (
-	"log"
+	"context"
+	"errors"
+	"flag"
+	"log/slog"
 	"os"
 
 	"github.com/RaghibA/iot-telemetry/db"
+	"github.com/RaghibA/iot-telemetry/pkg/broker/factory"
 	"github.com/RaghibA/iot-telemetry/pkg/config"
-	"github.com/RaghibA/iot-telemetry/pkg/kafka"
+	"github.com/RaghibA/iot-telemetry/pkg/jwt"
+	"github.com/RaghibA/iot-telemetry/pkg/logging"
+	"github.com/RaghibA/iot-telemetry/pkg/tracing"
 	"github.com/RaghibA/iot-telemetry/services/admin/internal/server"
 )
 
-// Run initializes the configuration, database, Kafka client, and starts the admin server.
+// Run initializes the configuration, database, message broker, and starts the admin server.
 // Params: None
 // Returns: None
 func Run() {
-	dbConfig, err := config.GetDBConfig()
+	logger := logging.New("admin-service")
+	slog.SetDefault(logger)
+
+	cfg, err := config.Load("admin-service", os.Args[1:], config.Server, config.DB, config.Broker, config.JWT)
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
 	if err != nil {
-		log.Fatal(err)
+		fatal(logger, err)
 	}
-	db, err := db.NewDB(dbConfig)
+	jwt.SetSecret(cfg.JWT.Secret)
+
+	shutdownTracing, err := tracing.Init(context.Background(), "admin-service", cfg.Tracing.OTLPEndpoint)
 	if err != nil {
-		log.Fatal(err)
+		fatal(logger, err)
 	}
+	defer shutdownTracing(context.Background())
 
-	adminConfig, err := config.GetAdminConfig()
+	db, err := db.NewDB(&cfg.DB)
 	if err != nil {
-		log.Fatal(err)
+		fatal(logger, err)
 	}
+	defer db.Close()
 
-	kc := &kafka.KafkaService{}
-	logger := log.New(os.Stdout, "ADMIN SERVICE: ", log.LstdFlags)
-	s := server.NewAdminServer(adminConfig, db, logger, kc)
+	b, err := factory.New(cfg)
+	if err != nil {
+		fatal(logger, err)
+	}
+	defer b.Close()
+
+	s := server.NewAdminServer(cfg, db, logger, b)
 	if err := s.Run(); err != nil {
-		log.Fatal(err)
+		fatal(logger, err)
 	}
 }
+
+// fatal logs an unrecoverable startup error and exits.
+// Params:
+// - logger: *slog.Logger - the service logger
+// - err: error - the error to log
+// Returns: None
+func fatal(logger *slog.Logger, err error) {
+	logger.Error("admin service failed", "err", err)
+	os.Exit(1)
+}
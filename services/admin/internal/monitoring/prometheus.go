@@ -1,7 +1,8 @@
 package monitoring
 
 import (
-	"log"
+	"errors"
+	"log/slog"
 	"net/http"
 	"time"
 
@@ -20,29 +21,45 @@ type Metrics struct {
 // - *Metrics: a pointer to the created Metrics instance
 func NewMetrics() *Metrics {
 	m := &Metrics{
-		HttpRequestDuration: prometheus.NewHistogramVec(
+		HttpRequestDuration: register(prometheus.NewHistogramVec(
 			prometheus.HistogramOpts{
 				Name:    "http_request_dur_sec",
 				Help:    "Duration of HTTP requests measured in seconds.",
 				Buckets: prometheus.DefBuckets,
 			},
 			[]string{"method", "route"},
-		),
-		HttpRequestStatus: prometheus.NewCounterVec(
+		)),
+		HttpRequestStatus: register(prometheus.NewCounterVec(
 			prometheus.CounterOpts{
 				Name: "http_request_status_ct",
 				Help: "Total HTTP requests",
 			},
 			[]string{"method", "route", "status_code"},
-		),
+		)),
 	}
-
-	prometheus.MustRegister(m.HttpRequestDuration, m.HttpRequestStatus)
-	log.Println("Prometheus Collector Registered")
+	slog.Info("Prometheus collector registered")
 
 	return m
 }
 
+// register registers a collector with the default registry. When an identical collector
+// is already registered, as when several services share a process, the existing one is
+// returned so their metrics are recorded together.
+// Params:
+// - c: T - the collector to register
+// Returns:
+// - T: the registered collector
+func register[T prometheus.Collector](c T) T {
+	if err := prometheus.Register(c); err != nil {
+		var are prometheus.AlreadyRegisteredError
+		if errors.As(err, &are) {
+			return are.ExistingCollector.(T)
+		}
+		panic(err)
+	}
+	return c
+}
+
 type statusRecorder struct {
 	http.ResponseWriter
 	statusCode int
@@ -1,15 +1,17 @@
 package routes
 
 import (
-	"context"
 	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 
+	"github.com/RaghibA/iot-telemetry/pkg/broker"
+	"github.com/RaghibA/iot-telemetry/pkg/httpserver"
 	"github.com/RaghibA/iot-telemetry/pkg/jwt"
-	"github.com/RaghibA/iot-telemetry/pkg/kafka"
+	"github.com/RaghibA/iot-telemetry/pkg/logging"
 	"github.com/RaghibA/iot-telemetry/pkg/models"
+	"github.com/RaghibA/iot-telemetry/pkg/payload"
 	"github.com/RaghibA/iot-telemetry/services/admin/internal/store"
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
@@ -18,23 +20,30 @@ import (
 
 type Handler struct {
 	store  store.DeviceStore
-	logger *log.Logger
-	kafka  kafka.KafkaClient
+	logger *slog.Logger
+	broker broker.Broker
 }
 
 type CreateDeviceRequestBody struct {
 	DeviceName string
 }
 
+// SetSchemaRequestBody registers the Protobuf message type of a device's payloads.
+// DescriptorSet is a serialized FileDescriptorSet defining it, base64 encoded in JSON.
+type SetSchemaRequestBody struct {
+	MessageType   string
+	DescriptorSet []byte
+}
+
 // NewAdminHander creates a new handler for admin routes.
 // Params:
 // - store: store.DeviceStore - the device store instance
-// - logger: *log.Logger - the logger instance
-// - kafka: kafka.KafkaClient - the Kafka client instance
+// - logger: *slog.Logger - the logger instance
+// - broker: broker.Broker - the message broker instance
 // Returns:
 // - *Handler: a pointer to the created Handler
-func NewAdminHander(store store.DeviceStore, logger *log.Logger, kafka kafka.KafkaClient) *Handler {
-	return &Handler{store: store, logger: logger, kafka: kafka}
+func NewAdminHander(store store.DeviceStore, logger *slog.Logger, broker broker.Broker) *Handler {
+	return &Handler{store: store, logger: logger, broker: broker}
 }
 
 // AdminRoutes sets up the admin routes.
@@ -46,6 +55,9 @@ func (h *Handler) AdminRoutes(router *mux.Router) {
 	router.HandleFunc("/device", jwt.AuthWithAccessToken(h.registerDevice)).Methods(http.MethodPost)
 	router.HandleFunc("/device", jwt.AuthWithAccessToken(h.getDevices)).Methods(http.MethodGet)
 	router.HandleFunc("/device", jwt.AuthWithAccessToken(h.deleteDevice)).Methods(http.MethodDelete)
+	router.HandleFunc("/device/schema", jwt.AuthWithAccessToken(h.setSchema)).Methods(http.MethodPut)
+	router.HandleFunc("/device/schema", jwt.AuthWithAccessToken(h.getSchema)).Methods(http.MethodGet)
+	router.HandleFunc("/device/schema", jwt.AuthWithAccessToken(h.deleteSchema)).Methods(http.MethodDelete)
 }
 
 // healthCheck is a handler for the health check endpoint.
@@ -68,51 +80,50 @@ func (h *Handler) healthCheck(w http.ResponseWriter, r *http.Request) {
 // Returns: None
 func (h *Handler) registerDevice(w http.ResponseWriter, r *http.Request) {
 	var deviceBody CreateDeviceRequestBody
-	decoder := json.NewDecoder(r.Body)
-
-	if err := decoder.Decode(&deviceBody); err != nil {
-		h.logger.Println("Failed to unmarshal input")
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+	if err := httpserver.DecodeJSON(r, &deviceBody); err != nil {
+		h.logger.WarnContext(r.Context(), "invalid request body", "err", err)
+		httpserver.WriteBodyError(w, err)
 		return
 	}
 
 	if deviceBody.DeviceName == "" {
-		h.logger.Println("Empty device name field")
+		h.logger.WarnContext(r.Context(), "empty device name field")
 		http.Error(w, "Provide a device name", http.StatusBadRequest)
 		return
 	}
 
 	userId := r.Context().Value(jwt.UserKey).(string)
 	if userId == "" {
-		h.logger.Println("No userId in context")
+		h.logger.ErrorContext(r.Context(), "no userId in context")
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
 	deviceId := uuid.New().String()
+	logging.SetDeviceID(r.Context(), deviceId)
 
-	topicName := h.kafka.GenerateTopicName(deviceBody.DeviceName, deviceId)
+	streamName := h.broker.StreamName(deviceBody.DeviceName, deviceId)
 
 	newDevice := &models.Device{
 		DeviceName: deviceBody.DeviceName,
 		DeviceID:   deviceId,
 		UserID:     userId,
-		TopicName:  topicName,
+		TopicName:  streamName,
 	}
 
-	err := h.kafka.CreateTopic(topicName)
+	err := h.broker.CreateStream(r.Context(), streamName)
 	if err != nil {
-		h.logger.Println(err)
+		h.logger.ErrorContext(r.Context(), "failed to create stream", "stream", streamName, "err", err)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
 
-	dbCtx := context.Background()
+	dbCtx := r.Context()
 	devices, err := h.store.GetUserDevices(dbCtx, userId)
 	if err != nil && err != pgx.ErrNoRows {
-		h.logger.Println(err)
-		err = h.kafka.DeleteTopic(topicName)
+		h.logger.ErrorContext(r.Context(), "db get user devices", "err", err)
+		err = h.broker.DeleteStream(r.Context(), streamName)
 		if err != nil {
-			h.logger.Println("Failed to delete new topic after device db write err", err)
+			h.logger.ErrorContext(r.Context(), "failed to delete new stream after device db read err", "stream", streamName, "err", err)
 		}
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
@@ -120,7 +131,7 @@ func (h *Handler) registerDevice(w http.ResponseWriter, r *http.Request) {
 
 	for _, d := range devices {
 		if d.DeviceName == newDevice.DeviceName {
-			h.logger.Println("Duplicate device name")
+			h.logger.WarnContext(r.Context(), "duplicate device name", "device_name", newDevice.DeviceName)
 			http.Error(
 				w,
 				fmt.Sprintf("You already have a device with the name: %s", newDevice.DeviceName),
@@ -130,10 +141,9 @@ func (h *Handler) registerDevice(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	dbCtx = context.Background()
 	err = h.store.AddDevice(dbCtx, newDevice)
 	if err != nil {
-		h.logger.Println(err)
+		h.logger.ErrorContext(r.Context(), "db add device", "err", err)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
@@ -154,21 +164,21 @@ func (h *Handler) registerDevice(w http.ResponseWriter, r *http.Request) {
 func (h *Handler) getDevices(w http.ResponseWriter, r *http.Request) {
 	userId := r.Context().Value(jwt.UserKey).(string)
 
-	dbCtx := context.Background()
+	dbCtx := r.Context()
 	devices, err := h.store.GetUserDevices(dbCtx, userId)
 	if err != nil {
 		if err == pgx.ErrNoRows {
-			h.logger.Println("No device found for user")
+			h.logger.WarnContext(r.Context(), "no device found for user")
 			http.Error(w, "No device found for provided id", http.StatusBadRequest)
 		} else {
-			h.logger.Println("Error:", err)
+			h.logger.ErrorContext(r.Context(), "db get user devices", "err", err)
 			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		}
 		return
 	}
 
 	if len(devices) == 0 {
-		h.logger.Println("user has no devices")
+		h.logger.WarnContext(r.Context(), "user has no devices")
 		http.Error(w, "No devices found", http.StatusBadRequest)
 		return
 	}
@@ -186,60 +196,182 @@ func (h *Handler) getDevices(w http.ResponseWriter, r *http.Request) {
 // - r: *http.Request - the HTTP request
 // Returns: None
 func (h *Handler) deleteDevice(w http.ResponseWriter, r *http.Request) {
+	device := h.ownedDevice(w, r, "delete")
+	if device == nil {
+		return
+	}
+
+	dbCtx := r.Context()
+	err := h.store.DeleteDevice(dbCtx, device.DeviceID)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "db delete device", "err", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	err = h.broker.DeleteStream(r.Context(), device.TopicName)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "failed to delete stream", "stream", device.TopicName, "err", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	deviceName := device.DeviceName
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message": fmt.Sprintf("%s deleted", deviceName),
+	})
+}
+
+// ownedDevice looks up the device in the deviceId query param and checks that it belongs
+// to the user making the request, responding with an error if not.
+// Params:
+// - w: http.ResponseWriter - the HTTP response writer
+// - r: *http.Request - the HTTP request
+// - action: string - what the user is doing, for the error message
+// Returns:
+// - *models.Device: the device, nil if an error response was written
+func (h *Handler) ownedDevice(w http.ResponseWriter, r *http.Request, action string) *models.Device {
 	deviceId := r.URL.Query().Get("deviceId")
 	if deviceId == "" {
-		h.logger.Println("no device id provided in query param")
+		h.logger.WarnContext(r.Context(), "no device id provided in query param")
 		http.Error(w, "No deviceId provided in query param", http.StatusBadRequest)
-		return
+		return nil
 	}
+	logging.SetDeviceID(r.Context(), deviceId)
 
-	dbCtx := context.Background()
-	device, err := h.store.GetDeviceByID(dbCtx, deviceId)
+	device, err := h.store.GetDeviceByID(r.Context(), deviceId)
 	if err != nil {
 		if err == pgx.ErrNoRows {
-			h.logger.Printf("No device found for id: %s", deviceId)
+			h.logger.WarnContext(r.Context(), "no device found for id")
 			http.Error(w, "No device found for provided id", http.StatusBadRequest)
 		} else {
-			h.logger.Println("Error:", err)
+			h.logger.ErrorContext(r.Context(), "db get device", "err", err)
 			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		}
-		return
+		return nil
 	}
 
-	deviceUserId := device.UserID
 	userIdClaim := r.Context().Value(jwt.UserKey)
 	if userIdClaim == nil {
-		h.logger.Println("No userId claim")
+		h.logger.ErrorContext(r.Context(), "no userId claim")
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return nil
+	}
+
+	if device.UserID != userIdClaim {
+		h.logger.WarnContext(r.Context(), "device user id & claim user id mismatch", "device_user_id", device.UserID)
+		http.Error(w, fmt.Sprintf("You are not authorized to %s this device", action), http.StatusUnauthorized)
+		return nil
+	}
+
+	return device
+}
+
+// setSchema is a handler for registering the Protobuf schema of a device's payloads.
+// Params:
+// - w: http.ResponseWriter - the HTTP response writer
+// - r: *http.Request - the HTTP request
+// Returns: None
+func (h *Handler) setSchema(w http.ResponseWriter, r *http.Request) {
+	device := h.ownedDevice(w, r, "update")
+	if device == nil {
 		return
 	}
 
-	if deviceUserId != userIdClaim {
-		h.logger.Println("device user id & claim user is mismatch")
-		h.logger.Println(deviceUserId, userIdClaim)
-		http.Error(w, "You are not authorized to delete this device", http.StatusUnauthorized)
+	var schemaBody SetSchemaRequestBody
+	if err := httpserver.DecodeJSON(r, &schemaBody); err != nil {
+		h.logger.WarnContext(r.Context(), "invalid request body", "err", err)
+		httpserver.WriteBodyError(w, err)
 		return
 	}
 
-	err = h.store.DeleteDevice(dbCtx, deviceId)
-	if err != nil {
-		h.logger.Println(err)
+	if schemaBody.MessageType == "" || len(schemaBody.DescriptorSet) == 0 {
+		h.logger.WarnContext(r.Context(), "empty schema fields")
+		http.Error(w, "Provide a messageType and a descriptorSet", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := payload.ParseSchema(schemaBody.DescriptorSet, schemaBody.MessageType); err != nil {
+		h.logger.WarnContext(r.Context(), "invalid schema", "err", err)
+		http.Error(w, fmt.Sprintf("Invalid schema: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	schema := &models.DeviceSchema{
+		DeviceID:      device.DeviceID,
+		MessageType:   schemaBody.MessageType,
+		DescriptorSet: schemaBody.DescriptorSet,
+	}
+	if err := h.store.SetDeviceSchema(r.Context(), schema); err != nil {
+		h.logger.ErrorContext(r.Context(), "db set device schema", "err", err)
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
 
-	err = h.kafka.DeleteTopic(device.TopicName)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"deviceId":    schema.DeviceID,
+		"messageType": schema.MessageType,
+	})
+}
+
+// getSchema is a handler for retrieving the Protobuf schema of a device's payloads.
+// Params:
+// - w: http.ResponseWriter - the HTTP response writer
+// - r: *http.Request - the HTTP request
+// Returns: None
+func (h *Handler) getSchema(w http.ResponseWriter, r *http.Request) {
+	device := h.ownedDevice(w, r, "view")
+	if device == nil {
+		return
+	}
+
+	schema, err := h.store.GetDeviceSchema(r.Context(), device.DeviceID)
 	if err != nil {
-		h.logger.Println(err)
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		if err == pgx.ErrNoRows {
+			h.logger.WarnContext(r.Context(), "no schema found for device")
+			http.Error(w, "No schema registered for provided id", http.StatusBadRequest)
+		} else {
+			h.logger.ErrorContext(r.Context(), "db get device schema", "err", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		}
 		return
 	}
 
-	deviceName := device.DeviceName
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"deviceId":      schema.DeviceID,
+		"messageType":   schema.MessageType,
+		"descriptorSet": schema.DescriptorSet,
+		"updatedAt":     schema.UpdatedAt,
+	})
+}
+
+// deleteSchema is a handler for removing the Protobuf schema of a device's payloads.
+// Params:
+// - w: http.ResponseWriter - the HTTP response writer
+// - r: *http.Request - the HTTP request
+// Returns: None
+func (h *Handler) deleteSchema(w http.ResponseWriter, r *http.Request) {
+	device := h.ownedDevice(w, r, "update")
+	if device == nil {
+		return
+	}
+
+	if err := h.store.DeleteDeviceSchema(r.Context(), device.DeviceID); err != nil {
+		h.logger.ErrorContext(r.Context(), "db delete device schema", "err", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(map[string]interface{}{
-		"message": fmt.Sprintf("%s deleted", deviceName),
+		"message": fmt.Sprintf("%s schema deleted", device.DeviceName),
 	})
 }
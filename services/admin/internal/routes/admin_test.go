@@ -6,29 +6,33 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"testing"
 	"time"
 
+	"github.com/RaghibA/iot-telemetry/pkg/broker"
 	"github.com/RaghibA/iot-telemetry/pkg/jwt"
-	"github.com/RaghibA/iot-telemetry/pkg/kafka"
 	"github.com/RaghibA/iot-telemetry/pkg/models"
 	"github.com/RaghibA/iot-telemetry/pkg/utils"
 	"github.com/RaghibA/iot-telemetry/services/admin/internal/store"
 	"github.com/gorilla/mux"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/known/structpb"
 )
 
-var testLogger *log.Logger
+var testLogger *slog.Logger
 var buf *bytes.Buffer
-var kc *kafka.MockKafkaServer
+var mb *broker.MockBroker
 
 func TestMain(m *testing.M) {
 	buf = new(bytes.Buffer)
 	testLogger = utils.NewTestLogger(buf)
-	kc = kafka.NewMockKafkaServer()
+	mb = broker.NewMockBroker()
 
 	code := m.Run()
 	os.Exit(code)
@@ -36,7 +40,7 @@ func TestMain(m *testing.M) {
 
 func TestRegisterDeviceHandler(t *testing.T) {
 	deviceStore := store.NewMockStore()
-	handler := NewAdminHander(deviceStore, testLogger, kc)
+	handler := NewAdminHander(deviceStore, testLogger, mb)
 	registerApi := "/api/v1/admin/device"
 
 	t.Run("should fail if request body is invalid", func(t *testing.T) {
@@ -208,20 +212,20 @@ func TestRegisterDeviceHandler(t *testing.T) {
 func TestGetDevicesHandler(t *testing.T) {
 	getDevicesApi := "/api/v1/admin/device"
 	deviceStore := store.NewMockStore()
-	handler := NewAdminHander(deviceStore, testLogger, kc)
+	handler := NewAdminHander(deviceStore, testLogger, mb)
 	userId := "1234test"
 	deviceStore.AddDevice(context.Background(), &models.Device{
 		DeviceName: "test1",
 		DeviceID:   "test1234",
 		UserID:     userId,
-		TopicName:  kc.GenerateTopicName("test1", "test1234"),
+		TopicName:  mb.StreamName("test1", "test1234"),
 		CreatedAt:  time.Now(),
 	})
 	deviceStore.AddDevice(context.Background(), &models.Device{
 		DeviceName: "test2",
 		DeviceID:   "test2345",
 		UserID:     userId,
-		TopicName:  kc.GenerateTopicName("test2", "test2345"),
+		TopicName:  mb.StreamName("test2", "test2345"),
 		CreatedAt:  time.Now(),
 	})
 
@@ -345,13 +349,13 @@ func TestGetDevicesHandler(t *testing.T) {
 func TestDeleteDeviceHandler(t *testing.T) {
 	deleteDeviceApi := "/api/v1/admin/device"
 	deviceStore := store.NewMockStore()
-	handler := NewAdminHander(deviceStore, testLogger, kc)
+	handler := NewAdminHander(deviceStore, testLogger, mb)
 	userId := "1234test"
 	deviceStore.AddDevice(context.Background(), &models.Device{
 		DeviceName: "test1",
 		DeviceID:   "test1234",
 		UserID:     userId,
-		TopicName:  kc.GenerateTopicName("test1", "test1234"),
+		TopicName:  mb.StreamName("test1", "test1234"),
 		CreatedAt:  time.Now(),
 	})
 
@@ -471,3 +475,148 @@ func TestDeleteDeviceHandler(t *testing.T) {
 		}
 	})
 }
+
+func TestDeviceSchemaHandlers(t *testing.T) {
+	deviceStore := store.NewMockStore()
+	handler := NewAdminHander(deviceStore, testLogger, mb)
+	schemaApi := "/api/v1/admin/device/schema"
+	userId := "1234user"
+	deviceStore.Devices["test1234"] = &models.Device{DeviceName: "testDevice", DeviceID: "test1234", UserID: userId}
+
+	router := mux.NewRouter()
+	router.HandleFunc(schemaApi, jwt.AuthWithAccessToken(handler.setSchema)).Methods(http.MethodPut)
+	router.HandleFunc(schemaApi, jwt.AuthWithAccessToken(handler.getSchema)).Methods(http.MethodGet)
+	router.HandleFunc(schemaApi, jwt.AuthWithAccessToken(handler.deleteSchema)).Methods(http.MethodDelete)
+
+	serve := func(t *testing.T, method string, userId string, body any) *httptest.ResponseRecorder {
+		t.Helper()
+		var reqBody bytes.Buffer
+		if body != nil {
+			if err := json.NewEncoder(&reqBody).Encode(body); err != nil {
+				t.Fatal(err)
+			}
+		}
+		req, err := http.NewRequest(method, schemaApi+"?deviceId=test1234", &reqBody)
+		if err != nil {
+			t.Fatal(err)
+		}
+		token, err := jwt.GenerateAccessToken(userId, time.Now().Add(time.Hour*1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	descriptorSet, err := proto.Marshal(&descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{
+		protodesc.ToFileDescriptorProto(structpb.File_google_protobuf_struct_proto),
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("should fail if the schema is invalid", func(t *testing.T) {
+		buf.Reset()
+
+		for _, body := range []SetSchemaRequestBody{
+			{MessageType: "google.protobuf.Struct"},
+			{MessageType: "google.protobuf.Missing", DescriptorSet: descriptorSet},
+			{MessageType: "google.protobuf.Struct", DescriptorSet: []byte("not a descriptor set")},
+		} {
+			rr := serve(t, http.MethodPut, userId, body)
+			if rr.Code != http.StatusBadRequest {
+				t.Errorf("expected status code %d for %s, got %d", http.StatusBadRequest, body.MessageType, rr.Code)
+			}
+		}
+		if len(deviceStore.Schemas) != 0 {
+			t.Errorf("expected no schema to be stored, got %v", deviceStore.Schemas)
+		}
+
+		if t.Failed() {
+			t.Log(buf.String())
+		}
+	})
+
+	t.Run("should fail if access token user id does not match device user id", func(t *testing.T) {
+		buf.Reset()
+
+		for _, method := range []string{http.MethodPut, http.MethodGet, http.MethodDelete} {
+			rr := serve(t, method, "32143132", SetSchemaRequestBody{MessageType: "google.protobuf.Struct", DescriptorSet: descriptorSet})
+			if rr.Code != http.StatusUnauthorized {
+				t.Errorf("expected status code %d for %s, got %d", http.StatusUnauthorized, method, rr.Code)
+			}
+		}
+
+		if t.Failed() {
+			t.Log(buf.String())
+		}
+	})
+
+	t.Run("should register, get and delete a schema", func(t *testing.T) {
+		buf.Reset()
+
+		rr := serve(t, http.MethodPut, userId, SetSchemaRequestBody{MessageType: "google.protobuf.Struct", DescriptorSet: descriptorSet})
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d: %s", http.StatusOK, rr.Code, rr.Body.String())
+		}
+
+		rr = serve(t, http.MethodGet, userId, nil)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d", http.StatusOK, rr.Code)
+		}
+		var got SetSchemaRequestBody
+		if err := json.NewDecoder(rr.Body).Decode(&got); err != nil {
+			t.Fatal(err)
+		}
+		if got.MessageType != "google.protobuf.Struct" || !bytes.Equal(got.DescriptorSet, descriptorSet) {
+			t.Errorf("expected the registered schema, got %s", got.MessageType)
+		}
+
+		rr = serve(t, http.MethodDelete, userId, nil)
+		if rr.Code != http.StatusOK {
+			t.Errorf("expected status code %d, got %d", http.StatusOK, rr.Code)
+		}
+		rr = serve(t, http.MethodGet, userId, nil)
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("expected status code %d after deleting, got %d", http.StatusBadRequest, rr.Code)
+		}
+
+		if t.Failed() {
+			t.Log(buf.String())
+		}
+	})
+}
+
+func FuzzRegisterDevice(f *testing.F) {
+	registerApi := "/api/v1/admin/device"
+	token, err := jwt.GenerateAccessToken("1234user", time.Now().Add(time.Hour*1))
+	if err != nil {
+		f.Fatal(err)
+	}
+
+	for _, seed := range []string{``, `{}`, `{"deviceName":"sensor-1"}`, `{"DeviceName":"Sensor 1 / kitchen"}`, `{"deviceName":7}`, `{"deviceName":"a","userId":"other"}`, `{"deviceName":"\u0000"}`} {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, body []byte) {
+		buf.Reset()
+		handler := NewAdminHander(store.NewMockStore(), testLogger, broker.NewMockBroker())
+
+		req, err := http.NewRequest(http.MethodPost, registerApi, bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+
+		rr := httptest.NewRecorder()
+		router := mux.NewRouter()
+		router.HandleFunc(registerApi, jwt.AuthWithAccessToken(handler.registerDevice)).Methods(http.MethodPost)
+		router.ServeHTTP(rr, req)
+
+		if rr.Code == http.StatusInternalServerError {
+			t.Errorf("expected no server error for %q, logs: %s", body, buf.String())
+		}
+	})
+}
@@ -1,41 +1,43 @@
 package server
 
 import (
-	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 
+	"github.com/RaghibA/iot-telemetry/db"
+	"github.com/RaghibA/iot-telemetry/pkg/broker"
 	"github.com/RaghibA/iot-telemetry/pkg/config"
-	"github.com/RaghibA/iot-telemetry/pkg/kafka"
+	"github.com/RaghibA/iot-telemetry/pkg/health"
+	"github.com/RaghibA/iot-telemetry/pkg/httpserver"
+	"github.com/RaghibA/iot-telemetry/pkg/logging"
+	"github.com/RaghibA/iot-telemetry/pkg/tracing"
 	"github.com/RaghibA/iot-telemetry/services/admin/internal/monitoring"
 	"github.com/RaghibA/iot-telemetry/services/admin/internal/routes"
 	"github.com/RaghibA/iot-telemetry/services/admin/internal/store"
 	"github.com/gorilla/mux"
-	"github.com/jackc/pgx/v5"
 )
 
 type AdminServer struct {
-	addr        string
-	db          *pgx.Conn
-	logger      *log.Logger
-	kafkaClient kafka.KafkaClient
+	config *config.Config
+	db     db.DB
+	logger *slog.Logger
+	broker broker.Broker
 }
 
 // NewAdminServer creates a new authentication server instance.
 // Params:
-// - config: *config.AdminConfig - the authentication configuration
-// - db: *pgx.Conn - the database connection
-// - logger: *log.Logger - the logger instance
-// - kafkaClient: kafka.KafkaClient - the Kafka client instance
+// - cfg: *config.Config - the service configuration
+// - db: db.DB - the database
+// - logger: *slog.Logger - the logger instance
+// - broker: broker.Broker - the message broker instance
 // Returns:
 // - *AdminServer: a pointer to the created AdminServer
-func NewAdminServer(config *config.AdminConfig, db *pgx.Conn, logger *log.Logger, kafkaClient kafka.KafkaClient) *AdminServer {
-	addr := fmt.Sprintf("%s:%s", config.HOST, config.PORT)
+func NewAdminServer(cfg *config.Config, db db.DB, logger *slog.Logger, broker broker.Broker) *AdminServer {
 	return &AdminServer{
-		addr:        addr,
-		db:          db,
-		logger:      logger,
-		kafkaClient: kafkaClient,
+		config: cfg,
+		db:     db,
+		logger: logger,
+		broker: broker,
 	}
 }
 
@@ -44,18 +46,37 @@ func NewAdminServer(config *config.AdminConfig, db *pgx.Conn, logger *log.Logger
 // Returns:
 // - error: error if any occurred during the server startup
 func (s *AdminServer) Run() error {
+	router := mux.NewRouter()
+	router.Use(tracing.Middleware("admin-service"))
+	router.Use(logging.Middleware(s.logger))
+	router.Use(httpserver.LimitBody(s.config.Limits))
+	s.Routes(router)
+
+	router.Handle("/metrics", monitoring.PrometheusHandler()) // Expose metrics at /metrics
+
+	srv := httpserver.New(s.config, router)
+	s.logger.Info("admin server running", "addr", srv.Addr, "tls", s.config.TLS.Enabled())
+	return httpserver.ListenAndServe(s.config, srv)
+}
+
+// Routes registers the admin service routes under /api/v1/admin on router. The caller is
+// responsible for the tracing, logging and body limit middlewares.
+// Params:
+// - router: *mux.Router - the router to register the routes on
+// Returns: None
+func (s *AdminServer) Routes(router *mux.Router) {
 	metrics := monitoring.NewMetrics()
 
-	router := mux.NewRouter()
 	subRouter := router.PathPrefix("/api/v1/admin").Subrouter()
 	subRouter.Use(metrics.MetricMonitoring) // Apply middleware to only this subrouter
 
 	deviceStore := store.NewDeviceStore(s.db, s.logger)
-	deviceHandler := routes.NewAdminHander(deviceStore, s.logger, s.kafkaClient)
+	deviceHandler := routes.NewAdminHander(deviceStore, s.logger, s.broker)
 	deviceHandler.AdminRoutes(subRouter)
 
-	router.Handle("/metrics", monitoring.PrometheusHandler()) // Expose metrics at /metrics
-
-	log.Printf("Admin server running on %v", s.addr)
-	return http.ListenAndServe(s.addr, router)
+	checker := health.NewChecker(s.config.Timeouts.Readiness)
+	checker.Add("database", s.db.Ping)
+	checker.Add("broker", s.broker.Ping)
+	subRouter.HandleFunc("/health/live", checker.LiveHandler).Methods(http.MethodGet)
+	subRouter.HandleFunc("/health/ready", checker.ReadyHandler).Methods(http.MethodGet)
 }
@@ -9,12 +9,14 @@ import (
 
 type MockStore struct {
 	Devices map[string]*models.Device
+	Schemas map[string]*models.DeviceSchema
 	Err     error
 }
 
 func NewMockStore() *MockStore {
 	return &MockStore{
 		Devices: make(map[string]*models.Device),
+		Schemas: make(map[string]*models.DeviceSchema),
 		Err:     nil,
 	}
 }
@@ -24,6 +26,9 @@ func NewMockStore() *MockStore {
 	GetUserDevices(ctx context.Context, userId string) ([]models.Device, error)
 	AddDevice(ctx context.Context, device *models.Device) error
 	DeleteDevice(ctx context.Context, deviceId string) error
+	GetDeviceSchema(ctx context.Context, deviceId string) (*models.DeviceSchema, error)
+	SetDeviceSchema(ctx context.Context, schema *models.DeviceSchema) error
+	DeleteDeviceSchema(ctx context.Context, deviceId string) error
 */
 
 func (s *MockStore) GetDeviceByID(ctx context.Context, deviceId string) (*models.Device, error) {
@@ -70,3 +75,33 @@ func (s *MockStore) DeleteDevice(ctx context.Context, deviceId string) error {
 	delete(s.Devices, deviceId)
 	return nil
 }
+
+func (s *MockStore) GetDeviceSchema(ctx context.Context, deviceId string) (*models.DeviceSchema, error) {
+	if s.Err != nil {
+		return nil, s.Err
+	}
+
+	schema, exists := s.Schemas[deviceId]
+	if !exists {
+		return nil, pgx.ErrNoRows
+	}
+	return schema, nil
+}
+
+func (s *MockStore) SetDeviceSchema(ctx context.Context, schema *models.DeviceSchema) error {
+	if s.Err != nil {
+		return s.Err
+	}
+
+	s.Schemas[schema.DeviceID] = schema
+	return nil
+}
+
+func (s *MockStore) DeleteDeviceSchema(ctx context.Context, deviceId string) error {
+	if s.Err != nil {
+		return s.Err
+	}
+
+	delete(s.Schemas, deviceId)
+	return nil
+}
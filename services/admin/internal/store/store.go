@@ -2,10 +2,10 @@ package store
 
 import (
 	"context"
-	"log"
+	"log/slog"
 
+	"github.com/RaghibA/iot-telemetry/db"
 	"github.com/RaghibA/iot-telemetry/pkg/models"
-	"github.com/jackc/pgx/v5"
 )
 
 // DeviceStore defines the interface for device-related database operations.
@@ -14,20 +14,23 @@ type DeviceStore interface {
 	GetUserDevices(ctx context.Context, userId string) ([]models.Device, error)
 	AddDevice(ctx context.Context, device *models.Device) error
 	DeleteDevice(ctx context.Context, deviceId string) error
+	GetDeviceSchema(ctx context.Context, deviceId string) (*models.DeviceSchema, error)
+	SetDeviceSchema(ctx context.Context, schema *models.DeviceSchema) error
+	DeleteDeviceSchema(ctx context.Context, deviceId string) error
 }
 
 type store struct {
-	db     *pgx.Conn
-	logger *log.Logger
+	db     db.DB
+	logger *slog.Logger
 }
 
 // NewDeviceStore creates a new device store instance.
 // Params:
-// - db: *pgx.Conn - the database connection
-// - logger: *log.Logger - the logger instance
+// - db: db.DB - the database
+// - logger: *slog.Logger - the logger instance
 // Returns:
 // - *store: a pointer to the created store
-func NewDeviceStore(db *pgx.Conn, logger *log.Logger) *store {
+func NewDeviceStore(db db.DB, logger *slog.Logger) *store {
 	return &store{db: db, logger: logger}
 }
 
@@ -140,3 +143,63 @@ func (s *store) DeleteDevice(ctx context.Context, deviceId string) error {
 	_, err := s.db.Exec(ctx, queryString, deviceId)
 	return err
 }
+
+// GetDeviceSchema retrieves the Protobuf schema registered for a device.
+// Params:
+// - ctx: context.Context - the context for the request
+// - deviceId: string - the ID of the device
+// Returns:
+// - *models.DeviceSchema: a pointer to the retrieved schema
+// - error: pgx.ErrNoRows if the device has no schema, or any other error during the retrieval
+func (s *store) GetDeviceSchema(ctx context.Context, deviceId string) (*models.DeviceSchema, error) {
+	var schema models.DeviceSchema
+
+	queryString := `
+		SELECT device_id, message_type, descriptor_set, updated_at FROM device_schemas WHERE device_id=$1
+	`
+
+	err := s.db.QueryRow(ctx, queryString, deviceId).Scan(
+		&schema.DeviceID,
+		&schema.MessageType,
+		&schema.DescriptorSet,
+		&schema.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &schema, nil
+}
+
+// SetDeviceSchema registers a Protobuf schema for a device, replacing any previous one.
+// Params:
+// - ctx: context.Context - the context for the request
+// - schema: *models.DeviceSchema - pointer to the schema to register
+// Returns:
+// - error: error if any occurred during the update
+func (s *store) SetDeviceSchema(ctx context.Context, schema *models.DeviceSchema) error {
+	queryString := `
+	INSERT INTO device_schemas (device_id, message_type, descriptor_set)
+	VALUES ($1, $2, $3)
+	ON CONFLICT (device_id) DO UPDATE
+	SET message_type = excluded.message_type, descriptor_set = excluded.descriptor_set, updated_at = CURRENT_TIMESTAMP
+	`
+
+	_, err := s.db.Exec(ctx, queryString, schema.DeviceID, schema.MessageType, schema.DescriptorSet)
+	return err
+}
+
+// DeleteDeviceSchema removes the Protobuf schema registered for a device.
+// Params:
+// - ctx: context.Context - the context for the request
+// - deviceId: string - the ID of the device
+// Returns:
+// - error: error if any occurred during the deletion
+func (s *store) DeleteDeviceSchema(ctx context.Context, deviceId string) error {
+	queryString := `
+	DELETE FROM device_schemas WHERE device_id=$1
+	`
+
+	_, err := s.db.Exec(ctx, queryString, deviceId)
+	return err
+}
@@ -0,0 +1,25 @@
+// Package service exposes the admin service routes so they can be mounted next to the
+// other services by the all-in-one binary.
+package service
+
+import (
+	"log/slog"
+
+	"github.com/RaghibA/iot-telemetry/db"
+	"github.com/RaghibA/iot-telemetry/pkg/broker"
+	"github.com/RaghibA/iot-telemetry/pkg/config"
+	"github.com/RaghibA/iot-telemetry/services/admin/internal/server"
+	"github.com/gorilla/mux"
+)
+
+// Routes registers the admin service routes under /api/v1/admin on router.
+// Params:
+// - router: *mux.Router - the router to register the routes on
+// - cfg: *config.Config - the service configuration
+// - db: db.DB - the database
+// - logger: *slog.Logger - the logger instance
+// - broker: broker.Broker - the message broker instance
+// Returns: None
+func Routes(router *mux.Router, cfg *config.Config, db db.DB, logger *slog.Logger, broker broker.Broker) {
+	server.NewAdminServer(cfg, db, logger, broker).Routes(router)
+}
@@ -1,32 +1,60 @@
 package app
 
 import (
-    "log"
+    "context"
+    "errors"
+    "flag"
+    "log/slog"
+    "os"
 
     "github.com/RaghibA/iot-telemetry/db"
     "github.com/RaghibA/iot-telemetry/pkg/config"
+    "github.com/RaghibA/iot-telemetry/pkg/jwt"
+    "github.com/RaghibA/iot-telemetry/pkg/logging"
+    "github.com/RaghibA/iot-telemetry/pkg/tracing"
     "github.com/RaghibA/iot-telemetry/services/auth/internal/server"
 )
 
-// Run initializes the database and authentication server, and starts the server.
+// Run initializes the configuration, database and authentication server, and starts the server.
 // Params: None
 // Returns: None
 func Run() {
-    dbConfig, err := config.GetDBConfig()
+    logger := logging.New("auth-service")
+    slog.SetDefault(logger)
+
+    cfg, err := config.Load("auth-service", os.Args[1:], config.Server, config.DB, config.JWT)
+    if errors.Is(err, flag.ErrHelp) {
+        os.Exit(0)
+    }
     if err != nil {
-        log.Fatal(err)
+        fatal(logger, err)
     }
-    db, err := db.NewDB(dbConfig)
+    jwt.SetSecret(cfg.JWT.Secret)
+
+    shutdownTracing, err := tracing.Init(context.Background(), "auth-service", cfg.Tracing.OTLPEndpoint)
     if err != nil {
-        log.Fatal(err)
+        fatal(logger, err)
     }
+    defer shutdownTracing(context.Background())
 
-    authConfig, err := config.GetAuthConfig()
+    db, err := db.NewDB(&cfg.DB)
     if err != nil {
-        log.Fatal(err)
+        fatal(logger, err)
     }
-    s := server.NewAuthServer(authConfig, db)
+    defer db.Close()
+
+    s := server.NewAuthServer(cfg, db, logger)
     if err = s.Run(); err != nil {
-        log.Fatal(err)
+        fatal(logger, err)
     }
 }
+
+// fatal logs an unrecoverable startup error and exits.
+// Params:
+// - logger: *slog.Logger - the service logger
+// - err: error - the error to log
+// Returns: None
+func fatal(logger *slog.Logger, err error) {
+    logger.Error("auth service failed", "err", err)
+    os.Exit(1)
+}
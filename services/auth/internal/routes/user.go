@@ -1,12 +1,13 @@
 package routes
 
 import (
-	"context"
 	"encoding/json"
-	"log"
+	"fmt"
+	"log/slog"
 	"net/http"
 	"time"
 
+	"github.com/RaghibA/iot-telemetry/pkg/httpserver"
 	"github.com/RaghibA/iot-telemetry/pkg/jwt"
 	"github.com/RaghibA/iot-telemetry/pkg/models"
 	"github.com/RaghibA/iot-telemetry/services/auth/internal/store"
@@ -18,9 +19,12 @@ import (
 	"golang.org/x/crypto/bcrypt"
 )
 
+// maxPasswordBytes is the longest password bcrypt hashes.
+const maxPasswordBytes = 72
+
 type Handler struct {
 	store  store.UserStore
-	logger *log.Logger
+	logger *slog.Logger
 }
 
 type CreateUserRequestBody struct {
@@ -37,10 +41,10 @@ type LoginRequestBody struct {
 // NewUserHandler creates a new Handler for user-related routes.
 // Params:
 // - store: store.UserStore - the user store interface
-// - logger: *log.Logger - the logger instance
+// - logger: *slog.Logger - the logger instance
 // Returns:
 // - *Handler: a pointer to the created Handler
-func NewUserHandler(store store.UserStore, logger *log.Logger) *Handler {
+func NewUserHandler(store store.UserStore, logger *slog.Logger) *Handler {
 	return &Handler{store: store, logger: logger}
 }
 
@@ -77,61 +81,66 @@ func (h *Handler) healthCheck(w http.ResponseWriter, r *http.Request) {
 // Returns: None
 func (h *Handler) createUser(w http.ResponseWriter, r *http.Request) {
 	var user CreateUserRequestBody
-	decoder := json.NewDecoder(r.Body)
 	validator := validator.New()
 
-	if err := decoder.Decode(&user); err != nil {
-		h.logger.Println(err)
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+	if err := httpserver.DecodeJSON(r, &user); err != nil {
+		h.logger.WarnContext(r.Context(), "invalid request body", "err", err)
+		httpserver.WriteBodyError(w, err)
 		return
 	}
 
 	if err := validator.Var(user.Email, "required,email"); err != nil {
-		h.logger.Println(err)
+		h.logger.WarnContext(r.Context(), "invalid email", "err", err)
 		http.Error(w, "Invalid email", http.StatusBadRequest)
 		return
 	}
 
 	if err := validator.Var(user.Password, "required,min=8"); err != nil {
-		h.logger.Println(err)
+		h.logger.WarnContext(r.Context(), "invalid password", "err", err)
 		http.Error(w, "Password must be at least 8 characters", http.StatusBadRequest)
 		return
 	}
 
+	if len(user.Password) > maxPasswordBytes {
+		h.logger.WarnContext(r.Context(), "password too long")
+		http.Error(w, fmt.Sprintf("Password must be at most %d bytes", maxPasswordBytes), http.StatusBadRequest)
+		return
+	}
+
 	if err := validator.Var(user.Username, "required,min=6"); err != nil {
-		h.logger.Println(err)
+		h.logger.WarnContext(r.Context(), "invalid username", "err", err)
 		http.Error(w, "Username must be at least 6 characters", http.StatusBadRequest)
 		return
 	}
 
-	ctx := context.Background()
+	ctx := r.Context()
 	_, err := h.store.GetUserByEmail(ctx, user.Email)
 	if err != nil && err != pgx.ErrNoRows {
-		h.logger.Println(err)
+		h.logger.ErrorContext(r.Context(), "db get user by email", "err", err)
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
 	if err == nil {
-		h.logger.Println(err)
+		h.logger.WarnContext(r.Context(), "email already registered")
 		http.Error(w, "An account with this email already exists", http.StatusConflict)
 		return
 	}
 
 	_, err = h.store.GetUserByUsername(ctx, user.Username)
 	if err != nil && err != pgx.ErrNoRows {
-		h.logger.Println(err)
+		h.logger.ErrorContext(r.Context(), "db get user by username", "err", err)
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
 	if err == nil {
-		h.logger.Println(err)
+		h.logger.WarnContext(r.Context(), "username already registered")
 		http.Error(w, "An account with this username already exists", http.StatusConflict)
 		return
 	}
 
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(user.Password), 14)
 	if err != nil {
-		h.logger.Println(err)
+		h.logger.ErrorContext(r.Context(), "failed to hash password", "err", err)
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
@@ -147,7 +156,7 @@ func (h *Handler) createUser(w http.ResponseWriter, r *http.Request) {
 	// Generate API Key
 	keyString, err := utils.GenerateAPIKey()
 	if err != nil {
-		h.logger.Println(err)
+		h.logger.ErrorContext(r.Context(), "failed to generate api key", "err", err)
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
@@ -156,16 +165,16 @@ func (h *Handler) createUser(w http.ResponseWriter, r *http.Request) {
 		APIKey: keyString,
 	}
 
-	dbctx := context.Background()
+	dbctx := r.Context()
 
 	if err := h.store.AddUser(dbctx, newUser); err != nil {
-		h.logger.Println(err)
+		h.logger.ErrorContext(r.Context(), "db add user", "err", err)
 		http.Error(w, "Failed to create account", http.StatusInternalServerError)
 		return
 	}
 
 	if err := h.store.AddApiKey(dbctx, apiKey); err != nil {
-		h.logger.Println(err)
+		h.logger.ErrorContext(r.Context(), "db add api key", "err", err)
 		http.Error(w, "Failed to create API key", http.StatusInternalServerError)
 		_ = h.store.DeleteUser(dbctx, newUser.UserID)
 		return
@@ -186,11 +195,9 @@ func (h *Handler) createUser(w http.ResponseWriter, r *http.Request) {
 // Returns: None
 func (h *Handler) loginUser(w http.ResponseWriter, r *http.Request) {
 	var loginBody LoginRequestBody
-	decoder := json.NewDecoder(r.Body)
-
-	if err := decoder.Decode(&loginBody); err != nil {
-		h.logger.Println(err)
-		http.Error(w, "Invalid Request Body", http.StatusBadRequest)
+	if err := httpserver.DecodeJSON(r, &loginBody); err != nil {
+		h.logger.WarnContext(r.Context(), "invalid request body", "err", err)
+		httpserver.WriteBodyError(w, err)
 		return
 	}
 
@@ -199,29 +206,29 @@ func (h *Handler) loginUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	dbctx := context.Background()
+	dbctx := r.Context()
 	user, err := h.store.GetUserByUsername(dbctx, loginBody.Username)
 	if err == pgx.ErrNoRows {
-		h.logger.Println(err)
+		h.logger.WarnContext(r.Context(), "user not found", "err", err)
 		http.Error(w, "User not found", http.StatusBadRequest)
 		return
 	}
 	if err != nil {
-		h.logger.Println(err)
+		h.logger.ErrorContext(r.Context(), "db get user by username", "err", err)
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
 
 	err = bcrypt.CompareHashAndPassword(user.Password, []byte(loginBody.Password))
 	if err != nil {
-		h.logger.Println(err)
+		h.logger.WarnContext(r.Context(), "login failed", "err", err)
 		http.Error(w, "Login Failed", http.StatusUnauthorized)
 		return
 	}
 
 	token, err := jwt.GenerateCookie(user.UserID, time.Now().Add(time.Hour*24*7))
 	if err != nil {
-		h.logger.Println(err)
+		h.logger.ErrorContext(r.Context(), "failed to generate cookie", "err", err)
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
@@ -252,14 +259,14 @@ func (h *Handler) loginUser(w http.ResponseWriter, r *http.Request) {
 func (h *Handler) generateToken(w http.ResponseWriter, r *http.Request) {
 	userId, ok := r.Context().Value(jwt.UserKey).(string)
 	if !ok {
-		h.logger.Println("No userId in request context")
+		h.logger.ErrorContext(r.Context(), "no userId in request context")
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
 
 	jwt, err := jwt.GenerateAccessToken(userId, time.Now().Add(time.Hour*1))
 	if err != nil {
-		h.logger.Println(err)
+		h.logger.ErrorContext(r.Context(), "failed to generate access token", "err", err)
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
@@ -300,22 +307,22 @@ func (h *Handler) logoutUser(w http.ResponseWriter, r *http.Request) {
 func (h *Handler) regenerateApiKey(w http.ResponseWriter, r *http.Request) {
 	userId, ok := r.Context().Value(jwt.UserKey).(string)
 	if !ok {
-		h.logger.Println("No userId in request context")
+		h.logger.ErrorContext(r.Context(), "no userId in request context")
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
 
-	dbctx := context.Background()
+	dbctx := r.Context()
 	err := h.store.DeleteApiKey(dbctx, userId)
 	if err == pgx.ErrNoRows {
-		h.logger.Println(err)
+		h.logger.ErrorContext(r.Context(), "db delete api key", "err", err)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
 
 	keyString, err := utils.GenerateAPIKey()
 	if err != nil {
-		h.logger.Println(err)
+		h.logger.ErrorContext(r.Context(), "failed to generate api key", "err", err)
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
@@ -326,7 +333,7 @@ func (h *Handler) regenerateApiKey(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if err := h.store.AddApiKey(dbctx, apiKey); err != nil {
-		h.logger.Println(err)
+		h.logger.ErrorContext(r.Context(), "db add api key", "err", err)
 		http.Error(w, "Failed to create API key, please retry later.", http.StatusInternalServerError)
 		return
 	}
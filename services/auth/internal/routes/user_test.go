@@ -3,10 +3,11 @@ package routes
 import (
 	"bytes"
 	"encoding/json"
-	"log"
+	"log/slog"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
 	"time"
 
@@ -18,7 +19,7 @@ import (
 	"golang.org/x/crypto/bcrypt"
 )
 
-var testLogger *log.Logger
+var testLogger *slog.Logger
 var buf *bytes.Buffer
 
 func TestMain(m *testing.M) {
@@ -43,12 +44,10 @@ func TestRegisterUserHandler(t *testing.T) {
 
 	t.Run("should fail if the username is not unique", func(t *testing.T) {
 		buf.Reset()
-		payload := models.User{
-			UserID:    "123",
-			Username:  "test-user", // dupe username
-			Password:  []byte("1234"),
-			Email:     "test@gmail.com",
-			CreatedAt: time.Now(),
+		payload := CreateUserRequestBody{
+			Username: "test-user", // dupe username
+			Password: "12345678",
+			Email:    "test@gmail.com",
 		}
 
 		marshalled, err := json.Marshal(payload)
@@ -78,12 +77,10 @@ func TestRegisterUserHandler(t *testing.T) {
 
 	t.Run("should fail if the email is not unique", func(t *testing.T) {
 		buf.Reset()
-		payload := models.User{
-			UserID:    "123",
-			Username:  "test-user1",
-			Password:  []byte("1234"),
-			Email:     "test@gmail.com", // dupe email
-			CreatedAt: time.Now(),
+		payload := CreateUserRequestBody{
+			Username: "test-user1",
+			Password: "12345678",
+			Email:    "test@gmail.com", // dupe email
 		}
 
 		marshalled, err := json.Marshal(payload)
@@ -113,12 +110,10 @@ func TestRegisterUserHandler(t *testing.T) {
 
 	t.Run("should create a new account", func(t *testing.T) {
 		buf.Reset()
-		payload := models.User{
-			UserID:    "12345678",
-			Username:  "newuser",
-			Password:  []byte("1234test"),
-			Email:     "newuser@gmail.com",
-			CreatedAt: time.Now(),
+		payload := CreateUserRequestBody{
+			Username: "newuser",
+			Password: "1234test",
+			Email:    "newuser@gmail.com",
 		}
 
 		marshalled, err := json.Marshal(payload)
@@ -145,6 +140,39 @@ func TestRegisterUserHandler(t *testing.T) {
 			t.Logf("logs on failure: %s", buf.String())
 		}
 	})
+
+	t.Run("should fail if the password is too long to hash", func(t *testing.T) {
+		buf.Reset()
+		payload := CreateUserRequestBody{
+			Username: "longpassuser",
+			Password: strings.Repeat("p", maxPasswordBytes+1),
+			Email:    "longpass@gmail.com",
+		}
+
+		marshalled, err := json.Marshal(payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req, err := http.NewRequest(http.MethodPost, "/api/v1/auth/register", bytes.NewBuffer(marshalled))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		router := mux.NewRouter()
+
+		router.HandleFunc("/api/v1/auth/register", handler.createUser).Methods(http.MethodPost)
+		router.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("expected status code %d, got %d", http.StatusBadRequest, rr.Code)
+		}
+
+		if t.Failed() {
+			t.Logf("logs on failure: %s", buf.String())
+		}
+	})
 }
 
 func TestLoginUserHandler(t *testing.T) {
@@ -507,3 +535,44 @@ func TestApiKeyHandler(t *testing.T) {
 		}
 	})
 }
+
+// fuzzBody posts body to a route served by handler and fails on a server error, which no
+// request body should cause with a working store.
+func fuzzBody(t *testing.T, path string, handler http.HandlerFunc, body []byte) {
+	req, err := http.NewRequest(http.MethodPost, path, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	router := mux.NewRouter()
+	router.HandleFunc(path, handler).Methods(http.MethodPost)
+	router.ServeHTTP(rr, req)
+
+	if rr.Code == http.StatusInternalServerError {
+		t.Errorf("expected no server error for %q, logs: %s", body, buf.String())
+	}
+}
+
+func FuzzCreateUser(f *testing.F) {
+	// valid bodies are left to the fuzzer, hashing their passwords takes a second each
+	for _, seed := range []string{``, `{}`, `{"username":"newuser","password":"short","email":"a@b.c"}`, `{"username":1}`, `{"username":"a","admin":true}`, `{"email":"not an email"} {}`} {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, body []byte) {
+		buf.Reset()
+		handler := NewUserHandler(store.NewMockUserStore(), testLogger)
+		fuzzBody(t, "/api/v1/auth/register", handler.createUser, body)
+	})
+}
+
+func FuzzLoginUser(f *testing.F) {
+	for _, seed := range []string{``, `{}`, `{"username":"test-user","password":"mypassword"}`, `{"username":["x"]}`, `{"password":"x","role":"admin"}`, `{"username":"a"`} {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, body []byte) {
+		buf.Reset()
+		handler := NewUserHandler(store.NewMockUserStore(), testLogger)
+		fuzzBody(t, "/api/v1/auth/login", handler.loginUser, body)
+	})
+}
@@ -1,37 +1,37 @@
 package server
 
 import (
-	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
-	"os"
 
+	"github.com/RaghibA/iot-telemetry/db"
 	"github.com/RaghibA/iot-telemetry/pkg/config"
+	"github.com/RaghibA/iot-telemetry/pkg/health"
+	"github.com/RaghibA/iot-telemetry/pkg/httpserver"
+	"github.com/RaghibA/iot-telemetry/pkg/logging"
+	"github.com/RaghibA/iot-telemetry/pkg/tracing"
 	"github.com/RaghibA/iot-telemetry/services/auth/internal/monitoring"
 	"github.com/RaghibA/iot-telemetry/services/auth/internal/routes"
 	"github.com/RaghibA/iot-telemetry/services/auth/internal/store"
 	"github.com/gorilla/mux"
-	"github.com/jackc/pgx/v5"
 )
 
 type AuthServer struct {
-	Addr   string
-	Db     *pgx.Conn
-	Logger *log.Logger
+	Config *config.Config
+	Db     db.DB
+	Logger *slog.Logger
 }
 
 // NewAuthServer creates a new authentication server instance.
 // Params:
-// - config: *config.AuthConfig - the authentication configuration
-// - db: *pgx.Conn - the database connection
+// - cfg: *config.Config - the service configuration
+// - db: db.DB - the database
+// - logger: *slog.Logger - the logger instance
 // Returns:
 // - *AuthServer: a pointer to the created AuthServer
-func NewAuthServer(config *config.AuthConfig, db *pgx.Conn) *AuthServer {
-	addr := fmt.Sprintf("%s:%s", config.HOST, config.PORT)
-	logger := log.New(os.Stdout, "AUTH_SERVER: ", log.LstdFlags)
-
+func NewAuthServer(cfg *config.Config, db db.DB, logger *slog.Logger) *AuthServer {
 	return &AuthServer{
-		Addr:   addr,
+		Config: cfg,
 		Db:     db,
 		Logger: logger,
 	}
@@ -42,9 +42,27 @@ func NewAuthServer(config *config.AuthConfig, db *pgx.Conn) *AuthServer {
 // Returns:
 // - error: error if any occurred during the server startup
 func (s *AuthServer) Run() error {
+	router := mux.NewRouter()
+	router.Use(tracing.Middleware("auth-service"))
+	router.Use(logging.Middleware(s.Logger))
+	router.Use(httpserver.LimitBody(s.Config.Limits))
+	s.Routes(router)
+
+	router.Handle("/metrics", monitoring.PrometheusHandler()) // Expose metrics at /metrics
+
+	srv := httpserver.New(s.Config, router)
+	s.Logger.Info("auth server running", "addr", srv.Addr, "tls", s.Config.TLS.Enabled())
+	return httpserver.ListenAndServe(s.Config, srv)
+}
+
+// Routes registers the auth service routes under /api/v1/auth on router. The caller is
+// responsible for the tracing, logging and body limit middlewares.
+// Params:
+// - router: *mux.Router - the router to register the routes on
+// Returns: None
+func (s *AuthServer) Routes(router *mux.Router) {
 	metrics := monitoring.NewMetrics()
 
-	router := mux.NewRouter()
 	subRouter := router.PathPrefix("/api/v1/auth").Subrouter()
 	subRouter.Use(metrics.MetricMonitoring) // Apply middleware to only this subrouter
 
@@ -52,8 +70,8 @@ func (s *AuthServer) Run() error {
 	userHandler := routes.NewUserHandler(userStore, s.Logger)
 	userHandler.UserRoutes(subRouter)
 
-	router.Handle("/metrics", monitoring.PrometheusHandler()) // Expose metrics at /metrics
-
-	log.Printf("Auth server running on %v", s.Addr)
-	return http.ListenAndServe(s.Addr, router)
+	checker := health.NewChecker(s.Config.Timeouts.Readiness)
+	checker.Add("database", s.Db.Ping)
+	subRouter.HandleFunc("/health/live", checker.LiveHandler).Methods(http.MethodGet)
+	subRouter.HandleFunc("/health/ready", checker.ReadyHandler).Methods(http.MethodGet)
 }
@@ -2,10 +2,10 @@ package store
 
 import (
 	"context"
-	"log"
+	"log/slog"
 
+	"github.com/RaghibA/iot-telemetry/db"
 	"github.com/RaghibA/iot-telemetry/pkg/models"
-	"github.com/jackc/pgx/v5"
 )
 
 type UserStore interface {
@@ -19,17 +19,17 @@ type UserStore interface {
 }
 
 type store struct {
-	db     *pgx.Conn
-	logger *log.Logger
+	db     db.DB
+	logger *slog.Logger
 }
 
 // NewUserStore creates a new user store instance.
 // Params:
-// - db: *pgx.Conn - the database connection
-// - logger: *log.Logger - the logger instance
+// - db: db.DB - the database
+// - logger: *slog.Logger - the logger instance
 // Returns:
 // - *store: a pointer to the created store
-func NewUserStore(db *pgx.Conn, logger *log.Logger) *store {
+func NewUserStore(db db.DB, logger *slog.Logger) *store {
 	return &store{db: db, logger: logger}
 }
 
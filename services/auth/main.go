@@ -1,8 +1,6 @@
 package main
 
 import (
-    "log"
-
     "github.com/RaghibA/iot-telemetry/services/auth/internal/app"
 )
 
@@ -10,6 +8,5 @@ import (
 // Params: None
 // Returns: None
 func main() {
-    log.Println("Starting auth service")
     app.Run()
 }
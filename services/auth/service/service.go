@@ -0,0 +1,23 @@
+// Package service exposes the auth service routes so they can be mounted next to the
+// other services by the all-in-one binary.
+package service
+
+import (
+	"log/slog"
+
+	"github.com/RaghibA/iot-telemetry/db"
+	"github.com/RaghibA/iot-telemetry/pkg/config"
+	"github.com/RaghibA/iot-telemetry/services/auth/internal/server"
+	"github.com/gorilla/mux"
+)
+
+// Routes registers the auth service routes under /api/v1/auth on router.
+// Params:
+// - router: *mux.Router - the router to register the routes on
+// - cfg: *config.Config - the service configuration
+// - db: db.DB - the database
+// - logger: *slog.Logger - the logger instance
+// Returns: None
+func Routes(router *mux.Router, cfg *config.Config, db db.DB, logger *slog.Logger) {
+	server.NewAuthServer(cfg, db, logger).Routes(router)
+}
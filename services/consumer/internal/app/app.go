@@ -1,34 +1,67 @@
 package app
 
 import (
-	"log"
+	"context"
+	"errors"
+	"flag"
+	"log/slog"
 	"os"
 
 	"github.com/RaghibA/iot-telemetry/db"
+	"github.com/RaghibA/iot-telemetry/pkg/broker/factory"
 	"github.com/RaghibA/iot-telemetry/pkg/config"
-	"github.com/RaghibA/iot-telemetry/pkg/kafka"
+	"github.com/RaghibA/iot-telemetry/pkg/jwt"
+	"github.com/RaghibA/iot-telemetry/pkg/logging"
+	"github.com/RaghibA/iot-telemetry/pkg/tracing"
 	"github.com/RaghibA/iot-telemetry/services/consumer/internal/server"
 )
 
+// Run initializes the configuration, database, message broker, and starts the consumer server.
+// Params: None
+// Returns: None
 func Run() {
-	dbConfig, err := config.GetDBConfig()
+	logger := logging.New("consumer-service")
+	slog.SetDefault(logger)
+
+	cfg, err := config.Load("consumer-service", os.Args[1:], config.Server, config.DB, config.Broker, config.Consumer, config.JWT)
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
+	if err != nil {
+		fatal(logger, err)
+	}
+	jwt.SetSecret(cfg.JWT.Secret)
+
+	shutdownTracing, err := tracing.Init(context.Background(), "consumer-service", cfg.Tracing.OTLPEndpoint)
 	if err != nil {
-		log.Fatal(err)
+		fatal(logger, err)
 	}
-	db, err := db.NewDB(dbConfig)
+	defer shutdownTracing(context.Background())
+
+	db, err := db.NewDB(&cfg.DB)
 	if err != nil {
-		log.Fatal(err)
+		fatal(logger, err)
 	}
+	defer db.Close()
 
-	consumerConfig, err := config.GetConsumerConfig()
+	b, err := factory.New(cfg)
 	if err != nil {
-		log.Fatal(err)
+		fatal(logger, err)
 	}
+	defer b.Close()
 
-	kc := &kafka.KafkaService{}
-	logger := log.New(os.Stdout, "CONSUMER SERVICE: ", log.LstdFlags)
-	s := server.NewConsumerServer(consumerConfig, db, logger, kc)
-	if err = s.Run(); err != nil {
-		log.Fatal(err)
+	s := server.NewConsumerServer(cfg, db, logger, b)
+	if err := s.Run(); err != nil {
+		fatal(logger, err)
 	}
 }
+
+// fatal logs an unrecoverable startup error and exits.
+// Params:
+// - logger: *slog.Logger - the service logger
+// - err: error - the error to log
+// Returns: None
+func fatal(logger *slog.Logger, err error) {
+	logger.Error("consumer service failed", "err", err)
+	os.Exit(1)
+}
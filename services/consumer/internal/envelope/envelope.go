@@ -0,0 +1,114 @@
+// Package envelope wraps streamed telemetry with the metadata the data service attached
+// when it ingested it, for clients that need more than the raw device payload:
+//
+//	{"deviceId": "...", "offset": 42, "metadata": {"receivedAt": "...", ...}, "data": {...}}
+package envelope
+
+import (
+	"context"
+	"encoding/json"
+	"maps"
+	"time"
+
+	"github.com/RaghibA/iot-telemetry/pkg/broker"
+	"github.com/RaghibA/iot-telemetry/pkg/payload"
+)
+
+// Envelope is a message as delivered to clients that asked for metadata.
+type Envelope struct {
+	DeviceID string          `json:"deviceId"`
+	Offset   uint64          `json:"offset"`
+	Metadata Metadata        `json:"metadata"`
+	Data     json.RawMessage `json:"data"`
+}
+
+// Metadata describes how and when a message was ingested. Fields missing from the
+// message, e.g. on messages published before they were introduced, are left out.
+type Metadata struct {
+	ReceivedAt    string `json:"receivedAt,omitempty"`
+	EventTime     string `json:"eventTime,omitempty"`
+	APIKeyID      string `json:"apiKeyId,omitempty"`
+	SourceIP      string `json:"sourceIp,omitempty"`
+	ContentType   string `json:"contentType,omitempty"`
+	SchemaVersion string `json:"schemaVersion,omitempty"`
+	RequestID     string `json:"requestId,omitempty"`
+}
+
+// Wrap encodes a message and its metadata headers as an Envelope.
+// Params:
+// - msg: broker.Message - the message to wrap
+// Returns:
+// - []byte: the JSON encoded envelope
+// - error: error if the envelope could not be encoded
+func Wrap(msg broker.Message) ([]byte, error) {
+	receivedAt := msg.Headers[broker.ReceivedAtHeader]
+	if receivedAt == "" && !msg.Timestamp.IsZero() {
+		receivedAt = msg.Timestamp.UTC().Format(time.RFC3339Nano)
+	}
+
+	data := json.RawMessage(msg.Value)
+	if payload.Binary(msg.Headers[broker.ContentTypeHeader]) || !json.Valid(msg.Value) {
+		// carry payloads that are not JSON as a base64 string
+		encoded, err := json.Marshal(msg.Value)
+		if err != nil {
+			return nil, err
+		}
+		data = encoded
+	}
+
+	return json.Marshal(Envelope{
+		DeviceID: msg.Key,
+		Offset:   msg.Offset,
+		Metadata: Metadata{
+			ReceivedAt:    receivedAt,
+			EventTime:     msg.Headers[broker.EventTimeHeader],
+			APIKeyID:      msg.Headers[broker.APIKeyIDHeader],
+			SourceIP:      msg.Headers[broker.SourceIPHeader],
+			ContentType:   msg.Headers[broker.ContentTypeHeader],
+			SchemaVersion: msg.Headers[broker.SchemaVersionHeader],
+			RequestID:     msg.Headers[broker.RequestIDHeader],
+		},
+		Data: data,
+	})
+}
+
+// Subscription delivers the messages of another subscription wrapped in envelopes.
+type Subscription struct {
+	broker.Subscription
+}
+
+// NewSubscription wraps a subscription so its messages are delivered as envelopes.
+// Params:
+// - sub: broker.Subscription - the subscription to wrap
+// Returns:
+// - *Subscription: a pointer to the created Subscription
+func NewSubscription(sub broker.Subscription) *Subscription {
+	return &Subscription{Subscription: sub}
+}
+
+// Next returns the next message with its value replaced by an envelope, and its
+// content_type header set to application/json.
+// Params:
+// - ctx: context.Context - bounds the wait for a message
+// Returns:
+// - broker.Message: the message
+// - error: the error of the wrapped subscription
+func (s *Subscription) Next(ctx context.Context) (broker.Message, error) {
+	msg, err := s.Subscription.Next(ctx)
+	if err != nil {
+		return msg, err
+	}
+	value, err := Wrap(msg)
+	if err != nil {
+		return msg, err
+	}
+	// the envelope keeps the payload's content type in its metadata
+	headers := maps.Clone(msg.Headers)
+	if headers == nil {
+		headers = make(map[string]string, 1)
+	}
+	headers[broker.ContentTypeHeader] = payload.JSON
+	msg.Headers = headers
+	msg.Value = value
+	return msg, nil
+}
@@ -0,0 +1,92 @@
+package envelope
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/RaghibA/iot-telemetry/pkg/broker"
+)
+
+func TestWrap(t *testing.T) {
+	t.Run("should wrap the payload with its metadata", func(t *testing.T) {
+		got, err := Wrap(broker.Message{
+			Key:    "device1",
+			Value:  []byte(`{"temp":1}`),
+			Offset: 7,
+			Headers: map[string]string{
+				broker.ReceivedAtHeader:    "2024-05-01T10:00:00Z",
+				broker.EventTimeHeader:     "2024-05-01T09:59:58Z",
+				broker.APIKeyIDHeader:      "a1b2",
+				broker.SourceIPHeader:      "203.0.113.9",
+				broker.ContentTypeHeader:   "application/json",
+				broker.SchemaVersionHeader: "1",
+				broker.RequestIDHeader:     "req-1",
+				"traceparent":              "00-abc",
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := `{"deviceId":"device1","offset":7,"metadata":{"receivedAt":"2024-05-01T10:00:00Z","eventTime":"2024-05-01T09:59:58Z","apiKeyId":"a1b2","sourceIp":"203.0.113.9","contentType":"application/json","schemaVersion":"1","requestId":"req-1"},"data":{"temp":1}}`
+		if string(got) != want {
+			t.Errorf("expected %s, got %s", want, got)
+		}
+	})
+
+	t.Run("should fall back to the broker timestamp without metadata headers", func(t *testing.T) {
+		got, err := Wrap(broker.Message{Key: "device1", Value: []byte(`{"temp":1}`), Timestamp: time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := `{"deviceId":"device1","offset":0,"metadata":{"receivedAt":"2024-05-01T10:00:00Z"},"data":{"temp":1}}`
+		if string(got) != want {
+			t.Errorf("expected %s, got %s", want, got)
+		}
+	})
+
+	t.Run("should encode payloads that are not JSON as base64", func(t *testing.T) {
+		got, err := Wrap(broker.Message{Key: "device1", Value: []byte{0xa1, 0x01}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := `{"deviceId":"device1","offset":0,"metadata":{},"data":"oQE="}`
+		if string(got) != want {
+			t.Errorf("expected %s, got %s", want, got)
+		}
+
+		// a MessagePack 1 is also the JSON number 1
+		got, err = Wrap(broker.Message{Key: "device1", Value: []byte{0x31}, Headers: map[string]string{broker.ContentTypeHeader: "application/x-msgpack"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		want = `{"deviceId":"device1","offset":0,"metadata":{"contentType":"application/x-msgpack"},"data":"MQ=="}`
+		if string(got) != want {
+			t.Errorf("expected %s, got %s", want, got)
+		}
+	})
+}
+
+func TestSubscription(t *testing.T) {
+	t.Run("should deliver messages as envelopes", func(t *testing.T) {
+		mb := broker.NewMockBroker()
+		mb.Backlog["stream"] = []broker.Message{{Key: "device1", Value: []byte(`{"temp":1}`)}}
+		sub, err := mb.Subscribe(context.Background(), "stream", broker.SubscribeOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		wrapped := NewSubscription(sub)
+		defer wrapped.Close()
+
+		msg, err := wrapped.Next(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := `{"deviceId":"device1","offset":0,"metadata":{},"data":{"temp":1}}`; string(msg.Value) != want {
+			t.Errorf("expected %s, got %s", want, msg.Value)
+		}
+		if msg.Headers[broker.ContentTypeHeader] != "application/json" {
+			t.Errorf("expected content_type application/json, got %q", msg.Headers[broker.ContentTypeHeader])
+		}
+	})
+}
@@ -0,0 +1,210 @@
+// Package filter selects and trims the telemetry streamed to a consumer. A filter is a
+// CEL expression over the device payload, bound to the variable data, e.g.
+//
+//	data.status != "ok" && data.temp > 40.0
+//
+// and a projection is a list of dotted field paths, e.g. temp,location.lat, that the
+// delivered payload is reduced to.
+package filter
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/RaghibA/iot-telemetry/pkg/broker"
+	"github.com/google/cel-go/cel"
+)
+
+// costLimit bounds the work a filter may do per message, so an expensive expression
+// cannot stall a stream.
+const costLimit = 10000
+
+// maxExpressionLength is the longest filter expression accepted.
+const maxExpressionLength = 1024
+
+// env declares the variables available to filter expressions.
+var env = mustEnv()
+
+func mustEnv() *cel.Env {
+	e, err := cel.NewEnv(
+		cel.Variable("data", cel.MapType(cel.StringType, cel.DynType)),
+		cel.CrossTypeNumericComparisons(true),
+	)
+	if err != nil {
+		panic(err)
+	}
+	return e
+}
+
+// Filter decides which messages a consumer receives and which of their fields. The zero
+// value passes every message through unchanged. It is safe for concurrent use.
+type Filter struct {
+	program cel.Program
+	fields  [][]string
+}
+
+// Compile builds a filter from an expression and a projection.
+// Params:
+// - expr: string - a CEL expression over data evaluating to a bool, empty for none
+// - fields: []string - dotted paths of the fields to keep, empty for all
+// Returns:
+// - *Filter: the compiled filter
+// - error: error describing why the expression or a field path is invalid
+func Compile(expr string, fields []string) (*Filter, error) {
+	f := &Filter{}
+
+	if expr != "" {
+		if len(expr) > maxExpressionLength {
+			return nil, fmt.Errorf("filter is longer than %d characters", maxExpressionLength)
+		}
+		ast, iss := env.Compile(expr)
+		if iss.Err() != nil {
+			return nil, fmt.Errorf("invalid filter: %w", iss.Err())
+		}
+		if ast.OutputType() != cel.BoolType && ast.OutputType() != cel.DynType {
+			return nil, fmt.Errorf("filter must evaluate to a bool, not %s", ast.OutputType())
+		}
+		program, err := env.Program(ast, cel.CostLimit(costLimit))
+		if err != nil {
+			return nil, fmt.Errorf("invalid filter: %w", err)
+		}
+		f.program = program
+	}
+
+	for _, field := range fields {
+		path := strings.Split(field, ".")
+		for _, p := range path {
+			if p == "" {
+				return nil, fmt.Errorf("invalid field %q", field)
+			}
+		}
+		f.fields = append(f.fields, path)
+	}
+	return f, nil
+}
+
+// Empty reports whether the filter passes every message through unchanged, without
+// reading it.
+func (f *Filter) Empty() bool {
+	return f.program == nil && len(f.fields) == 0
+}
+
+// Apply filters and projects one message value.
+// Params:
+// - value: []byte - the JSON payload
+// Returns:
+// - []byte: the payload to deliver
+// - bool: false if the message is filtered out, or could not be evaluated
+func (f *Filter) Apply(value []byte) ([]byte, bool) {
+	if f.program != nil {
+		var data map[string]any
+		if err := json.Unmarshal(value, &data); err != nil {
+			return nil, false
+		}
+		out, _, err := f.program.Eval(map[string]any{"data": data})
+		if err != nil {
+			// a missing field is an error in CEL; has(data.field) guards against it
+			return nil, false
+		}
+		if match, ok := out.Value().(bool); !ok || !match {
+			return nil, false
+		}
+	}
+
+	if len(f.fields) == 0 {
+		return value, true
+	}
+	projected, err := project(value, f.fields)
+	if err != nil {
+		return nil, false
+	}
+	return projected, true
+}
+
+// project copies the fields at paths from a JSON object into a new object, keeping their
+// nesting and their original encoding. Missing fields are left out.
+func project(value []byte, paths [][]string) ([]byte, error) {
+	out := map[string]any{}
+	for _, path := range paths {
+		raw, err := lookup(value, path)
+		if errors.Is(err, errNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		parent := out
+		for _, key := range path[:len(path)-1] {
+			child, ok := parent[key].(map[string]any)
+			if !ok {
+				child = map[string]any{}
+				parent[key] = child
+			}
+			parent = child
+		}
+		parent[path[len(path)-1]] = raw
+	}
+	return json.Marshal(out)
+}
+
+var errNotFound = errors.New("field not found")
+
+// lookup returns the raw JSON of the field at path.
+func lookup(value []byte, path []string) (json.RawMessage, error) {
+	raw := json.RawMessage(value)
+	for depth, key := range path {
+		var object map[string]json.RawMessage
+		if err := json.Unmarshal(raw, &object); err != nil {
+			if depth > 0 {
+				// the parent field is not an object
+				return nil, errNotFound
+			}
+			return nil, err
+		}
+		next, ok := object[key]
+		if !ok {
+			return nil, errNotFound
+		}
+		raw = next
+	}
+	return raw, nil
+}
+
+// Subscription delivers the messages of another subscription that pass a filter.
+type Subscription struct {
+	broker.Subscription
+	filter *Filter
+}
+
+// NewSubscription wraps a subscription with a filter.
+// Params:
+// - sub: broker.Subscription - the subscription to filter
+// - f: *Filter - the filter to apply
+// Returns:
+// - *Subscription: a pointer to the created Subscription
+func NewSubscription(sub broker.Subscription, f *Filter) *Subscription {
+	return &Subscription{Subscription: sub, filter: f}
+}
+
+// Next returns the next message that passes the filter, with its projected value.
+// Params:
+// - ctx: context.Context - bounds the wait for a message
+// Returns:
+// - broker.Message: the message
+// - error: the error of the wrapped subscription
+func (s *Subscription) Next(ctx context.Context) (broker.Message, error) {
+	for {
+		msg, err := s.Subscription.Next(ctx)
+		if err != nil {
+			return msg, err
+		}
+		if value, ok := s.filter.Apply(msg.Value); ok {
+			msg.Value = value
+			return msg, nil
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package filter
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/RaghibA/iot-telemetry/pkg/broker"
+)
+
+func TestCompile(t *testing.T) {
+	cases := []struct {
+		name   string
+		expr   string
+		fields []string
+		err    string
+	}{
+		{"should reject syntax errors", `data.status !=`, nil, "invalid filter"},
+		{"should reject undeclared variables", `status != "ok"`, nil, "undeclared reference"},
+		{"should reject non bool expressions", `1 + 2`, nil, "must evaluate to a bool"},
+		{"should reject overly long expressions", strings.Repeat("a", maxExpressionLength+1), nil, "longer than"},
+		{"should reject empty field path segments", "", []string{"location..lat"}, "invalid field"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := Compile(tc.expr, tc.fields)
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("expected error containing %q, got %v", tc.err, err)
+			}
+		})
+	}
+}
+
+func TestApply(t *testing.T) {
+	payload := `{"status":"fault","temp":41.5,"count":3,"location":{"lat":52.5,"lon":13.4},"blob":"xxxxxxxx"}`
+
+	cases := []struct {
+		name   string
+		expr   string
+		fields []string
+		want   string
+		pass   bool
+	}{
+		{"should pass messages through without a filter", "", nil, payload, true},
+		{"should pass matching messages", `data.status != "ok"`, nil, payload, true},
+		{"should drop messages that do not match", `data.status == "ok"`, nil, "", false},
+		{"should compare numbers across types", `data.temp > 40 && data.count == 3`, nil, payload, true},
+		{"should drop messages missing a filtered field", `data.missing == 1`, nil, "", false},
+		{"should guard missing fields with has", `!has(data.missing)`, nil, payload, true},
+		{"should project fields keeping their nesting", "", []string{"temp", "location.lat", "missing"}, `{"location":{"lat":52.5},"temp":41.5}`, true},
+		{"should skip paths through non objects", "", []string{"temp.value"}, `{}`, true},
+		{"should filter then project", `data.temp > 40.0`, []string{"status"}, `{"status":"fault"}`, true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			f, err := Compile(tc.expr, tc.fields)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, ok := f.Apply([]byte(payload))
+			if ok != tc.pass {
+				t.Fatalf("expected pass %v, got %v", tc.pass, ok)
+			}
+			if ok && string(got) != tc.want {
+				t.Errorf("expected %s, got %s", tc.want, got)
+			}
+		})
+	}
+
+	t.Run("should drop payloads that are not JSON objects", func(t *testing.T) {
+		f, err := Compile(`data.status != "ok"`, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := f.Apply([]byte(`[1,2]`)); ok {
+			t.Error("expected the message to be dropped")
+		}
+	})
+}
+
+func TestSubscription(t *testing.T) {
+	t.Run("should only return messages that pass the filter", func(t *testing.T) {
+		f, err := Compile(`data.status != "ok"`, []string{"status"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		mb := broker.NewMockBroker()
+		mb.Backlog["stream"] = []broker.Message{{Value: []byte(`{"status":"ok"}`)}, {Value: []byte(`{"status":"fault","temp":1}`)}}
+		sub, err := mb.Subscribe(context.Background(), "stream", broker.SubscribeOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		filtered := NewSubscription(sub, f)
+		defer filtered.Close()
+
+		msg, err := filtered.Next(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(msg.Value) != `{"status":"fault"}` {
+			t.Errorf(`expected {"status":"fault"}, got %s`, msg.Value)
+		}
+	})
+}
@@ -0,0 +1,312 @@
+// Package hub shares broker subscriptions between the clients streaming the same
+// device. The hub runs one subscription per active stream and fans its messages out to
+// every attached client through a bounded buffer, so a slow client cannot hold up the
+// others.
+package hub
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+
+	"github.com/RaghibA/iot-telemetry/pkg/broker"
+	"github.com/RaghibA/iot-telemetry/pkg/config"
+)
+
+// ErrSlowConsumer ends a client's subscription when its buffer is full and the hub is
+// configured to disconnect slow clients.
+var ErrSlowConsumer = errors.New("hub: client is not keeping up with the stream")
+
+// Options configures the per-client buffering.
+type Options struct {
+	// BufferSize is the number of messages buffered per client.
+	BufferSize int
+	// SlowPolicy is applied when a client's buffer is full: config.PolicyDropOldest,
+	// config.PolicyDropNewest or config.PolicyDisconnect.
+	SlowPolicy string
+}
+
+// Hub multiplexes broker subscriptions. It is safe for concurrent use.
+type Hub struct {
+	broker broker.Broker
+	opts   Options
+	logger *slog.Logger
+
+	mu     sync.Mutex
+	topics map[string]*topic
+	closed bool
+}
+
+// New creates a hub subscribing through b.
+// Params:
+// - b: broker.Broker - the broker to subscribe to
+// - opts: Options - the client buffering options
+// - logger: *slog.Logger - the logger instance
+// Returns:
+// - *Hub: a pointer to the created Hub
+func New(b broker.Broker, opts Options, logger *slog.Logger) *Hub {
+	return &Hub{
+		broker: b,
+		opts:   opts,
+		logger: logger,
+		topics: make(map[string]*topic),
+	}
+}
+
+// Subscribe attaches a client to a stream. Subscriptions starting at the newest message
+// share the stream's hub subscription, others are passed through to the broker since
+// they need their own position in the stream.
+// Params:
+// - ctx: context.Context - bounds the wait for the stream subscription
+// - stream: string - the stream to subscribe to
+// - opts: broker.SubscribeOptions - where the subscription starts
+// Returns:
+// - broker.Subscription: the client subscription, which must be closed
+// - error: error if the stream could not be subscribed to
+func (h *Hub) Subscribe(ctx context.Context, stream string, opts broker.SubscribeOptions) (broker.Subscription, error) {
+	if opts.Start != broker.StartNewest {
+		return h.broker.Subscribe(ctx, stream, opts)
+	}
+
+	h.mu.Lock()
+	if h.closed {
+		h.mu.Unlock()
+		return nil, broker.ErrClosed
+	}
+	t, ok := h.topics[stream]
+	if !ok {
+		topicCtx, cancel := context.WithCancel(context.Background())
+		t = &topic{name: stream, clients: make(map[*Client]struct{}), ready: make(chan struct{}), cancel: cancel}
+		h.topics[stream] = t
+		go h.open(topicCtx, t)
+	}
+	c := &Client{
+		hub:      h,
+		topic:    t,
+		messages: make(chan broker.Message, max(h.opts.BufferSize, 1)),
+		done:     make(chan struct{}),
+	}
+	t.mu.Lock()
+	t.clients[c] = struct{}{}
+	t.mu.Unlock()
+	h.mu.Unlock()
+
+	select {
+	case <-t.ready:
+	case <-ctx.Done():
+		c.Close()
+		return nil, ctx.Err()
+	}
+	if t.err != nil {
+		c.Close()
+		return nil, t.err
+	}
+	return c, nil
+}
+
+// Streams returns the number of streams with an active hub subscription.
+// Params: None
+// Returns:
+// - int: the number of streams
+func (h *Hub) Streams() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return len(h.topics)
+}
+
+// Close ends every hub subscription. Attached clients receive broker.ErrClosed.
+// Params: None
+// Returns:
+// - error: always nil
+func (h *Hub) Close() error {
+	h.mu.Lock()
+	h.closed = true
+	topics := h.topics
+	h.topics = make(map[string]*topic)
+	h.mu.Unlock()
+
+	for _, t := range topics {
+		t.stop(broker.ErrClosed)
+	}
+	return nil
+}
+
+// open subscribes to a topic's stream and fans out its messages until ctx is cancelled
+// or the subscription ends.
+func (h *Hub) open(ctx context.Context, t *topic) {
+	sub, err := h.broker.Subscribe(ctx, t.name, broker.SubscribeOptions{Start: broker.StartNewest})
+	if err != nil {
+		t.cancel()
+		t.err = err
+		h.remove(t)
+		close(t.ready)
+		t.stop(err)
+		return
+	}
+	close(t.ready)
+	h.logger.Info("stream subscription opened", "stream", t.name)
+
+	for {
+		msg, err := sub.Next(ctx)
+		if err != nil {
+			_ = sub.Close()
+			h.remove(t)
+			if ctx.Err() == nil {
+				h.logger.Warn("stream subscription ended", "stream", t.name, "err", err)
+				t.stop(err)
+			}
+			return
+		}
+		t.broadcast(msg, h.opts.SlowPolicy)
+	}
+}
+
+// remove forgets a topic so the next client opens a new subscription.
+func (h *Hub) remove(t *topic) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.topics[t.name] == t {
+		delete(h.topics, t.name)
+	}
+}
+
+// detach removes a client from its topic and stops the topic with its last client.
+func (h *Hub) detach(c *Client) {
+	h.mu.Lock()
+	t := c.topic
+	t.mu.Lock()
+	_, attached := t.clients[c]
+	if attached {
+		delete(t.clients, c)
+		c.end(broker.ErrClosed)
+	}
+	last := len(t.clients) == 0
+	t.mu.Unlock()
+	if last && h.topics[t.name] == t {
+		delete(h.topics, t.name)
+	}
+	h.mu.Unlock()
+
+	if attached && c.dropped > 0 {
+		h.logger.Info("slow client dropped messages", "stream", t.name, "dropped", c.dropped)
+	}
+	if last {
+		t.cancel()
+	}
+}
+
+// topic is one stream subscription shared by its clients.
+type topic struct {
+	name   string
+	ready  chan struct{} // closed once the subscription is open or err is set
+	err    error
+	cancel context.CancelFunc // stops the subscription
+
+	mu      sync.Mutex
+	clients map[*Client]struct{}
+}
+
+// broadcast hands a message to every client, applying policy to full buffers.
+func (t *topic) broadcast(msg broker.Message, policy string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for c := range t.clients {
+		select {
+		case c.messages <- msg:
+			continue
+		default:
+		}
+
+		switch policy {
+		case config.PolicyDropNewest:
+			c.dropped++
+		case config.PolicyDisconnect:
+			delete(t.clients, c)
+			c.end(ErrSlowConsumer)
+		default:
+			// drop the oldest buffered messages until the new one fits; the client may
+			// be reading concurrently, so the buffer can drain between attempts
+			for {
+				select {
+				case <-c.messages:
+					c.dropped++
+				default:
+				}
+				select {
+				case c.messages <- msg:
+				default:
+					continue
+				}
+				break
+			}
+		}
+	}
+}
+
+// stop ends every client of the topic with err.
+func (t *topic) stop(err error) {
+	t.cancel()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for c := range t.clients {
+		delete(t.clients, c)
+		c.end(err)
+	}
+}
+
+// Client is one consumer of a shared stream subscription. It implements
+// broker.Subscription.
+type Client struct {
+	hub      *Hub
+	topic    *topic
+	messages chan broker.Message
+	done     chan struct{}
+	err      error  // set before done is closed
+	dropped  uint64 // guarded by topic.mu
+}
+
+// end closes the client with err. The caller holds topic.mu.
+func (c *Client) end(err error) {
+	c.err = err
+	close(c.done)
+}
+
+// Next returns the next buffered message. Once the client has been ended, by Close, a
+// slow consumer disconnect or the end of the stream subscription, it returns the reason.
+func (c *Client) Next(ctx context.Context) (broker.Message, error) {
+	select {
+	case <-c.done:
+		return broker.Message{}, c.err
+	default:
+	}
+
+	select {
+	case msg := <-c.messages:
+		return msg, nil
+	case <-c.done:
+		return broker.Message{}, c.err
+	case <-ctx.Done():
+		return broker.Message{}, ctx.Err()
+	}
+}
+
+// Dropped returns the number of messages dropped because the client's buffer was full.
+func (c *Client) Dropped() uint64 {
+	c.topic.mu.Lock()
+	defer c.topic.mu.Unlock()
+
+	return c.dropped
+}
+
+// Close detaches the client. The stream subscription is closed with its last client.
+// It is safe to call more than once.
+func (c *Client) Close() error {
+	c.hub.detach(c)
+	return nil
+}
@@ -0,0 +1,241 @@
+package hub
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/RaghibA/iot-telemetry/pkg/broker"
+	"github.com/RaghibA/iot-telemetry/pkg/broker/memory"
+	"github.com/RaghibA/iot-telemetry/pkg/config"
+)
+
+var testLogger = slog.New(slog.NewTextHandler(new(lockedWriter), nil))
+
+type lockedWriter struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (w *lockedWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.buf.Write(p)
+}
+
+// newTestHub creates a hub over a memory broker with one stream.
+func newTestHub(t *testing.T, opts Options) (*Hub, *memory.Broker) {
+	t.Helper()
+	b := memory.New(memory.DefaultCapacity)
+	t.Cleanup(func() { b.Close() })
+	if err := b.CreateStream(context.Background(), "stream"); err != nil {
+		t.Fatal(err)
+	}
+
+	h := New(b, opts, testLogger)
+	t.Cleanup(func() { h.Close() })
+	return h, b
+}
+
+func subscribe(t *testing.T, h *Hub) *Client {
+	t.Helper()
+	sub, err := h.Subscribe(context.Background(), "stream", broker.SubscribeOptions{Start: broker.StartNewest})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sub.(*Client)
+}
+
+func publish(t *testing.T, b broker.Broker, values ...string) {
+	t.Helper()
+	for _, v := range values {
+		if _, err := b.Publish(context.Background(), "stream", broker.Message{Value: []byte(v)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// waitFor polls cond until it holds or the test times out.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// drain reads the messages buffered by c.
+func drain(t *testing.T, c *Client) []string {
+	t.Helper()
+	var values []string
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		msg, err := c.Next(ctx)
+		cancel()
+		if errors.Is(err, context.DeadlineExceeded) {
+			return values
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		values = append(values, string(msg.Value))
+	}
+}
+
+func TestHub(t *testing.T) {
+	t.Run("should fan out one stream subscription to every client", func(t *testing.T) {
+		h, b := newTestHub(t, Options{BufferSize: 8, SlowPolicy: config.PolicyDropOldest})
+		first, second := subscribe(t, h), subscribe(t, h)
+
+		publish(t, b, "1", "2")
+		for _, c := range []*Client{first, second} {
+			for _, want := range []string{"1", "2"} {
+				msg, err := c.Next(context.Background())
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(msg.Value) != want {
+					t.Errorf("expected %s, got %s", want, msg.Value)
+				}
+			}
+		}
+		if n := h.Streams(); n != 1 {
+			t.Errorf("expected 1 stream subscription, got %d", n)
+		}
+	})
+
+	t.Run("should close the stream subscription with its last client", func(t *testing.T) {
+		mb := broker.NewMockBroker()
+		h := New(mb, Options{BufferSize: 8, SlowPolicy: config.PolicyDropOldest}, testLogger)
+		defer h.Close()
+
+		first, _ := h.Subscribe(context.Background(), "stream", broker.SubscribeOptions{})
+		second, _ := h.Subscribe(context.Background(), "stream", broker.SubscribeOptions{})
+		first.Close()
+		if n := h.Streams(); n != 1 {
+			t.Errorf("expected the stream to stay open for the second client, got %d streams", n)
+		}
+		second.Close()
+		if n := h.Streams(); n != 0 {
+			t.Errorf("expected the stream to close, got %d streams", n)
+		}
+
+		third, err := h.Subscribe(context.Background(), "stream", broker.SubscribeOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer third.Close()
+		if n := mb.Subscribers("stream"); n != 2 {
+			t.Errorf("expected a new broker subscription, got %d subscriptions", n)
+		}
+	})
+
+	t.Run("should drop the oldest messages of a slow client", func(t *testing.T) {
+		h, b := newTestHub(t, Options{BufferSize: 2, SlowPolicy: config.PolicyDropOldest})
+		c := subscribe(t, h)
+
+		publish(t, b, "1", "2", "3", "4", "5")
+		waitFor(t, "3 dropped messages", func() bool { return c.Dropped() == 3 })
+
+		if got := fmt.Sprint(drain(t, c)); got != "[4 5]" {
+			t.Errorf("expected [4 5], got %s", got)
+		}
+	})
+
+	t.Run("should drop the newest messages of a slow client", func(t *testing.T) {
+		h, b := newTestHub(t, Options{BufferSize: 2, SlowPolicy: config.PolicyDropNewest})
+		c := subscribe(t, h)
+
+		publish(t, b, "1", "2", "3", "4", "5")
+		waitFor(t, "3 dropped messages", func() bool { return c.Dropped() == 3 })
+
+		if got := fmt.Sprint(drain(t, c)); got != "[1 2]" {
+			t.Errorf("expected [1 2], got %s", got)
+		}
+	})
+
+	t.Run("should disconnect a slow client without affecting the others", func(t *testing.T) {
+		h, b := newTestHub(t, Options{BufferSize: 2, SlowPolicy: config.PolicyDisconnect})
+		slow, fast := subscribe(t, h), subscribe(t, h)
+
+		// the fast client reads every message before the next one is published, while
+		// the slow client reads nothing and overflows on the third
+		for _, v := range []string{"1", "2", "3"} {
+			publish(t, b, v)
+			msg, err := fast.Next(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(msg.Value) != v {
+				t.Errorf("expected %s, got %s", v, msg.Value)
+			}
+		}
+
+		waitFor(t, "the slow client to be disconnected", func() bool {
+			select {
+			case <-slow.done:
+				return true
+			default:
+				return false
+			}
+		})
+		if _, err := slow.Next(context.Background()); !errors.Is(err, ErrSlowConsumer) {
+			t.Errorf("expected ErrSlowConsumer, got %v", err)
+		}
+	})
+
+	t.Run("should end clients when the stream is deleted", func(t *testing.T) {
+		h, b := newTestHub(t, Options{BufferSize: 2, SlowPolicy: config.PolicyDropOldest})
+		c := subscribe(t, h)
+
+		if err := b.DeleteStream(context.Background(), "stream"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := c.Next(context.Background()); !errors.Is(err, broker.ErrClosed) {
+			t.Errorf("expected broker.ErrClosed, got %v", err)
+		}
+		waitFor(t, "the stream to be forgotten", func() bool { return h.Streams() == 0 })
+	})
+
+	t.Run("should return subscribe errors", func(t *testing.T) {
+		h, _ := newTestHub(t, Options{BufferSize: 2, SlowPolicy: config.PolicyDropOldest})
+
+		_, err := h.Subscribe(context.Background(), "missing", broker.SubscribeOptions{})
+		if !errors.Is(err, broker.ErrStreamNotFound) {
+			t.Errorf("expected broker.ErrStreamNotFound, got %v", err)
+		}
+		if n := h.Streams(); n != 0 {
+			t.Errorf("expected no stream subscription, got %d", n)
+		}
+	})
+
+	t.Run("should pass subscriptions with a start position through to the broker", func(t *testing.T) {
+		h, b := newTestHub(t, Options{BufferSize: 2, SlowPolicy: config.PolicyDropOldest})
+		publish(t, b, "1", "2")
+
+		sub, err := h.Subscribe(context.Background(), "stream", broker.SubscribeOptions{Start: broker.StartOldest})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer sub.Close()
+
+		msg, err := sub.Next(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(msg.Value) != "1" {
+			t.Errorf("expected the oldest message, got %s", msg.Value)
+		}
+		if n := h.Streams(); n != 0 {
+			t.Errorf("expected no hub subscription, got %d", n)
+		}
+	})
+}
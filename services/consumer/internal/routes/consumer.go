@@ -3,38 +3,144 @@ package routes
 import (
 	"context"
 	"encoding/json"
-	"log"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/RaghibA/iot-telemetry/pkg/broker"
+	"github.com/RaghibA/iot-telemetry/pkg/httpserver"
 	"github.com/RaghibA/iot-telemetry/pkg/jwt"
-	"github.com/RaghibA/iot-telemetry/pkg/kafka"
+	"github.com/RaghibA/iot-telemetry/pkg/logging"
+	"github.com/RaghibA/iot-telemetry/pkg/models"
+	"github.com/RaghibA/iot-telemetry/pkg/payload"
+	"github.com/RaghibA/iot-telemetry/pkg/transport"
+	"github.com/RaghibA/iot-telemetry/services/consumer/internal/envelope"
+	"github.com/RaghibA/iot-telemetry/services/consumer/internal/filter"
+	"github.com/RaghibA/iot-telemetry/services/consumer/internal/hub"
 	"github.com/RaghibA/iot-telemetry/services/consumer/internal/store"
+	"github.com/RaghibA/iot-telemetry/services/consumer/internal/throttle"
+	"github.com/RaghibA/iot-telemetry/services/consumer/internal/ticket"
+	"github.com/RaghibA/iot-telemetry/services/consumer/internal/transcode"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
 	"github.com/jackc/pgx/v5"
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/protobuf/reflect/protoreflect"
 )
 
-var upgrader = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
-	CheckOrigin: func(r *http.Request) bool {
-		return true
-	},
-}
+// Formats selectable with the format query parameter.
+const (
+	// formatRaw delivers payloads as the device sent them.
+	formatRaw = "raw"
+	// formatJSON transcodes binary payloads to JSON.
+	formatJSON = "json"
+)
 
 type Handler struct {
-	store  store.ConsumerStore
-	logger *log.Logger
-	kafka  kafka.KafkaClient
+	store    store.ConsumerStore
+	logger   *slog.Logger
+	hub      *hub.Hub
+	tickets  *ticket.Store
+	ws       transport.WebSocketOptions
+	upgrader *websocket.Upgrader
+}
+
+func NewConsumerHander(store store.ConsumerStore, logger *slog.Logger, hub *hub.Hub, tickets *ticket.Store, ws transport.WebSocketOptions) *Handler {
+	return &Handler{
+		store:    store,
+		logger:   logger,
+		hub:      hub,
+		tickets:  tickets,
+		ws:       ws,
+		upgrader: ws.Upgrader(bearerProtocol),
+	}
+}
+
+// streamError is a failure to open a device stream. It is reported as an HTTP error on
+// event streams, and as a close frame after the upgrade on websockets, since browsers do
+// not expose the status of a failed handshake.
+type streamError struct {
+	status  int
+	message string
 }
 
-func NewConsumerHander(store store.ConsumerStore, logger *log.Logger, kafka kafka.KafkaClient) *Handler {
-	return &Handler{store: store, logger: logger, kafka: kafka}
+func (e *streamError) Error() string {
+	return e.message
+}
+
+// closeCode maps the HTTP status to a websocket close code: client errors use the
+// application range as 4000 + status, e.g. 4404, server errors use 1011.
+func (e *streamError) closeCode() int {
+	if e.status >= http.StatusInternalServerError {
+		return websocket.CloseInternalServerErr
+	}
+	return 4000 + e.status
+}
+
+// streamEndCode returns the close code and reason for a websocket stream that ended
+// with err.
+func streamEndCode(err error) (int, string) {
+	switch {
+	case errors.Is(err, hub.ErrSlowConsumer):
+		return websocket.ClosePolicyViolation, "client is not keeping up with the stream"
+	case errors.Is(err, broker.ErrClosed):
+		return websocket.CloseGoingAway, "stream closed"
+	default:
+		return websocket.CloseInternalServerErr, "stream failed"
+	}
 }
 
 func (h *Handler) ConsumerRoutes(router *mux.Router) {
 	router.HandleFunc("/health", h.healthCheck).Methods(http.MethodGet)
 	router.HandleFunc("/messages", jwt.AuthWithAccessToken(h.ConsumerMessages)).Methods(http.MethodGet)
+	router.HandleFunc("/ws/ticket", jwt.AuthWithAccessToken(h.IssueTicket)).Methods(http.MethodPost)
+}
+
+// IssueTicketRequestBody optionally restricts a ticket to one device.
+type IssueTicketRequestBody struct {
+	DeviceID string `json:"deviceId"`
+}
+
+// IssueTicket mints a single use ticket for opening a websocket without headers. The body
+// is optional.
+// Params:
+// - w: http.ResponseWriter - the HTTP response writer
+// - r: *http.Request - the HTTP request
+// Returns: None
+func (h *Handler) IssueTicket(w http.ResponseWriter, r *http.Request) {
+	var body IssueTicketRequestBody
+	if err := httpserver.DecodeJSON(r, &body); err != nil && !errors.Is(err, io.EOF) {
+		h.logger.WarnContext(r.Context(), "invalid request body", "err", err)
+		httpserver.WriteBodyError(w, err)
+		return
+	}
+
+	userId, _ := r.Context().Value(jwt.UserKey).(string)
+	tokenExpires, _ := r.Context().Value(jwt.ExpiresKey).(time.Time)
+	if userId == "" || tokenExpires.IsZero() {
+		h.logger.ErrorContext(r.Context(), "no user id or token expiry found in ctx")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	id, t, err := h.tickets.Issue(userId, body.DeviceID, tokenExpires)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "failed to issue ticket", "err", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"ticket":    id,
+		"expiresAt": t.Expires,
+	})
 }
 
 func (h *Handler) healthCheck(w http.ResponseWriter, r *http.Request) {
@@ -45,42 +151,299 @@ func (h *Handler) healthCheck(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// ConsumerMessages streams a device's telemetry over a websocket. Failures after the
+// upgrade are reported with a close code and reason, and the connection is kept alive
+// with pings until the client disconnects or its access token expires.
+// Params:
+// - w: http.ResponseWriter - the HTTP response writer
+// - r: *http.Request - the HTTP request
+// Returns: None
 func (h *Handler) ConsumerMessages(w http.ResponseWriter, r *http.Request) {
-	conn, err := upgrader.Upgrade(w, r, nil)
+	conn, err := h.upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		h.logger.Println("WS upgrade failed:", err)
+		h.logger.WarnContext(r.Context(), "ws upgrade failed", "err", err)
 		return
 	}
-	defer conn.Close()
+	ws := transport.NewWebSocket(conn, h.ws)
 
-	userId := r.Context().Value(jwt.UserKey).(string)
+	sess, serr := h.authenticate(r)
+	if serr != nil {
+		_ = ws.Close(serr.closeCode(), serr.message)
+		return
+	}
+	logging.SetUserID(r.Context(), sess.userId)
 
-	if userId == "" {
-		h.logger.Println("no user id found in ctx")
+	deviceId := requestedDevice(r)
+	if sess.deviceId != "" {
+		if deviceId != "" && deviceId != sess.deviceId {
+			h.logger.WarnContext(r.Context(), "ticket issued for another device", "ticket_device_id", sess.deviceId)
+			_ = ws.Close(4000+http.StatusForbidden, "Ticket was issued for another device")
+			return
+		}
+		deviceId = sess.deviceId
+	}
+
+	pipeline, serr := h.pipeline(r, true)
+	if serr != nil {
+		_ = ws.Close(serr.closeCode(), serr.message)
 		return
 	}
 
-	deviceId := r.Header.Get("x-device-id")
-	if deviceId == "" {
-		h.logger.Println("no device id in req header")
+	device, sub, serr := h.subscribe(r, sess.userId, deviceId, broker.SubscribeOptions{Start: broker.StartNewest})
+	if serr != nil {
+		_ = ws.Close(serr.closeCode(), serr.message)
 		return
 	}
+	defer sub.Close()
 
-	dbCtx := context.Background()
-	device, err := h.store.GetDeviceById(dbCtx, deviceId)
+	ctx, cancel := context.WithCancelCause(r.Context())
+	defer cancel(nil)
+	sess.expireWith(func() { cancel(errTokenExpired) })
+	defer sess.stop()
+
+	ctx = ws.Run(ctx, func(data []byte) error { return h.reauthenticate(r, sess, data) })
+	err = transport.Forward(ctx, pipeline(sub), ws, attribute.String("device.id", device.DeviceID))
+
+	var cause *streamError
+	if errors.As(context.Cause(ctx), &cause) {
+		h.logger.InfoContext(r.Context(), "websocket closed", "stream", device.TopicName, "reason", cause.message)
+		_ = ws.Close(cause.closeCode(), cause.message)
+		return
+	}
+	if ctx.Err() != nil {
+		h.logger.InfoContext(r.Context(), "client disconnected", "stream", device.TopicName, "cause", context.Cause(ctx))
+		_ = conn.Close()
+		return
+	}
+
+	h.logger.InfoContext(r.Context(), "subscription ended", "stream", device.TopicName, "err", err)
+	_ = ws.Close(streamEndCode(err))
+}
+
+// StreamEvents streams a device's telemetry as server-sent events. Clients reconnecting
+// with a Last-Event-ID header resume after the last event they received.
+// Params:
+// - w: http.ResponseWriter - the HTTP response writer
+// - r: *http.Request - the HTTP request
+// Returns: None
+func (h *Handler) StreamEvents(w http.ResponseWriter, r *http.Request) {
+	pipeline, serr := h.pipeline(r, false)
+	if serr != nil {
+		http.Error(w, serr.message, serr.status)
+		return
+	}
+
+	userId, _ := r.Context().Value(jwt.UserKey).(string)
+	device, sub, serr := h.subscribe(r, userId, requestedDevice(r), transport.SSEResumeOptions(r))
+	if serr != nil {
+		http.Error(w, serr.message, serr.status)
+		return
+	}
+	defer sub.Close()
+
+	sse, err := transport.NewSSE(w)
 	if err != nil {
-		if err == pgx.ErrNoRows {
-			h.logger.Println("device not found: ", err)
-		} else {
-			h.logger.Println(err)
-		}
+		h.logger.ErrorContext(r.Context(), "event stream not supported", "err", err)
 		return
 	}
 
+	err = transport.Forward(r.Context(), pipeline(sub), sse, attribute.String("device.id", device.DeviceID))
+	h.logger.InfoContext(r.Context(), "subscription ended", "stream", device.TopicName, "err", err)
+}
+
+// pipeline builds the processing the client asked for in the query: binary payloads
+// transcoded to JSON if the format parameter is json, a filter and projection, then a
+// throttle, then an envelope with the message metadata if the envelope parameter is true.
+// Filters, projections and averages read JSON, so they transcode by default and cannot be
+// combined with the raw format.
+// Params:
+// - r: *http.Request - the HTTP request
+// - binary: bool - whether the transport can deliver binary payloads as sent, the default
+// Returns:
+// - func(broker.Subscription) broker.Subscription: wraps a subscription with the processing
+// - *streamError: a 400 error describing invalid parameters, nil on success
+func (h *Handler) pipeline(r *http.Request, binary bool) (func(broker.Subscription) broker.Subscription, *streamError) {
+	f, serr := h.compileFilter(r)
+	if serr != nil {
+		return nil, serr
+	}
+	rate, serr := h.throttleOptions(r)
+	if serr != nil {
+		return nil, serr
+	}
+
+	readsJSON := !f.Empty() || rate.Mode == throttle.ModeAverage
+	format := formatRaw
+	if !binary || readsJSON {
+		format = formatJSON
+	}
+	if v := r.URL.Query().Get("format"); v != "" {
+		switch {
+		case v != formatRaw && v != formatJSON:
+			h.logger.WarnContext(r.Context(), "invalid stream format", "format", v)
+			return nil, &streamError{http.StatusBadRequest, fmt.Sprintf("format %q must be %s or %s", v, formatRaw, formatJSON)}
+		case v == formatRaw && !binary:
+			h.logger.WarnContext(r.Context(), "raw format on a text stream")
+			return nil, &streamError{http.StatusBadRequest, fmt.Sprintf("format %s is only available over websockets", formatRaw)}
+		case v == formatRaw && readsJSON:
+			h.logger.WarnContext(r.Context(), "raw format with a filter")
+			return nil, &streamError{http.StatusBadRequest, fmt.Sprintf("format %s cannot be used with a filter, fields or an average, which read JSON", formatRaw)}
+		}
+		format = v
+	}
+
+	wrap := false
+	if v := r.URL.Query().Get("envelope"); v != "" {
+		var err error
+		if wrap, err = strconv.ParseBool(v); err != nil {
+			h.logger.WarnContext(r.Context(), "invalid stream envelope", "envelope", v)
+			return nil, &streamError{http.StatusBadRequest, fmt.Sprintf("invalid envelope %q", v)}
+		}
+	}
+
+	return func(sub broker.Subscription) broker.Subscription {
+		if format == formatJSON {
+			sub = transcode.NewSubscription(sub, h.deviceSchema)
+		}
+		sub = throttle.New(filter.NewSubscription(sub, f), rate)
+		if wrap {
+			sub = envelope.NewSubscription(sub)
+		}
+		return sub
+	}, nil
+}
+
+// deviceSchema returns the Protobuf message type registered for a device, nil if it has
+// none.
+// Params:
+// - ctx: context.Context - the stream context
+// - deviceId: string - the device ID
+// Returns:
+// - protoreflect.MessageDescriptor: the message type
+// - error: error if the schema could not be read
+func (h *Handler) deviceSchema(ctx context.Context, deviceId string) (protoreflect.MessageDescriptor, error) {
+	schema, err := h.store.GetDeviceSchema(ctx, deviceId)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		h.logger.ErrorContext(ctx, "db get device schema", "err", err)
+		return nil, err
+	}
+	return payload.ParseSchema(schema.DescriptorSet, schema.MessageType)
+}
+
+// compileFilter compiles the filter expression and field projection given in the filter
+// and fields query parameters.
+// Params:
+// - r: *http.Request - the HTTP request
+// Returns:
+// - *filter.Filter: the compiled filter, passing every message if none was given
+// - *streamError: a 400 error describing an invalid filter, nil on success
+func (h *Handler) compileFilter(r *http.Request) (*filter.Filter, *streamError) {
+	var fields []string
+	for _, field := range strings.Split(r.URL.Query().Get("fields"), ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			fields = append(fields, field)
+		}
+	}
+
+	f, err := filter.Compile(r.URL.Query().Get("filter"), fields)
+	if err != nil {
+		h.logger.WarnContext(r.Context(), "invalid stream filter", "err", err)
+		return nil, &streamError{http.StatusBadRequest, err.Error()}
+	}
+	return f, nil
+}
+
+// throttleOptions reads the throttle mode from the throttle query parameter, with its
+// rate in messages per second or its interval as a duration such as 500ms.
+// Params:
+// - r: *http.Request - the HTTP request
+// Returns:
+// - throttle.Options: the throttle options, the zero value if none were given
+// - *streamError: a 400 error describing invalid options, nil on success
+func (h *Handler) throttleOptions(r *http.Request) (throttle.Options, *streamError) {
+	query := r.URL.Query()
+	opts := throttle.Options{Mode: query.Get("throttle")}
+
+	var err error
+	if v := query.Get("rate"); v != "" {
+		if opts.Rate, err = strconv.ParseFloat(v, 64); err != nil {
+			err = fmt.Errorf("invalid rate %q", v)
+		}
+	}
+	if v := query.Get("interval"); v != "" && err == nil {
+		if opts.Interval, err = time.ParseDuration(v); err != nil {
+			err = fmt.Errorf("invalid interval %q", v)
+		}
+	}
+	if err == nil {
+		err = opts.Validate()
+	}
+	if err != nil {
+		h.logger.WarnContext(r.Context(), "invalid stream throttle", "err", err)
+		return throttle.Options{}, &streamError{http.StatusBadRequest, err.Error()}
+	}
+	return opts, nil
+}
+
+// requestedDevice returns the device named in the request path, the deviceId query
+// parameter or the x-device-id header.
+func requestedDevice(r *http.Request) string {
+	if id := mux.Vars(r)["deviceId"]; id != "" {
+		return id
+	}
+	if id := r.URL.Query().Get("deviceId"); id != "" {
+		return id
+	}
+	return r.Header.Get("x-device-id")
+}
+
+// subscribe looks up a device, checks that it belongs to the authenticated user and
+// subscribes to its stream through the hub.
+// Params:
+// - r: *http.Request - the HTTP request
+// - userId: string - the authenticated user
+// - deviceId: string - the requested device
+// - opts: broker.SubscribeOptions - where the subscription starts
+// Returns:
+// - *models.Device: the device
+// - broker.Subscription: the subscription, which the caller must close
+// - *streamError: the failure to report to the client, nil on success
+func (h *Handler) subscribe(r *http.Request, userId string, deviceId string, opts broker.SubscribeOptions) (*models.Device, broker.Subscription, *streamError) {
+	if userId == "" {
+		h.logger.ErrorContext(r.Context(), "no user id found in ctx")
+		return nil, nil, &streamError{http.StatusInternalServerError, "Internal server error"}
+	}
+
+	if deviceId == "" {
+		h.logger.WarnContext(r.Context(), "no device id in request")
+		return nil, nil, &streamError{http.StatusBadRequest, "Provide device id in the path, 'deviceId' query parameter or 'x-device-id' header"}
+	}
+	logging.SetDeviceID(r.Context(), deviceId)
+
+	dbCtx := r.Context()
+	device, err := h.store.GetDeviceById(dbCtx, deviceId)
+	if err == pgx.ErrNoRows {
+		h.logger.WarnContext(r.Context(), "device not found", "err", err)
+		return nil, nil, &streamError{http.StatusNotFound, "Device not found"}
+	}
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "db get device", "err", err)
+		return nil, nil, &streamError{http.StatusInternalServerError, "Internal server error"}
+	}
+
 	if userId != device.UserID {
-		h.logger.Println("device uid & access token uid mismatch", userId, device.UserID)
-		return
+		h.logger.WarnContext(r.Context(), "device uid & access token uid mismatch", "device_user_id", device.UserID)
+		return nil, nil, &streamError{http.StatusForbidden, "Access token does not have permission to consume from this device"}
+	}
+
+	sub, err := h.hub.Subscribe(r.Context(), device.TopicName, opts)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "failed to subscribe", "stream", device.TopicName, "err", err)
+		return nil, nil, &streamError{http.StatusInternalServerError, "Internal server error"}
 	}
 
-	h.kafka.ConsumeFromTopic(device.TopicName, deviceId, conn)
+	return device, sub, nil
 }
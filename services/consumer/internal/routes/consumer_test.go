@@ -0,0 +1,880 @@
+package routes
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/RaghibA/iot-telemetry/pkg/broker"
+	"github.com/RaghibA/iot-telemetry/pkg/config"
+	"github.com/RaghibA/iot-telemetry/pkg/jwt"
+	"github.com/RaghibA/iot-telemetry/pkg/models"
+	"github.com/RaghibA/iot-telemetry/pkg/payload"
+	"github.com/RaghibA/iot-telemetry/pkg/transport"
+	"github.com/RaghibA/iot-telemetry/services/consumer/internal/hub"
+	"github.com/RaghibA/iot-telemetry/services/consumer/internal/store"
+	"github.com/RaghibA/iot-telemetry/services/consumer/internal/ticket"
+	"github.com/fxamacker/cbor/v2"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+var testLogger *slog.Logger
+var buf *syncBuffer
+
+// syncBuffer is a log buffer that stream handlers can write to from their own goroutines.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) Reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.buf.Reset()
+}
+
+func TestMain(m *testing.M) {
+	buf = new(syncBuffer)
+	testLogger = slog.New(slog.NewTextHandler(buf, nil)).With("service", "test")
+
+	code := m.Run()
+	os.Exit(code)
+}
+
+// newTestServer serves the consumer stream routes backed by a mock store holding one
+// device owned by user "1234user".
+func newTestServer(t *testing.T) (*httptest.Server, *broker.MockBroker) {
+	t.Helper()
+	consumerStore := store.NewMockStore()
+	consumerStore.Devices["device1"] = &models.Device{DeviceID: "device1", UserID: "1234user", TopicName: "stream1"}
+	mb := broker.NewMockBroker()
+	streamHub := hub.New(mb, hub.Options{BufferSize: 16, SlowPolicy: config.PolicyDropOldest}, testLogger)
+	t.Cleanup(func() { streamHub.Close() })
+	handler := NewConsumerHander(consumerStore, testLogger, streamHub, ticket.NewStore(time.Minute), transport.WebSocketOptions{
+		PingInterval:    time.Second,
+		PongTimeout:     5 * time.Second,
+		WriteTimeout:    time.Second,
+		AllowedOrigins:  []string{"https://dashboard.example.com"},
+		Compression:     true,
+		ReadBufferSize:  1024,
+		WriteBufferSize: 1024,
+		MaxMessageSize:  4096,
+	})
+
+	router := mux.NewRouter()
+	handler.ConsumerRoutes(router.PathPrefix("/api/v1/telemetry").Subrouter())
+	router.HandleFunc("/api/v1/telemetry/ws", handler.ConsumerMessages)
+	router.HandleFunc("/api/v1/telemetry/ws/{deviceId}", handler.ConsumerMessages)
+	router.HandleFunc("/api/v1/telemetry/events", jwt.AuthWithAccessToken(handler.StreamEvents))
+	router.HandleFunc("/api/v1/telemetry/events/{deviceId}", jwt.AuthWithAccessToken(handler.StreamEvents))
+
+	srv := httptest.NewServer(router)
+	t.Cleanup(srv.Close)
+	return srv, mb
+}
+
+// accessToken returns an access token for userId expiring after ttl.
+func accessToken(t *testing.T, userId string, ttl time.Duration) string {
+	t.Helper()
+	token, err := jwt.GenerateAccessToken(userId, time.Now().Add(ttl))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// authHeaders returns the headers of a stream request by userId for deviceId.
+func authHeaders(t *testing.T, userId string, deviceId string) http.Header {
+	t.Helper()
+	headers := http.Header{}
+	headers.Set("Authorization", "Bearer "+accessToken(t, userId, time.Hour))
+	if deviceId != "" {
+		headers.Set("x-device-id", deviceId)
+	}
+	return headers
+}
+
+// expectClose reads from conn until the server closes it, and checks the close code.
+func expectClose(t *testing.T, conn *websocket.Conn, code int) {
+	t.Helper()
+	if err := conn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		_, _, err := conn.ReadMessage()
+		if err == nil {
+			continue
+		}
+		var closeErr *websocket.CloseError
+		if !errors.As(err, &closeErr) || closeErr.Code != code {
+			t.Errorf("expected close code %d, got %v", code, err)
+		}
+		return
+	}
+}
+
+// expectMessage publishes value to the device stream until conn receives it. Streams
+// start at the newest message and subscribe after the upgrade, so earlier publishes may
+// be missed.
+func expectMessage(t *testing.T, conn *websocket.Conn, mb *broker.MockBroker, value string) {
+	t.Helper()
+	received := make(chan string, 1)
+	go func() {
+		_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, msg, err := conn.ReadMessage()
+		if err == nil {
+			received <- string(msg)
+		}
+		close(received)
+	}()
+
+	for {
+		if _, err := mb.Publish(context.Background(), "stream1", broker.Message{Value: []byte(value)}); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case msg, ok := <-received:
+			if !ok {
+				t.Fatal("no message delivered to the websocket")
+			}
+			if msg != value {
+				t.Errorf("expected %s, got %s", value, msg)
+			}
+			return
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
+
+func TestConsumerMessagesHandler(t *testing.T) {
+	srv, mb := newTestServer(t)
+	wsURL := "ws" + strings.TrimPrefix(srv.URL, "http") + "/api/v1/telemetry/ws"
+
+	cases := []struct {
+		name     string
+		userId   string
+		deviceId string
+		code     int
+	}{
+		{"should close with 4400 if device id is not provided", "1234user", "", 4400},
+		{"should close with 4404 if device does not exist", "1234user", "missing", 4404},
+		{"should close with 4403 if device belongs to another user", "5678user", "device1", 4403},
+		{"should close with 4401 if no credentials are provided", "", "device1", 4401},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			buf.Reset()
+			headers := http.Header{"X-Device-Id": {tc.deviceId}}
+			if tc.userId != "" {
+				headers = authHeaders(t, tc.userId, tc.deviceId)
+			}
+			conn, _, err := websocket.DefaultDialer.Dial(wsURL, headers)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			expectClose(t, conn, tc.code)
+		})
+	}
+
+	t.Run("should close with 1001 when the stream is closed", func(t *testing.T) {
+		buf.Reset()
+		conn, _, err := websocket.DefaultDialer.Dial(wsURL, authHeaders(t, "1234user", "device1"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		// the subscription is opened after the upgrade, so wait for it before closing
+		deadline := time.Now().Add(5 * time.Second)
+		for mb.Subscribers("stream1") == 0 {
+			if time.Now().After(deadline) {
+				t.Fatal("timed out waiting for the subscription")
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		mb.CloseStream("stream1")
+
+		if err := conn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+			t.Fatal(err)
+		}
+		_, _, err = conn.ReadMessage()
+		var closeErr *websocket.CloseError
+		if !errors.As(err, &closeErr) || closeErr.Code != websocket.CloseGoingAway {
+			t.Errorf("expected close code 1001, got %v", err)
+		}
+	})
+
+	t.Run("should deliver messages over the websocket", func(t *testing.T) {
+		buf.Reset()
+		mb.Backlog["stream1"] = []broker.Message{{Value: []byte(`{"temp":21}`)}}
+		defer delete(mb.Backlog, "stream1")
+
+		conn, _, err := websocket.DefaultDialer.Dial(wsURL, authHeaders(t, "1234user", "device1"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		if err := conn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+			t.Fatal(err)
+		}
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(msg) != `{"temp":21}` {
+			t.Errorf("expected backlog message, got %s", msg)
+		}
+
+		if _, err := mb.Publish(context.Background(), "stream1", broker.Message{Value: []byte(`{"temp":22}`)}); err != nil {
+			t.Fatal(err)
+		}
+		_, msg, err = conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(msg) != `{"temp":22}` {
+			t.Errorf("expected published message, got %s", msg)
+		}
+	})
+}
+
+// issueTicket requests a websocket ticket for userId, restricted to deviceId if set.
+func issueTicket(t *testing.T, srv *httptest.Server, userId string, deviceId string) string {
+	t.Helper()
+	body, err := json.Marshal(map[string]string{"deviceId": deviceId})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest(http.MethodPost, srv.URL+"/api/v1/telemetry/ws/ticket", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header = authHeaders(t, userId, "")
+
+	res, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", res.StatusCode)
+	}
+	var issued struct {
+		Ticket string `json:"ticket"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&issued); err != nil {
+		t.Fatal(err)
+	}
+	return issued.Ticket
+}
+
+func TestWebSocketAuth(t *testing.T) {
+	srv, mb := newTestServer(t)
+	wsURL := "ws" + strings.TrimPrefix(srv.URL, "http") + "/api/v1/telemetry/ws"
+
+	t.Run("should accept a ticket once", func(t *testing.T) {
+		buf.Reset()
+		id := issueTicket(t, srv, "1234user", "device1")
+
+		conn, _, err := websocket.DefaultDialer.Dial(wsURL+"?ticket="+id, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		expectMessage(t, conn, mb, `{"temp":24}`)
+
+		again, _, err := websocket.DefaultDialer.Dial(wsURL+"?ticket="+id, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer again.Close()
+		expectClose(t, again, 4401)
+	})
+
+	t.Run("should close with 4403 if the ticket was issued for another device", func(t *testing.T) {
+		buf.Reset()
+		id := issueTicket(t, srv, "1234user", "device1")
+
+		conn, _, err := websocket.DefaultDialer.Dial(wsURL+"/device2?ticket="+id, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		expectClose(t, conn, 4403)
+	})
+
+	t.Run("should accept a token in the bearer subprotocol and a device in the path", func(t *testing.T) {
+		buf.Reset()
+		dialer := websocket.Dialer{Subprotocols: []string{"bearer", accessToken(t, "1234user", time.Hour)}}
+
+		conn, _, err := dialer.Dial(wsURL+"/device1", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		if conn.Subprotocol() != "bearer" {
+			t.Errorf("expected the bearer subprotocol to be selected, got %q", conn.Subprotocol())
+		}
+		expectMessage(t, conn, mb, `{"temp":25}`)
+	})
+
+	t.Run("should accept a device in the query", func(t *testing.T) {
+		buf.Reset()
+		headers := http.Header{"Authorization": {"Bearer " + accessToken(t, "1234user", time.Hour)}}
+
+		conn, _, err := websocket.DefaultDialer.Dial(wsURL+"?deviceId=device1", headers)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		expectMessage(t, conn, mb, `{"temp":26}`)
+	})
+
+	t.Run("should close with 4401 when the token expires", func(t *testing.T) {
+		buf.Reset()
+		headers := authHeaders(t, "1234user", "device1")
+		headers.Set("Authorization", "Bearer "+accessToken(t, "1234user", time.Second))
+
+		conn, _, err := websocket.DefaultDialer.Dial(wsURL, headers)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		expectClose(t, conn, 4401)
+	})
+
+	t.Run("should stay open after re-authenticating", func(t *testing.T) {
+		buf.Reset()
+		headers := authHeaders(t, "1234user", "device1")
+		headers.Set("Authorization", "Bearer "+accessToken(t, "1234user", 2*time.Second))
+
+		conn, _, err := websocket.DefaultDialer.Dial(wsURL, headers)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		err = conn.WriteJSON(map[string]string{"type": "auth", "token": accessToken(t, "1234user", time.Hour)})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// outlive the first token, whose exp claim is truncated to the second
+		time.Sleep(2500 * time.Millisecond)
+		expectMessage(t, conn, mb, `{"temp":27}`)
+	})
+
+	t.Run("should refuse websockets from other origins", func(t *testing.T) {
+		buf.Reset()
+		headers := authHeaders(t, "1234user", "device1")
+		headers.Set("Origin", "https://evil.example.net")
+
+		_, res, err := websocket.DefaultDialer.Dial(wsURL, headers)
+		if err == nil {
+			t.Fatal("expected the handshake to fail")
+		}
+		if res == nil || res.StatusCode != http.StatusForbidden {
+			t.Errorf("expected status 403, got %v", res)
+		}
+
+		headers.Set("Origin", "https://dashboard.example.com")
+		conn, _, err := websocket.DefaultDialer.Dial(wsURL, headers)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+	})
+
+	t.Run("should close with 4403 when re-authenticating as another user", func(t *testing.T) {
+		buf.Reset()
+		conn, _, err := websocket.DefaultDialer.Dial(wsURL, authHeaders(t, "1234user", "device1"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		err = conn.WriteJSON(map[string]string{"type": "auth", "token": accessToken(t, "5678user", time.Hour)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectClose(t, conn, 4403)
+	})
+}
+
+func TestStreamFilter(t *testing.T) {
+	srv, mb := newTestServer(t)
+	wsURL := "ws" + strings.TrimPrefix(srv.URL, "http") + "/api/v1/telemetry/ws/device1"
+
+	t.Run("should close with 4400 if the filter does not compile", func(t *testing.T) {
+		buf.Reset()
+		conn, _, err := websocket.DefaultDialer.Dial(wsURL+"?filter="+url.QueryEscape(`data.status !=`), authHeaders(t, "1234user", ""))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		expectClose(t, conn, 4400)
+	})
+
+	t.Run("should deliver only matching messages with the projected fields", func(t *testing.T) {
+		buf.Reset()
+		query := "?filter=" + url.QueryEscape(`data.status != "ok"`) + "&fields=status,temp"
+		conn, _, err := websocket.DefaultDialer.Dial(wsURL+query, authHeaders(t, "1234user", ""))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		received := make(chan string, 1)
+		go func() {
+			_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			_, msg, err := conn.ReadMessage()
+			if err == nil {
+				received <- string(msg)
+			}
+			close(received)
+		}()
+
+		// the subscription starts after the upgrade, so both messages are sent until one
+		// arrives, the first being the one filtered out
+		for {
+			for _, v := range []string{`{"status":"ok","temp":20}`, `{"status":"fault","temp":45,"blob":"xxxx"}`} {
+				if _, err := mb.Publish(context.Background(), "stream1", broker.Message{Value: []byte(v)}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			select {
+			case msg, ok := <-received:
+				if !ok {
+					t.Fatal("no message delivered to the websocket")
+				}
+				if want := `{"status":"fault","temp":45}`; msg != want {
+					t.Errorf("expected %s, got %s", want, msg)
+				}
+				return
+			case <-time.After(50 * time.Millisecond):
+			}
+		}
+	})
+
+	t.Run("should return 400 for an event stream with an invalid filter", func(t *testing.T) {
+		buf.Reset()
+		req, err := http.NewRequest(http.MethodGet, srv.URL+"/api/v1/telemetry/events/device1?filter="+url.QueryEscape("1 + 2"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header = authHeaders(t, "1234user", "")
+
+		res, err := srv.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		body, _ := io.ReadAll(res.Body)
+		if res.StatusCode != http.StatusBadRequest || !strings.Contains(string(body), "must evaluate to a bool") {
+			t.Errorf("expected 400 with the compile error, got %d %s", res.StatusCode, body)
+		}
+	})
+}
+
+func TestStreamThrottle(t *testing.T) {
+	srv, mb := newTestServer(t)
+	wsURL := "ws" + strings.TrimPrefix(srv.URL, "http") + "/api/v1/telemetry/ws/device1"
+
+	t.Run("should close with 4400 if the throttle is invalid", func(t *testing.T) {
+		buf.Reset()
+		conn, _, err := websocket.DefaultDialer.Dial(wsURL+"?throttle=rate&rate=0", authHeaders(t, "1234user", ""))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		expectClose(t, conn, 4400)
+	})
+
+	t.Run("should average messages over the interval", func(t *testing.T) {
+		buf.Reset()
+		conn, _, err := websocket.DefaultDialer.Dial(wsURL+"?throttle=average&interval=100ms", authHeaders(t, "1234user", ""))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		deadline := time.Now().Add(5 * time.Second)
+		for mb.Subscribers("stream1") == 0 {
+			if time.Now().After(deadline) {
+				t.Fatal("timed out waiting for the subscription")
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		for _, v := range []string{`{"temp":10}`, `{"temp":20}`} {
+			if _, err := mb.Publish(context.Background(), "stream1", broker.Message{Value: []byte(v)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if err := conn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+			t.Fatal(err)
+		}
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(msg) != `{"temp":15}` {
+			t.Errorf(`expected {"temp":15}, got %s`, msg)
+		}
+	})
+}
+
+func TestStreamEnvelope(t *testing.T) {
+	srv, mb := newTestServer(t)
+	wsURL := "ws" + strings.TrimPrefix(srv.URL, "http") + "/api/v1/telemetry/ws/device1"
+
+	t.Run("should close with 4400 if the envelope parameter is invalid", func(t *testing.T) {
+		buf.Reset()
+		conn, _, err := websocket.DefaultDialer.Dial(wsURL+"?envelope=maybe", authHeaders(t, "1234user", ""))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		expectClose(t, conn, 4400)
+	})
+
+	t.Run("should wrap the projected payload with its metadata", func(t *testing.T) {
+		buf.Reset()
+		conn, _, err := websocket.DefaultDialer.Dial(wsURL+"?envelope=true&fields=temp", authHeaders(t, "1234user", ""))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		deadline := time.Now().Add(5 * time.Second)
+		for mb.Subscribers("stream1") == 0 {
+			if time.Now().After(deadline) {
+				t.Fatal("timed out waiting for the subscription")
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		_, err = mb.Publish(context.Background(), "stream1", broker.Message{
+			Key:   "device1",
+			Value: []byte(`{"temp":10,"status":"ok"}`),
+			Headers: map[string]string{
+				broker.ReceivedAtHeader: "2024-05-01T10:00:00Z",
+				broker.SourceIPHeader:   "203.0.113.9",
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := conn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+			t.Fatal(err)
+		}
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := `{"deviceId":"device1","offset":0,"metadata":{"receivedAt":"2024-05-01T10:00:00Z","sourceIp":"203.0.113.9"},"data":{"temp":10}}`
+		if string(msg) != want {
+			t.Errorf("expected %s, got %s", want, msg)
+		}
+	})
+}
+
+// readPublished publishes msg to the device stream until conn receives a message, and
+// returns it with its message type.
+func readPublished(t *testing.T, conn *websocket.Conn, mb *broker.MockBroker, msg broker.Message) (int, []byte) {
+	t.Helper()
+	type received struct {
+		messageType int
+		data        []byte
+	}
+	ch := make(chan received, 1)
+	go func() {
+		_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		messageType, data, err := conn.ReadMessage()
+		if err == nil {
+			ch <- received{messageType, data}
+		}
+		close(ch)
+	}()
+
+	for {
+		if _, err := mb.Publish(context.Background(), "stream1", msg); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case r, ok := <-ch:
+			if !ok {
+				t.Fatal("no message delivered to the websocket")
+			}
+			return r.messageType, r.data
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
+
+func TestStreamFormat(t *testing.T) {
+	reading, err := cbor.Marshal(map[string]any{"temp": 10, "status": "ok"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cborMsg := broker.Message{Key: "device1", Value: reading, Headers: map[string]string{broker.ContentTypeHeader: payload.CBOR}}
+
+	t.Run("should close with 4400 if the format parameter is invalid", func(t *testing.T) {
+		buf.Reset()
+		srv, _ := newTestServer(t)
+		conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/api/v1/telemetry/ws/device1?format=xml", authHeaders(t, "1234user", ""))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		expectClose(t, conn, 4400)
+	})
+
+	t.Run("should deliver binary payloads as sent by default", func(t *testing.T) {
+		buf.Reset()
+		srv, mb := newTestServer(t)
+		conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/api/v1/telemetry/ws/device1", authHeaders(t, "1234user", ""))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		messageType, data := readPublished(t, conn, mb, cborMsg)
+		if messageType != websocket.BinaryMessage || !bytes.Equal(data, reading) {
+			t.Errorf("expected the CBOR payload in a binary message, got type %d: %x", messageType, data)
+		}
+	})
+
+	t.Run("should transcode binary payloads to JSON before filtering", func(t *testing.T) {
+		buf.Reset()
+		srv, mb := newTestServer(t)
+		query := url.Values{"format": {"json"}, "filter": {"data.temp > 5"}, "fields": {"temp"}}
+		conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/api/v1/telemetry/ws/device1?"+query.Encode(), authHeaders(t, "1234user", ""))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		messageType, data := readPublished(t, conn, mb, cborMsg)
+		if messageType != websocket.TextMessage || string(data) != `{"temp":10}` {
+			t.Errorf("expected {\"temp\":10} in a text message, got type %d: %s", messageType, data)
+		}
+	})
+
+	t.Run("should transcode binary payloads by default when filtering", func(t *testing.T) {
+		buf.Reset()
+		srv, mb := newTestServer(t)
+		query := url.Values{"filter": {"data.temp > 5"}}
+		conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/api/v1/telemetry/ws/device1?"+query.Encode(), authHeaders(t, "1234user", ""))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		messageType, data := readPublished(t, conn, mb, cborMsg)
+		if messageType != websocket.TextMessage || string(data) != `{"status":"ok","temp":10}` {
+			t.Errorf("expected the reading as JSON in a text message, got type %d: %s", messageType, data)
+		}
+	})
+
+	t.Run("should close with 4400 if the raw format is combined with a filter", func(t *testing.T) {
+		for _, query := range []url.Values{
+			{"format": {"raw"}, "filter": {"data.temp > 5"}},
+			{"format": {"raw"}, "fields": {"temp"}},
+			{"format": {"raw"}, "throttle": {"average"}, "interval": {"1s"}},
+		} {
+			buf.Reset()
+			srv, _ := newTestServer(t)
+			conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/api/v1/telemetry/ws/device1?"+query.Encode(), authHeaders(t, "1234user", ""))
+			if err != nil {
+				t.Fatal(err)
+			}
+			expectClose(t, conn, 4400)
+			conn.Close()
+		}
+	})
+
+	t.Run("should transcode server-sent events and refuse the raw format", func(t *testing.T) {
+		buf.Reset()
+		srv, mb := newTestServer(t)
+
+		req, err := http.NewRequest(http.MethodGet, srv.URL+"/api/v1/telemetry/events?format=raw", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header = authHeaders(t, "1234user", "device1")
+		res, err := srv.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusBadRequest {
+			t.Errorf("expected status 400 for the raw format, got %d", res.StatusCode)
+		}
+
+		mb.Backlog["stream1"] = []broker.Message{cborMsg}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/api/v1/telemetry/events", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header = authHeaders(t, "1234user", "device1")
+		res, err = srv.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+
+		reader := bufio.NewReader(res.Body)
+		var event strings.Builder
+		for !strings.HasSuffix(event.String(), "\n\n") {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			event.WriteString(line)
+		}
+		if want := "id: 0\ndata: {\"status\":\"ok\",\"temp\":10}\n\n"; event.String() != want {
+			t.Errorf("expected %q, got %q", want, event.String())
+		}
+	})
+}
+
+func TestSharedSubscription(t *testing.T) {
+	srv, mb := newTestServer(t)
+	wsURL := "ws" + strings.TrimPrefix(srv.URL, "http") + "/api/v1/telemetry/ws"
+
+	t.Run("should share one stream subscription between clients", func(t *testing.T) {
+		buf.Reset()
+		var conns []*websocket.Conn
+		for i := 0; i < 3; i++ {
+			conn, _, err := websocket.DefaultDialer.Dial(wsURL, authHeaders(t, "1234user", "device1"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conns = append(conns, conn)
+		}
+
+		if _, err := mb.Publish(context.Background(), "stream1", broker.Message{Value: []byte(`{"temp":23}`)}); err != nil {
+			t.Fatal(err)
+		}
+		for i, conn := range conns {
+			if err := conn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+				t.Fatal(err)
+			}
+			_, msg, err := conn.ReadMessage()
+			if err != nil {
+				t.Fatalf("client %d: %v", i, err)
+			}
+			if string(msg) != `{"temp":23}` {
+				t.Errorf("client %d: expected published message, got %s", i, msg)
+			}
+		}
+		if n := mb.Subscribers("stream1"); n != 1 {
+			t.Errorf("expected 1 broker subscription, got %d", n)
+		}
+	})
+}
+
+func TestStreamEventsHandler(t *testing.T) {
+	srv, mb := newTestServer(t)
+
+	t.Run("should return 403 if device belongs to another user", func(t *testing.T) {
+		buf.Reset()
+		req, err := http.NewRequest(http.MethodGet, srv.URL+"/api/v1/telemetry/events", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header = authHeaders(t, "5678user", "device1")
+
+		res, err := srv.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusForbidden {
+			t.Errorf("expected status 403, got %d", res.StatusCode)
+		}
+	})
+
+	t.Run("should stream messages as server-sent events", func(t *testing.T) {
+		buf.Reset()
+		mb.Backlog["stream1"] = []broker.Message{{Offset: 3, Value: []byte(`{"temp":21}`)}}
+		defer delete(mb.Backlog, "stream1")
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/api/v1/telemetry/events", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header = authHeaders(t, "1234user", "device1")
+
+		res, err := srv.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		if ct := res.Header.Get("Content-Type"); ct != "text/event-stream" {
+			t.Fatalf("expected text/event-stream, got %s", ct)
+		}
+
+		reader := bufio.NewReader(res.Body)
+		var event strings.Builder
+		for !strings.HasSuffix(event.String(), "\n\n") {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			event.WriteString(line)
+		}
+		if want := "id: 3\ndata: {\"temp\":21}\n\n"; event.String() != want {
+			t.Errorf("expected %q, got %q", want, event.String())
+		}
+	})
+}
+
+func FuzzIssueTicket(f *testing.F) {
+	for _, seed := range []string{``, `{}`, `{"deviceId":"device1"}`, `{"deviceId":"device2"}`, `{"deviceId":["device1"]}`, `{"deviceId":"device1","ttl":"1h"}`, `{"deviceId":"device1"} {}`} {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, body []byte) {
+		srv, _ := newTestServer(t)
+		req, err := http.NewRequest(http.MethodPost, srv.URL+"/api/v1/telemetry/ws/ticket", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header = authHeaders(t, "1234user", "")
+
+		res, err := srv.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode == http.StatusInternalServerError {
+			t.Errorf("expected no server error for %q", body)
+		}
+	})
+}
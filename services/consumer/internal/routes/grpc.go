@@ -0,0 +1,111 @@
+package routes
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/RaghibA/iot-telemetry/pkg/broker"
+	"github.com/RaghibA/iot-telemetry/pkg/grpcserver"
+	"github.com/RaghibA/iot-telemetry/pkg/jwt"
+	"github.com/RaghibA/iot-telemetry/pkg/telemetrypb"
+	"github.com/RaghibA/iot-telemetry/pkg/transport"
+	"github.com/RaghibA/iot-telemetry/services/consumer/internal/hub"
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// streamServer serves telemetrypb.StreamService with the subscriptions of the websocket.
+type streamServer struct {
+	telemetrypb.UnimplementedStreamServiceServer
+	h *Handler
+}
+
+// StreamService returns the gRPC streaming API, authenticated with jwt.AuthenticateGRPC.
+// Params: None
+// Returns:
+// - telemetrypb.StreamServiceServer: the service implementation
+func (h *Handler) StreamService() telemetrypb.StreamServiceServer {
+	return &streamServer{h: h}
+}
+
+// Subscribe streams a device's telemetry, filtered, transcoded and throttled as the
+// websocket's query parameters would. The stream ends with UNAUTHENTICATED when the access
+// token expires, since server streams cannot re-authenticate in band.
+func (s *streamServer) Subscribe(req *telemetrypb.SubscribeRequest, stream grpc.ServerStreamingServer[telemetrypb.Event]) error {
+	h := s.h
+	r := subscribeRequest(stream.Context(), req)
+
+	userId, _ := r.Context().Value(jwt.UserKey).(string)
+	expires, _ := r.Context().Value(jwt.ExpiresKey).(time.Time)
+	if expires.IsZero() {
+		h.logger.ErrorContext(r.Context(), "no token expiry found in ctx")
+		return status.Error(codes.Internal, "Internal server error")
+	}
+
+	pipeline, serr := h.pipeline(r, true)
+	if serr != nil {
+		return grpcserver.HTTPError(serr.status, serr.message)
+	}
+	device, sub, serr := h.subscribe(r, userId, req.GetDeviceId(), broker.SubscribeOptions{Start: broker.StartNewest})
+	if serr != nil {
+		return grpcserver.HTTPError(serr.status, serr.message)
+	}
+	defer sub.Close()
+
+	ctx, cancel := context.WithDeadlineCause(r.Context(), expires, errTokenExpired)
+	defer cancel()
+	err := transport.Forward(ctx, pipeline(sub), transport.NewGRPC(stream), attribute.String("device.id", device.DeviceID))
+
+	var cause *streamError
+	if errors.As(context.Cause(ctx), &cause) {
+		h.logger.InfoContext(r.Context(), "grpc stream closed", "stream", device.TopicName, "reason", cause.message)
+		return grpcserver.HTTPError(cause.status, cause.message)
+	}
+	if ctx.Err() != nil {
+		h.logger.InfoContext(r.Context(), "client disconnected", "stream", device.TopicName, "cause", context.Cause(ctx))
+		return status.FromContextError(ctx.Err()).Err()
+	}
+
+	h.logger.InfoContext(r.Context(), "subscription ended", "stream", device.TopicName, "err", err)
+	switch {
+	case errors.Is(err, hub.ErrSlowConsumer):
+		return status.Error(codes.ResourceExhausted, "client is not keeping up with the stream")
+	case errors.Is(err, broker.ErrClosed):
+		return status.Error(codes.Unavailable, "stream closed")
+	default:
+		return status.Error(codes.Internal, "stream failed")
+	}
+}
+
+// subscribeRequest stands in for the websocket handshake of a Subscribe call, with the
+// request's options as query parameters, so the stream is built by the same code.
+func subscribeRequest(ctx context.Context, req *telemetrypb.SubscribeRequest) *http.Request {
+	query := url.Values{}
+	set := func(key string, value string) {
+		if value != "" {
+			query.Set(key, value)
+		}
+	}
+	set("filter", req.GetFilter())
+	set("fields", strings.Join(req.GetFields(), ","))
+	set("format", req.GetFormat())
+	set("throttle", req.GetThrottle())
+	if req.GetRate() != 0 {
+		set("rate", strconv.FormatFloat(req.GetRate(), 'g', -1, 64))
+	}
+	if req.Interval != nil {
+		set("interval", req.Interval.AsDuration().String())
+	}
+
+	method, _ := grpc.Method(ctx)
+	r, _ := http.NewRequestWithContext(ctx, http.MethodGet, method, nil)
+	r.URL.RawQuery = query.Encode()
+	return r
+}
@@ -0,0 +1,147 @@
+package routes
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/RaghibA/iot-telemetry/pkg/jwt"
+	"github.com/gorilla/websocket"
+)
+
+// bearerProtocol is the websocket subprotocol carrying an access token. Browsers open the
+// socket with the protocols ["bearer", token] and the server selects "bearer".
+const bearerProtocol = "bearer"
+
+var errTokenExpired = &streamError{http.StatusUnauthorized, "Token expired, re-authenticate before the access token expires"}
+
+// session is the authentication of a websocket connection. It expires with the access
+// token it was opened with, unless the client re-authenticates in band.
+type session struct {
+	userId string
+	// deviceId restricts the session to one device when it was opened with a ticket
+	// issued for that device
+	deviceId string
+
+	mu      sync.Mutex
+	expires time.Time
+	timer   *time.Timer
+}
+
+// authMessage is sent by clients over an open websocket to replace an expiring token:
+// {"type": "auth", "token": "<access token>"}
+type authMessage struct {
+	Type  string `json:"type"`
+	Token string `json:"token"`
+}
+
+// authenticate identifies the user opening a websocket from, in order, a ticket query
+// parameter, the bearer subprotocol or the Authorization header.
+// Params:
+// - r: *http.Request - the handshake request
+// Returns:
+// - *session: the authenticated session
+// - *streamError: the failure to report to the client, nil on success
+func (h *Handler) authenticate(r *http.Request) (*session, *streamError) {
+	if id := r.URL.Query().Get("ticket"); id != "" {
+		t, ok := h.tickets.Redeem(id)
+		if !ok {
+			h.logger.WarnContext(r.Context(), "invalid websocket ticket")
+			return nil, &streamError{http.StatusUnauthorized, "Invalid or expired ticket"}
+		}
+		return &session{userId: t.UserID, deviceId: t.DeviceID, expires: t.TokenExpires}, nil
+	}
+
+	token := bearerToken(r)
+	if token == "" {
+		h.logger.WarnContext(r.Context(), "no websocket credentials provided")
+		return nil, &streamError{http.StatusUnauthorized, "Provide a ticket, a bearer subprotocol or a bearer token in the Authorization header"}
+	}
+	userId, expires, serr := h.validateToken(r, token)
+	if serr != nil {
+		return nil, serr
+	}
+	return &session{userId: userId, expires: expires}, nil
+}
+
+// bearerToken returns the access token offered after the bearer subprotocol, or sent in
+// the Authorization header.
+func bearerToken(r *http.Request) string {
+	protocols := websocket.Subprotocols(r)
+	for i, p := range protocols {
+		if p == bearerProtocol && i+1 < len(protocols) {
+			return protocols[i+1]
+		}
+	}
+	token, _ := jwt.BearerToken(r.Header.Get("Authorization"))
+	return token
+}
+
+// validateToken checks an access token presented on a websocket.
+func (h *Handler) validateToken(r *http.Request, token string) (string, time.Time, *streamError) {
+	userId, expires, err := jwt.ValidateAccessToken(token)
+	switch {
+	case errors.Is(err, jwt.ErrTokenExpired):
+		h.logger.WarnContext(r.Context(), "token expired", "err", err)
+		return "", time.Time{}, &streamError{http.StatusUnauthorized, "Token expired, log in to account."}
+	case errors.Is(err, jwt.ErrInvalidToken):
+		h.logger.WarnContext(r.Context(), "invalid token", "err", err)
+		return "", time.Time{}, &streamError{http.StatusUnauthorized, "Invalid token"}
+	case err != nil:
+		h.logger.ErrorContext(r.Context(), "jwt secret not configured", "err", err)
+		return "", time.Time{}, &streamError{http.StatusInternalServerError, "Internal server error"}
+	}
+	return userId, expires, nil
+}
+
+// expireWith calls expire once the session's token expires.
+func (s *session) expireWith(expire func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.timer = time.AfterFunc(time.Until(s.expires), expire)
+}
+
+// stop releases the expiry timer.
+func (s *session) stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+}
+
+// reauthenticate handles a message sent by the client. Auth messages replace the session
+// token with a fresh one for the same user; other messages are ignored.
+// Params:
+// - r: *http.Request - the handshake request
+// - s: *session - the connection's session
+// - data: []byte - the client message
+// Returns:
+// - error: a *streamError ending the connection if the new token is rejected
+func (h *Handler) reauthenticate(r *http.Request, s *session, data []byte) error {
+	var msg authMessage
+	if err := json.Unmarshal(data, &msg); err != nil || msg.Type != "auth" {
+		return nil
+	}
+
+	userId, expires, serr := h.validateToken(r, msg.Token)
+	if serr != nil {
+		return serr
+	}
+	if userId != s.userId {
+		h.logger.WarnContext(r.Context(), "re-authentication with another user's token", "token_user_id", userId)
+		return &streamError{http.StatusForbidden, "Token belongs to another user"}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.expires = expires
+	s.timer.Reset(time.Until(expires))
+	h.logger.InfoContext(r.Context(), "websocket re-authenticated", "expires", expires)
+	return nil
+}
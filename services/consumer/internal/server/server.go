@@ -1,51 +1,113 @@
 package server
 
 import (
-	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 
+	"github.com/RaghibA/iot-telemetry/db"
+	"github.com/RaghibA/iot-telemetry/pkg/broker"
 	"github.com/RaghibA/iot-telemetry/pkg/config"
+	"github.com/RaghibA/iot-telemetry/pkg/grpcserver"
+	"github.com/RaghibA/iot-telemetry/pkg/health"
+	"github.com/RaghibA/iot-telemetry/pkg/httpserver"
 	"github.com/RaghibA/iot-telemetry/pkg/jwt"
-	"github.com/RaghibA/iot-telemetry/pkg/kafka"
+	"github.com/RaghibA/iot-telemetry/pkg/logging"
+	"github.com/RaghibA/iot-telemetry/pkg/telemetrypb"
+	"github.com/RaghibA/iot-telemetry/pkg/tracing"
+	"github.com/RaghibA/iot-telemetry/pkg/transport"
+	"github.com/RaghibA/iot-telemetry/services/consumer/internal/hub"
 	"github.com/RaghibA/iot-telemetry/services/consumer/internal/monitoring"
 	"github.com/RaghibA/iot-telemetry/services/consumer/internal/routes"
 	"github.com/RaghibA/iot-telemetry/services/consumer/internal/store"
+	"github.com/RaghibA/iot-telemetry/services/consumer/internal/ticket"
 	"github.com/gorilla/mux"
-	"github.com/jackc/pgx/v5"
 )
 
 type ConsumerServer struct {
-	addr        string
-	db          *pgx.Conn
-	logger      *log.Logger
-	kafkaClient kafka.KafkaClient
+	config *config.Config
+	db     db.DB
+	logger *slog.Logger
+	broker broker.Broker
 }
 
-func NewConsumerServer(config *config.ConsumerConfig, db *pgx.Conn, logger *log.Logger, kafkaClient kafka.KafkaClient) *ConsumerServer {
+func NewConsumerServer(cfg *config.Config, db db.DB, logger *slog.Logger, broker broker.Broker) *ConsumerServer {
 	return &ConsumerServer{
-		addr:        fmt.Sprintf("%s:%s", config.HOST, config.PORT),
-		db:          db,
-		logger:      logger,
-		kafkaClient: kafkaClient,
+		config: cfg,
+		db:     db,
+		logger: logger,
+		broker: broker,
 	}
 }
 
 func (s *ConsumerServer) Run() error {
+	router := mux.NewRouter()
+	router.Use(tracing.Middleware("consumer-service"))
+	router.Use(logging.Middleware(s.logger))
+	router.Use(httpserver.LimitBody(s.config.Limits))
+	grpcServer, err := grpcserver.New(s.config, s.logger)
+	if err != nil {
+		return err
+	}
+	s.Routes(router, grpcServer)
+
+	router.Handle("/metrics", monitoring.PrometheusHandler()) // Expose metrics at /metrics
+
+	if err := grpcServer.Start(); err != nil {
+		return err
+	}
+	defer grpcServer.Stop()
+
+	srv := httpserver.New(s.config, router)
+	s.logger.Info("consumer server running", "addr", srv.Addr, "tls", s.config.TLS.Enabled())
+	return httpserver.ListenAndServe(s.config, srv)
+}
+
+// Routes registers the consumer service routes under /api/v1/telemetry on router, and its
+// gRPC streaming API on grpcServer. The caller is responsible for the tracing, logging and
+// body limit middlewares.
+// Params:
+// - router: *mux.Router - the router to register the routes on
+// - grpcServer: *grpcserver.Server - the gRPC server to register the API on
+// Returns: None
+func (s *ConsumerServer) Routes(router *mux.Router, grpcServer *grpcserver.Server) {
 	metrics := monitoring.NewMetrics()
 
-	router := mux.NewRouter()
 	subRouter := router.PathPrefix("/api/v1/telemetry").Subrouter()
 	subRouter.Use(metrics.MetricMonitoring) // Apply middleware to only this subrouter
 
 	consumerStore := store.NewConsumerStore(s.db, s.logger)
-	consumerHandler := routes.NewConsumerHander(consumerStore, s.logger, s.kafkaClient)
-	consumerHandler.ConsumerRoutes(subRouter)
+	streamHub := hub.New(s.broker, hub.Options{
+		BufferSize: s.config.Consumer.BufferSize,
+		SlowPolicy: s.config.Consumer.SlowPolicy,
+	}, s.logger)
+	tickets := ticket.NewStore(s.config.Consumer.TicketTTL)
+	consumerHandler := routes.NewConsumerHander(consumerStore, s.logger, streamHub, tickets, transport.WebSocketOptions{
+		PingInterval: s.config.Consumer.PingInterval,
+		PongTimeout:  s.config.Consumer.PongTimeout,
+		WriteTimeout: s.config.Consumer.WriteTimeout,
 
-	router.NewRoute().Path("/api/v1/telemetry/ws").HandlerFunc(jwt.AuthWithAccessToken(consumerHandler.ConsumerMessages))
+		AllowedOrigins:  s.config.Consumer.AllowedOrigins,
+		Compression:     s.config.Consumer.Compression,
+		ReadBufferSize:  s.config.Consumer.ReadBufferSize,
+		WriteBufferSize: s.config.Consumer.WriteBufferSize,
+		MaxMessageSize:  s.config.Consumer.MaxMessageSize,
+	})
+	consumerHandler.ConsumerRoutes(subRouter)
+	grpcServer.Register(&telemetrypb.StreamService_ServiceDesc, consumerHandler.StreamService(), jwt.AuthenticateGRPC)
 
-	router.Handle("/metrics", monitoring.PrometheusHandler()) // Expose metrics at /metrics
+	// long lived streams are registered outside the metrics middleware, whose response
+	// recorder can neither be hijacked nor flushed. Websockets authenticate after the
+	// upgrade, so that browsers can read the reason a connection was refused.
+	for _, path := range []string{"/api/v1/telemetry/ws", "/api/v1/telemetry/ws/{deviceId}"} {
+		router.NewRoute().Path(path).Methods(http.MethodGet).HandlerFunc(consumerHandler.ConsumerMessages)
+	}
+	for _, path := range []string{"/api/v1/telemetry/events", "/api/v1/telemetry/events/{deviceId}"} {
+		router.NewRoute().Path(path).Methods(http.MethodGet).HandlerFunc(jwt.AuthWithAccessToken(consumerHandler.StreamEvents))
+	}
 
-	log.Printf("Consumer server running on %v", s.addr)
-	return http.ListenAndServe(s.addr, router)
+	checker := health.NewChecker(s.config.Timeouts.Readiness)
+	checker.Add("database", s.db.Ping)
+	checker.Add("broker", s.broker.Ping)
+	subRouter.HandleFunc("/health/live", checker.LiveHandler).Methods(http.MethodGet)
+	subRouter.HandleFunc("/health/ready", checker.ReadyHandler).Methods(http.MethodGet)
 }
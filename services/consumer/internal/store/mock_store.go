@@ -0,0 +1,46 @@
+package store
+
+import (
+	"context"
+
+	"github.com/RaghibA/iot-telemetry/pkg/models"
+	"github.com/jackc/pgx/v5"
+)
+
+type MockStore struct {
+	Devices map[string]*models.Device
+	Schemas map[string]*models.DeviceSchema
+	Err     error
+}
+
+func NewMockStore() *MockStore {
+	return &MockStore{
+		Devices: make(map[string]*models.Device),
+		Schemas: make(map[string]*models.DeviceSchema),
+		Err:     nil,
+	}
+}
+
+func (s *MockStore) GetDeviceById(ctx context.Context, deviceId string) (*models.Device, error) {
+	if s.Err != nil {
+		return nil, s.Err
+	}
+
+	device, exists := s.Devices[deviceId]
+	if !exists {
+		return nil, pgx.ErrNoRows
+	}
+	return device, nil
+}
+
+func (s *MockStore) GetDeviceSchema(ctx context.Context, deviceId string) (*models.DeviceSchema, error) {
+	if s.Err != nil {
+		return nil, s.Err
+	}
+
+	schema, exists := s.Schemas[deviceId]
+	if !exists {
+		return nil, pgx.ErrNoRows
+	}
+	return schema, nil
+}
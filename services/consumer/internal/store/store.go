@@ -2,22 +2,23 @@ package store
 
 import (
 	"context"
-	"log"
+	"log/slog"
 
+	"github.com/RaghibA/iot-telemetry/db"
 	"github.com/RaghibA/iot-telemetry/pkg/models"
-	"github.com/jackc/pgx/v5"
 )
 
 type ConsumerStore interface {
 	GetDeviceById(ctx context.Context, deviceId string) (*models.Device, error)
+	GetDeviceSchema(ctx context.Context, deviceId string) (*models.DeviceSchema, error)
 }
 
 type store struct {
-	db     *pgx.Conn
-	logger *log.Logger
+	db     db.DB
+	logger *slog.Logger
 }
 
-func NewConsumerStore(db *pgx.Conn, logger *log.Logger) *store {
+func NewConsumerStore(db db.DB, logger *slog.Logger) *store {
 	return &store{
 		db:     db,
 		logger: logger,
@@ -44,3 +45,30 @@ func (s *store) GetDeviceById(ctx context.Context, deviceId string) (*models.Dev
 
 	return &device, nil
 }
+
+// GetDeviceSchema returns the Protobuf schema registered for a device.
+// Params:
+// - ctx: context.Context - the request context
+// - deviceId: string - the device ID
+// Returns:
+// - *models.DeviceSchema: the device's schema
+// - error: pgx.ErrNoRows if the device has no schema, or the database error
+func (s *store) GetDeviceSchema(ctx context.Context, deviceId string) (*models.DeviceSchema, error) {
+	var schema models.DeviceSchema
+
+	queryString := `
+		SELECT device_id, message_type, descriptor_set, updated_at FROM device_schemas WHERE device_id=$1
+	`
+
+	err := s.db.QueryRow(ctx, queryString, deviceId).Scan(
+		&schema.DeviceID,
+		&schema.MessageType,
+		&schema.DescriptorSet,
+		&schema.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &schema, nil
+}
@@ -0,0 +1,221 @@
+// Package throttle downsamples a live stream for clients that cannot keep up with a
+// high rate device. It wraps a subscription with one of three modes:
+//
+//   - rate: at most Rate messages per second, dropping the rest
+//   - latest: the latest message of each Interval
+//   - average: one message per Interval, with numeric fields averaged over it
+package throttle
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/RaghibA/iot-telemetry/pkg/broker"
+)
+
+// Throttle modes selectable with Options.Mode.
+const (
+	ModeRate    = "rate"
+	ModeLatest  = "latest"
+	ModeAverage = "average"
+)
+
+const (
+	// MaxRate is the highest rate a client may ask for, in messages per second.
+	MaxRate = 1000
+	// MinInterval is the shortest sampling interval a client may ask for.
+	MinInterval = 10 * time.Millisecond
+)
+
+// Options configures a throttle. The zero value does not throttle.
+type Options struct {
+	// Mode is ModeRate, ModeLatest, ModeAverage or empty for none.
+	Mode string
+	// Rate is the maximum number of messages per second in ModeRate.
+	Rate float64
+	// Interval is the sampling interval in ModeLatest and ModeAverage.
+	Interval time.Duration
+}
+
+// Validate checks that the options are complete for their mode.
+// Params: None
+// Returns:
+// - error: error describing the invalid option
+func (o Options) Validate() error {
+	switch o.Mode {
+	case "":
+		return nil
+	case ModeRate:
+		if o.Rate <= 0 || o.Rate > MaxRate {
+			return fmt.Errorf("rate must be between 0 and %d messages per second", MaxRate)
+		}
+	case ModeLatest, ModeAverage:
+		if o.Interval < MinInterval {
+			return fmt.Errorf("interval must be at least %s", MinInterval)
+		}
+	default:
+		return fmt.Errorf("throttle %q must be one of %s, %s or %s", o.Mode, ModeRate, ModeLatest, ModeAverage)
+	}
+	return nil
+}
+
+// New wraps a subscription with a throttle.
+// Params:
+// - sub: broker.Subscription - the subscription to throttle
+// - opts: Options - the validated throttle options
+// Returns:
+// - broker.Subscription: the throttled subscription, sub itself without a mode
+func New(sub broker.Subscription, opts Options) broker.Subscription {
+	switch opts.Mode {
+	case ModeRate:
+		return &rateSubscription{Subscription: sub, spacing: time.Duration(float64(time.Second) / opts.Rate)}
+	case ModeLatest, ModeAverage:
+		return &windowSubscription{Subscription: sub, interval: opts.Interval, average: opts.Mode == ModeAverage}
+	default:
+		return sub
+	}
+}
+
+// rateSubscription drops the messages that arrive less than spacing after the last one
+// delivered.
+type rateSubscription struct {
+	broker.Subscription
+	spacing time.Duration
+	last    time.Time
+}
+
+func (s *rateSubscription) Next(ctx context.Context) (broker.Message, error) {
+	for {
+		msg, err := s.Subscription.Next(ctx)
+		if err != nil {
+			return msg, err
+		}
+		if now := time.Now(); now.Sub(s.last) >= s.spacing {
+			s.last = now
+			return msg, nil
+		}
+	}
+}
+
+// windowSubscription collects the messages of an interval, starting with the first one
+// received, and delivers the latest of them, or their average, when it ends.
+type windowSubscription struct {
+	broker.Subscription
+	interval time.Duration
+	average  bool
+}
+
+func (s *windowSubscription) Next(ctx context.Context) (broker.Message, error) {
+	first, err := s.Subscription.Next(ctx)
+	if err != nil {
+		return first, err
+	}
+
+	latest := first
+	var window *mean
+	if s.average {
+		window = &mean{}
+		window.add(first.Value)
+	}
+
+	windowCtx, cancel := context.WithTimeout(ctx, s.interval)
+	defer cancel()
+	for {
+		msg, err := s.Subscription.Next(windowCtx)
+		if errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil {
+			break
+		}
+		if err != nil {
+			return msg, err
+		}
+		latest = msg
+		if window != nil {
+			window.add(msg.Value)
+		}
+	}
+
+	if window != nil {
+		if value, ok := window.value(); ok {
+			latest.Value = value
+		}
+	}
+	return latest, nil
+}
+
+// mean averages the numeric fields of JSON objects, recursing into nested objects.
+// Other fields keep their latest value. Values that are not JSON objects are ignored.
+type mean struct {
+	fields map[string]any // *mean, *sum or the latest value
+	seen   bool
+}
+
+type sum struct {
+	total float64
+	n     int
+}
+
+func (m *mean) add(value []byte) {
+	var object map[string]any
+	if err := json.Unmarshal(value, &object); err != nil {
+		return
+	}
+	m.addObject(object)
+}
+
+func (m *mean) addObject(object map[string]any) {
+	if m.fields == nil {
+		m.fields = make(map[string]any)
+	}
+	m.seen = true
+
+	for k, v := range object {
+		switch v := v.(type) {
+		case float64:
+			if s, ok := m.fields[k].(*sum); ok {
+				s.total += v
+				s.n++
+			} else {
+				m.fields[k] = &sum{total: v, n: 1}
+			}
+		case map[string]any:
+			nested, ok := m.fields[k].(*mean)
+			if !ok {
+				nested = &mean{}
+				m.fields[k] = nested
+			}
+			nested.addObject(v)
+		default:
+			m.fields[k] = v
+		}
+	}
+}
+
+// value returns the averaged object, or false if no object was added.
+func (m *mean) value() ([]byte, bool) {
+	if !m.seen {
+		return nil, false
+	}
+	value, err := json.Marshal(m.object())
+	if err != nil {
+		return nil, false
+	}
+	return value, true
+}
+
+func (m *mean) object() map[string]any {
+	out := make(map[string]any, len(m.fields))
+	for k, v := range m.fields {
+		switch v := v.(type) {
+		case *sum:
+			out[k] = v.total / float64(v.n)
+		case *mean:
+			out[k] = v.object()
+		default:
+			out[k] = v
+		}
+	}
+	return out
+}
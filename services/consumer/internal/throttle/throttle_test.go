@@ -0,0 +1,137 @@
+package throttle
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/RaghibA/iot-telemetry/pkg/broker"
+)
+
+// subscribe returns a mock subscription that first delivers values.
+func subscribe(t *testing.T, values ...string) (*broker.MockBroker, broker.Subscription) {
+	t.Helper()
+	mb := broker.NewMockBroker()
+	for _, v := range values {
+		mb.Backlog["stream"] = append(mb.Backlog["stream"], broker.Message{Value: []byte(v)})
+	}
+	sub, err := mb.Subscribe(context.Background(), "stream", broker.SubscribeOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sub.Close() })
+	return mb, sub
+}
+
+func next(t *testing.T, sub broker.Subscription) string {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	msg, err := sub.Next(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(msg.Value)
+}
+
+func TestValidate(t *testing.T) {
+	cases := []struct {
+		name string
+		opts Options
+		err  string
+	}{
+		{"should accept no throttle", Options{}, ""},
+		{"should accept a rate", Options{Mode: ModeRate, Rate: 0.5}, ""},
+		{"should reject a rate above the maximum", Options{Mode: ModeRate, Rate: MaxRate + 1}, "rate must be"},
+		{"should reject a missing interval", Options{Mode: ModeLatest}, "interval must be"},
+		{"should reject unknown modes", Options{Mode: "median", Interval: time.Second}, "must be one of"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.opts.Validate()
+			if tc.err == "" && err != nil {
+				t.Errorf("expected no error, got %v", err)
+			}
+			if tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)) {
+				t.Errorf("expected error containing %q, got %v", tc.err, err)
+			}
+		})
+	}
+}
+
+func TestThrottle(t *testing.T) {
+	t.Run("should drop messages above the rate", func(t *testing.T) {
+		mb, sub := subscribe(t, "1")
+		throttled := New(sub, Options{Mode: ModeRate, Rate: 10})
+		if got := next(t, throttled); got != "1" {
+			t.Errorf("expected 1, got %s", got)
+		}
+
+		// the client reads while the device publishes, 2 and 3 arrive within 100ms of 1
+		received := make(chan string, 1)
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			msg, _ := throttled.Next(ctx)
+			received <- string(msg.Value)
+		}()
+		for _, v := range []string{"2", "3"} {
+			if _, err := mb.Publish(context.Background(), "stream", broker.Message{Value: []byte(v)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		time.Sleep(150 * time.Millisecond)
+		if _, err := mb.Publish(context.Background(), "stream", broker.Message{Value: []byte("4")}); err != nil {
+			t.Fatal(err)
+		}
+		if got := <-received; got != "4" {
+			t.Errorf("expected 2 and 3 to be dropped and 4 delivered, got %s", got)
+		}
+	})
+
+	t.Run("should deliver the latest message of an interval", func(t *testing.T) {
+		_, sub := subscribe(t, "1", "2", "3")
+		throttled := New(sub, Options{Mode: ModeLatest, Interval: 50 * time.Millisecond})
+
+		start := time.Now()
+		if got := next(t, throttled); got != "3" {
+			t.Errorf("expected 3, got %s", got)
+		}
+		if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+			t.Errorf("expected the interval to pass before delivery, took %s", elapsed)
+		}
+	})
+
+	t.Run("should average numeric fields over an interval", func(t *testing.T) {
+		_, sub := subscribe(t,
+			`{"temp":1,"status":"ok","axis":{"x":2}}`,
+			`not json`,
+			`{"temp":4,"status":"fault","axis":{"x":4}}`,
+		)
+		throttled := New(sub, Options{Mode: ModeAverage, Interval: 50 * time.Millisecond})
+
+		if got, want := next(t, throttled), `{"axis":{"x":3},"status":"fault","temp":2.5}`; got != want {
+			t.Errorf("expected %s, got %s", want, got)
+		}
+	})
+
+	t.Run("should return the context error while collecting a window", func(t *testing.T) {
+		_, sub := subscribe(t, "1")
+		throttled := New(sub, Options{Mode: ModeLatest, Interval: time.Hour})
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		if _, err := throttled.Next(ctx); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("expected context.DeadlineExceeded, got %v", err)
+		}
+	})
+
+	t.Run("should pass the subscription through without a mode", func(t *testing.T) {
+		_, sub := subscribe(t)
+		if New(sub, Options{}) != sub {
+			t.Error("expected the subscription itself")
+		}
+	})
+}
@@ -0,0 +1,107 @@
+// Package ticket issues short lived, single use credentials for opening a websocket.
+// Browsers cannot set headers on a websocket handshake, so a dashboard mints a ticket
+// over REST with its access token and passes it as a query parameter instead.
+//
+// Tickets are kept in memory: with several consumer replicas the ticket request and the
+// websocket must reach the same instance.
+package ticket
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"sync"
+	"time"
+)
+
+// Ticket records who a ticket was issued to.
+type Ticket struct {
+	// UserID is the user the ticket authenticates.
+	UserID string
+	// DeviceID is the device the ticket is restricted to, empty for any of the user's devices.
+	DeviceID string
+	// Expires is the time after which the ticket can no longer be redeemed.
+	Expires time.Time
+	// TokenExpires is the expiry of the access token the ticket was issued with. A
+	// connection opened with the ticket must re-authenticate before then.
+	TokenExpires time.Time
+}
+
+// Store holds issued tickets until they are redeemed or expire. It is safe for
+// concurrent use.
+type Store struct {
+	ttl time.Duration
+	now func() time.Time
+
+	mu      sync.Mutex
+	tickets map[string]Ticket
+}
+
+// NewStore creates a ticket store.
+// Params:
+// - ttl: time.Duration - how long an issued ticket can be redeemed
+// Returns:
+// - *Store: a pointer to the created Store
+func NewStore(ttl time.Duration) *Store {
+	return &Store{
+		ttl:     ttl,
+		now:     time.Now,
+		tickets: make(map[string]Ticket),
+	}
+}
+
+// Issue creates a ticket for a user. The ticket never outlives the access token it was
+// issued with.
+// Params:
+// - userId: string - the user to authenticate
+// - deviceId: string - the device to restrict the ticket to, empty for any
+// - tokenExpires: time.Time - the expiry of the caller's access token
+// Returns:
+// - string: the ticket to pass when opening the websocket
+// - Ticket: the issued ticket
+// - error: error if no random ticket could be generated
+func (s *Store) Issue(userId string, deviceId string, tokenExpires time.Time) (string, Ticket, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", Ticket{}, err
+	}
+	id := base64.RawURLEncoding.EncodeToString(raw)
+
+	now := s.now()
+	t := Ticket{UserID: userId, DeviceID: deviceId, Expires: now.Add(s.ttl), TokenExpires: tokenExpires}
+	if t.Expires.After(tokenExpires) {
+		t.Expires = tokenExpires
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// forget tickets that were never redeemed
+	for k, old := range s.tickets {
+		if !now.Before(old.Expires) {
+			delete(s.tickets, k)
+		}
+	}
+	s.tickets[id] = t
+	return id, t, nil
+}
+
+// Redeem consumes a ticket. A ticket can only be redeemed once.
+// Params:
+// - id: string - the ticket
+// Returns:
+// - Ticket: the redeemed ticket
+// - bool: false if the ticket is unknown, already redeemed or expired
+func (s *Store) Redeem(id string) (Ticket, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, ok := s.tickets[id]
+	if !ok {
+		return Ticket{}, false
+	}
+	delete(s.tickets, id)
+	if !s.now().Before(t.Expires) {
+		return Ticket{}, false
+	}
+	return t, true
+}
@@ -0,0 +1,73 @@
+package ticket
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStore(t *testing.T) {
+	tokenExpires := time.Now().Add(time.Hour)
+
+	t.Run("should redeem a ticket only once", func(t *testing.T) {
+		s := NewStore(time.Minute)
+		id, _, err := s.Issue("user1", "device1", tokenExpires)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got, ok := s.Redeem(id)
+		if !ok {
+			t.Fatal("expected the ticket to be redeemed")
+		}
+		if got.UserID != "user1" || got.DeviceID != "device1" || !got.TokenExpires.Equal(tokenExpires) {
+			t.Errorf("unexpected ticket %+v", got)
+		}
+		if _, ok := s.Redeem(id); ok {
+			t.Error("expected a second redemption to fail")
+		}
+	})
+
+	t.Run("should reject expired and unknown tickets", func(t *testing.T) {
+		s := NewStore(time.Minute)
+		id, _, err := s.Issue("user1", "", tokenExpires)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		s.now = func() time.Time { return time.Now().Add(2 * time.Minute) }
+		if _, ok := s.Redeem(id); ok {
+			t.Error("expected an expired ticket to be rejected")
+		}
+		if _, ok := s.Redeem("unknown"); ok {
+			t.Error("expected an unknown ticket to be rejected")
+		}
+	})
+
+	t.Run("should not outlive the access token", func(t *testing.T) {
+		s := NewStore(time.Minute)
+		soon := time.Now().Add(10 * time.Second)
+
+		_, got, err := s.Issue("user1", "", soon)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !got.Expires.Equal(soon) {
+			t.Errorf("expected the ticket to expire with the token at %v, got %v", soon, got.Expires)
+		}
+	})
+
+	t.Run("should forget tickets that were never redeemed", func(t *testing.T) {
+		s := NewStore(time.Minute)
+		if _, _, err := s.Issue("user1", "", tokenExpires); err != nil {
+			t.Fatal(err)
+		}
+
+		s.now = func() time.Time { return time.Now().Add(2 * time.Minute) }
+		if _, _, err := s.Issue("user1", "", tokenExpires.Add(time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+		if n := len(s.tickets); n != 1 {
+			t.Errorf("expected the expired ticket to be pruned, %d tickets held", n)
+		}
+	})
+}
@@ -0,0 +1,131 @@
+// Package transcode converts telemetry sent in a binary format (CBOR, MessagePack or
+// Protobuf) to JSON, for clients that asked for JSON and for the filters, projections and
+// averages that read payloads as JSON.
+package transcode
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"time"
+
+	"github.com/RaghibA/iot-telemetry/pkg/broker"
+	"github.com/RaghibA/iot-telemetry/pkg/payload"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// schemaTTL is how long a device's Protobuf schema is used before it is looked up again,
+// so a stream picks up a schema registered or replaced while it is open.
+const schemaTTL = time.Minute
+
+// schemaRetry is how long a failed schema lookup is remembered before it is tried again,
+// so a database outage is not queried for every message.
+const schemaRetry = 5 * time.Second
+
+// errNoSchema is returned by deviceSchema when the lookup failed and no schema was found
+// before.
+var errNoSchema = errors.New("device schema unavailable")
+
+// SchemaFunc returns the Protobuf message type of a device's payloads, or nil if it has
+// none registered.
+type SchemaFunc func(ctx context.Context, deviceId string) (protoreflect.MessageDescriptor, error)
+
+type cachedSchema struct {
+	desc    protoreflect.MessageDescriptor
+	fetched time.Time
+	// failed is set when the last lookup failed, desc being the schema found before it
+	failed bool
+}
+
+// Subscription delivers the messages of another subscription as JSON. Messages that
+// cannot be transcoded, such as Protobuf payloads of a device without a schema, are
+// dropped. When a schema lookup fails, the last schema found is kept, or the device's
+// Protobuf messages are dropped until a retry succeeds. It is not safe for concurrent use.
+type Subscription struct {
+	broker.Subscription
+	schema  SchemaFunc
+	schemas map[string]cachedSchema
+	now     func() time.Time
+}
+
+// NewSubscription wraps a subscription so its messages are delivered as JSON.
+// Params:
+// - sub: broker.Subscription - the subscription to wrap
+// - schema: SchemaFunc - looks up the Protobuf schema of the device sending a message
+// Returns:
+// - *Subscription: a pointer to the created Subscription
+func NewSubscription(sub broker.Subscription, schema SchemaFunc) *Subscription {
+	return &Subscription{Subscription: sub, schema: schema, schemas: make(map[string]cachedSchema), now: time.Now}
+}
+
+// Next returns the next message that can be transcoded, with its value as JSON and its
+// content_type header set to application/json.
+// Params:
+// - ctx: context.Context - bounds the wait for a message
+// Returns:
+// - broker.Message: the message
+// - error: the error of the wrapped subscription, or of ctx
+func (s *Subscription) Next(ctx context.Context) (broker.Message, error) {
+	for {
+		msg, err := s.Subscription.Next(ctx)
+		if err != nil {
+			return msg, err
+		}
+		contentType := msg.Headers[broker.ContentTypeHeader]
+		if !payload.Binary(contentType) {
+			// messages without a content type predate binary formats and are JSON
+			return msg, nil
+		}
+
+		var desc protoreflect.MessageDescriptor
+		if contentType == payload.Protobuf {
+			desc, err = s.deviceSchema(ctx, msg.Key)
+			if errors.Is(err, errNoSchema) {
+				continue
+			}
+			if err != nil {
+				return msg, err
+			}
+		}
+		value, err := payload.ToJSON(contentType, msg.Value, desc)
+		if err != nil {
+			continue
+		}
+
+		// headers may be shared with other subscribers of the message
+		headers := maps.Clone(msg.Headers)
+		headers[broker.ContentTypeHeader] = payload.JSON
+		msg.Headers = headers
+		msg.Value = value
+		return msg, nil
+	}
+}
+
+// deviceSchema returns the Protobuf schema of a device, from the cache if it is recent.
+// A failed lookup is retried after schemaRetry, and the schema found before it is used
+// meanwhile; errNoSchema is returned if there is none.
+func (s *Subscription) deviceSchema(ctx context.Context, deviceId string) (protoreflect.MessageDescriptor, error) {
+	now := s.now()
+	cached, ok := s.schemas[deviceId]
+	ttl := schemaTTL
+	if cached.failed {
+		ttl = schemaRetry
+	}
+	if !ok || now.Sub(cached.fetched) >= ttl {
+		desc, err := s.schema(ctx, deviceId)
+		if err != nil && ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if err != nil {
+			// the schema func logs the failure
+			cached = cachedSchema{desc: cached.desc, fetched: now, failed: true}
+		} else {
+			cached = cachedSchema{desc: desc, fetched: now}
+		}
+		s.schemas[deviceId] = cached
+	}
+	if cached.failed && cached.desc == nil {
+		return nil, errNoSchema
+	}
+	return cached.desc, nil
+}
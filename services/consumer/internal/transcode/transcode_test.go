@@ -0,0 +1,206 @@
+package transcode
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/RaghibA/iot-telemetry/pkg/broker"
+	"github.com/RaghibA/iot-telemetry/pkg/payload"
+	"github.com/fxamacker/cbor/v2"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// subscribe returns a subscription delivering msgs, then blocking.
+func subscribe(t *testing.T, msgs ...broker.Message) broker.Subscription {
+	t.Helper()
+	mb := broker.NewMockBroker()
+	mb.Backlog["stream"] = msgs
+	sub, err := mb.Subscribe(context.Background(), "stream", broker.SubscribeOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sub.Close() })
+	return sub
+}
+
+func message(contentType string, value []byte) broker.Message {
+	return broker.Message{Key: "device1", Value: value, Headers: map[string]string{broker.ContentTypeHeader: contentType}}
+}
+
+func noSchema(ctx context.Context, deviceId string) (protoreflect.MessageDescriptor, error) {
+	return nil, nil
+}
+
+func TestSubscription(t *testing.T) {
+	ctx := context.Background()
+	reading, err := cbor.Marshal(map[string]any{"temp": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("should transcode binary payloads and pass JSON through", func(t *testing.T) {
+		jsonMsg := message(payload.JSON, []byte(`{"temp":2}`))
+		legacyMsg := broker.Message{Key: "device1", Value: []byte(`{"temp":3}`)}
+		cborMsg := message(payload.CBOR, reading)
+		sub := NewSubscription(subscribe(t, cborMsg, jsonMsg, legacyMsg), noSchema)
+
+		for _, want := range []string{`{"temp":1}`, `{"temp":2}`, `{"temp":3}`} {
+			msg, err := sub.Next(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(msg.Value) != want {
+				t.Errorf("expected %s, got %s", want, msg.Value)
+			}
+		}
+		if cborMsg.Headers[broker.ContentTypeHeader] != payload.CBOR {
+			t.Error("expected the original headers to be left alone")
+		}
+	})
+
+	t.Run("should set the content type to JSON", func(t *testing.T) {
+		sub := NewSubscription(subscribe(t, message(payload.CBOR, reading)), noSchema)
+		msg, err := sub.Next(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.Headers[broker.ContentTypeHeader] != payload.JSON {
+			t.Errorf("expected content_type %s, got %q", payload.JSON, msg.Headers[broker.ContentTypeHeader])
+		}
+	})
+
+	t.Run("should drop payloads that cannot be transcoded", func(t *testing.T) {
+		value, err := proto.Marshal(&structpb.Struct{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		sub := NewSubscription(subscribe(t,
+			message(payload.CBOR, []byte{0xa1}),
+			message(payload.Protobuf, value),
+			message(payload.CBOR, reading),
+		), noSchema)
+
+		msg, err := sub.Next(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(msg.Value) != `{"temp":1}` {
+			t.Errorf("expected the malformed and schemaless messages to be dropped, got %s", msg.Value)
+		}
+	})
+
+	t.Run("should decode Protobuf payloads with a cached schema", func(t *testing.T) {
+		value, err := structpb.NewStruct(map[string]any{"temp": 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := proto.Marshal(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		lookups := 0
+		schema := func(ctx context.Context, deviceId string) (protoreflect.MessageDescriptor, error) {
+			lookups++
+			return value.ProtoReflect().Descriptor(), nil
+		}
+		msgs := []broker.Message{message(payload.Protobuf, data), message(payload.Protobuf, data), message(payload.Protobuf, data)}
+		sub := NewSubscription(subscribe(t, msgs...), schema)
+		now := time.Now()
+		sub.now = func() time.Time { return now }
+
+		for i := range msgs {
+			if i == 2 {
+				now = now.Add(schemaTTL)
+			}
+			msg, err := sub.Next(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(msg.Value) != `{"temp":1}` {
+				t.Errorf("expected {\"temp\":1}, got %s", msg.Value)
+			}
+		}
+		if lookups != 2 {
+			t.Errorf("expected the schema to be looked up again after %s, got %d lookups", schemaTTL, lookups)
+		}
+	})
+
+	t.Run("should skip messages while a schema lookup fails and retry it", func(t *testing.T) {
+		value, err := structpb.NewStruct(map[string]any{"temp": 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := proto.Marshal(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		lookups := 0
+		schema := func(ctx context.Context, deviceId string) (protoreflect.MessageDescriptor, error) {
+			lookups++
+			if lookups == 1 {
+				return nil, errors.New("db down")
+			}
+			return value.ProtoReflect().Descriptor(), nil
+		}
+		sub := NewSubscription(subscribe(t,
+			message(payload.Protobuf, data),
+			message(payload.Protobuf, data),
+			message(payload.CBOR, reading),
+			message(payload.Protobuf, data),
+		), schema)
+		now := time.Now()
+		sub.now = func() time.Time { return now }
+
+		msg, err := sub.Next(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(msg.Value) != `{"temp":1}` || msg.Headers[broker.ContentTypeHeader] != payload.JSON {
+			t.Errorf("expected the CBOR reading after the skipped Protobuf ones, got %s", msg.Value)
+		}
+		if lookups != 1 {
+			t.Errorf("expected the failed lookup not to be retried within %s, got %d lookups", schemaRetry, lookups)
+		}
+
+		now = now.Add(schemaRetry)
+		if msg, err = sub.Next(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if string(msg.Value) != `{"temp":1}` {
+			t.Errorf("expected the Protobuf reading once the retry succeeds, got %s", msg.Value)
+		}
+	})
+
+	t.Run("should keep the last schema found while a lookup fails", func(t *testing.T) {
+		value, err := structpb.NewStruct(map[string]any{"temp": 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := proto.Marshal(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		schema := func(ctx context.Context, deviceId string) (protoreflect.MessageDescriptor, error) {
+			return nil, errors.New("db down")
+		}
+		sub := NewSubscription(subscribe(t, message(payload.Protobuf, data)), schema)
+		now := time.Now()
+		sub.now = func() time.Time { return now }
+		sub.schemas["device1"] = cachedSchema{desc: value.ProtoReflect().Descriptor(), fetched: now.Add(-schemaTTL)}
+
+		msg, err := sub.Next(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(msg.Value) != `{"temp":1}` {
+			t.Errorf("expected the reading decoded with the last schema, got %s", msg.Value)
+		}
+	})
+}
@@ -0,0 +1,28 @@
+// Package service exposes the consumer service routes so they can be mounted next to the
+// other services by the all-in-one binary.
+package service
+
+import (
+	"log/slog"
+
+	"github.com/RaghibA/iot-telemetry/db"
+	"github.com/RaghibA/iot-telemetry/pkg/broker"
+	"github.com/RaghibA/iot-telemetry/pkg/config"
+	"github.com/RaghibA/iot-telemetry/pkg/grpcserver"
+	"github.com/RaghibA/iot-telemetry/services/consumer/internal/server"
+	"github.com/gorilla/mux"
+)
+
+// Routes registers the consumer service routes under /api/v1/telemetry on router, and its
+// gRPC streaming API on grpcServer.
+// Params:
+// - router: *mux.Router - the router to register the routes on
+// - grpcServer: *grpcserver.Server - the gRPC server to register the API on
+// - cfg: *config.Config - the service configuration
+// - db: db.DB - the database
+// - logger: *slog.Logger - the logger instance
+// - broker: broker.Broker - the message broker instance
+// Returns: None
+func Routes(router *mux.Router, grpcServer *grpcserver.Server, cfg *config.Config, db db.DB, logger *slog.Logger, broker broker.Broker) {
+	server.NewConsumerServer(cfg, db, logger, broker).Routes(router, grpcServer)
+}
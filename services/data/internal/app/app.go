@@ -1,37 +1,65 @@
 package app
 
 import (
-	"log"
+	"context"
+	"errors"
+	"flag"
+	"log/slog"
 	"os"
 
 	"github.com/RaghibA/iot-telemetry/db"
+	"github.com/RaghibA/iot-telemetry/pkg/broker/factory"
 	"github.com/RaghibA/iot-telemetry/pkg/config"
-	"github.com/RaghibA/iot-telemetry/pkg/kafka"
+	"github.com/RaghibA/iot-telemetry/pkg/logging"
+	"github.com/RaghibA/iot-telemetry/pkg/tracing"
 	"github.com/RaghibA/iot-telemetry/services/data/internal/server"
 )
 
-// Run initializes the configuration, database, Kafka client, and starts the data server.
+// Run initializes the configuration, database, message broker, and starts the data server.
 // Params: None
 // Returns: None
 func Run() {
-	dbConfig, err := config.GetDBConfig()
+	logger := logging.New("data-service")
+	slog.SetDefault(logger)
+
+	cfg, err := config.Load("data-service", os.Args[1:], config.Server, config.DB, config.Broker, config.Ingest)
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
 	if err != nil {
-		log.Fatal(err)
+		fatal(logger, err)
 	}
-	db, err := db.NewDB(dbConfig)
+
+	shutdownTracing, err := tracing.Init(context.Background(), "data-service", cfg.Tracing.OTLPEndpoint)
 	if err != nil {
-		log.Fatal(err)
+		fatal(logger, err)
 	}
+	defer shutdownTracing(context.Background())
 
-	dataConfig, err := config.GetDataConfig()
+	db, err := db.NewDB(&cfg.DB)
 	if err != nil {
-		log.Fatal(err)
+		fatal(logger, err)
 	}
+	defer db.Close()
 
-	kc := &kafka.KafkaService{}
-	logger := log.New(os.Stdout, "DATA SERVICE: ", log.LstdFlags)
-	s := server.NewDataServer(dataConfig, db, logger, kc)
+	b, err := factory.New(cfg)
+	if err != nil {
+		fatal(logger, err)
+	}
+	defer b.Close()
+
+	s := server.NewDataServer(cfg, db, logger, b)
 	if err := s.Run(); err != nil {
-		log.Fatal(err)
+		fatal(logger, err)
 	}
 }
+
+// fatal logs an unrecoverable startup error and exits.
+// Params:
+// - logger: *slog.Logger - the service logger
+// - err: error - the error to log
+// Returns: None
+func fatal(logger *slog.Logger, err error) {
+	logger.Error("data service failed", "err", err)
+	os.Exit(1)
+}
@@ -0,0 +1,352 @@
+// Package coap accepts telemetry from constrained devices over CoAP (RFC 7252) on UDP. Each
+// request is translated to a request to the data service's HTTP routes, so CoAP telemetry
+// goes through the same validation, authorization, limits and publishing as HTTP telemetry.
+package coap
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/RaghibA/iot-telemetry/pkg/httpserver"
+	"github.com/RaghibA/iot-telemetry/pkg/payload"
+	"github.com/RaghibA/iot-telemetry/pkg/senml"
+	"github.com/RaghibA/iot-telemetry/services/data/internal/routes"
+	"github.com/fxamacker/cbor/v2"
+	"github.com/plgd-dev/go-coap/v3/message"
+	"github.com/plgd-dev/go-coap/v3/message/codes"
+	"github.com/plgd-dev/go-coap/v3/message/pool"
+	"github.com/plgd-dev/go-coap/v3/mux"
+	"github.com/plgd-dev/go-coap/v3/net/blockwise"
+	"github.com/plgd-dev/go-coap/v3/net/responsewriter"
+	"github.com/plgd-dev/go-coap/v3/options"
+	"github.com/plgd-dev/go-coap/v3/options/config"
+	"github.com/plgd-dev/go-coap/v3/udp"
+	udpClient "github.com/plgd-dev/go-coap/v3/udp/client"
+	udpServer "github.com/plgd-dev/go-coap/v3/udp/server"
+
+	coapNet "github.com/plgd-dev/go-coap/v3/net"
+)
+
+// APIKeyOption is the CoAP option carrying the API key, from the experimental range. It is
+// critical, so servers that do not know it reject the request rather than ignore the key,
+// and unsafe to forward, so proxies do not pass it on unknowingly.
+const APIKeyOption message.OptionID = 65003
+
+// Response codes of RFC 8132 that go-coap does not name.
+const (
+	conflict            codes.Code = 4<<5 | 9
+	unprocessableEntity codes.Code = 4<<5 | 22
+)
+
+// maxDiagnosticBytes bounds the diagnostic payload of error responses.
+const maxDiagnosticBytes = 128
+
+// Options configures the CoAP listener.
+type Options struct {
+	// Prefix is the path the data routes are served under, e.g. /api/v1/data.
+	Prefix string
+	// MaxBodyBytes is the largest payload accepted, reassembled from its blocks.
+	MaxBodyBytes int64
+	// BlockwiseTimeout is how long the blocks of a payload are kept waiting for the rest.
+	BlockwiseTimeout time.Duration
+}
+
+// Server serves POST /t/{deviceId} over CoAP.
+type Server struct {
+	handler http.Handler
+	logger  *slog.Logger
+	opts    Options
+	srv     *udpServer.Server
+	conn    *coapNet.UDPConn
+}
+
+// NewServer creates a CoAP server forwarding telemetry to the data routes.
+// Params:
+// - handler: http.Handler - the router serving the data routes under opts.Prefix
+// - logger: *slog.Logger - the logger instance
+// - opts: Options - the listener options
+// Returns:
+// - *Server: the server, started with Start
+func NewServer(handler http.Handler, logger *slog.Logger, opts Options) *Server {
+	s := &Server{handler: handler, logger: logger, opts: opts}
+
+	router := mux.NewRouter()
+	router.DefaultHandleFunc(func(w mux.ResponseWriter, r *mux.Message) {
+		respond(w, codes.NotFound, "Send telemetry to /t/{deviceId}")
+	})
+	router.HandleFunc("/t/{deviceId}", s.sendTelemetry)
+
+	s.srv = udp.NewServer(
+		options.WithMux(router),
+		options.WithBlockwise(true, blockwise.SZX1024, opts.BlockwiseTimeout),
+		options.WithProcessReceivedMessageFunc(config.ProcessReceivedMessageFunc[*udpClient.Conn](s.limitSize)),
+		options.WithErrors(func(err error) {
+			logger.Warn("coap error", "err", err)
+		}),
+	)
+	return s
+}
+
+// Start listens on a UDP address and serves requests until Stop is called.
+// Params:
+// - addr: string - the address to listen on, e.g. :5683
+// Returns:
+// - error: error if the address cannot be listened on
+func (s *Server) Start(addr string) error {
+	conn, err := coapNet.NewListenUDP("udp", addr)
+	if err != nil {
+		return fmt.Errorf("coap listen %s: %w", addr, err)
+	}
+	s.conn = conn
+	go func() {
+		if err := s.srv.Serve(conn); err != nil {
+			s.logger.Error("coap server failed", "err", err)
+		}
+	}()
+	return nil
+}
+
+// Addr returns the address the server listens on, nil before Start.
+func (s *Server) Addr() net.Addr {
+	if s.conn == nil {
+		return nil
+	}
+	return s.conn.LocalAddr()
+}
+
+// Stop stops serving and closes the listener.
+func (s *Server) Stop() {
+	s.srv.Stop()
+}
+
+// limitSize answers 4.13 to the blocks of payloads larger than MaxBodyBytes, before they
+// are reassembled, and passes other messages on.
+func (s *Server) limitSize(req *pool.Message, cc *udpClient.Conn, handler config.HandlerFunc[*udpClient.Conn]) {
+	if s.tooLarge(req) {
+		handler = func(w *responsewriter.ResponseWriter[*udpClient.Conn], r *pool.Message) {
+			if err := w.SetResponse(codes.RequestEntityTooLarge, message.TextPlain, bytes.NewReader([]byte(fmt.Sprintf("Payload is larger than %d bytes", s.opts.MaxBodyBytes)))); err != nil {
+				s.logger.Warn("coap set response", "err", err)
+				return
+			}
+			w.Message().SetOptionUint32(message.Size1, uint32(min(s.opts.MaxBodyBytes, math.MaxUint32)))
+			// answer as the connection would: piggybacked on the ACK of a confirmable
+			// request, else in a new non-confirmable message
+			if r.Type() == message.Confirmable {
+				w.Message().SetType(message.Acknowledgement)
+				w.Message().SetMessageID(r.MessageID())
+			} else {
+				w.Message().SetType(message.NonConfirmable)
+				w.Message().SetMessageID(cc.GetMessageID())
+			}
+		}
+	}
+	cc.ProcessReceivedMessageWithHandler(req, handler)
+}
+
+// tooLarge reports whether a request announces, or has sent blocks of, a payload larger
+// than MaxBodyBytes.
+func (s *Server) tooLarge(req *pool.Message) bool {
+	if size, err := req.GetOptionUint32(message.Size1); err == nil && int64(size) > s.opts.MaxBodyBytes {
+		return true
+	}
+	block, err := req.GetOptionUint32(message.Block1)
+	if err != nil {
+		return false
+	}
+	szx, num, _, err := blockwise.DecodeBlockOption(block)
+	if err != nil {
+		return false
+	}
+	n, _ := req.BodySize()
+	return num*szx.Size()+n > s.opts.MaxBodyBytes
+}
+
+// envelope is a payload carrying its API key, for devices that cannot set APIKeyOption.
+type envelope struct {
+	APIKey    string          `json:"apiKey" cbor:"apiKey"`
+	Data      json.RawMessage `json:"data" cbor:"-"`
+	CBORData  cbor.RawMessage `json:"-" cbor:"data"`
+	Timestamp *time.Time      `json:"timestamp,omitempty" cbor:"timestamp,omitempty"`
+	MessageID string          `json:"messageId,omitempty" cbor:"messageId,omitempty"`
+}
+
+// sendTelemetry forwards a reading to the data routes: JSON and CBOR payloads to /event and
+// SenML packs to /senml. The API key is APIKeyOption, or else the apiKey field of a JSON or
+// CBOR envelope holding the reading in data.
+func (s *Server) sendTelemetry(w mux.ResponseWriter, r *mux.Message) {
+	if r.Code() != codes.POST {
+		respond(w, codes.MethodNotAllowed, "Send telemetry with POST")
+		return
+	}
+	deviceId := r.RouteParams.Vars["deviceId"]
+
+	ct := payload.JSON
+	if format, err := r.ContentFormat(); err == nil {
+		switch format {
+		case message.AppJSON:
+			ct = payload.JSON
+		case message.AppCBOR:
+			ct = payload.CBOR
+		case message.AppSenmlJSON:
+			ct = senml.JSON
+		case message.AppSenmlCbor:
+			ct = senml.CBOR
+		default:
+			respond(w, codes.UnsupportedMediaType, "Send application/json, application/cbor, application/senml+json or application/senml+cbor")
+			return
+		}
+	}
+	var data []byte
+	if r.Body() != nil {
+		var err error
+		if data, err = io.ReadAll(io.LimitReader(r.Body(), s.opts.MaxBodyBytes+1)); err != nil {
+			respond(w, codes.BadRequest, "Cannot read payload")
+			return
+		}
+	}
+	if int64(len(data)) > s.opts.MaxBodyBytes {
+		respond(w, codes.RequestEntityTooLarge, fmt.Sprintf("Payload is larger than %d bytes", s.opts.MaxBodyBytes))
+		return
+	}
+
+	path, body := "/event", data
+	headers := http.Header{"Content-Type": {ct}}
+	if key, err := r.GetOptionBytes(APIKeyOption); err == nil {
+		headers.Set("x-api-key", string(key))
+		switch ct {
+		case payload.JSON:
+			if !json.Valid(data) {
+				respond(w, codes.BadRequest, "Send the reading as a JSON payload")
+				return
+			}
+			body, _ = json.Marshal(routes.SendEventRequestBody{DeviceID: deviceId, Data: data})
+		case senml.JSON, senml.CBOR:
+			path = "/senml"
+			headers.Set("X-Device-ID", deviceId)
+		default:
+			headers.Set("X-Device-ID", deviceId)
+		}
+	} else {
+		env, ok := readEnvelope(ct, data)
+		if !ok {
+			respond(w, codes.Unauthorized, fmt.Sprintf(`Provide the API key in option %d, or send {"apiKey": ..., "data": ...}`, APIKeyOption))
+			return
+		}
+		headers.Set("x-api-key", env.APIKey)
+		if ct == payload.JSON {
+			body, _ = json.Marshal(routes.SendEventRequestBody{DeviceID: deviceId, Data: env.Data, Timestamp: env.Timestamp, MessageID: env.MessageID})
+		} else {
+			body = env.CBORData
+			headers.Set("X-Device-ID", deviceId)
+			if env.Timestamp != nil {
+				headers.Set("X-Event-Time", env.Timestamp.Format(time.RFC3339Nano))
+			}
+			if env.MessageID != "" {
+				headers.Set("Idempotency-Key", env.MessageID)
+			}
+		}
+	}
+
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodPost, s.opts.Prefix+path, bytes.NewReader(body))
+	if err != nil {
+		s.logger.Error("coap build request", "err", err)
+		respond(w, codes.InternalServerError, "Internal Server Error")
+		return
+	}
+	req.Header = headers
+	req.RemoteAddr = w.Conn().RemoteAddr().String()
+
+	rec := httpserver.NewRecorder()
+	s.handler.ServeHTTP(rec, req)
+	if rec.Status < 300 {
+		respond(w, codes.Changed, "")
+		return
+	}
+	respond(w, statusCode(rec.Status), rec.Body.String())
+	if rec.Status == http.StatusTooManyRequests || rec.Status == http.StatusServiceUnavailable {
+		// RFC 8516 and RFC 7252 carry the time to wait in Max-Age
+		if wait, err := strconv.ParseUint(rec.Header().Get("Retry-After"), 10, 32); err == nil {
+			w.Message().SetOptionUint32(message.MaxAge, uint32(wait))
+		}
+	}
+}
+
+// readEnvelope decodes a JSON or CBOR envelope, which must carry an API key and a reading.
+func readEnvelope(ct string, data []byte) (*envelope, bool) {
+	env := &envelope{}
+	var err error
+	switch ct {
+	case payload.JSON:
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(env)
+	case payload.CBOR:
+		err = cbor.Unmarshal(data, env)
+	default:
+		return nil, false
+	}
+	if err != nil || env.APIKey == "" || len(env.Data) == 0 && len(env.CBORData) == 0 {
+		return nil, false
+	}
+	return env, true
+}
+
+// statusCode maps an HTTP error status to a CoAP response code.
+func statusCode(status int) codes.Code {
+	switch status {
+	case http.StatusBadRequest:
+		return codes.BadRequest
+	case http.StatusUnauthorized:
+		return codes.Unauthorized
+	case http.StatusForbidden:
+		return codes.Forbidden
+	case http.StatusNotFound:
+		return codes.NotFound
+	case http.StatusMethodNotAllowed:
+		return codes.MethodNotAllowed
+	case http.StatusConflict:
+		return conflict
+	case http.StatusRequestEntityTooLarge:
+		return codes.RequestEntityTooLarge
+	case http.StatusUnsupportedMediaType:
+		return codes.UnsupportedMediaType
+	case http.StatusUnprocessableEntity:
+		return unprocessableEntity
+	case http.StatusTooManyRequests:
+		return codes.TooManyRequests
+	case http.StatusBadGateway:
+		return codes.BadGateway
+	case http.StatusServiceUnavailable:
+		return codes.ServiceUnavailable
+	case http.StatusGatewayTimeout:
+		return codes.GatewayTimeout
+	}
+	if status < 500 {
+		return codes.BadRequest
+	}
+	return codes.InternalServerError
+}
+
+// respond sets the response code and a diagnostic payload, truncated to fit small frames.
+func respond(w mux.ResponseWriter, code codes.Code, diagnostic string) {
+	var body io.ReadSeeker
+	if diagnostic != "" {
+		diagnostic = string(bytes.TrimSpace([]byte(diagnostic)))
+		if len(diagnostic) > maxDiagnosticBytes {
+			diagnostic = diagnostic[:maxDiagnosticBytes]
+		}
+		body = bytes.NewReader([]byte(diagnostic))
+	}
+	if err := w.SetResponse(code, message.TextPlain, body); err != nil && !errors.Is(err, io.EOF) {
+		slog.Default().Warn("coap set response", "err", err)
+	}
+}
@@ -0,0 +1,336 @@
+package coap
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/RaghibA/iot-telemetry/pkg/broker"
+	"github.com/RaghibA/iot-telemetry/pkg/models"
+	"github.com/RaghibA/iot-telemetry/services/data/internal/routes"
+	"github.com/RaghibA/iot-telemetry/services/data/internal/store"
+	"github.com/fxamacker/cbor/v2"
+	"github.com/gorilla/mux"
+	"github.com/plgd-dev/go-coap/v3/message"
+	"github.com/plgd-dev/go-coap/v3/message/codes"
+	"github.com/plgd-dev/go-coap/v3/message/pool"
+	"github.com/plgd-dev/go-coap/v3/net/blockwise"
+	"github.com/plgd-dev/go-coap/v3/options"
+	"github.com/plgd-dev/go-coap/v3/udp"
+	udpClient "github.com/plgd-dev/go-coap/v3/udp/client"
+)
+
+// forwarded is a request the server forwarded to the data routes.
+type forwarded struct {
+	path   string
+	header http.Header
+	body   []byte
+}
+
+// stubRoutes records forwarded requests and answers with status.
+type stubRoutes struct {
+	mu       sync.Mutex
+	requests []forwarded
+	status   int
+	header   http.Header
+}
+
+func (s *stubRoutes) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests = append(s.requests, forwarded{path: r.URL.Path, header: r.Header, body: body})
+	for k, v := range s.header {
+		w.Header()[k] = v
+	}
+	if s.status >= 300 {
+		http.Error(w, http.StatusText(s.status), s.status)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (s *stubRoutes) last(t *testing.T) forwarded {
+	t.Helper()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.requests) == 0 {
+		t.Fatal("expected a forwarded request")
+	}
+	return s.requests[len(s.requests)-1]
+}
+
+// newTestServer starts a server on a local port and dials it with a client sending blocks
+// of szx.
+func newTestServer(t *testing.T, routes http.Handler, maxBodyBytes int64, szx blockwise.SZX) *udpClient.Conn {
+	t.Helper()
+	srv := NewServer(routes, slog.New(slog.NewTextHandler(io.Discard, nil)), Options{Prefix: "/api/v1/data", MaxBodyBytes: maxBodyBytes, BlockwiseTimeout: 5 * time.Second})
+	if err := srv.Start("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(srv.Stop)
+
+	co, err := udp.Dial(srv.Addr().String(), options.WithBlockwise(true, szx, 5*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { co.Close() })
+	return co
+}
+
+func apiKey(key string) message.Option {
+	return message.Option{ID: APIKeyOption, Value: []byte(key)}
+}
+
+func post(t *testing.T, co *udpClient.Conn, path string, format message.MediaType, body []byte, opts ...message.Option) *pool.Message {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	resp, err := co.Post(ctx, path, format, bytes.NewReader(body), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func diagnostic(resp *pool.Message) string {
+	body, _ := resp.ReadBody()
+	return string(body)
+}
+
+func TestSendTelemetry(t *testing.T) {
+	t.Run("should forward a JSON reading with the API key option as an event", func(t *testing.T) {
+		routes := &stubRoutes{}
+		co := newTestServer(t, routes, 1024, blockwise.SZX1024)
+
+		resp := post(t, co, "/t/device1", message.AppJSON, []byte(`{"temp":21.5}`), apiKey("key1"))
+		if resp.Code() != codes.Changed {
+			t.Fatalf("expected 2.04, got %v: %s", resp.Code(), diagnostic(resp))
+		}
+		req := routes.last(t)
+		if req.path != "/api/v1/data/event" || req.header.Get("x-api-key") != "key1" || req.header.Get("Content-Type") != "application/json" {
+			t.Errorf("unexpected request %+v", req)
+		}
+		if string(req.body) != `{"deviceId":"device1","data":{"temp":21.5}}` {
+			t.Errorf("unexpected body %s", req.body)
+		}
+	})
+
+	t.Run("should take the API key, timestamp and message ID from a JSON envelope", func(t *testing.T) {
+		routes := &stubRoutes{}
+		co := newTestServer(t, routes, 1024, blockwise.SZX1024)
+
+		resp := post(t, co, "/t/device1", message.AppJSON, []byte(`{"apiKey":"key1","data":{"temp":21.5},"timestamp":"2026-03-01T12:00:00Z","messageId":"m-1"}`))
+		if resp.Code() != codes.Changed {
+			t.Fatalf("expected 2.04, got %v: %s", resp.Code(), diagnostic(resp))
+		}
+		req := routes.last(t)
+		if req.header.Get("x-api-key") != "key1" {
+			t.Errorf("expected key1, got %q", req.header.Get("x-api-key"))
+		}
+		if string(req.body) != `{"deviceId":"device1","data":{"temp":21.5},"timestamp":"2026-03-01T12:00:00Z","messageId":"m-1"}` {
+			t.Errorf("unexpected body %s", req.body)
+		}
+	})
+
+	t.Run("should forward a CBOR envelope's reading with its metadata in headers", func(t *testing.T) {
+		routes := &stubRoutes{}
+		co := newTestServer(t, routes, 1024, blockwise.SZX1024)
+
+		reading, _ := cbor.Marshal(map[string]float64{"temp": 21.5})
+		data, _ := cbor.Marshal(map[string]any{"apiKey": "key1", "data": cbor.RawMessage(reading), "timestamp": "2026-03-01T12:00:00Z", "messageId": "m-1"})
+		resp := post(t, co, "/t/device1", message.AppCBOR, data)
+		if resp.Code() != codes.Changed {
+			t.Fatalf("expected 2.04, got %v: %s", resp.Code(), diagnostic(resp))
+		}
+		req := routes.last(t)
+		if !bytes.Equal(req.body, reading) || req.header.Get("Content-Type") != "application/cbor" {
+			t.Errorf("expected the CBOR reading, got %x as %q", req.body, req.header.Get("Content-Type"))
+		}
+		if req.header.Get("X-Device-ID") != "device1" || req.header.Get("X-Event-Time") != "2026-03-01T12:00:00Z" || req.header.Get("Idempotency-Key") != "m-1" {
+			t.Errorf("unexpected headers %v", req.header)
+		}
+	})
+
+	t.Run("should forward SenML packs to the SenML route", func(t *testing.T) {
+		routes := &stubRoutes{}
+		co := newTestServer(t, routes, 1024, blockwise.SZX1024)
+
+		resp := post(t, co, "/t/device1", message.AppSenmlJSON, []byte(`[{"n":"temp","v":21.5}]`), apiKey("key1"))
+		if resp.Code() != codes.Changed {
+			t.Fatalf("expected 2.04, got %v: %s", resp.Code(), diagnostic(resp))
+		}
+		req := routes.last(t)
+		if req.path != "/api/v1/data/senml" || req.header.Get("X-Device-ID") != "device1" || req.header.Get("Content-Type") != "application/senml+json" {
+			t.Errorf("unexpected request %+v", req)
+		}
+	})
+
+	t.Run("should answer non-confirmable requests", func(t *testing.T) {
+		routes := &stubRoutes{}
+		co := newTestServer(t, routes, 1024, blockwise.SZX1024)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		req, err := co.NewPostRequest(ctx, "/t/device1", message.AppJSON, bytes.NewReader([]byte(`{"temp":21.5}`)), apiKey("key1"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.SetType(message.NonConfirmable)
+		resp, err := co.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Code() != codes.Changed {
+			t.Errorf("expected 2.04, got %v", resp.Code())
+		}
+		routes.last(t)
+	})
+
+	t.Run("should reassemble payloads sent in blocks", func(t *testing.T) {
+		routes := &stubRoutes{}
+		co := newTestServer(t, routes, 4096, blockwise.SZX16)
+
+		readings := make([]int, 300)
+		data, _ := json.Marshal(map[string]any{"readings": readings})
+		resp := post(t, co, "/t/device1", message.AppJSON, data, apiKey("key1"))
+		if resp.Code() != codes.Changed {
+			t.Fatalf("expected 2.04, got %v: %s", resp.Code(), diagnostic(resp))
+		}
+		var body struct {
+			Data json.RawMessage `json:"data"`
+		}
+		if err := json.Unmarshal(routes.last(t).body, &body); err != nil || !bytes.Equal(body.Data, data) {
+			t.Errorf("expected the reassembled payload, got %s, %v", body.Data, err)
+		}
+	})
+
+	t.Run("should refuse payloads over the limit", func(t *testing.T) {
+		for _, tc := range []struct {
+			name string
+			szx  blockwise.SZX
+		}{
+			{"in blocks", blockwise.SZX16},
+			{"in one message", blockwise.SZX1024},
+		} {
+			t.Run("should refuse them sent "+tc.name, func(t *testing.T) {
+				routes := &stubRoutes{}
+				co := newTestServer(t, routes, 64, tc.szx)
+
+				resp := post(t, co, "/t/device1", message.AppJSON, []byte(`{"data":"`+strings.Repeat("a", 200)+`"}`), apiKey("key1"))
+				if resp.Code() != codes.RequestEntityTooLarge {
+					t.Errorf("expected 4.13, got %v: %s", resp.Code(), diagnostic(resp))
+				}
+				if len(routes.requests) != 0 {
+					t.Errorf("expected nothing forwarded, got %d requests", len(routes.requests))
+				}
+			})
+		}
+	})
+
+	t.Run("should refuse requests without an API key or a known format", func(t *testing.T) {
+		for _, tc := range []struct {
+			name   string
+			format message.MediaType
+			body   string
+			opts   []message.Option
+			code   codes.Code
+		}{
+			{"a reading without a key", message.AppJSON, `{"temp":21.5}`, nil, codes.Unauthorized},
+			{"an envelope without a reading", message.AppJSON, `{"apiKey":"key1"}`, nil, codes.Unauthorized},
+			{"a SenML pack without the key option", message.AppSenmlJSON, `[{"n":"temp","v":21.5}]`, nil, codes.Unauthorized},
+			{"a reading that is not JSON", message.AppJSON, `{"temp":`, []message.Option{apiKey("key1")}, codes.BadRequest},
+			{"an unsupported format", message.TextPlain, `21.5`, []message.Option{apiKey("key1")}, codes.UnsupportedMediaType},
+		} {
+			t.Run("should refuse "+tc.name, func(t *testing.T) {
+				routes := &stubRoutes{}
+				co := newTestServer(t, routes, 1024, blockwise.SZX1024)
+
+				resp := post(t, co, "/t/device1", tc.format, []byte(tc.body), tc.opts...)
+				if resp.Code() != tc.code {
+					t.Errorf("expected %v, got %v: %s", tc.code, resp.Code(), diagnostic(resp))
+				}
+			})
+		}
+	})
+
+	t.Run("should map the data routes' errors to response codes", func(t *testing.T) {
+		for _, tc := range []struct {
+			status int
+			code   codes.Code
+		}{
+			{http.StatusUnauthorized, codes.Unauthorized},
+			{http.StatusForbidden, codes.Forbidden},
+			{http.StatusConflict, conflict},
+			{http.StatusUnprocessableEntity, unprocessableEntity},
+			{http.StatusTeapot, codes.BadRequest},
+			{http.StatusServiceUnavailable, codes.ServiceUnavailable},
+			{http.StatusNotImplemented, codes.InternalServerError},
+		} {
+			t.Run("should map "+http.StatusText(tc.status), func(t *testing.T) {
+				routes := &stubRoutes{status: tc.status}
+				co := newTestServer(t, routes, 1024, blockwise.SZX1024)
+
+				resp := post(t, co, "/t/device1", message.AppJSON, []byte(`{"temp":21.5}`), apiKey("key1"))
+				if resp.Code() != tc.code || diagnostic(resp) != http.StatusText(tc.status) {
+					t.Errorf("expected %v, got %v: %s", tc.code, resp.Code(), diagnostic(resp))
+				}
+			})
+		}
+
+		t.Run("should carry Retry-After in Max-Age", func(t *testing.T) {
+			routes := &stubRoutes{status: http.StatusTooManyRequests, header: http.Header{"Retry-After": {"30"}}}
+			co := newTestServer(t, routes, 1024, blockwise.SZX1024)
+
+			resp := post(t, co, "/t/device1", message.AppJSON, []byte(`{"temp":21.5}`), apiKey("key1"))
+			if maxAge, err := resp.GetOptionUint32(message.MaxAge); resp.Code() != codes.TooManyRequests || err != nil || maxAge != 30 {
+				t.Errorf("expected 4.29 with Max-Age 30, got %v with %d, %v", resp.Code(), maxAge, err)
+			}
+		})
+	})
+
+	t.Run("should answer 4.01 and 4.04 for unknown API keys and devices", func(t *testing.T) {
+		dataStore := store.NewMockStore()
+		dataStore.ApiKeys["key1"] = &models.ApiKey{UserID: "1234user", APIKey: "key1"}
+		dataStore.Devices["device1"] = &models.Device{DeviceID: "device1", UserID: "1234user", TopicName: "stream1"}
+		router := mux.NewRouter()
+		routes.NewDataHandler(dataStore, slog.New(slog.NewTextHandler(io.Discard, nil)), broker.NewMockBroker(), routes.Options{}).
+			DataRoutes(router.PathPrefix("/api/v1/data").Subrouter())
+		co := newTestServer(t, router, 1024, blockwise.SZX1024)
+
+		if resp := post(t, co, "/t/device1", message.AppJSON, []byte(`{"temp":21.5}`), apiKey("key1")); resp.Code() != codes.Changed {
+			t.Fatalf("expected 2.04 for a known key and device, got %v: %s", resp.Code(), diagnostic(resp))
+		}
+		if resp := post(t, co, "/t/device1", message.AppJSON, []byte(`{"temp":21.5}`), apiKey("unknown")); resp.Code() != codes.Unauthorized {
+			t.Errorf("expected 4.01 for an unknown key, got %v: %s", resp.Code(), diagnostic(resp))
+		}
+		if resp := post(t, co, "/t/unknown", message.AppJSON, []byte(`{"temp":21.5}`), apiKey("key1")); resp.Code() != codes.NotFound {
+			t.Errorf("expected 4.04 for an unknown device, got %v: %s", resp.Code(), diagnostic(resp))
+		}
+	})
+
+	t.Run("should refuse other methods and paths", func(t *testing.T) {
+		routes := &stubRoutes{}
+		co := newTestServer(t, routes, 1024, blockwise.SZX1024)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		resp, err := co.Get(ctx, "/t/device1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Code() != codes.MethodNotAllowed {
+			t.Errorf("expected 4.05, got %v", resp.Code())
+		}
+		if resp := post(t, co, "/telemetry", message.AppJSON, []byte(`{}`), apiKey("key1")); resp.Code() != codes.NotFound {
+			t.Errorf("expected 4.04, got %v", resp.Code())
+		}
+	})
+}
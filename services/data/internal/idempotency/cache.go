@@ -0,0 +1,64 @@
+package idempotency
+
+import (
+	"context"
+	"time"
+)
+
+// Cache is a Store shared between replicas with the completed records of this replica
+// kept in memory, so retries reaching the same replica do not query the shared store.
+type Cache struct {
+	memory *Memory
+	shared Store
+}
+
+// NewCache puts an in-memory store in front of a shared one.
+// Params:
+// - memory: *Memory - the in-memory store
+// - shared: Store - the store shared between replicas, which reservations go through
+// Returns:
+// - *Cache: a pointer to the created Cache
+func NewCache(memory *Memory, shared Store) *Cache {
+	return &Cache{memory: memory, shared: shared}
+}
+
+// Reserve returns a completed record from memory, or reserves key in the shared store.
+// Params:
+// - ctx: context.Context - the request context
+// - key: string - the idempotency key
+// - fingerprint: string - the request fingerprint
+// - ttl: time.Duration - how long the reservation is held
+// Returns:
+// - Record: the earlier request's record if the key was not claimed or was interrupted
+// - bool: true if the key was claimed
+// - error: the shared store error
+func (c *Cache) Reserve(ctx context.Context, key string, fingerprint string, ttl time.Duration) (Record, bool, error) {
+	if rec, ok := c.memory.lookup(key); ok && !rec.Pending() && !rec.Interrupted() {
+		return rec, false, nil
+	}
+	return c.shared.Reserve(ctx, key, fingerprint, ttl)
+}
+
+// Complete saves the response, or the interruption, of key in both stores.
+// Params:
+// - ctx: context.Context - the request context
+// - key: string - the idempotency key
+// - rec: Record - the completed record
+// - ttl: time.Duration - how long the record is kept
+// Returns:
+// - error: the shared store error
+func (c *Cache) Complete(ctx context.Context, key string, rec Record, ttl time.Duration) error {
+	_ = c.memory.Complete(ctx, key, rec, ttl)
+	return c.shared.Complete(ctx, key, rec, ttl)
+}
+
+// Release forgets key in both stores.
+// Params:
+// - ctx: context.Context - the request context
+// - key: string - the idempotency key
+// Returns:
+// - error: the shared store error
+func (c *Cache) Release(ctx context.Context, key string) error {
+	_ = c.memory.Release(ctx, key)
+	return c.shared.Release(ctx, key)
+}
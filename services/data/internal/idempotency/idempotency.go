@@ -0,0 +1,106 @@
+// Package idempotency remembers the outcome of requests carrying a client-supplied key,
+// so a device retrying a request whose response it never received gets the original
+// response instead of sending its reading twice.
+//
+// A request first reserves its key. The reservation either claims the key, or returns
+// the record of the earlier request with the same key: still pending, or completed with
+// the response to replay. A request interrupted by a server error records how many of its
+// messages were published, and a retry claims its key again to publish the rest. Keys are kept in an in-memory LRU, optionally in front of a
+// store shared between replicas, the service database or Redis.
+package idempotency
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/RaghibA/iot-telemetry/db"
+	"github.com/RaghibA/iot-telemetry/pkg/config"
+	"github.com/redis/go-redis/v9"
+)
+
+// Record is what is remembered about a request.
+type Record struct {
+	// Fingerprint identifies the request payload, so a key reused for another payload
+	// can be rejected.
+	Fingerprint string `json:"fingerprint"`
+	// StatusCode and Body are the response, StatusCode is 0 while the request is pending.
+	StatusCode int    `json:"statusCode"`
+	Body       []byte `json:"body"`
+	// Sent is how many messages an interrupted request published.
+	Sent int `json:"sent"`
+}
+
+// Pending reports whether the request is still being processed.
+// Params: None
+// Returns:
+// - bool: true if the request has no response yet
+func (r Record) Pending() bool {
+	return r.StatusCode == 0
+}
+
+// Interrupted reports whether the request failed with a server error, possibly after
+// publishing some of its messages. Its key does not hold off a retry with the same
+// fingerprint, which Reserve lets claim it and publish the messages from Sent on.
+// Params: None
+// Returns:
+// - bool: true if the request was interrupted
+func (r Record) Interrupted() bool {
+	return r.StatusCode >= http.StatusInternalServerError
+}
+
+// Store keeps idempotency records until they expire.
+type Store interface {
+	// Reserve claims key for a request with the given fingerprint for ttl. It returns
+	// true if the key was claimed, or false and the record of the earlier request. A key
+	// whose record was interrupted is claimed by the same fingerprint, returning the record.
+	Reserve(ctx context.Context, key string, fingerprint string, ttl time.Duration) (Record, bool, error)
+	// Complete saves the response, or the interruption, of a claimed key, kept for ttl.
+	Complete(ctx context.Context, key string, rec Record, ttl time.Duration) error
+	// Release forgets a claimed key so the request can be retried.
+	Release(ctx context.Context, key string) error
+}
+
+// Fingerprint hashes the parts of a request that must match for it to be a retry.
+// Params:
+// - parts: ...[]byte - the request parts
+// Returns:
+// - string: the hex encoded fingerprint
+func Fingerprint(parts ...[]byte) string {
+	h := sha256.New()
+	for _, part := range parts {
+		// length prefixes keep ("ab", "c") and ("a", "bc") apart
+		fmt.Fprintf(h, "%d:", len(part))
+		h.Write(part)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// NewStore creates the store configured for the data service: an in-memory LRU, in front
+// of the database or Redis when one is configured.
+// Params:
+// - cfg: config.IngestConfig - the validated ingest configuration
+// - database: db.DB - the service database, used by the db store
+// - logger: *slog.Logger - the service logger
+// Returns:
+// - Store: the store
+// - error: error if the Redis URL cannot be parsed
+func NewStore(cfg config.IngestConfig, database db.DB, logger *slog.Logger) (Store, error) {
+	memory := NewMemory(cfg.IdempotencyCacheSize)
+	switch cfg.IdempotencyStore {
+	case config.IdempotencyDB:
+		return NewCache(memory, NewSQL(database, logger)), nil
+	case config.IdempotencyRedis:
+		opts, err := redis.ParseURL(cfg.IdempotencyRedisURL)
+		if err != nil {
+			return nil, err
+		}
+		return NewCache(memory, NewRedis(redis.NewClient(opts))), nil
+	default:
+		return memory, nil
+	}
+}
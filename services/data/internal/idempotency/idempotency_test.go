@@ -0,0 +1,183 @@
+package idempotency
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/RaghibA/iot-telemetry/db/sqlite"
+	"github.com/redis/go-redis/v9"
+)
+
+var testLogger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// testStore checks the behaviour every Store must have.
+func testStore(t *testing.T, newStore func(t *testing.T) Store) {
+	ctx := context.Background()
+	done := Record{Fingerprint: "fp", StatusCode: 202, Body: []byte(`{"message":"Telemetry Sent"}`)}
+
+	t.Run("should claim a new key once", func(t *testing.T) {
+		s := newStore(t)
+		if _, claimed, err := s.Reserve(ctx, "k1", "fp", time.Minute); err != nil || !claimed {
+			t.Fatalf("expected the key to be claimed, got %v %v", claimed, err)
+		}
+		rec, claimed, err := s.Reserve(ctx, "k1", "fp", time.Minute)
+		if err != nil || claimed {
+			t.Fatalf("expected the key to be taken, got %v %v", claimed, err)
+		}
+		if !rec.Pending() || rec.Fingerprint != "fp" {
+			t.Errorf("expected a pending record, got %+v", rec)
+		}
+	})
+
+	t.Run("should return the completed record", func(t *testing.T) {
+		s := newStore(t)
+		if _, _, err := s.Reserve(ctx, "k1", "fp", time.Minute); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Complete(ctx, "k1", done, time.Minute); err != nil {
+			t.Fatal(err)
+		}
+		rec, claimed, err := s.Reserve(ctx, "k1", "other", time.Minute)
+		if err != nil || claimed {
+			t.Fatalf("expected the key to be taken, got %v %v", claimed, err)
+		}
+		if rec.Fingerprint != "fp" || rec.StatusCode != 202 || string(rec.Body) != string(done.Body) {
+			t.Errorf("expected %+v, got %+v", done, rec)
+		}
+	})
+
+	t.Run("should claim a released key again", func(t *testing.T) {
+		s := newStore(t)
+		if _, _, err := s.Reserve(ctx, "k1", "fp", time.Minute); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Release(ctx, "k1"); err != nil {
+			t.Fatal(err)
+		}
+		if _, claimed, err := s.Reserve(ctx, "k1", "fp", time.Minute); err != nil || !claimed {
+			t.Errorf("expected the key to be claimed, got %v %v", claimed, err)
+		}
+	})
+
+	t.Run("should let a retry claim an interrupted key", func(t *testing.T) {
+		s := newStore(t)
+		if _, _, err := s.Reserve(ctx, "k1", "fp", time.Minute); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Complete(ctx, "k1", Record{Fingerprint: "fp", StatusCode: 500, Sent: 2}, time.Minute); err != nil {
+			t.Fatal(err)
+		}
+
+		if rec, claimed, err := s.Reserve(ctx, "k1", "other", time.Minute); err != nil || claimed || !rec.Interrupted() {
+			t.Fatalf("expected the key to be kept from another fingerprint, got %+v %v %v", rec, claimed, err)
+		}
+		rec, claimed, err := s.Reserve(ctx, "k1", "fp", time.Minute)
+		if err != nil || !claimed || rec.Sent != 2 {
+			t.Fatalf("expected the key to be claimed after 2 sent messages, got %+v %v %v", rec, claimed, err)
+		}
+		if rec, claimed, err := s.Reserve(ctx, "k1", "fp", time.Minute); err != nil || claimed || !rec.Pending() {
+			t.Errorf("expected the resumed key to be pending, got %+v %v %v", rec, claimed, err)
+		}
+	})
+
+	t.Run("should claim an expired key again", func(t *testing.T) {
+		s := newStore(t)
+		if _, _, err := s.Reserve(ctx, "k1", "fp", time.Minute); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Complete(ctx, "k1", done, 50*time.Millisecond); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(100 * time.Millisecond)
+		if _, claimed, err := s.Reserve(ctx, "k1", "fp", time.Minute); err != nil || !claimed {
+			t.Errorf("expected the key to be claimed, got %v %v", claimed, err)
+		}
+	})
+}
+
+func TestMemory(t *testing.T) {
+	testStore(t, func(t *testing.T) Store { return NewMemory(10) })
+
+	t.Run("should evict the least recently used key", func(t *testing.T) {
+		ctx := context.Background()
+		m := NewMemory(2)
+		for _, key := range []string{"k1", "k2"} {
+			if _, _, err := m.Reserve(ctx, key, "fp", time.Minute); err != nil {
+				t.Fatal(err)
+			}
+		}
+		m.lookup("k1")
+		if _, _, err := m.Reserve(ctx, "k3", "fp", time.Minute); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, ok := m.lookup("k2"); ok {
+			t.Error("expected k2 to be evicted")
+		}
+		if _, ok := m.lookup("k1"); !ok {
+			t.Error("expected k1 to be kept")
+		}
+	})
+}
+
+func TestSQL(t *testing.T) {
+	testStore(t, func(t *testing.T) Store {
+		d, err := sqlite.Open(filepath.Join(t.TempDir(), "test.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { d.Close() })
+		if err := d.Migrate(); err != nil {
+			t.Fatal(err)
+		}
+		return NewSQL(d, testLogger)
+	})
+}
+
+// TestRedis needs a running server, e.g. IDEMPOTENCY_TEST_REDIS_URL=redis://localhost:6379/15.
+// The database is flushed.
+func TestRedis(t *testing.T) {
+	url := os.Getenv("IDEMPOTENCY_TEST_REDIS_URL")
+	if url == "" {
+		t.Skip("IDEMPOTENCY_TEST_REDIS_URL not set")
+	}
+
+	testStore(t, func(t *testing.T) Store {
+		opts, err := redis.ParseURL(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client := redis.NewClient(opts)
+		t.Cleanup(func() { client.Close() })
+		if err := client.FlushDB(context.Background()).Err(); err != nil {
+			t.Fatal(err)
+		}
+		return NewRedis(client)
+	})
+}
+
+func TestCache(t *testing.T) {
+	testStore(t, func(t *testing.T) Store { return NewCache(NewMemory(10), NewMemory(10)) })
+
+	t.Run("should replay completed records without the shared store", func(t *testing.T) {
+		ctx := context.Background()
+		shared := NewMemory(10)
+		c := NewCache(NewMemory(10), shared)
+		if _, _, err := c.Reserve(ctx, "k1", "fp", time.Minute); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Complete(ctx, "k1", Record{Fingerprint: "fp", StatusCode: 202}, time.Minute); err != nil {
+			t.Fatal(err)
+		}
+		_ = shared.Release(ctx, "k1")
+
+		if rec, claimed, err := c.Reserve(ctx, "k1", "fp", time.Minute); err != nil || claimed || rec.StatusCode != 202 {
+			t.Errorf("expected the cached record, got %+v %v %v", rec, claimed, err)
+		}
+	})
+}
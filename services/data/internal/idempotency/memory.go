@@ -0,0 +1,139 @@
+package idempotency
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+)
+
+// Memory is an in-memory Store holding at most a fixed number of keys. When it is full
+// the least recently used key is forgotten, even if it has not expired.
+type Memory struct {
+	capacity int
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List // front is the most recently used
+	now     func() time.Time
+}
+
+type memoryEntry struct {
+	key     string
+	record  Record
+	expires time.Time
+}
+
+// NewMemory creates an in-memory store.
+// Params:
+// - capacity: int - the maximum number of keys held
+// Returns:
+// - *Memory: a pointer to the created Memory
+func NewMemory(capacity int) *Memory {
+	return &Memory{
+		capacity: max(capacity, 1),
+		entries:  make(map[string]*list.Element),
+		order:    list.New(),
+		now:      time.Now,
+	}
+}
+
+// Reserve claims key unless an unexpired record holds it. An interrupted record is claimed
+// by the same fingerprint.
+// Params:
+// - ctx: context.Context - unused
+// - key: string - the idempotency key
+// - fingerprint: string - the request fingerprint
+// - ttl: time.Duration - how long the reservation is held
+// Returns:
+// - Record: the earlier request's record if the key was not claimed or was interrupted
+// - bool: true if the key was claimed
+// - error: always nil
+func (m *Memory) Reserve(ctx context.Context, key string, fingerprint string, ttl time.Duration) (Record, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	rec, ok := m.get(key)
+	if ok && (!rec.Interrupted() || rec.Fingerprint != fingerprint) {
+		return rec, false, nil
+	}
+	m.set(key, Record{Fingerprint: fingerprint}, ttl)
+	return rec, true, nil
+}
+
+// Complete saves the response, or the interruption, of key.
+// Params:
+// - ctx: context.Context - unused
+// - key: string - the idempotency key
+// - rec: Record - the completed record
+// - ttl: time.Duration - how long the record is kept
+// Returns:
+// - error: always nil
+func (m *Memory) Complete(ctx context.Context, key string, rec Record, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.set(key, rec, ttl)
+	return nil
+}
+
+// Release forgets key.
+// Params:
+// - ctx: context.Context - unused
+// - key: string - the idempotency key
+// Returns:
+// - error: always nil
+func (m *Memory) Release(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if el, ok := m.entries[key]; ok {
+		m.order.Remove(el)
+		delete(m.entries, key)
+	}
+	return nil
+}
+
+// lookup returns the unexpired record of key.
+func (m *Memory) lookup(key string) (Record, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.get(key)
+}
+
+// get returns the unexpired record of key, marking it as recently used. m.mu must be held.
+func (m *Memory) get(key string) (Record, bool) {
+	el, ok := m.entries[key]
+	if !ok {
+		return Record{}, false
+	}
+	entry := el.Value.(*memoryEntry)
+	if !m.now().Before(entry.expires) {
+		m.order.Remove(el)
+		delete(m.entries, key)
+		return Record{}, false
+	}
+	m.order.MoveToFront(el)
+	return entry.record, true
+}
+
+// set stores the record of key, evicting the least recently used keys over capacity.
+// m.mu must be held.
+func (m *Memory) set(key string, rec Record, ttl time.Duration) {
+	expires := m.now().Add(ttl)
+	if el, ok := m.entries[key]; ok {
+		entry := el.Value.(*memoryEntry)
+		entry.record = rec
+		entry.expires = expires
+		m.order.MoveToFront(el)
+		return
+	}
+
+	m.entries[key] = m.order.PushFront(&memoryEntry{key: key, record: rec, expires: expires})
+	for m.order.Len() > m.capacity {
+		oldest := m.order.Back()
+		m.order.Remove(oldest)
+		delete(m.entries, oldest.Value.(*memoryEntry).key)
+	}
+}
@@ -0,0 +1,121 @@
+package idempotency
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// redisPrefix namespaces idempotency keys in a Redis database shared with other data.
+const redisPrefix = "idempotency:"
+
+// Redis is a Store in Redis, or a server speaking its protocol, with records saved as
+// JSON values that Redis expires itself.
+type Redis struct {
+	client *redis.Client
+}
+
+// NewRedis creates a store in Redis.
+// Params:
+// - client: *redis.Client - the Redis client
+// Returns:
+// - *Redis: a pointer to the created Redis
+func NewRedis(client *redis.Client) *Redis {
+	return &Redis{client: client}
+}
+
+// Reserve sets a pending record for key unless one exists, or replaces an interrupted
+// record with the same fingerprint.
+// Params:
+// - ctx: context.Context - the request context
+// - key: string - the idempotency key
+// - fingerprint: string - the request fingerprint
+// - ttl: time.Duration - how long the reservation is held
+// Returns:
+// - Record: the earlier request's record if the key was not claimed or was interrupted
+// - bool: true if the key was claimed
+// - error: the Redis error
+func (r *Redis) Reserve(ctx context.Context, key string, fingerprint string, ttl time.Duration) (Record, bool, error) {
+	value, err := json.Marshal(Record{Fingerprint: fingerprint})
+	if err != nil {
+		return Record{}, false, err
+	}
+
+	// the earlier record may expire or be claimed between the set and the get
+	for {
+		claimed, err := r.client.SetNX(ctx, redisPrefix+key, value, ttl).Result()
+		if err != nil {
+			return Record{}, false, err
+		}
+		if claimed {
+			return Record{}, true, nil
+		}
+
+		existing, err := r.client.Get(ctx, redisPrefix+key).Bytes()
+		if errors.Is(err, redis.Nil) {
+			continue
+		}
+		if err != nil {
+			return Record{}, false, err
+		}
+		var rec Record
+		if err := json.Unmarshal(existing, &rec); err != nil {
+			return Record{}, false, err
+		}
+		if !rec.Interrupted() || rec.Fingerprint != fingerprint {
+			return rec, false, nil
+		}
+
+		err = r.client.Watch(ctx, func(tx *redis.Tx) error {
+			current, err := tx.Get(ctx, redisPrefix+key).Bytes()
+			if err != nil {
+				return err
+			}
+			if !bytes.Equal(current, existing) {
+				return redis.TxFailedErr
+			}
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				pipe.Set(ctx, redisPrefix+key, value, ttl)
+				return nil
+			})
+			return err
+		}, redisPrefix+key)
+		if errors.Is(err, redis.TxFailedErr) || errors.Is(err, redis.Nil) {
+			continue
+		}
+		if err != nil {
+			return Record{}, false, err
+		}
+		return rec, true, nil
+	}
+}
+
+// Complete saves the response, or the interruption, of key.
+// Params:
+// - ctx: context.Context - the request context
+// - key: string - the idempotency key
+// - rec: Record - the completed record
+// - ttl: time.Duration - how long the record is kept
+// Returns:
+// - error: the Redis error
+func (r *Redis) Complete(ctx context.Context, key string, rec Record, ttl time.Duration) error {
+	value, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	return r.client.Set(ctx, redisPrefix+key, value, ttl).Err()
+}
+
+// Release deletes key.
+// Params:
+// - ctx: context.Context - the request context
+// - key: string - the idempotency key
+// Returns:
+// - error: the Redis error
+func (r *Redis) Release(ctx context.Context, key string) error {
+	return r.client.Del(ctx, redisPrefix+key).Err()
+}
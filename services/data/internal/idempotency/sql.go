@@ -0,0 +1,142 @@
+package idempotency
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/RaghibA/iot-telemetry/db"
+	"github.com/jackc/pgx/v5"
+)
+
+// pruneInterval is how often the SQL store deletes expired keys.
+const pruneInterval = time.Minute
+
+// SQL is a Store in the idempotency_keys table of the service database, Postgres or
+// SQLite. Expiry times are stored as unix milliseconds.
+type SQL struct {
+	db     db.DB
+	logger *slog.Logger
+
+	mu        sync.Mutex
+	lastPrune time.Time
+}
+
+// NewSQL creates a store in the service database.
+// Params:
+// - database: db.DB - the service database
+// - logger: *slog.Logger - the service logger
+// Returns:
+// - *SQL: a pointer to the created SQL
+func NewSQL(database db.DB, logger *slog.Logger) *SQL {
+	return &SQL{db: database, logger: logger}
+}
+
+// Reserve inserts a pending record for key, replacing an expired one, or an interrupted
+// one with the same fingerprint.
+// Params:
+// - ctx: context.Context - the request context
+// - key: string - the idempotency key
+// - fingerprint: string - the request fingerprint
+// - ttl: time.Duration - how long the reservation is held
+// Returns:
+// - Record: the earlier request's record if the key was not claimed or was interrupted
+// - bool: true if the key was claimed
+// - error: the database error
+func (s *SQL) Reserve(ctx context.Context, key string, fingerprint string, ttl time.Duration) (Record, bool, error) {
+	s.prune(ctx)
+
+	queryString := `
+		INSERT INTO idempotency_keys (idempotency_key, fingerprint, status_code, body, sent, expires_at)
+		VALUES ($1, $2, 0, '', 0, $3)
+		ON CONFLICT (idempotency_key) DO UPDATE
+		SET fingerprint = excluded.fingerprint, status_code = 0, body = '', sent = 0, expires_at = excluded.expires_at
+		WHERE idempotency_keys.expires_at <= $4
+	`
+	selectString := `
+		SELECT fingerprint, status_code, body, sent FROM idempotency_keys WHERE idempotency_key=$1
+	`
+	// only the retry that finds the record as it was interrupted claims it
+	resumeString := `
+		UPDATE idempotency_keys SET status_code = 0, body = '', sent = 0, expires_at = $4
+		WHERE idempotency_key = $1 AND status_code = $2 AND sent = $3
+	`
+
+	// the earlier record may be released or claimed between the insert and the select
+	for {
+		now := time.Now()
+		tag, err := s.db.Exec(ctx, queryString, key, fingerprint, now.Add(ttl).UnixMilli(), now.UnixMilli())
+		if err != nil {
+			return Record{}, false, err
+		}
+		if tag.RowsAffected() == 1 {
+			return Record{}, true, nil
+		}
+
+		var rec Record
+		var body string
+		err = s.db.QueryRow(ctx, selectString, key).Scan(&rec.Fingerprint, &rec.StatusCode, &body, &rec.Sent)
+		if errors.Is(err, pgx.ErrNoRows) {
+			continue
+		}
+		if err != nil {
+			return Record{}, false, err
+		}
+		rec.Body = []byte(body)
+		if !rec.Interrupted() || rec.Fingerprint != fingerprint {
+			return rec, false, nil
+		}
+
+		tag, err = s.db.Exec(ctx, resumeString, key, rec.StatusCode, rec.Sent, now.Add(ttl).UnixMilli())
+		if err != nil {
+			return Record{}, false, err
+		}
+		if tag.RowsAffected() == 1 {
+			return rec, true, nil
+		}
+	}
+}
+
+// Complete saves the response, or the interruption, of key.
+// Params:
+// - ctx: context.Context - the request context
+// - key: string - the idempotency key
+// - rec: Record - the completed record
+// - ttl: time.Duration - how long the record is kept
+// Returns:
+// - error: the database error
+func (s *SQL) Complete(ctx context.Context, key string, rec Record, ttl time.Duration) error {
+	queryString := `
+		UPDATE idempotency_keys SET status_code=$2, body=$3, sent=$4, expires_at=$5 WHERE idempotency_key=$1
+	`
+	_, err := s.db.Exec(ctx, queryString, key, rec.StatusCode, string(rec.Body), rec.Sent, time.Now().Add(ttl).UnixMilli())
+	return err
+}
+
+// Release deletes key.
+// Params:
+// - ctx: context.Context - the request context
+// - key: string - the idempotency key
+// Returns:
+// - error: the database error
+func (s *SQL) Release(ctx context.Context, key string) error {
+	_, err := s.db.Exec(ctx, `DELETE FROM idempotency_keys WHERE idempotency_key=$1`, key)
+	return err
+}
+
+// prune deletes expired keys, at most once per pruneInterval.
+func (s *SQL) prune(ctx context.Context) {
+	s.mu.Lock()
+	if time.Since(s.lastPrune) < pruneInterval {
+		s.mu.Unlock()
+		return
+	}
+	s.lastPrune = time.Now()
+	s.mu.Unlock()
+
+	if _, err := s.db.Exec(ctx, `DELETE FROM idempotency_keys WHERE expires_at <= $1`, time.Now().UnixMilli()); err != nil {
+		s.logger.WarnContext(ctx, "failed to prune idempotency keys", "err", err)
+	}
+}
@@ -1,10 +1,12 @@
 package monitoring
 
 import (
-	"log"
+	"errors"
+	"log/slog"
 	"net/http"
 	"time"
 
+	"github.com/gorilla/mux"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
@@ -12,6 +14,11 @@ import (
 type Metrics struct {
 	HttpRequestDuration *prometheus.HistogramVec
 	HttpRequestStatus   *prometheus.CounterVec
+	// RateLimited counts messages refused by a rate limit or quota, by limit.
+	RateLimited *prometheus.CounterVec
+	// WALDepth and WALBytes are the messages buffered in the write-ahead log and its size.
+	WALDepth prometheus.Gauge
+	WALBytes prometheus.Gauge
 }
 
 // NewMetrics creates a new Metrics instance and registers Prometheus metrics.
@@ -20,29 +27,64 @@ type Metrics struct {
 // - *Metrics: a pointer to the created Metrics instance
 func NewMetrics() *Metrics {
 	m := &Metrics{
-		HttpRequestDuration: prometheus.NewHistogramVec(
+		HttpRequestDuration: register(prometheus.NewHistogramVec(
 			prometheus.HistogramOpts{
 				Name:    "http_request_dur_sec",
 				Help:    "Duration of HTTP requests measured in seconds.",
 				Buckets: prometheus.DefBuckets,
 			},
 			[]string{"method", "route"},
-		),
-		HttpRequestStatus: prometheus.NewCounterVec(
+		)),
+		HttpRequestStatus: register(prometheus.NewCounterVec(
 			prometheus.CounterOpts{
 				Name: "http_request_status_ct",
 				Help: "Total HTTP requests",
 			},
 			[]string{"method", "route", "status_code"},
-		),
+		)),
+		RateLimited: register(prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "ingest_rate_limited_ct",
+				Help: "Telemetry messages refused by a rate limit or quota",
+			},
+			[]string{"limit"},
+		)),
+		WALDepth: register(prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "ingest_wal_depth",
+				Help: "Telemetry messages buffered in the write-ahead log waiting for the broker",
+			},
+		)),
+		WALBytes: register(prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "ingest_wal_bytes",
+				Help: "Size in bytes of the write-ahead log segment files",
+			},
+		)),
 	}
-
-	prometheus.MustRegister(m.HttpRequestDuration, m.HttpRequestStatus)
-	log.Println("Prometheus Collector Registered")
+	slog.Info("Prometheus collector registered")
 
 	return m
 }
 
+// register registers a collector with the default registry. When an identical collector
+// is already registered, as when several services share a process, the existing one is
+// returned so their metrics are recorded together.
+// Params:
+// - c: T - the collector to register
+// Returns:
+// - T: the registered collector
+func register[T prometheus.Collector](c T) T {
+	if err := prometheus.Register(c); err != nil {
+		var are prometheus.AlreadyRegisteredError
+		if errors.As(err, &are) {
+			return are.ExistingCollector.(T)
+		}
+		panic(err)
+	}
+	return c
+}
+
 type statusRecorder struct {
 	http.ResponseWriter
 	statusCode int
@@ -71,6 +113,12 @@ func (m *Metrics) MetricMonitoring(next http.Handler) http.Handler {
 
 		duration := time.Since(start).Seconds()
 		route := r.URL.Path
+		// label routes with path variables by their template, not one series per device
+		if current := mux.CurrentRoute(r); current != nil {
+			if template, err := current.GetPathTemplate(); err == nil {
+				route = template
+			}
+		}
 		status := http.StatusText(rw.statusCode)
 
 		m.HttpRequestDuration.WithLabelValues(r.Method, route).Observe(duration)
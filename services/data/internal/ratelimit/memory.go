@@ -0,0 +1,68 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// sweepInterval is how often the memory store forgets buckets that have refilled.
+const sweepInterval = time.Minute
+
+// Memory is a Store holding the buckets of one replica. Full buckets are forgotten, since
+// a new bucket starts full.
+type Memory struct {
+	mu        sync.Mutex
+	buckets   map[string]*memoryBucket
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+type memoryBucket struct {
+	bucket
+	limit Limit
+}
+
+// NewMemory creates an in-memory store.
+// Params: None
+// Returns:
+// - *Memory: a pointer to the created Memory
+func NewMemory() *Memory {
+	return &Memory{buckets: make(map[string]*memoryBucket), now: time.Now}
+}
+
+// Take takes a token from the bucket of key.
+// Params:
+// - ctx: context.Context - unused
+// - key: string - the bucket key
+// - limit: Limit - the bucket's limit
+// Returns:
+// - time.Duration: 0 if a token was taken, or how long until one is available
+// - error: always nil
+func (m *Memory) Take(ctx context.Context, key string, limit Limit) (time.Duration, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.now()
+	if now.Sub(m.lastSweep) >= sweepInterval {
+		m.sweep(now)
+	}
+
+	b, ok := m.buckets[key]
+	if !ok {
+		b = &memoryBucket{bucket: bucket{tokens: float64(limit.Burst), at: now}}
+		m.buckets[key] = b
+	}
+	b.limit = limit
+	return b.take(now, limit), nil
+}
+
+// sweep forgets the buckets that are full again. m.mu must be held.
+func (m *Memory) sweep(now time.Time) {
+	m.lastSweep = now
+	for key, b := range m.buckets {
+		if !now.Before(b.full(b.limit)) {
+			delete(m.buckets, key)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+// Package ratelimit limits how fast API keys and devices may send telemetry, with token
+// buckets: a bucket holds at most Burst tokens, refills at Rate tokens per second, and
+// every message takes one. Buckets are kept in memory per replica, or in Redis to share
+// them between replicas.
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"time"
+
+	"github.com/RaghibA/iot-telemetry/pkg/config"
+	"github.com/redis/go-redis/v9"
+)
+
+// Limit configures a token bucket. The zero value does not limit.
+type Limit struct {
+	// Rate is the number of tokens added per second.
+	Rate float64
+	// Burst is the size of the bucket.
+	Burst int
+}
+
+// Enabled reports whether the limit restricts anything.
+// Params: None
+// Returns:
+// - bool: true if the limit has a rate
+func (l Limit) Enabled() bool {
+	return l.Rate > 0
+}
+
+// Store keeps token buckets.
+type Store interface {
+	// Take takes a token from the bucket of key. It returns 0 if a token was taken, or
+	// how long until one is available.
+	Take(ctx context.Context, key string, limit Limit) (time.Duration, error)
+}
+
+// NewStore creates the store configured for the data service.
+// Params:
+// - cfg: config.IngestConfig - the validated ingest configuration
+// Returns:
+// - Store: the store
+// - error: error if the Redis URL cannot be parsed
+func NewStore(cfg config.IngestConfig) (Store, error) {
+	if cfg.RateLimitStore != config.RateLimitRedis {
+		return NewMemory(), nil
+	}
+	opts, err := redis.ParseURL(cfg.RateLimitRedisURL)
+	if err != nil {
+		return nil, err
+	}
+	return NewRedis(redis.NewClient(opts)), nil
+}
+
+// bucket is the state of a token bucket at a point in time.
+type bucket struct {
+	tokens float64
+	at     time.Time
+}
+
+// take refills the bucket up to now and takes a token from it.
+// Params:
+// - now: time.Time - the current time
+// - limit: Limit - the bucket's limit
+// Returns:
+// - time.Duration: 0 if a token was taken, or how long until one is available
+func (b *bucket) take(now time.Time, limit Limit) time.Duration {
+	if elapsed := now.Sub(b.at).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(float64(limit.Burst), b.tokens+elapsed*limit.Rate)
+	}
+	b.at = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / limit.Rate * float64(time.Second))
+}
+
+// full returns when the bucket will be full again.
+func (b *bucket) full(limit Limit) time.Time {
+	return b.at.Add(time.Duration((float64(limit.Burst) - b.tokens) / limit.Rate * float64(time.Second)))
+}
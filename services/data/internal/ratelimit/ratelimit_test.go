@@ -0,0 +1,92 @@
+package ratelimit
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// testStore checks the behaviour every Store must have.
+func testStore(t *testing.T, newStore func(t *testing.T) Store) {
+	ctx := context.Background()
+	limit := Limit{Rate: 10, Burst: 2}
+
+	t.Run("should allow a burst then limit to the rate", func(t *testing.T) {
+		s := newStore(t)
+		for i := 0; i < 2; i++ {
+			if wait, err := s.Take(ctx, "k1", limit); err != nil || wait != 0 {
+				t.Fatalf("expected token %d to be taken, got %s %v", i, wait, err)
+			}
+		}
+		wait, err := s.Take(ctx, "k1", limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if wait <= 0 || wait > 100*time.Millisecond {
+			t.Errorf("expected to wait up to 100ms, got %s", wait)
+		}
+
+		time.Sleep(wait + 10*time.Millisecond)
+		if wait, err := s.Take(ctx, "k1", limit); err != nil || wait != 0 {
+			t.Errorf("expected a refilled token, got %s %v", wait, err)
+		}
+	})
+
+	t.Run("should keep buckets apart", func(t *testing.T) {
+		s := newStore(t)
+		for i := 0; i < 2; i++ {
+			if _, err := s.Take(ctx, "k1", limit); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if wait, err := s.Take(ctx, "k2", limit); err != nil || wait != 0 {
+			t.Errorf("expected k2 to have its own bucket, got %s %v", wait, err)
+		}
+	})
+}
+
+func TestMemory(t *testing.T) {
+	testStore(t, func(t *testing.T) Store { return NewMemory() })
+
+	t.Run("should forget buckets that refilled", func(t *testing.T) {
+		now := time.Now()
+		m := NewMemory()
+		m.now = func() time.Time { return now }
+		if _, err := m.Take(context.Background(), "k1", Limit{Rate: 1, Burst: 1}); err != nil {
+			t.Fatal(err)
+		}
+
+		now = now.Add(2 * sweepInterval)
+		if _, err := m.Take(context.Background(), "k2", Limit{Rate: 1, Burst: 1}); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := m.buckets["k1"]; ok {
+			t.Error("expected the full bucket to be forgotten")
+		}
+	})
+}
+
+// TestRedis needs a running server, e.g. RATELIMIT_TEST_REDIS_URL=redis://localhost:6379/15.
+// The database is flushed.
+func TestRedis(t *testing.T) {
+	url := os.Getenv("RATELIMIT_TEST_REDIS_URL")
+	if url == "" {
+		t.Skip("RATELIMIT_TEST_REDIS_URL not set")
+	}
+
+	testStore(t, func(t *testing.T) Store {
+		opts, err := redis.ParseURL(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client := redis.NewClient(opts)
+		t.Cleanup(func() { client.Close() })
+		if err := client.FlushDB(context.Background()).Err(); err != nil {
+			t.Fatal(err)
+		}
+		return NewRedis(client)
+	})
+}
@@ -0,0 +1,69 @@
+package ratelimit
+
+import (
+	"context"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// redisPrefix namespaces bucket keys in a Redis database shared with other data.
+const redisPrefix = "ratelimit:"
+
+// takeScript is bucket.take run atomically in Redis, on the Redis clock so replicas with
+// skewed clocks share buckets fairly. It returns the wait in microseconds.
+var takeScript = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local time = redis.call('TIME')
+local now = tonumber(time[1]) * 1000000 + tonumber(time[2])
+
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'at')
+local tokens = tonumber(state[1]) or burst
+local at = tonumber(state[2]) or now
+if now > at then
+	tokens = math.min(burst, tokens + (now - at) / 1000000 * rate)
+end
+
+local wait = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+else
+	wait = math.ceil((1 - tokens) / rate * 1000000)
+end
+
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'at', tostring(now))
+-- a bucket left alone until it is full again is the same as a new one
+redis.call('PEXPIRE', KEYS[1], math.ceil((burst - tokens) / rate * 1000) + 1000)
+return wait
+`)
+
+// Redis is a Store in Redis, or a server speaking its protocol, shared between replicas.
+type Redis struct {
+	client *redis.Client
+}
+
+// NewRedis creates a store in Redis.
+// Params:
+// - client: *redis.Client - the Redis client
+// Returns:
+// - *Redis: a pointer to the created Redis
+func NewRedis(client *redis.Client) *Redis {
+	return &Redis{client: client}
+}
+
+// Take takes a token from the bucket of key.
+// Params:
+// - ctx: context.Context - the request context
+// - key: string - the bucket key
+// - limit: Limit - the bucket's limit
+// Returns:
+// - time.Duration: 0 if a token was taken, or how long until one is available
+// - error: the Redis error
+func (r *Redis) Take(ctx context.Context, key string, limit Limit) (time.Duration, error) {
+	wait, err := takeScript.Run(ctx, r.client, []string{redisPrefix + key}, limit.Rate, limit.Burst).Int64()
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(wait) * time.Microsecond, nil
+}
@@ -1,34 +1,149 @@
 package routes
 
 import (
-	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
-	"log"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"mime"
 	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
 
-	"github.com/RaghibA/iot-telemetry/pkg/kafka"
+	"github.com/RaghibA/iot-telemetry/pkg/broker"
+	"github.com/RaghibA/iot-telemetry/pkg/httpserver"
+	"github.com/RaghibA/iot-telemetry/pkg/lineprotocol"
+	"github.com/RaghibA/iot-telemetry/pkg/logging"
+	"github.com/RaghibA/iot-telemetry/pkg/models"
+	"github.com/RaghibA/iot-telemetry/pkg/otlp"
+	"github.com/RaghibA/iot-telemetry/pkg/payload"
+	"github.com/RaghibA/iot-telemetry/pkg/senml"
+	"github.com/RaghibA/iot-telemetry/services/data/internal/idempotency"
+	"github.com/RaghibA/iot-telemetry/services/data/internal/ratelimit"
 	"github.com/RaghibA/iot-telemetry/services/data/internal/store"
+	"github.com/RaghibA/iot-telemetry/services/data/internal/wal"
 	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v5"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/protobuf/reflect/protoreflect"
 )
 
+// schemaVersion is the version of the metadata headers attached to ingested messages.
+// Bump it when a header is removed or changes meaning.
+const schemaVersion = "1"
+
+// walFullRetryAfter is the Retry-After of telemetry refused because the write-ahead log
+// is full, the longest wait of its replayer between attempts to drain it.
+const walFullRetryAfter = "30"
+
+// defaultContentType is the media type of payloads sent without a Content-Type header.
+const defaultContentType = payload.JSON
+
+const (
+	// deviceIDHeader carries the device ID of binary payloads, like deviceId.
+	deviceIDHeader = "X-Device-ID"
+	// eventTimeHeader carries the device timestamp of binary payloads, like timestamp.
+	eventTimeHeader = "X-Event-Time"
+	// idempotencyKeyHeader carries the client's ID for a message, like messageId.
+	idempotencyKeyHeader = "Idempotency-Key"
+	// replayedHeader marks a response replayed for a retried message.
+	replayedHeader = "Idempotent-Replayed"
+	// maxMessageIDLength is the longest message ID accepted.
+	maxMessageIDLength = 255
+	// pendingTTL is how long a message ID is held while its message is published. It
+	// bounds how long retries are refused if the replica publishing it stops.
+	pendingTTL = time.Minute
+)
+
+// Limits reported in the limit label of Options.RateLimited.
+const (
+	limitAPIKey = "api_key"
+	limitDevice = "device"
+	limitQuota  = "quota"
+)
+
+// apiKeyContextKey holds the *models.ApiKey a gRPC call was authenticated with.
+type apiKeyContextKey struct{}
+
 type Handler struct {
 	store  store.EventStore
-	logger *log.Logger
-	kafka  kafka.KafkaClient
+	logger *slog.Logger
+	broker broker.Broker
+	opts   Options
+}
+
+// Options configures how the data service accepts telemetry.
+type Options struct {
+	// MaxFutureSkew is how far ahead of the server clock a device timestamp may be,
+	// unlimited if 0.
+	MaxFutureSkew time.Duration
+	// MaxEventAge is how far behind the server clock a device timestamp may be,
+	// unlimited if 0.
+	MaxEventAge time.Duration
+	// MaxDepth is the deepest nesting of objects and arrays in a payload, unlimited if 0.
+	MaxDepth int
+	// MaxKeys is the most object keys in a payload, unlimited if 0.
+	MaxKeys int
+	// MaxMeasurements is the most measurements in a SenML pack, unlimited if 0.
+	MaxMeasurements int
+	// MaxLines is the most lines in a line protocol write, unlimited if 0.
+	MaxLines int
+	// MaxDataPoints is the most data points in an OTLP metrics export, unlimited if 0.
+	MaxDataPoints int
+	// DeviceTag is the line protocol tag holding the device ID of writes without one in
+	// the path.
+	DeviceTag string
+	// TrustedProxies are the reverse proxies whose forwarding headers give the source IP.
+	TrustedProxies []netip.Prefix
+	// Idempotency remembers message IDs to deduplicate retries, nil to disable.
+	Idempotency idempotency.Store
+	// IdempotencyWindow is how long a message ID is remembered.
+	IdempotencyWindow time.Duration
+	// RateLimits keeps the token buckets of KeyLimit and DeviceLimit, nil to disable
+	// rate limiting.
+	RateLimits ratelimit.Store
+	// KeyLimit is the rate limit of each API key.
+	KeyLimit ratelimit.Limit
+	// DeviceLimit is the rate limit of each device.
+	DeviceLimit ratelimit.Limit
+	// Quotas enables the daily quotas of users.
+	Quotas bool
+	// DefaultQuota is the quota of users without limits of their own or a plan.
+	DefaultQuota models.Quota
+	// RateLimited counts messages refused by a limit, nil to not count them.
+	RateLimited *prometheus.CounterVec
 }
 
 type SendEventRequestBody struct {
 	DeviceID string          `json:"deviceId"`
 	Data     json.RawMessage `json:"data"`
+	// Timestamp is when the device took the reading, in RFC 3339. Optional.
+	Timestamp *time.Time `json:"timestamp,omitempty"`
+	// MessageID identifies the message across retries, like the Idempotency-Key header.
+	// Optional.
+	MessageID string `json:"messageId,omitempty"`
 }
 
-func NewDataHandler(store store.EventStore, logger *log.Logger, kafka kafka.KafkaClient) *Handler {
-	return &Handler{store: store, logger: logger, kafka: kafka}
+func NewDataHandler(store store.EventStore, logger *slog.Logger, broker broker.Broker, opts Options) *Handler {
+	return &Handler{store: store, logger: logger, broker: broker, opts: opts}
 }
 
 func (h *Handler) DataRoutes(router *mux.Router) {
 	router.HandleFunc("/health", h.healthCheck).Methods(http.MethodGet)
 	router.HandleFunc("/event", h.sendTelemetry).Methods(http.MethodPost)
+	router.HandleFunc("/senml", h.sendSenML).Methods(http.MethodPost)
+	// the OTLP/HTTP exporter posts to /v1/metrics under its endpoint
+	router.HandleFunc("/v1/metrics", h.sendOTLPMetrics).Methods(http.MethodPost)
+	// the InfluxDB 1.x and 2.x write APIs, optionally under a device's path
+	for _, prefix := range []string{"", "/devices/{deviceId}"} {
+		router.HandleFunc(prefix+"/write", h.sendLineProtocol).Methods(http.MethodPost)
+		router.HandleFunc(prefix+"/api/v2/write", h.sendLineProtocol).Methods(http.MethodPost)
+	}
 }
 
 func (h *Handler) healthCheck(w http.ResponseWriter, r *http.Request) {
@@ -40,60 +155,897 @@ func (h *Handler) healthCheck(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *Handler) sendTelemetry(w http.ResponseWriter, r *http.Request) {
-	var eventData SendEventRequestBody
-	decoder := json.NewDecoder(r.Body)
+	receivedAt := time.Now().UTC()
 
-	if err := decoder.Decode(&eventData); err != nil {
-		log.Println(err)
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+	ev, err := readEvent(r)
+	if err != nil {
+		h.logger.WarnContext(r.Context(), "invalid request body", "err", err)
+		httpserver.WriteBodyError(w, err)
 		return
 	}
+	h.sendEvent(w, r, receivedAt, ev)
+}
+
+// sendEvent checks a message read from a request and publishes it, for /event and Send.
+// Params:
+// - w: http.ResponseWriter - the HTTP response writer
+// - r: *http.Request - the HTTP request
+// - receivedAt: time.Time - when the request was received, in UTC
+// - ev: *event - the message
+// Returns: None
+func (h *Handler) sendEvent(w http.ResponseWriter, r *http.Request, receivedAt time.Time, ev *event) {
+	// Protobuf payloads are checked once the device's schema is known
+	if ev.contentType != payload.Protobuf && !h.checkPayload(w, r, ev, nil) {
+		return
+	}
+
+	if ev.deviceId == "" {
+		h.logger.WarnContext(r.Context(), "no device id in request")
+		if ev.contentType == payload.JSON {
+			http.Error(w, "Provide deviceId in request body", http.StatusBadRequest)
+		} else {
+			http.Error(w, fmt.Sprintf("Provide deviceId in '%s' header", deviceIDHeader), http.StatusBadRequest)
+		}
+		return
+	}
+	logging.SetDeviceID(r.Context(), ev.deviceId)
+
+	if ev.timestamp != nil {
+		if err := h.checkSkew(*ev.timestamp, receivedAt); err != nil {
+			h.logger.WarnContext(r.Context(), "device timestamp out of bounds", "timestamp", *ev.timestamp, "err", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	messageId, err := messageID(r, ev.messageId)
+	if err != nil {
+		h.logger.WarnContext(r.Context(), "invalid message id", "err", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var fingerprint string
+	if messageId != "" {
+		var timestamp []byte
+		if ev.timestamp != nil {
+			timestamp, _ = ev.timestamp.MarshalText()
+		}
+		fingerprint = idempotency.Fingerprint(ev.data, timestamp)
+	}
+
+	h.ingest(w, r, receivedAt, &batch{apiKey: r.Header.Get("x-api-key"), deviceId: ev.deviceId, messageId: messageId, fingerprint: fingerprint, events: []*event{ev}})
+}
+
+// sendSenML publishes each measurement of a SenML pack as a JSON event with its name,
+// unit, value and time. The device ID goes in a header, as for binary payloads.
+func (h *Handler) sendSenML(w http.ResponseWriter, r *http.Request) {
+	receivedAt := time.Now().UTC()
 
-	deviceId := eventData.DeviceID
+	ct, err := contentType(r)
+	if err != nil {
+		h.logger.WarnContext(r.Context(), "malformed content type", "err", err)
+		httpserver.WriteBodyError(w, err)
+		return
+	}
+	if !senml.Supported(ct) {
+		h.logger.WarnContext(r.Context(), "unsupported senml content type", "content_type", ct)
+		http.Error(w, fmt.Sprintf("Unsupported Content-Type %q, send %s or %s", ct, senml.JSON, senml.CBOR), http.StatusUnsupportedMediaType)
+		return
+	}
+	data, err := httpserver.ReadBody(r)
+	if err != nil {
+		h.logger.WarnContext(r.Context(), "invalid request body", "err", err)
+		httpserver.WriteBodyError(w, err)
+		return
+	}
+	measurements, err := senml.Parse(ct, data, receivedAt)
+	if err != nil {
+		h.logger.WarnContext(r.Context(), "invalid senml pack", "content_type", ct, "err", err)
+		http.Error(w, fmt.Sprintf("Invalid SenML pack: %s", err), http.StatusBadRequest)
+		return
+	}
+	if h.opts.MaxMeasurements > 0 && len(measurements) > h.opts.MaxMeasurements {
+		h.logger.WarnContext(r.Context(), "senml pack over limits", "measurements", len(measurements))
+		http.Error(w, fmt.Sprintf("SenML pack has more than %d measurements", h.opts.MaxMeasurements), http.StatusBadRequest)
+		return
+	}
+
+	deviceId := r.Header.Get(deviceIDHeader)
 	if deviceId == "" {
-		log.Println("No device id")
-		http.Error(w, "Provide deviceId in request body", http.StatusBadRequest)
+		h.logger.WarnContext(r.Context(), "no device id in request")
+		http.Error(w, fmt.Sprintf("Provide deviceId in '%s' header", deviceIDHeader), http.StatusBadRequest)
 		return
 	}
+	logging.SetDeviceID(r.Context(), deviceId)
 
-	apiKeyString := r.Header.Get("x-api-key")
-	if apiKeyString == "" {
-		h.logger.Println("No api key in header")
-		http.Error(w, "Provide api key in 'x-api-key' header", http.StatusBadRequest)
+	events := make([]*event, len(measurements))
+	for i, m := range measurements {
+		if err := h.checkSkew(m.Time, receivedAt); err != nil {
+			h.logger.WarnContext(r.Context(), "device timestamp out of bounds", "name", m.Name, "timestamp", m.Time, "err", err)
+			http.Error(w, fmt.Sprintf("%s: %s", m.Name, err), http.StatusBadRequest)
+			return
+		}
+		value, err := json.Marshal(m)
+		if err != nil {
+			// resolved measurements hold finite numbers, strings, booleans and bytes
+			h.logger.ErrorContext(r.Context(), "encode senml measurement", "err", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		events[i] = &event{contentType: payload.JSON, deviceId: deviceId, data: value, timestamp: &m.Time, part: strconv.Itoa(i)}
+	}
+
+	messageId, err := messageID(r, "")
+	if err != nil {
+		h.logger.WarnContext(r.Context(), "invalid message id", "err", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var fingerprint string
+	if messageId != "" {
+		fingerprint = idempotency.Fingerprint([]byte(ct), data)
+	}
+
+	h.ingest(w, r, receivedAt, &batch{apiKey: r.Header.Get("x-api-key"), deviceId: deviceId, messageId: messageId, fingerprint: fingerprint, events: events})
+}
+
+// sendLineProtocol accepts the writes of Telegraf and other InfluxDB clients, publishing
+// each line as a JSON event with its measurement, tags, fields and time. All lines of a
+// write belong to one device, named in the path or in the DeviceTag tag.
+func (h *Handler) sendLineProtocol(w http.ResponseWriter, r *http.Request) {
+	receivedAt := time.Now().UTC()
+
+	apiKey := influxAPIKey(r)
+	if apiKey == "" {
+		h.logger.WarnContext(r.Context(), "no api key in request")
+		http.Error(w, "Provide api key as a token, a password or in 'x-api-key' header", http.StatusUnauthorized)
 		return
 	}
 
-	dbCtx := context.Background()
-	apiKey, err := h.store.GetApiKey(dbCtx, apiKeyString)
+	precision := r.URL.Query().Get("precision")
+	unit, err := lineprotocol.ParsePrecision(precision)
 	if err != nil {
-		log.Println("db get api key", err)
+		h.logger.WarnContext(r.Context(), "invalid precision", "precision", precision)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	data, err := httpserver.ReadBody(r)
+	if err != nil {
+		h.logger.WarnContext(r.Context(), "invalid request body", "err", err)
+		httpserver.WriteBodyError(w, err)
+		return
+	}
+	points, err := lineprotocol.Parse(data, unit)
+	if err != nil {
+		h.logger.WarnContext(r.Context(), "invalid line protocol", "err", err)
+		http.Error(w, fmt.Sprintf("Invalid line protocol: %s", err), http.StatusBadRequest)
+		return
+	}
+	if h.opts.MaxLines > 0 && len(points) > h.opts.MaxLines {
+		// Telegraf splits the batch and retries on 413
+		h.logger.WarnContext(r.Context(), "line protocol write over limits", "lines", len(points))
+		http.Error(w, fmt.Sprintf("Write has more than %d lines", h.opts.MaxLines), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	deviceId := mux.Vars(r)["deviceId"]
+	events := make([]*event, len(points))
+	for i, p := range points {
+		if tag, ok := p.Tags[h.opts.DeviceTag]; ok {
+			if deviceId == "" {
+				deviceId = tag
+			}
+			if tag != deviceId {
+				h.logger.WarnContext(r.Context(), "line protocol write for several devices", "line", i+1)
+				http.Error(w, fmt.Sprintf("line %d: %s tag %q is not the device %q of the write, send each device's lines separately", i+1, h.opts.DeviceTag, tag, deviceId), http.StatusBadRequest)
+				return
+			}
+			delete(p.Tags, h.opts.DeviceTag)
+			if len(p.Tags) == 0 {
+				p.Tags = nil
+			}
+		}
+
+		ev := &event{contentType: payload.JSON, part: strconv.Itoa(i)}
+		if p.Time != nil {
+			if err := h.checkSkew(*p.Time, receivedAt); err != nil {
+				h.logger.WarnContext(r.Context(), "device timestamp out of bounds", "line", i+1, "timestamp", *p.Time, "err", err)
+				http.Error(w, fmt.Sprintf("line %d: %s", i+1, err), http.StatusBadRequest)
+				return
+			}
+			ev.timestamp = p.Time
+		} else {
+			// like InfluxDB, lines without a timestamp take the server's time
+			p.Time = &receivedAt
+		}
+		ev.data, err = json.Marshal(p)
+		if err != nil {
+			// parsed fields are finite numbers, strings and booleans
+			h.logger.ErrorContext(r.Context(), "encode line protocol point", "err", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		if !h.checkPayload(w, r, ev, nil) {
+			return
+		}
+		events[i] = ev
+	}
+
+	if deviceId == "" {
+		h.logger.WarnContext(r.Context(), "no device id in request")
+		http.Error(w, fmt.Sprintf("Provide the device ID in the path or the %s tag", h.opts.DeviceTag), http.StatusBadRequest)
+		return
+	}
+	logging.SetDeviceID(r.Context(), deviceId)
+	for _, ev := range events {
+		ev.deviceId = deviceId
+	}
+
+	messageId, err := messageID(r, "")
+	if err != nil {
+		h.logger.WarnContext(r.Context(), "invalid message id", "err", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var fingerprint string
+	if messageId != "" {
+		fingerprint = idempotency.Fingerprint([]byte(unit.String()), data)
+	}
+
+	h.ingest(w, r, receivedAt, &batch{apiKey: apiKey, deviceId: deviceId, messageId: messageId, fingerprint: fingerprint, events: events, response: &response{status: http.StatusNoContent}})
+}
+
+// sendOTLPMetrics accepts OTLP/HTTP metrics exports from OpenTelemetry Collectors and SDKs,
+// publishing each data point of their gauges, sums and histograms as a JSON event. All
+// resources of an export belong to one device, named in their device.id attribute. Data
+// points that cannot be flattened are reported as rejected in a partial success.
+func (h *Handler) sendOTLPMetrics(w http.ResponseWriter, r *http.Request) {
+	receivedAt := time.Now().UTC()
+
+	ct, err := contentType(r)
+	if err != nil {
+		h.logger.WarnContext(r.Context(), "malformed content type", "err", err)
+		httpserver.WriteBodyError(w, err)
+		return
+	}
+	if !otlp.Supported(ct) {
+		h.logger.WarnContext(r.Context(), "unsupported otlp content type", "content_type", ct)
+		http.Error(w, fmt.Sprintf("Unsupported Content-Type %q, send %s or %s", ct, otlp.Protobuf, otlp.JSON), http.StatusUnsupportedMediaType)
+		return
+	}
+	data, err := httpserver.ReadBody(r)
+	if err != nil {
+		h.logger.WarnContext(r.Context(), "invalid request body", "err", err)
+		httpserver.WriteBodyError(w, err)
+		return
+	}
+	metrics, err := otlp.Parse(ct, data)
+	if err != nil {
+		h.logger.WarnContext(r.Context(), "invalid otlp export", "content_type", ct, "err", err)
+		http.Error(w, fmt.Sprintf("Invalid OTLP export: %s", err), http.StatusBadRequest)
+		return
+	}
+	if total := int64(len(metrics.Points)) + metrics.Rejected; h.opts.MaxDataPoints > 0 && total > int64(h.opts.MaxDataPoints) {
+		h.logger.WarnContext(r.Context(), "otlp export over limits", "data_points", total)
+		http.Error(w, fmt.Sprintf("Export has more than %d data points", h.opts.MaxDataPoints), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if len(metrics.Points) == 0 {
+		h.logger.WarnContext(r.Context(), "otlp export without supported data points", "reason", metrics.Reason)
+		http.Error(w, fmt.Sprintf("No data point could be accepted: %s", metrics.Reason), http.StatusBadRequest)
+		return
+	}
+
+	deviceId := metrics.Points[0].DeviceID
+	events := make([]*event, len(metrics.Points))
+	for i, p := range metrics.Points {
+		if p.DeviceID == "" {
+			h.logger.WarnContext(r.Context(), "no device id in request")
+			http.Error(w, fmt.Sprintf("Provide the device ID in the %s resource attribute", otlp.DeviceAttribute), http.StatusBadRequest)
+			return
+		}
+		if p.DeviceID != deviceId {
+			h.logger.WarnContext(r.Context(), "otlp export for several devices")
+			http.Error(w, fmt.Sprintf("%s %q is not the device %q of the export, send each device's metrics separately", otlp.DeviceAttribute, p.DeviceID, deviceId), http.StatusBadRequest)
+			return
+		}
+
+		ev := &event{contentType: payload.JSON, deviceId: deviceId, part: strconv.Itoa(i)}
+		if p.Time != nil {
+			if err := h.checkSkew(*p.Time, receivedAt); err != nil {
+				h.logger.WarnContext(r.Context(), "device timestamp out of bounds", "name", p.Name, "timestamp", *p.Time, "err", err)
+				http.Error(w, fmt.Sprintf("%s: %s", p.Name, err), http.StatusBadRequest)
+				return
+			}
+			ev.timestamp = p.Time
+		} else {
+			p.Time = &receivedAt
+		}
+		ev.data, err = json.Marshal(p)
+		if err != nil {
+			// flattened points hold finite numbers, strings, booleans and their arrays and maps
+			h.logger.ErrorContext(r.Context(), "encode otlp data point", "err", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		if !h.checkPayload(w, r, ev, nil) {
+			return
+		}
+		events[i] = ev
+	}
+	logging.SetDeviceID(r.Context(), deviceId)
+
+	body, err := otlp.Response(ct, metrics.Rejected, metrics.Reason)
+	if err != nil {
+		// the content type was checked above
+		h.logger.ErrorContext(r.Context(), "encode otlp response", "err", err)
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
+	if metrics.Rejected > 0 {
+		h.logger.WarnContext(r.Context(), "otlp data points rejected", "rejected", metrics.Rejected, "reason", metrics.Reason)
+	}
+
+	messageId, err := messageID(r, "")
+	if err != nil {
+		h.logger.WarnContext(r.Context(), "invalid message id", "err", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var fingerprint string
+	if messageId != "" {
+		fingerprint = idempotency.Fingerprint([]byte(ct), data)
+	}
+
+	h.ingest(w, r, receivedAt, &batch{apiKey: r.Header.Get("x-api-key"), deviceId: deviceId, messageId: messageId, fingerprint: fingerprint, events: events, response: &response{status: http.StatusOK, contentType: ct, body: body}})
+}
+
+// batch is the messages a request sends for a device.
+type batch struct {
+	apiKey   string
+	deviceId string
+	// messageId is the client's ID for the request, empty if it sent none
+	messageId string
+	// fingerprint identifies the request's content among retries with the same ID
+	fingerprint string
+	events      []*event
+	// response replaces the 202 response for protocols that define their own, nil otherwise
+	response *response
+}
+
+// response is the success response of a batch.
+type response struct {
+	status      int
+	contentType string
+	// body is empty for responses without content
+	body []byte
+}
+
+// ingest checks the API key owns the device, applies the rate limits, deduplication and
+// quota, and publishes the messages of a request to the device's stream, responding 202,
+// or with the batch's own response, once they are all sent.
+// Params:
+// - w: http.ResponseWriter - the HTTP response writer
+// - r: *http.Request - the HTTP request
+// - receivedAt: time.Time - when the request was received, in UTC
+// - b: *batch - the messages to publish
+// Returns: None
+func (h *Handler) ingest(w http.ResponseWriter, r *http.Request, receivedAt time.Time, b *batch) {
+	apiKeyString := b.apiKey
+	if apiKeyString == "" {
+		h.logger.WarnContext(r.Context(), "no api key in header")
+		http.Error(w, "Provide api key in 'x-api-key' header", http.StatusBadRequest)
+		return
+	}
+	keyID := apiKeyID(apiKeyString)
 
-	device, err := h.store.GetDeviceByDeviceId(dbCtx, deviceId)
+	// checked before the database so a flood of requests does not reach it
+	if !h.takeToken(w, r, limitAPIKey, "key/"+keyID, h.opts.KeyLimit) {
+		return
+	}
+
+	// gRPC calls resolve their key once, when they are authenticated
+	apiKey, ok := r.Context().Value(apiKeyContextKey{}).(*models.ApiKey)
+	if !ok || apiKey.APIKey != apiKeyString {
+		if apiKey = h.resolveAPIKey(w, r, apiKeyString); apiKey == nil {
+			return
+		}
+	}
+
+	device, err := h.store.GetDeviceByDeviceId(r.Context(), b.deviceId)
+	if errors.Is(err, pgx.ErrNoRows) {
+		// unattended agents retry server errors, a misconfigured device ID would never stop
+		h.logger.WarnContext(r.Context(), "unknown device")
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return
+	}
 	if err != nil {
-		log.Println("db get device", err)
+		h.logger.ErrorContext(r.Context(), "db get device", "err", err)
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
 
+	logging.SetUserID(r.Context(), apiKey.UserID)
+
 	if apiKey.UserID != device.UserID {
-		log.Println("api key & device userId missmatch")
+		h.logger.WarnContext(r.Context(), "api key & device userId mismatch")
 		http.Error(w, "API key provided does not have permission to send data from this device", http.StatusUnauthorized)
 		return
 	}
 
-	err = h.kafka.SendTelemetry(eventData.Data, device.TopicName, device.DeviceID)
+	if !h.takeToken(w, r, limitDevice, "device/"+device.DeviceID, h.opts.DeviceLimit) {
+		return
+	}
+
+	var desc protoreflect.MessageDescriptor
+	for _, ev := range b.events {
+		if ev.contentType != payload.Protobuf {
+			continue
+		}
+		if desc == nil {
+			if desc = h.deviceSchema(w, r, device.DeviceID); desc == nil {
+				return
+			}
+		}
+		if !h.checkPayload(w, r, ev, desc) {
+			return
+		}
+	}
+
+	// reserved is the idempotency key claimed for this request, released if it is not sent
+	var reserved string
+	// resumed is set when a retry resumes a request interrupted after sent of its messages
+	var resumed bool
+	var sent int
+	if b.messageId != "" && h.opts.Idempotency != nil {
+		key := device.DeviceID + "/" + b.messageId
+		rec, claimed, err := h.opts.Idempotency.Reserve(r.Context(), key, b.fingerprint, pendingTTL)
+		switch {
+		case err != nil:
+			// a duplicate reading is better than a lost one
+			h.logger.ErrorContext(r.Context(), "idempotency store failed, sending without deduplication", "err", err)
+		case claimed:
+			reserved = key
+			if rec.Interrupted() {
+				resumed, sent = true, min(rec.Sent, len(b.events))
+				h.logger.InfoContext(r.Context(), "resuming an interrupted message", "message_id", b.messageId, "sent", sent)
+			}
+		case rec.Fingerprint != b.fingerprint:
+			h.logger.WarnContext(r.Context(), "message id reused for another message", "message_id", b.messageId)
+			http.Error(w, "messageId was already used for a different message", http.StatusUnprocessableEntity)
+			return
+		case rec.Pending():
+			h.logger.InfoContext(r.Context(), "duplicate of a message being sent", "message_id", b.messageId)
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "A message with this messageId is being sent, retry later", http.StatusConflict)
+			return
+		default:
+			h.logger.InfoContext(r.Context(), "duplicate message, replaying response", "message_id", b.messageId)
+			w.Header().Set(replayedHeader, "true")
+			if b.response != nil {
+				// the response of a batch follows from its content, which the fingerprint matched
+				writeResponse(w, b.response)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(rec.StatusCode)
+			w.Write(rec.Body)
+			return
+		}
+	}
+
+	// counted after deduplication so retries of a sent message are free, and a resumed
+	// message was counted in full by the request it resumes
+	var size int64
+	for _, ev := range b.events {
+		size += int64(len(ev.data))
+	}
+	if h.opts.Quotas && !resumed && !h.useQuota(w, r, apiKey.UserID, int64(len(b.events)), size, receivedAt) {
+		h.release(r, reserved)
+		return
+	}
+
+	for i := sent; i < len(b.events); i++ {
+		ev := b.events[i]
+		headers := map[string]string{
+			broker.ReceivedAtHeader:    receivedAt.Format(time.RFC3339Nano),
+			broker.APIKeyIDHeader:      keyID,
+			broker.SourceIPHeader:      httpserver.ClientIP(r, h.opts.TrustedProxies),
+			broker.ContentTypeHeader:   ev.contentType,
+			broker.SchemaVersionHeader: schemaVersion,
+		}
+		if ev.timestamp != nil {
+			headers[broker.EventTimeHeader] = ev.timestamp.UTC().Format(time.RFC3339Nano)
+		}
+		if requestID := logging.RequestID(r.Context()); requestID != "" {
+			headers[broker.RequestIDHeader] = requestID
+		}
+		if b.messageId != "" {
+			// each message of a request needs its own ID for brokers that deduplicate
+			headers[broker.MessageIDHeader] = b.messageId
+			if ev.part != "" {
+				headers[broker.MessageIDHeader] += "/" + ev.part
+			}
+		}
+
+		_, err = h.broker.Publish(r.Context(), device.TopicName, broker.Message{
+			Key:       device.DeviceID,
+			Value:     ev.data,
+			Headers:   headers,
+			Timestamp: receivedAt,
+		})
+		if errors.Is(err, wal.ErrFull) {
+			// the broker is down and the log buffering for it is full; it drains once the
+			// broker is back
+			h.logger.ErrorContext(r.Context(), "telemetry buffer full", "stream", device.TopicName, "sent", i, "err", err)
+			h.interrupt(r, reserved, idempotency.Record{Fingerprint: b.fingerprint, StatusCode: http.StatusServiceUnavailable, Sent: i})
+			w.Header().Set("Retry-After", walFullRetryAfter)
+			http.Error(w, "Service Unavailable, retry later", http.StatusServiceUnavailable)
+			return
+		}
+		if err != nil {
+			h.logger.ErrorContext(r.Context(), "failed to send telemetry", "stream", device.TopicName, "sent", i, "err", err)
+			h.interrupt(r, reserved, idempotency.Record{Fingerprint: b.fingerprint, StatusCode: http.StatusInternalServerError, Sent: i})
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	resp := b.response
+	if resp == nil {
+		body, _ := json.Marshal(map[string]interface{}{
+			"message": "Telemetry Sent",
+		})
+		resp = &response{status: http.StatusAccepted, contentType: "application/json", body: append(body, '\n')}
+	}
+	if reserved != "" {
+		rec := idempotency.Record{Fingerprint: b.fingerprint, StatusCode: resp.status}
+		if b.response == nil {
+			rec.Body = resp.body
+		}
+		if err := h.opts.Idempotency.Complete(r.Context(), reserved, rec, h.opts.IdempotencyWindow); err != nil {
+			h.logger.ErrorContext(r.Context(), "failed to save message id", "err", err)
+		}
+	}
+
+	writeResponse(w, resp)
+}
+
+// writeResponse writes the success response of a batch.
+func writeResponse(w http.ResponseWriter, resp *response) {
+	if len(resp.body) > 0 {
+		w.Header().Add("Content-Type", resp.contentType)
+	}
+	w.WriteHeader(resp.status)
+	w.Write(resp.body)
+}
+
+// event is a message read from a request, in any of the accepted payload formats.
+type event struct {
+	contentType string
+	deviceId    string
+	// data is the payload as sent
+	data      []byte
+	timestamp *time.Time
+	// messageId is the messageId field of a JSON request
+	messageId string
+	// part tells apart the events of a request sharing its message ID, empty for one event
+	part string
+}
+
+// readEvent reads a message from a request. JSON requests carry the payload in an
+// envelope; binary payloads are the whole body, with the device ID and timestamp in
+// headers.
+// Params:
+// - r: *http.Request - the HTTP request
+// Returns:
+// - *event: the message
+// - error: a *httpserver.BodyError if the request is rejected
+func readEvent(r *http.Request) (*event, error) {
+	ct, err := contentType(r)
+	if err != nil {
+		return nil, err
+	}
+	if !payload.Supported(ct) {
+		return nil, &httpserver.BodyError{
+			Status: http.StatusUnsupportedMediaType,
+			Msg:    fmt.Sprintf("Unsupported Content-Type %q, send %s, %s, %s or %s", ct, payload.JSON, payload.CBOR, payload.MsgPack, payload.Protobuf),
+		}
+	}
+
+	if ct == payload.JSON {
+		var eventData SendEventRequestBody
+		if err := httpserver.DecodeJSON(r, &eventData); err != nil {
+			return nil, err
+		}
+		return &event{
+			contentType: ct,
+			deviceId:    eventData.DeviceID,
+			data:        eventData.Data,
+			timestamp:   eventData.Timestamp,
+			messageId:   eventData.MessageID,
+		}, nil
+	}
+
+	data, err := httpserver.ReadBody(r)
+	if err != nil {
+		return nil, err
+	}
+	ev := &event{contentType: ct, deviceId: r.Header.Get(deviceIDHeader), data: data}
+	if value := r.Header.Get(eventTimeHeader); value != "" {
+		timestamp, err := time.Parse(time.RFC3339Nano, value)
+		if err != nil {
+			return nil, &httpserver.BodyError{Status: http.StatusBadRequest, Msg: fmt.Sprintf("%s header must be an RFC 3339 time", eventTimeHeader), Err: err}
+		}
+		ev.timestamp = &timestamp
+	}
+	return ev, nil
+}
+
+// resolveAPIKey looks up an API key, responding 401 if it is unknown. HTTP requests and
+// gRPC calls both check their key with it.
+// Params:
+// - w: http.ResponseWriter - the HTTP response writer
+// - r: *http.Request - the HTTP request
+// - key: string - the API key sent by the client
+// Returns:
+// - *models.ApiKey: the API key, nil if an error response was written
+func (h *Handler) resolveAPIKey(w http.ResponseWriter, r *http.Request, key string) *models.ApiKey {
+	apiKey, err := h.store.GetApiKey(r.Context(), key)
+	if errors.Is(err, pgx.ErrNoRows) {
+		h.logger.WarnContext(r.Context(), "unknown api key", "api_key_id", apiKeyID(key))
+		http.Error(w, "Invalid API key", http.StatusUnauthorized)
+		return nil
+	}
 	if err != nil {
-		log.Println(err)
+		h.logger.ErrorContext(r.Context(), "db get api key", "err", err)
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return nil
+	}
+	return apiKey
+}
+
+// checkPayload checks that a payload is well formed and within the depth and key limits,
+// responding 400 if not. Binary payloads are checked on their JSON form.
+// Params:
+// - w: http.ResponseWriter - the HTTP response writer
+// - r: *http.Request - the HTTP request
+// - ev: *event - the message
+// - desc: protoreflect.MessageDescriptor - the message type of Protobuf payloads, nil otherwise
+// Returns:
+// - bool: true if the request may continue
+func (h *Handler) checkPayload(w http.ResponseWriter, r *http.Request, ev *event, desc protoreflect.MessageDescriptor) bool {
+	data, err := payload.ToJSON(ev.contentType, ev.data, desc)
+	if err != nil {
+		h.logger.WarnContext(r.Context(), "invalid payload", "content_type", ev.contentType, "err", err)
+		http.Error(w, fmt.Sprintf("Invalid payload: %s", err), http.StatusBadRequest)
+		return false
+	}
+	if err := httpserver.CheckJSONLimits(data, h.opts.MaxDepth, h.opts.MaxKeys); err != nil {
+		h.logger.WarnContext(r.Context(), "payload over limits", "err", err)
+		httpserver.WriteBodyError(w, err)
+		return false
+	}
+	return true
+}
+
+// deviceSchema returns the Protobuf message type registered for a device, responding 415
+// if it has none.
+// Params:
+// - w: http.ResponseWriter - the HTTP response writer
+// - r: *http.Request - the HTTP request
+// - deviceId: string - the device ID
+// Returns:
+// - protoreflect.MessageDescriptor: the message type, nil if an error response was written
+func (h *Handler) deviceSchema(w http.ResponseWriter, r *http.Request, deviceId string) protoreflect.MessageDescriptor {
+	schema, err := h.store.GetDeviceSchema(r.Context(), deviceId)
+	if errors.Is(err, pgx.ErrNoRows) {
+		h.logger.WarnContext(r.Context(), "protobuf payload from a device without a schema")
+		http.Error(w, fmt.Sprintf("Register a Protobuf schema for this device to send %s", payload.Protobuf), http.StatusUnsupportedMediaType)
+		return nil
+	}
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "db get device schema", "err", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return nil
+	}
+
+	desc, err := payload.ParseSchema(schema.DescriptorSet, schema.MessageType)
+	if err != nil {
+		// schemas are checked when they are registered
+		h.logger.ErrorContext(r.Context(), "invalid stored schema", "err", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return nil
+	}
+	return desc
+}
+
+// release frees a reserved message ID so the message can be retried.
+// Params:
+// - r: *http.Request - the HTTP request
+// - reserved: string - the reserved idempotency key, or an empty string for none
+// Returns: None
+func (h *Handler) release(r *http.Request, reserved string) {
+	if reserved == "" {
 		return
 	}
+	if err := h.opts.Idempotency.Release(r.Context(), reserved); err != nil {
+		h.logger.ErrorContext(r.Context(), "failed to release message id", "err", err)
+	}
+}
 
-	w.Header().Add("Content-Type", "application/json")
-	w.WriteHeader(http.StatusAccepted)
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"message": "Telemetry Sent",
-	})
+// interrupt records how many messages of a request were sent before it failed, so a
+// retry with the same message ID claims it again and only sends the rest.
+// Params:
+// - r: *http.Request - the HTTP request
+// - reserved: string - the reserved idempotency key, or an empty string for none
+// - rec: idempotency.Record - the interrupted record
+// Returns: None
+func (h *Handler) interrupt(r *http.Request, reserved string, rec idempotency.Record) {
+	if reserved == "" {
+		return
+	}
+	if err := h.opts.Idempotency.Complete(r.Context(), reserved, rec, h.opts.IdempotencyWindow); err != nil {
+		h.logger.ErrorContext(r.Context(), "failed to save the progress of a message id", "err", err)
+	}
+}
+
+// takeToken takes a token from a rate limit bucket, responding 429 if there is none.
+// Params:
+// - w: http.ResponseWriter - the HTTP response writer
+// - r: *http.Request - the HTTP request
+// - limit: string - the name of the limit
+// - key: string - the bucket key
+// - l: ratelimit.Limit - the bucket's limit
+// Returns:
+// - bool: true if the request may continue
+func (h *Handler) takeToken(w http.ResponseWriter, r *http.Request, limit string, key string, l ratelimit.Limit) bool {
+	if h.opts.RateLimits == nil || !l.Enabled() {
+		return true
+	}
+	wait, err := h.opts.RateLimits.Take(r.Context(), key, l)
+	if err != nil {
+		// an outage of the shared store should not stop ingestion
+		h.logger.ErrorContext(r.Context(), "rate limit store failed, not limiting", "limit", limit, "err", err)
+		return true
+	}
+	if wait > 0 {
+		h.limited(w, r, limit, wait, "Rate limit exceeded, retry later")
+		return false
+	}
+	return true
+}
+
+// useQuota counts the messages of a request against its user's daily quota, responding
+// 429 if it is used up.
+// Params:
+// - w: http.ResponseWriter - the HTTP response writer
+// - r: *http.Request - the HTTP request
+// - userId: string - the user sending the messages
+// - messages: int64 - the number of messages
+// - bytes: int64 - the total payload size
+// - receivedAt: time.Time - when the request was received, in UTC
+// Returns:
+// - bool: true if the request may continue
+func (h *Handler) useQuota(w http.ResponseWriter, r *http.Request, userId string, messages int64, bytes int64, receivedAt time.Time) bool {
+	quota, err := h.store.GetQuota(r.Context(), userId, h.opts.DefaultQuota)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "db get quota, not enforcing it", "err", err)
+		return true
+	}
+	ok, err := h.store.AddUsage(r.Context(), userId, receivedAt.Format(time.DateOnly), messages, bytes, quota)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "db add usage, not enforcing quota", "err", err)
+		return true
+	}
+	if !ok {
+		midnight := receivedAt.Truncate(24 * time.Hour).Add(24 * time.Hour)
+		h.limited(w, r, limitQuota, midnight.Sub(receivedAt), "Daily quota exceeded")
+		return false
+	}
+	return true
+}
+
+// limited responds 429 with a Retry-After header and counts the refused message.
+// Params:
+// - w: http.ResponseWriter - the HTTP response writer
+// - r: *http.Request - the HTTP request
+// - limit: string - the name of the exceeded limit
+// - wait: time.Duration - how long until the client may retry
+// - msg: string - the error message
+// Returns: None
+func (h *Handler) limited(w http.ResponseWriter, r *http.Request, limit string, wait time.Duration, msg string) {
+	h.logger.WarnContext(r.Context(), "telemetry limited", "limit", limit, "retry_after", wait)
+	if h.opts.RateLimited != nil {
+		h.opts.RateLimited.WithLabelValues(limit).Inc()
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	http.Error(w, msg, http.StatusTooManyRequests)
+}
+
+// checkSkew rejects device timestamps too far from the time the platform received them.
+// Params:
+// - eventTime: time.Time - the device timestamp
+// - receivedAt: time.Time - when the request was received
+// Returns:
+// - error: error describing the violated bound, nil if within bounds
+func (h *Handler) checkSkew(eventTime time.Time, receivedAt time.Time) error {
+	if h.opts.MaxFutureSkew > 0 && eventTime.Sub(receivedAt) > h.opts.MaxFutureSkew {
+		return fmt.Errorf("timestamp is more than %s ahead of the server clock", h.opts.MaxFutureSkew)
+	}
+	if h.opts.MaxEventAge > 0 && receivedAt.Sub(eventTime) > h.opts.MaxEventAge {
+		return fmt.Errorf("timestamp is more than %s old", h.opts.MaxEventAge)
+	}
+	return nil
+}
+
+// messageID returns the client's ID for a message, from the Idempotency-Key header or the
+// messageId field, or an empty string if it sent none.
+// Params:
+// - r: *http.Request - the HTTP request
+// - field: string - the messageId field of the request body
+// Returns:
+// - string: the message ID
+// - error: error if the header and field differ or the ID is too long
+func messageID(r *http.Request, field string) (string, error) {
+	id := r.Header.Get(idempotencyKeyHeader)
+	if id != "" && field != "" && id != field {
+		return "", fmt.Errorf("%s header and messageId differ", idempotencyKeyHeader)
+	}
+	if id == "" {
+		id = field
+	}
+	if len(id) > maxMessageIDLength {
+		return "", fmt.Errorf("messageId is longer than %d characters", maxMessageIDLength)
+	}
+	return id, nil
+}
+
+// influxAPIKey returns the API key of a line protocol write, from the x-api-key header, an
+// InfluxDB 2.x token, the password of InfluxDB 1.x basic auth or the p query parameter, in
+// that order, or an empty string if it has none.
+// Params:
+// - r: *http.Request - the HTTP request
+// Returns:
+// - string: the API key
+func influxAPIKey(r *http.Request) string {
+	if key := r.Header.Get("x-api-key"); key != "" {
+		return key
+	}
+	if scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " "); ok && (strings.EqualFold(scheme, "Token") || strings.EqualFold(scheme, "Bearer")) {
+		return strings.TrimSpace(token)
+	}
+	if _, password, ok := r.BasicAuth(); ok {
+		return password
+	}
+	return r.URL.Query().Get("p")
+}
+
+// apiKeyID derives a stable identifier for an API key that does not reveal the key.
+func apiKeyID(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:8])
+}
+
+// contentType returns the media type of the request body, without parameters, or
+// defaultContentType without a Content-Type header.
+// Params:
+// - r: *http.Request - the HTTP request
+// Returns:
+// - string: the media type
+// - error: a *httpserver.BodyError with status 415 if the header is malformed
+func contentType(r *http.Request) (string, error) {
+	header := r.Header.Get("Content-Type")
+	if header == "" {
+		return defaultContentType, nil
+	}
+	mediaType, _, err := mime.ParseMediaType(header)
+	if err != nil {
+		return "", &httpserver.BodyError{
+			Status: http.StatusUnsupportedMediaType,
+			Msg:    fmt.Sprintf("Malformed Content-Type %q: %s", header, err),
+			Err:    err,
+		}
+	}
+	return mediaType, nil
 }
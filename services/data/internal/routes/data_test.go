@@ -1,21 +1,1074 @@
 package routes
 
-import "testing"
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/RaghibA/iot-telemetry/pkg/broker"
+	"github.com/RaghibA/iot-telemetry/pkg/httpserver"
+	"github.com/RaghibA/iot-telemetry/pkg/models"
+	"github.com/RaghibA/iot-telemetry/pkg/payload"
+	"github.com/RaghibA/iot-telemetry/pkg/senml"
+	"github.com/RaghibA/iot-telemetry/services/data/internal/idempotency"
+	"github.com/RaghibA/iot-telemetry/services/data/internal/ratelimit"
+	"github.com/RaghibA/iot-telemetry/services/data/internal/store"
+	"github.com/RaghibA/iot-telemetry/services/data/internal/wal"
+	"github.com/fxamacker/cbor/v2"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/vmihailenco/msgpack/v5"
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+var testLogger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// newTestRouter serves the data routes backed by a mock store holding device1, owned by
+// "1234user", and API keys for that user and another one.
+func newTestRouter() (*mux.Router, *broker.MockBroker) {
+	router, mb, _ := newIdempotentTestRouter()
+	return router, mb
+}
+
+// newTestStore creates the mock store of newTestRouter.
+func newTestStore() *store.MockStore {
+	dataStore := store.NewMockStore()
+	dataStore.ApiKeys["key1"] = &models.ApiKey{UserID: "1234user", APIKey: "key1"}
+	dataStore.ApiKeys["key2"] = &models.ApiKey{UserID: "5678user", APIKey: "key2"}
+	dataStore.Devices["device1"] = &models.Device{DeviceID: "device1", UserID: "1234user", TopicName: "stream1"}
+	dataStore.Devices["device2"] = &models.Device{DeviceID: "device2", UserID: "1234user", TopicName: "stream2"}
+	return dataStore
+}
+
+// newIdempotentTestRouter is newTestRouter, also returning the idempotency store.
+func newIdempotentTestRouter() (*mux.Router, *broker.MockBroker, *idempotency.Memory) {
+	dataStore := newTestStore()
+	mb := broker.NewMockBroker()
+	idempotencyStore := idempotency.NewMemory(100)
+
+	handler := NewDataHandler(dataStore, testLogger, mb, Options{
+		MaxFutureSkew:     time.Minute,
+		MaxEventAge:       time.Hour,
+		MaxDepth:          4,
+		MaxKeys:           8,
+		TrustedProxies:    []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+		Idempotency:       idempotencyStore,
+		IdempotencyWindow: time.Hour,
+	})
+	router := mux.NewRouter()
+	handler.DataRoutes(router)
+	return router, mb, idempotencyStore
+}
+
+// newLimitedTestRouter is newTestRouter with the given limits.
+func newLimitedTestRouter(opts Options) (*mux.Router, *broker.MockBroker, *store.MockStore) {
+	dataStore := newTestStore()
+	mb := broker.NewMockBroker()
+	opts.RateLimits = ratelimit.NewMemory()
+
+	router := mux.NewRouter()
+	NewDataHandler(dataStore, testLogger, mb, opts).DataRoutes(router)
+	return router, mb, dataStore
+}
+
+func sendEvent(router *mux.Router, apiKey string, body string) *httptest.ResponseRecorder {
+	return sendEventWithKey(router, apiKey, "", body)
+}
+
+func sendEventWithKey(router *mux.Router, apiKey string, idempotencyKey string, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/event", bytes.NewBufferString(body))
+	if idempotencyKey != "" {
+		req.Header.Set("Idempotency-Key", idempotencyKey)
+	}
+	req.RemoteAddr = "10.0.0.2:4000"
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	req.Header.Set("X-Forwarded-For", "203.0.113.9")
+	if apiKey != "" {
+		req.Header.Set("x-api-key", apiKey)
+	}
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	return rr
+}
 
 func TestSendTelemetryHandler(t *testing.T) {
-	t.Run("should return 401 if api key is not provided", func(t *testing.T) {
+	t.Run("should return 400 if api key is not provided", func(t *testing.T) {
+		router, _ := newTestRouter()
+		rr := sendEvent(router, "", `{"deviceId":"device1","data":{"temp":1}}`)
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", rr.Code)
+		}
+	})
 
+	t.Run("should return 401 for an unknown api key", func(t *testing.T) {
+		router, mb := newTestRouter()
+		rr := sendEvent(router, "unknown", `{"deviceId":"device1","data":{"temp":1}}`)
+		if rr.Code != http.StatusUnauthorized {
+			t.Errorf("expected status 401, got %d", rr.Code)
+		}
+		if _, ok := mb.Messages["stream1"]; ok {
+			t.Error("expected nothing to be published")
+		}
 	})
 
 	t.Run("should return 401 if api key uid does not match device uid", func(t *testing.T) {
-
+		router, mb := newTestRouter()
+		rr := sendEvent(router, "key2", `{"deviceId":"device1","data":{"temp":1}}`)
+		if rr.Code != http.StatusUnauthorized {
+			t.Errorf("expected status 401, got %d", rr.Code)
+		}
+		if _, ok := mb.Messages["stream1"]; ok {
+			t.Error("expected nothing to be published")
+		}
 	})
 
 	t.Run("should return 400 if device id is null", func(t *testing.T) {
+		router, _ := newTestRouter()
+		rr := sendEvent(router, "key1", `{"data":{"temp":1}}`)
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", rr.Code)
+		}
+	})
 
+	t.Run("should return 400 for unknown fields", func(t *testing.T) {
+		router, _ := newTestRouter()
+		rr := sendEvent(router, "key1", `{"deviceId":"device1","data":{"temp":1},"topic":"other"}`)
+		if rr.Code != http.StatusBadRequest || !strings.Contains(rr.Body.String(), `unknown field "topic"`) {
+			t.Errorf("expected status 400 naming the field, got %d %s", rr.Code, rr.Body)
+		}
+	})
+
+	t.Run("should return 400 if the payload is over the json limits", func(t *testing.T) {
+		router, mb := newTestRouter()
+		for _, data := range []string{`[[[[[1]]]]]`, `{"a":1,"b":2,"c":3,"d":4,"e":5,"f":6,"g":7,"h":8,"i":9}`} {
+			rr := sendEvent(router, "key1", `{"deviceId":"device1","data":`+data+`}`)
+			if rr.Code != http.StatusBadRequest {
+				t.Errorf("expected status 400 for %s, got %d", data, rr.Code)
+			}
+		}
+		if _, ok := mb.Messages["stream1"]; ok {
+			t.Error("expected nothing to be published")
+		}
 	})
 
 	t.Run("should send telemetry", func(t *testing.T) {
+		router, mb := newTestRouter()
+		before := time.Now()
+		rr := sendEvent(router, "key1", `{"deviceId":"device1","data":{"temp":1}}`)
+		if rr.Code != http.StatusAccepted {
+			t.Fatalf("expected status 202, got %d", rr.Code)
+		}
+
+		msg := mb.Messages["stream1"]
+		if msg.Key != "device1" || string(msg.Value) != `{"temp":1}` {
+			t.Errorf("unexpected message %s: %s", msg.Key, msg.Value)
+		}
+		receivedAt, err := time.Parse(time.RFC3339Nano, msg.Headers[broker.ReceivedAtHeader])
+		if err != nil || receivedAt.Before(before.Add(-time.Second)) || !receivedAt.Equal(msg.Timestamp) {
+			t.Errorf("expected received_at to match the message timestamp, got %q and %s", msg.Headers[broker.ReceivedAtHeader], msg.Timestamp)
+		}
+		want := map[string]string{
+			broker.SourceIPHeader:      "203.0.113.9",
+			broker.ContentTypeHeader:   "application/json",
+			broker.SchemaVersionHeader: schemaVersion,
+			broker.APIKeyIDHeader:      apiKeyID("key1"),
+		}
+		for k, v := range want {
+			if msg.Headers[k] != v {
+				t.Errorf("expected header %s=%s, got %q", k, v, msg.Headers[k])
+			}
+		}
+		if strings.Contains(msg.Headers[broker.APIKeyIDHeader], "key1") {
+			t.Error("expected the api key id not to reveal the key")
+		}
+		if _, ok := msg.Headers[broker.EventTimeHeader]; ok {
+			t.Error("expected no event_time without a device timestamp")
+		}
+	})
+
+	t.Run("should attach the device timestamp", func(t *testing.T) {
+		router, mb := newTestRouter()
+		eventTime := time.Now().Add(-10 * time.Minute).In(time.FixedZone("CET", 3600)).Truncate(time.Millisecond)
+		rr := sendEvent(router, "key1", `{"deviceId":"device1","data":{"temp":1},"timestamp":"`+eventTime.Format(time.RFC3339Nano)+`"}`)
+		if rr.Code != http.StatusAccepted {
+			t.Fatalf("expected status 202, got %d", rr.Code)
+		}
+		if got, want := mb.Messages["stream1"].Headers[broker.EventTimeHeader], eventTime.UTC().Format(time.RFC3339Nano); got != want {
+			t.Errorf("expected event_time %s, got %s", want, got)
+		}
+	})
+
+	t.Run("should return 400 if the device timestamp is out of bounds", func(t *testing.T) {
+		router, mb := newTestRouter()
+		for _, eventTime := range []time.Time{time.Now().Add(2 * time.Minute), time.Now().Add(-2 * time.Hour)} {
+			rr := sendEvent(router, "key1", `{"deviceId":"device1","data":{"temp":1},"timestamp":"`+eventTime.Format(time.RFC3339)+`"}`)
+			if rr.Code != http.StatusBadRequest {
+				t.Errorf("expected status 400 for %s, got %d", eventTime, rr.Code)
+			}
+		}
+		if _, ok := mb.Messages["stream1"]; ok {
+			t.Error("expected nothing to be published")
+		}
+	})
+
+	t.Run("should return 503 with Retry-After once the write-ahead log is full", func(t *testing.T) {
+		log, err := wal.Open(t.TempDir(), wal.Options{SegmentBytes: 256, MaxBytes: 256})
+		if err != nil {
+			t.Fatal(err)
+		}
+		forwarder := wal.NewForwarder(&failingBroker{MockBroker: broker.NewMockBroker(), failAfter: 0}, log, testLogger, wal.ForwarderOptions{})
+		t.Cleanup(func() { forwarder.Stop() })
+		router := mux.NewRouter()
+		NewDataHandler(newTestStore(), testLogger, forwarder, Options{
+			Idempotency:       idempotency.NewMemory(100),
+			IdempotencyWindow: time.Hour,
+		}).DataRoutes(router)
+
+		var rr *httptest.ResponseRecorder
+		var key string
+		for i := 0; i < 10; i++ {
+			key = fmt.Sprintf("msg-%d", i)
+			if rr = sendEventWithKey(router, "key1", key, `{"deviceId":"device1","data":{"temp":1}}`); rr.Code != http.StatusAccepted {
+				break
+			}
+		}
+		if rr.Code != http.StatusServiceUnavailable || rr.Header().Get("Retry-After") != walFullRetryAfter {
+			t.Fatalf("expected status 503 with Retry-After, got %d: %s", rr.Code, rr.Body)
+		}
+		// the refused message is not left pending, so its retry is sent again
+		if rr = sendEventWithKey(router, "key1", key, `{"deviceId":"device1","data":{"temp":1}}`); rr.Code != http.StatusServiceUnavailable {
+			t.Errorf("expected the retry to be refused with 503 while the log is full, got %d", rr.Code)
+		}
+	})
+}
+
+func TestIdempotentTelemetry(t *testing.T) {
+	body := `{"deviceId":"device1","data":{"temp":1},"messageId":"m-1"}`
+
+	t.Run("should publish a retried message once and replay the response", func(t *testing.T) {
+		router, mb, _ := newIdempotentTestRouter()
+		first := sendEvent(router, "key1", body)
+		if first.Code != http.StatusAccepted {
+			t.Fatalf("expected status 202, got %d", first.Code)
+		}
+		if got := mb.Messages["stream1"].Headers[broker.MessageIDHeader]; got != "m-1" {
+			t.Errorf("expected message_id m-1, got %q", got)
+		}
+		delete(mb.Messages, "stream1")
+
+		retry := sendEventWithKey(router, "key1", "m-1", `{"deviceId":"device1","data":{"temp":1}}`)
+		if retry.Code != http.StatusAccepted || retry.Body.String() != first.Body.String() {
+			t.Errorf("expected the original response, got %d %s", retry.Code, retry.Body)
+		}
+		if retry.Header().Get("Idempotent-Replayed") != "true" {
+			t.Error("expected the response to be marked as replayed")
+		}
+		if _, ok := mb.Messages["stream1"]; ok {
+			t.Error("expected the retry not to be published")
+		}
+	})
+
+	t.Run("should return 422 if a message id is reused for another message", func(t *testing.T) {
+		router, _, _ := newIdempotentTestRouter()
+		sendEvent(router, "key1", body)
+		rr := sendEvent(router, "key1", `{"deviceId":"device1","data":{"temp":2},"messageId":"m-1"}`)
+		if rr.Code != http.StatusUnprocessableEntity {
+			t.Errorf("expected status 422, got %d", rr.Code)
+		}
+	})
+
+	t.Run("should return 409 while the first message is being sent", func(t *testing.T) {
+		router, _, idempotencyStore := newIdempotentTestRouter()
+		fingerprint := idempotency.Fingerprint([]byte(`{"temp":1}`), nil)
+		if _, _, err := idempotencyStore.Reserve(context.Background(), "device1/m-1", fingerprint, time.Minute); err != nil {
+			t.Fatal(err)
+		}
+		rr := sendEvent(router, "key1", body)
+		if rr.Code != http.StatusConflict || rr.Header().Get("Retry-After") == "" {
+			t.Errorf("expected status 409 with Retry-After, got %d", rr.Code)
+		}
+	})
+
+	t.Run("should accept a retry after a failed publish", func(t *testing.T) {
+		router, mb, _ := newIdempotentTestRouter()
+		mb.Err = errors.New("broker down")
+		if rr := sendEvent(router, "key1", body); rr.Code != http.StatusInternalServerError {
+			t.Fatalf("expected status 500, got %d", rr.Code)
+		}
+		mb.Err = nil
+		if rr := sendEvent(router, "key1", body); rr.Code != http.StatusAccepted {
+			t.Errorf("expected status 202, got %d", rr.Code)
+		}
+		if _, ok := mb.Messages["stream1"]; !ok {
+			t.Error("expected the retry to be published")
+		}
+	})
+
+	t.Run("should return 400 if the header and messageId differ", func(t *testing.T) {
+		router, _, _ := newIdempotentTestRouter()
+		rr := sendEventWithKey(router, "key1", "m-2", body)
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", rr.Code)
+		}
+	})
+}
+
+func TestLimits(t *testing.T) {
+	t.Run("should return 429 once an api key exceeds its rate", func(t *testing.T) {
+		opts := Options{KeyLimit: ratelimit.Limit{Rate: 0.001, Burst: 2}}
+		router, mb, _ := newLimitedTestRouter(opts)
+
+		sendEvent(router, "key1", `{"deviceId":"device1","data":{"temp":1}}`)
+		sendEvent(router, "key1", `{"deviceId":"device2","data":{"temp":2}}`)
+		rr := sendEvent(router, "key1", `{"deviceId":"device1","data":{"temp":3}}`)
+		if rr.Code != http.StatusTooManyRequests {
+			t.Fatalf("expected status 429, got %d", rr.Code)
+		}
+		if rr.Header().Get("Retry-After") != "1000" {
+			t.Errorf("expected Retry-After 1000, got %q", rr.Header().Get("Retry-After"))
+		}
+		if string(mb.Messages["stream1"].Value) != `{"temp":1}` {
+			t.Errorf("expected the limited message not to be published, got %s", mb.Messages["stream1"].Value)
+		}
+
+		if rr := sendEvent(router, "key2", `{"deviceId":"device1","data":{"temp":1}}`); rr.Code != http.StatusUnauthorized {
+			t.Errorf("expected another api key to have its own bucket, got %d", rr.Code)
+		}
+	})
+
+	t.Run("should return 429 once a device exceeds its rate", func(t *testing.T) {
+		opts := Options{DeviceLimit: ratelimit.Limit{Rate: 0.001, Burst: 1}}
+		router, _, _ := newLimitedTestRouter(opts)
+
+		sendEvent(router, "key1", `{"deviceId":"device1","data":{"temp":1}}`)
+		if rr := sendEvent(router, "key1", `{"deviceId":"device1","data":{"temp":2}}`); rr.Code != http.StatusTooManyRequests {
+			t.Errorf("expected status 429, got %d", rr.Code)
+		}
+		if rr := sendEvent(router, "key1", `{"deviceId":"device2","data":{"temp":1}}`); rr.Code != http.StatusAccepted {
+			t.Errorf("expected another device to have its own bucket, got %d", rr.Code)
+		}
+	})
+
+	t.Run("should return 429 until midnight once the daily quota is used", func(t *testing.T) {
+		opts := Options{Quotas: true, DefaultQuota: models.Quota{DailyMessages: 1}}
+		router, _, dataStore := newLimitedTestRouter(opts)
+		dataStore.Quotas["1234user"] = models.Quota{DailyMessages: 2}
+
+		for i := 0; i < 2; i++ {
+			if rr := sendEvent(router, "key1", `{"deviceId":"device1","data":{"temp":1}}`); rr.Code != http.StatusAccepted {
+				t.Fatalf("expected status 202, got %d", rr.Code)
+			}
+		}
+		rr := sendEvent(router, "key1", `{"deviceId":"device2","data":{"temp":1}}`)
+		if rr.Code != http.StatusTooManyRequests {
+			t.Fatalf("expected status 429, got %d", rr.Code)
+		}
+		retryAfter, err := strconv.Atoi(rr.Header().Get("Retry-After"))
+		if err != nil || retryAfter < 1 || retryAfter > 24*60*60 {
+			t.Errorf("expected Retry-After within a day, got %q", rr.Header().Get("Retry-After"))
+		}
+	})
+
+	t.Run("should not count replayed messages against the quota", func(t *testing.T) {
+		opts := Options{Quotas: true, DefaultQuota: models.Quota{DailyMessages: 1}, Idempotency: idempotency.NewMemory(10), IdempotencyWindow: time.Hour}
+		router, _, _ := newLimitedTestRouter(opts)
+
+		for i := 0; i < 2; i++ {
+			rr := sendEventWithKey(router, "key1", "m1", `{"deviceId":"device1","data":{"temp":1}}`)
+			if rr.Code != http.StatusAccepted {
+				t.Fatalf("attempt %d: expected status 202, got %d", i, rr.Code)
+			}
+		}
+	})
+
+	t.Run("should count limited messages by limit", func(t *testing.T) {
+		counter := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "test_rate_limited"}, []string{"limit"})
+		opts := Options{DeviceLimit: ratelimit.Limit{Rate: 0.001, Burst: 1}, RateLimited: counter}
+		router, _, _ := newLimitedTestRouter(opts)
+
+		for i := 0; i < 3; i++ {
+			sendEvent(router, "key1", `{"deviceId":"device1","data":{"temp":1}}`)
+		}
+		if got := testutil.ToFloat64(counter.WithLabelValues(limitDevice)); got != 2 {
+			t.Errorf("expected 2 device limited messages, got %v", got)
+		}
+	})
+}
+
+// post sends body to path with its content type and headers.
+func post(router *mux.Router, path string, contentType string, headers map[string]string, body []byte) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(body))
+	req.Header.Set("Content-Type", contentType)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	return rr
+}
+
+// deviceHeaders returns headers with the api key of key1 and the device ID of device1,
+// unless headers set them.
+func deviceHeaders(headers map[string]string) map[string]string {
+	out := map[string]string{"x-api-key": "key1", deviceIDHeader: "device1"}
+	for k, v := range headers {
+		out[k] = v
+	}
+	return out
+}
+
+func TestBinaryTelemetry(t *testing.T) {
+	reading := map[string]any{"temp": 21.5, "ok": true}
+
+	t.Run("should publish CBOR and MessagePack payloads as sent", func(t *testing.T) {
+		cborData, err := cbor.Marshal(reading)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msgpackData, err := msgpack.Marshal(reading)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for contentType, data := range map[string][]byte{payload.CBOR: cborData, payload.MsgPack: msgpackData} {
+			router, mb, _ := newLimitedTestRouter(Options{MaxDepth: 4, MaxKeys: 8})
+			eventTime := time.Now().Add(-time.Minute).UTC().Truncate(time.Millisecond)
+			rr := post(router, "/event", contentType, deviceHeaders(map[string]string{"X-Event-Time": eventTime.Format(time.RFC3339Nano)}), data)
+			if rr.Code != http.StatusAccepted {
+				t.Fatalf("expected status 202 for %s, got %d: %s", contentType, rr.Code, rr.Body)
+			}
+
+			msg := mb.Messages["stream1"]
+			if !bytes.Equal(msg.Value, data) {
+				t.Errorf("expected the %s payload as sent, got %x", contentType, msg.Value)
+			}
+			if msg.Headers[broker.ContentTypeHeader] != contentType {
+				t.Errorf("expected content_type %s, got %q", contentType, msg.Headers[broker.ContentTypeHeader])
+			}
+			if msg.Headers[broker.EventTimeHeader] != eventTime.Format(time.RFC3339Nano) {
+				t.Errorf("expected event_time from the header, got %q", msg.Headers[broker.EventTimeHeader])
+			}
+		}
+	})
+
+	t.Run("should return 400 for malformed payloads and headers", func(t *testing.T) {
+		router, mb, _ := newLimitedTestRouter(Options{MaxDepth: 4, MaxKeys: 8})
+		deep, err := msgpack.Marshal([]any{[]any{[]any{[]any{[]any{1}}}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, tc := range []struct {
+			name        string
+			contentType string
+			headers     map[string]string
+			body        []byte
+		}{
+			{"truncated CBOR", payload.CBOR, nil, []byte{0xa1, 0x64}},
+			{"MessagePack over the depth limit", payload.MsgPack, nil, deep},
+			{"an empty body", payload.CBOR, nil, nil},
+			{"no device id", payload.CBOR, map[string]string{"X-Device-ID": ""}, []byte{0x01}},
+			{"an invalid event time", payload.CBOR, map[string]string{"X-Event-Time": "yesterday"}, []byte{0x01}},
+		} {
+			rr := post(router, "/event", tc.contentType, deviceHeaders(tc.headers), tc.body)
+			if rr.Code != http.StatusBadRequest {
+				t.Errorf("expected status 400 for %s, got %d", tc.name, rr.Code)
+			}
+		}
+		if _, ok := mb.Messages["stream1"]; ok {
+			t.Error("expected nothing to be published")
+		}
+	})
+
+	t.Run("should return 415 for unsupported formats", func(t *testing.T) {
+		router, _ := newTestRouter()
+		rr := post(router, "/event", "text/csv", deviceHeaders(nil), []byte("temp,21.5"))
+		if rr.Code != http.StatusUnsupportedMediaType {
+			t.Errorf("expected status 415, got %d", rr.Code)
+		}
+	})
+
+	t.Run("should return 415 for a malformed Content-Type", func(t *testing.T) {
+		router, mb := newTestRouter()
+		for _, path := range []string{"/event", "/senml", "/v1/metrics"} {
+			rr := post(router, path, "application/json; charset", deviceHeaders(nil), []byte(`{"deviceId":"device1","data":{"temp":1}}`))
+			if rr.Code != http.StatusUnsupportedMediaType || !strings.Contains(rr.Body.String(), "Malformed Content-Type") {
+				t.Errorf("expected status 415 for %s, got %d: %s", path, rr.Code, rr.Body)
+			}
+		}
+		if _, ok := mb.Messages["stream1"]; ok {
+			t.Error("expected nothing to be published")
+		}
+	})
+
+	t.Run("should decode Protobuf payloads with the device's schema", func(t *testing.T) {
+		router, mb, dataStore := newLimitedTestRouter(Options{MaxDepth: 4, MaxKeys: 8})
+		value, err := structpb.NewStruct(reading)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := proto.Marshal(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := post(router, "/event", payload.Protobuf, deviceHeaders(nil), data)
+		if rr.Code != http.StatusUnsupportedMediaType {
+			t.Errorf("expected status 415 without a schema, got %d", rr.Code)
+		}
+
+		descriptorSet, err := proto.Marshal(&descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{
+			protodesc.ToFileDescriptorProto(structpb.File_google_protobuf_struct_proto),
+		}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		dataStore.Schemas["device1"] = &models.DeviceSchema{DeviceID: "device1", MessageType: "google.protobuf.Struct", DescriptorSet: descriptorSet}
+
+		rr = post(router, "/event", payload.Protobuf, deviceHeaders(nil), []byte{0xff, 0xff})
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400 for a malformed message, got %d", rr.Code)
+		}
+
+		rr = post(router, "/event", payload.Protobuf, deviceHeaders(nil), data)
+		if rr.Code != http.StatusAccepted {
+			t.Fatalf("expected status 202, got %d: %s", rr.Code, rr.Body)
+		}
+		msg := mb.Messages["stream1"]
+		if !bytes.Equal(msg.Value, data) || msg.Headers[broker.ContentTypeHeader] != payload.Protobuf {
+			t.Errorf("expected the Protobuf payload as sent, got %x with content_type %q", msg.Value, msg.Headers[broker.ContentTypeHeader])
+		}
+	})
+}
+
+func FuzzSendTelemetry(f *testing.F) {
+	for _, seed := range []string{
+		`{"deviceId":"device1","data":{"temp":1}}`,
+		`{"deviceId":"device1","data":[[[[1]]]],"messageId":"m1"}`,
+		`{"deviceId":"device1","data":{"a":"\"}"},"timestamp":"2024-01-01T00:00:00Z"}`,
+		`{"deviceId":"device1","data":`,
+		`{"deviceId":1}`,
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, body string) {
+		router, mb := newTestRouter()
+		rr := sendEvent(router, "key1", body)
+		if rr.Code != http.StatusAccepted {
+			return
+		}
+
+		msg := mb.Messages["stream1"]
+		if len(msg.Value) > 0 && !json.Valid(msg.Value) {
+			t.Errorf("expected a JSON payload, published %q", msg.Value)
+		}
+		if err := httpserver.CheckJSONLimits(msg.Value, 4, 8); err != nil {
+			t.Errorf("expected the payload within the limits, published %q: %v", msg.Value, err)
+		}
+	})
+}
+
+// subscribe collects the next n messages published to a stream of mb.
+func subscribe(t *testing.T, mb *broker.MockBroker, stream string) func(n int) []broker.Message {
+	t.Helper()
+	sub, err := mb.Subscribe(context.Background(), stream, broker.SubscribeOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sub.Close() })
+	return func(n int) []broker.Message {
+		t.Helper()
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		msgs := make([]broker.Message, n)
+		for i := range msgs {
+			if msgs[i], err = sub.Next(ctx); err != nil {
+				t.Fatalf("expected %d messages, got %d: %v", n, i, err)
+			}
+		}
+		return msgs
+	}
+}
+
+// failingBroker is a MockBroker whose publishes fail once failAfter messages were
+// published, unless failAfter is negative.
+type failingBroker struct {
+	*broker.MockBroker
+	failAfter int
+	published int
+}
+
+func (b *failingBroker) Publish(ctx context.Context, stream string, msg broker.Message) (uint64, error) {
+	if b.failAfter >= 0 && b.published >= b.failAfter {
+		return 0, errors.New("broker down")
+	}
+	b.published++
+	return b.MockBroker.Publish(ctx, stream, msg)
+}
+
+func TestSenMLTelemetry(t *testing.T) {
+	bt := time.Now().Add(-time.Minute).Truncate(time.Second)
+	pack := fmt.Sprintf(`[{"bn":"urn:dev:mac:0024befffe804ff1:","bt":%d,"bu":"Cel","n":"temp","v":21.5},{"n":"humidity","u":"%%RH","t":1,"v":40},{"n":"door","vb":true}]`, bt.Unix())
+
+	t.Run("should publish each measurement as a JSON event", func(t *testing.T) {
+		router, mb, _ := newLimitedTestRouter(Options{MaxFutureSkew: time.Minute, MaxEventAge: time.Hour})
+		next := subscribe(t, mb, "stream1")
+
+		rr := post(router, "/senml", senml.JSON, deviceHeaders(map[string]string{"Idempotency-Key": "pack-1"}), []byte(pack))
+		if rr.Code != http.StatusAccepted {
+			t.Fatalf("expected status 202, got %d: %s", rr.Code, rr.Body)
+		}
+
+		msgs := next(3)
+		for i, want := range []struct{ value, eventTime string }{
+			{`{"name":"urn:dev:mac:0024befffe804ff1:temp","unit":"Cel","value":21.5,"time":"` + bt.UTC().Format(time.RFC3339Nano) + `"}`, bt.UTC().Format(time.RFC3339Nano)},
+			{`{"name":"urn:dev:mac:0024befffe804ff1:humidity","unit":"%RH","value":40,"time":"` + bt.Add(time.Second).UTC().Format(time.RFC3339Nano) + `"}`, bt.Add(time.Second).UTC().Format(time.RFC3339Nano)},
+			{`{"name":"urn:dev:mac:0024befffe804ff1:door","unit":"Cel","value":true,"time":"` + bt.UTC().Format(time.RFC3339Nano) + `"}`, bt.UTC().Format(time.RFC3339Nano)},
+		} {
+			if string(msgs[i].Value) != want.value {
+				t.Errorf("message %d: expected %s, got %s", i, want.value, msgs[i].Value)
+			}
+			if got := msgs[i].Headers[broker.ContentTypeHeader]; got != payload.JSON {
+				t.Errorf("message %d: expected content_type %s, got %q", i, payload.JSON, got)
+			}
+			if got := msgs[i].Headers[broker.EventTimeHeader]; got != want.eventTime {
+				t.Errorf("message %d: expected event_time %s, got %q", i, want.eventTime, got)
+			}
+			if got, want := msgs[i].Headers[broker.MessageIDHeader], "pack-1/"+strconv.Itoa(i); got != want {
+				t.Errorf("message %d: expected message_id %s, got %q", i, want, got)
+			}
+		}
+	})
+
+	t.Run("should accept SenML CBOR", func(t *testing.T) {
+		router, mb, _ := newLimitedTestRouter(Options{})
+		next := subscribe(t, mb, "stream1")
+		data, err := cbor.Marshal([]map[int]any{{-2: "dev1/", 0: "temp", 1: "Cel", 2: 21.5}})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := post(router, "/senml", senml.CBOR, deviceHeaders(nil), data)
+		if rr.Code != http.StatusAccepted {
+			t.Fatalf("expected status 202, got %d: %s", rr.Code, rr.Body)
+		}
+		var event map[string]any
+		if err := json.Unmarshal(next(1)[0].Value, &event); err != nil {
+			t.Fatal(err)
+		}
+		if event["name"] != "dev1/temp" || event["unit"] != "Cel" || event["value"] != 21.5 {
+			t.Errorf("unexpected event %v", event)
+		}
+	})
+
+	t.Run("should reject invalid packs without publishing", func(t *testing.T) {
+		router, mb, _ := newLimitedTestRouter(Options{MaxFutureSkew: time.Minute, MaxEventAge: time.Hour, MaxMeasurements: 2})
+		for _, tc := range []struct {
+			name        string
+			contentType string
+			headers     map[string]string
+			body        string
+			status      int
+		}{
+			{"a unit outside the registry", senml.JSON, nil, `[{"n":"temp","u":"degC","v":21.5}]`, http.StatusBadRequest},
+			{"malformed JSON", senml.JSON, nil, `[{"n":"temp"`, http.StatusBadRequest},
+			{"too many measurements", senml.JSON, nil, pack, http.StatusBadRequest},
+			{"a measurement too old", senml.JSON, nil, `[{"n":"temp","t":-7200,"v":1}]`, http.StatusBadRequest},
+			{"no device id", senml.JSON, map[string]string{"X-Device-ID": ""}, `[{"n":"temp","v":1}]`, http.StatusBadRequest},
+			{"an empty body", senml.JSON, nil, ``, http.StatusBadRequest},
+			{"plain JSON", payload.JSON, nil, `[{"n":"temp","v":1}]`, http.StatusUnsupportedMediaType},
+		} {
+			rr := post(router, "/senml", tc.contentType, deviceHeaders(tc.headers), []byte(tc.body))
+			if rr.Code != tc.status {
+				t.Errorf("expected status %d for %s, got %d: %s", tc.status, tc.name, rr.Code, rr.Body)
+			}
+		}
+		if _, ok := mb.Messages["stream1"]; ok {
+			t.Error("expected nothing to be published")
+		}
+	})
+
+	t.Run("should count each measurement against the message quota", func(t *testing.T) {
+		router, mb, dataStore := newLimitedTestRouter(Options{Quotas: true, DefaultQuota: models.Quota{DailyMessages: 4}})
+		if rr := post(router, "/senml", senml.JSON, deviceHeaders(nil), []byte(pack)); rr.Code != http.StatusAccepted {
+			t.Fatalf("expected status 202, got %d", rr.Code)
+		}
+		delete(mb.Messages, "stream1")
+
+		if rr := post(router, "/senml", senml.JSON, deviceHeaders(nil), []byte(pack)); rr.Code != http.StatusTooManyRequests {
+			t.Errorf("expected status 429 for 6 messages over a quota of 4, got %d", rr.Code)
+		}
+		if _, ok := mb.Messages["stream1"]; ok {
+			t.Error("expected nothing to be published over the quota")
+		}
+		if got := dataStore.Usage["1234user/"+time.Now().UTC().Format(time.DateOnly)]; got != 3 {
+			t.Errorf("expected 3 messages used, got %d", got)
+		}
+	})
+
+	t.Run("should only send the rest of a pack interrupted by a failed publish", func(t *testing.T) {
+		dataStore := newTestStore()
+		fb := &failingBroker{MockBroker: broker.NewMockBroker(), failAfter: 1}
+		router := mux.NewRouter()
+		NewDataHandler(dataStore, testLogger, fb, Options{
+			Idempotency:       idempotency.NewMemory(100),
+			IdempotencyWindow: time.Hour,
+			Quotas:            true,
+			DefaultQuota:      models.Quota{DailyMessages: 100},
+		}).DataRoutes(router)
+		next := subscribe(t, fb.MockBroker, "stream1")
+		headers := deviceHeaders(map[string]string{"Idempotency-Key": "pack-3"})
+
+		if rr := post(router, "/senml", senml.JSON, headers, []byte(pack)); rr.Code != http.StatusInternalServerError {
+			t.Fatalf("expected status 500, got %d", rr.Code)
+		}
+		fb.failAfter = -1
+		if rr := post(router, "/senml", senml.JSON, headers, []byte(pack)); rr.Code != http.StatusAccepted {
+			t.Fatalf("expected status 202, got %d: %s", rr.Code, rr.Body)
+		}
+		if rr := post(router, "/senml", senml.JSON, headers, []byte(pack)); rr.Code != http.StatusAccepted || rr.Header().Get("Idempotent-Replayed") != "true" {
+			t.Errorf("expected a replayed 202, got %d", rr.Code)
+		}
+
+		if fb.published != 3 {
+			t.Errorf("expected 3 messages published, got %d", fb.published)
+		}
+		for i, msg := range next(3) {
+			if got, want := msg.Headers[broker.MessageIDHeader], "pack-3/"+strconv.Itoa(i); got != want {
+				t.Errorf("message %d: expected message_id %s, got %q", i, want, got)
+			}
+		}
+		if got := dataStore.Usage["1234user/"+time.Now().UTC().Format(time.DateOnly)]; got != 3 {
+			t.Errorf("expected 3 messages used, got %d", got)
+		}
+	})
+
+	t.Run("should replay a retried pack", func(t *testing.T) {
+		router, mb, _ := newIdempotentTestRouter()
+		headers := deviceHeaders(map[string]string{"Idempotency-Key": "pack-2"})
+		if rr := post(router, "/senml", senml.JSON, headers, []byte(pack)); rr.Code != http.StatusAccepted {
+			t.Fatalf("expected status 202, got %d", rr.Code)
+		}
+		delete(mb.Messages, "stream1")
+
+		rr := post(router, "/senml", senml.JSON, headers, []byte(pack))
+		if rr.Code != http.StatusAccepted || rr.Header().Get("Idempotent-Replayed") != "true" {
+			t.Errorf("expected a replayed 202, got %d", rr.Code)
+		}
+		if _, ok := mb.Messages["stream1"]; ok {
+			t.Error("expected the retry not to be published")
+		}
+	})
+}
+
+// lineProtocol is the content type Telegraf sends line protocol writes with.
+const lineProtocol = "text/plain; charset=utf-8"
+
+func TestLineProtocolTelemetry(t *testing.T) {
+	ts := time.Now().Add(-time.Minute).Truncate(time.Second).UTC()
+	lines := fmt.Sprintf("cpu,host=gw-1,device_id=device1 usage_idle=98.5,cores=4i %d\nmem,device_id=device1 free=1024i\n", ts.Unix())
+	token := map[string]string{"Authorization": "Token key1"}
+
+	t.Run("should publish each line as a JSON event", func(t *testing.T) {
+		router, mb, _ := newLimitedTestRouter(Options{MaxFutureSkew: time.Minute, MaxEventAge: time.Hour, DeviceTag: "device_id"})
+		next := subscribe(t, mb, "stream1")
+
+		rr := post(router, "/api/v2/write?org=acme&bucket=telegraf&precision=s", lineProtocol, map[string]string{"Authorization": "Token key1", "Idempotency-Key": "batch-1"}, []byte(lines))
+		if rr.Code != http.StatusNoContent || rr.Body.Len() != 0 {
+			t.Fatalf("expected an empty 204, got %d: %s", rr.Code, rr.Body)
+		}
+
+		msgs := next(2)
+		want := `{"measurement":"cpu","tags":{"host":"gw-1"},"fields":{"cores":4,"usage_idle":98.5},"time":"` + ts.Format(time.RFC3339Nano) + `"}`
+		if string(msgs[0].Value) != want {
+			t.Errorf("expected %s, got %s", want, msgs[0].Value)
+		}
+		if got := msgs[0].Headers[broker.EventTimeHeader]; got != ts.Format(time.RFC3339Nano) {
+			t.Errorf("expected event_time %s, got %q", ts.Format(time.RFC3339Nano), got)
+		}
+
+		var mem map[string]any
+		if err := json.Unmarshal(msgs[1].Value, &mem); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := mem["tags"]; ok || mem["measurement"] != "mem" || mem["time"] == nil {
+			t.Errorf("expected mem without tags and with the server's time, got %v", mem)
+		}
+		if got, ok := msgs[1].Headers[broker.EventTimeHeader]; ok {
+			t.Errorf("expected no event_time for a line without a timestamp, got %q", got)
+		}
+		for i, msg := range msgs {
+			if got, want := msg.Headers[broker.MessageIDHeader], "batch-1/"+strconv.Itoa(i); got != want {
+				t.Errorf("message %d: expected message_id %s, got %q", i, want, got)
+			}
+		}
+	})
+
+	t.Run("should take the device from the path", func(t *testing.T) {
+		router, mb, _ := newLimitedTestRouter(Options{DeviceTag: "device_id"})
+		next := subscribe(t, mb, "stream2")
+
+		rr := post(router, "/devices/device2/write?db=telegraf&precision=ms", lineProtocol, token, []byte(fmt.Sprintf("temp,room=lab value=21.5 %d\n", ts.UnixMilli())))
+		if rr.Code != http.StatusNoContent {
+			t.Fatalf("expected status 204, got %d: %s", rr.Code, rr.Body)
+		}
+		if got := next(1)[0]; got.Key != "device2" || got.Headers[broker.EventTimeHeader] != ts.Format(time.RFC3339Nano) {
+			t.Errorf("expected a device2 message at %s, got %s %v", ts, got.Key, got.Headers)
+		}
+	})
+
+	t.Run("should accept the api key as a token, a password or a query parameter", func(t *testing.T) {
+		router, _, _ := newLimitedTestRouter(Options{DeviceTag: "device_id"})
+		basic := httptest.NewRequest(http.MethodPost, "/", nil)
+		basic.SetBasicAuth("telegraf", "key1")
+
+		for _, tc := range []struct {
+			name    string
+			path    string
+			headers map[string]string
+			status  int
+		}{
+			{"a token", "/api/v2/write", token, http.StatusNoContent},
+			{"a bearer token", "/api/v2/write", map[string]string{"Authorization": "Bearer key1"}, http.StatusNoContent},
+			{"basic auth", "/write", map[string]string{"Authorization": basic.Header.Get("Authorization")}, http.StatusNoContent},
+			{"the p parameter", "/write?u=telegraf&p=key1", nil, http.StatusNoContent},
+			{"the x-api-key header", "/write", map[string]string{"x-api-key": "key1"}, http.StatusNoContent},
+			{"no key", "/write", nil, http.StatusUnauthorized},
+			{"another user's key", "/write", map[string]string{"Authorization": "Token key2"}, http.StatusUnauthorized},
+		} {
+			rr := post(router, tc.path, lineProtocol, tc.headers, []byte("cpu,device_id=device1 usage=1"))
+			if rr.Code != tc.status {
+				t.Errorf("expected status %d for %s, got %d: %s", tc.status, tc.name, rr.Code, rr.Body)
+			}
+		}
+	})
+
+	t.Run("should return 401 for an unknown key and 404 for an unknown device", func(t *testing.T) {
+		router, mb, _ := newLimitedTestRouter(Options{DeviceTag: "device_id"})
+		if rr := post(router, "/api/v2/write", lineProtocol, map[string]string{"Authorization": "Token unknown"}, []byte("cpu,device_id=device1 usage=1")); rr.Code != http.StatusUnauthorized {
+			t.Errorf("expected status 401 for an unknown key, got %d: %s", rr.Code, rr.Body)
+		}
+		if rr := post(router, "/api/v2/write", lineProtocol, token, []byte("cpu,device_id=unknown usage=1")); rr.Code != http.StatusNotFound {
+			t.Errorf("expected status 404 for an unknown device, got %d: %s", rr.Code, rr.Body)
+		}
+		if len(mb.Messages) != 0 {
+			t.Errorf("expected nothing to be published, got %v", mb.Messages)
+		}
+	})
+
+	t.Run("should reject invalid writes without publishing", func(t *testing.T) {
+		router, mb, _ := newLimitedTestRouter(Options{MaxFutureSkew: time.Minute, MaxEventAge: time.Hour, MaxKeys: 4, MaxLines: 1, DeviceTag: "device_id"})
+		for _, tc := range []struct {
+			name   string
+			path   string
+			body   string
+			status int
+		}{
+			{"malformed lines", "/write", "cpu,device_id=device1 usage", http.StatusBadRequest},
+			{"an unknown precision", "/write?precision=d", "cpu,device_id=device1 usage=1", http.StatusBadRequest},
+			{"too many lines", "/write", lines, http.StatusRequestEntityTooLarge},
+			{"no device", "/write", "cpu usage=1", http.StatusBadRequest},
+			{"a line of another device", "/devices/device1/write", "cpu,device_id=device2 usage=1", http.StatusBadRequest},
+			{"a line too old", "/write?precision=s", fmt.Sprintf("cpu,device_id=device1 usage=1 %d", ts.Add(-2*time.Hour).Unix()), http.StatusBadRequest},
+			{"a line over the json limits", "/write", "cpu,device_id=device1 a=1,b=2,c=3,d=4", http.StatusBadRequest},
+		} {
+			rr := post(router, tc.path, lineProtocol, token, []byte(tc.body))
+			if rr.Code != tc.status {
+				t.Errorf("expected status %d for %s, got %d: %s", tc.status, tc.name, rr.Code, rr.Body)
+			}
+		}
+		if len(mb.Messages) != 0 {
+			t.Errorf("expected nothing to be published, got %v", mb.Messages)
+		}
+	})
+
+	t.Run("should replay a retried write", func(t *testing.T) {
+		router, mb, _ := newIdempotentTestRouter()
+		headers := map[string]string{"Authorization": "Token key1", "Idempotency-Key": "batch-2"}
+		if rr := post(router, "/devices/device1/write", lineProtocol, headers, []byte("cpu usage=1")); rr.Code != http.StatusNoContent {
+			t.Fatalf("expected status 204, got %d", rr.Code)
+		}
+		delete(mb.Messages, "stream1")
+
+		rr := post(router, "/devices/device1/write", lineProtocol, headers, []byte("cpu usage=1"))
+		if rr.Code != http.StatusNoContent || rr.Header().Get("Idempotent-Replayed") != "true" || rr.Header().Get("Content-Type") != "" {
+			t.Errorf("expected a replayed 204 without a body, got %d %v", rr.Code, rr.Header())
+		}
+		if _, ok := mb.Messages["stream1"]; ok {
+			t.Error("expected the retry not to be published")
+		}
+	})
+}
+
+// otlpExport is an OTLP JSON export of a gauge and a histogram from a device.
+func otlpExport(deviceId string, timeUnixNano int64) string {
+	return fmt.Sprintf(`{"resourceMetrics":[{"resource":{"attributes":[{"key":"device.id","value":{"stringValue":%q}},{"key":"host.name","value":{"stringValue":"gw-1"}}]},
+		"scopeMetrics":[{"scope":{"name":"hostmetrics"},"metrics":[
+			{"name":"cpu.utilization","unit":"1","gauge":{"dataPoints":[{"timeUnixNano":"%d","asDouble":0.25,"attributes":[{"key":"cpu","value":{"stringValue":"0"}}]}]}},
+			{"name":"latency","unit":"ms","histogram":{"aggregationTemporality":1,"dataPoints":[{"count":"2","sum":7,"explicitBounds":[5],"bucketCounts":["1","1"]}]}},
+			{"name":"quantiles","summary":{"dataPoints":[{"count":"1"}]}}
+		]}]}]}`, deviceId, timeUnixNano)
+}
+
+func TestOTLPMetrics(t *testing.T) {
+	ts := time.Now().Add(-time.Minute).Truncate(time.Second).UTC()
+	export := otlpExport("device1", ts.UnixNano())
+	key := map[string]string{"x-api-key": "key1"}
+
+	t.Run("should publish each data point as a JSON event", func(t *testing.T) {
+		router, mb, _ := newLimitedTestRouter(Options{MaxFutureSkew: time.Minute, MaxEventAge: time.Hour})
+		next := subscribe(t, mb, "stream1")
+
+		rr := post(router, "/v1/metrics", "application/json", map[string]string{"x-api-key": "key1", "Idempotency-Key": "export-1"}, []byte(export))
+		if rr.Code != http.StatusOK || rr.Header().Get("Content-Type") != "application/json" {
+			t.Fatalf("expected a JSON 200, got %d: %s", rr.Code, rr.Body)
+		}
+		var resp struct {
+			PartialSuccess struct {
+				RejectedDataPoints string `json:"rejectedDataPoints"`
+				ErrorMessage       string `json:"errorMessage"`
+			} `json:"partialSuccess"`
+		}
+		if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.PartialSuccess.RejectedDataPoints != "1" || !strings.Contains(resp.PartialSuccess.ErrorMessage, "summaries") {
+			t.Errorf("expected the summary to be rejected, got %s", rr.Body)
+		}
+
+		msgs := next(2)
+		want := `{"name":"cpu.utilization","unit":"1","type":"gauge","resource":{"host.name":"gw-1"},"scope":"hostmetrics","attributes":{"cpu":"0"},"value":0.25,"time":"` + ts.Format(time.RFC3339Nano) + `"}`
+		if string(msgs[0].Value) != want {
+			t.Errorf("expected %s, got %s", want, msgs[0].Value)
+		}
+		if got := msgs[0].Headers[broker.EventTimeHeader]; got != ts.Format(time.RFC3339Nano) {
+			t.Errorf("expected event_time %s, got %q", ts.Format(time.RFC3339Nano), got)
+		}
+
+		var histogram map[string]any
+		if err := json.Unmarshal(msgs[1].Value, &histogram); err != nil {
+			t.Fatal(err)
+		}
+		if histogram["type"] != "histogram" || histogram["temporality"] != "delta" || histogram["count"] != float64(2) || histogram["time"] == nil {
+			t.Errorf("unexpected histogram event %v", histogram)
+		}
+		if got, ok := msgs[1].Headers[broker.EventTimeHeader]; ok {
+			t.Errorf("expected no event_time for a data point without a time, got %q", got)
+		}
+		for i, msg := range msgs {
+			if got, want := msg.Headers[broker.MessageIDHeader], "export-1/"+strconv.Itoa(i); got != want {
+				t.Errorf("message %d: expected message_id %s, got %q", i, want, got)
+			}
+		}
+	})
+
+	t.Run("should accept Protobuf and respond in Protobuf", func(t *testing.T) {
+		router, mb, _ := newLimitedTestRouter(Options{})
+		next := subscribe(t, mb, "stream2")
+		req := &colmetricspb.ExportMetricsServiceRequest{}
+		if err := protojson.Unmarshal([]byte(otlpExport("device2", ts.UnixNano())), req); err != nil {
+			t.Fatal(err)
+		}
+		data, err := proto.Marshal(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := post(router, "/v1/metrics", "application/x-protobuf", key, data)
+		if rr.Code != http.StatusOK || rr.Header().Get("Content-Type") != "application/x-protobuf" {
+			t.Fatalf("expected a Protobuf 200, got %d: %s", rr.Code, rr.Body)
+		}
+		resp := &colmetricspb.ExportMetricsServiceResponse{}
+		if err := proto.Unmarshal(rr.Body.Bytes(), resp); err != nil || resp.GetPartialSuccess().GetRejectedDataPoints() != 1 {
+			t.Errorf("expected one rejected data point, got %v, %v", resp, err)
+		}
+		if got := next(2)[0]; got.Key != "device2" {
+			t.Errorf("expected a device2 message, got %s", got.Key)
+		}
+	})
+
+	t.Run("should check the api key owns the device", func(t *testing.T) {
+		router, _, _ := newLimitedTestRouter(Options{})
+		if rr := post(router, "/v1/metrics", "application/json", map[string]string{"x-api-key": "key2"}, []byte(export)); rr.Code != http.StatusUnauthorized {
+			t.Errorf("expected status 401 for another user's key, got %d", rr.Code)
+		}
+		if rr := post(router, "/v1/metrics", "application/json", map[string]string{"x-api-key": ""}, []byte(export)); rr.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400 without a key, got %d", rr.Code)
+		}
+	})
+
+	t.Run("should return 401 for an unknown key and 404 for an unknown device", func(t *testing.T) {
+		router, mb, _ := newLimitedTestRouter(Options{})
+		if rr := post(router, "/v1/metrics", "application/json", map[string]string{"x-api-key": "unknown"}, []byte(export)); rr.Code != http.StatusUnauthorized {
+			t.Errorf("expected status 401 for an unknown key, got %d: %s", rr.Code, rr.Body)
+		}
+		if rr := post(router, "/v1/metrics", "application/json", key, []byte(otlpExport("unknown", ts.UnixNano()))); rr.Code != http.StatusNotFound {
+			t.Errorf("expected status 404 for an unknown device, got %d: %s", rr.Code, rr.Body)
+		}
+		if len(mb.Messages) != 0 {
+			t.Errorf("expected nothing to be published, got %v", mb.Messages)
+		}
+	})
+
+	t.Run("should reject invalid exports without publishing", func(t *testing.T) {
+		router, mb, _ := newLimitedTestRouter(Options{MaxFutureSkew: time.Minute, MaxEventAge: time.Hour, MaxDataPoints: 4})
+		two := strings.Replace(export, `]}]}]}`, `]}]},`+strings.TrimPrefix(otlpExport("device2", ts.UnixNano()), `{"resourceMetrics":[`), 1)
+		for _, tc := range []struct {
+			name        string
+			contentType string
+			body        string
+			status      int
+		}{
+			{"malformed JSON", "application/json", `{"resourceMetrics":`, http.StatusBadRequest},
+			{"no device id", "application/json", strings.Replace(export, "device.id", "service.name", 1), http.StatusBadRequest},
+			{"several devices", "application/json", strings.Replace(two, `"summary":{"dataPoints":[{"count":"1"}]}`, `"sum":{"dataPoints":[]}`, 2), http.StatusBadRequest},
+			{"too many data points", "application/json", two, http.StatusRequestEntityTooLarge},
+			{"a data point too old", "application/json", otlpExport("device1", ts.Add(-2*time.Hour).UnixNano()), http.StatusBadRequest},
+			{"only unsupported data points", "application/json", `{"resourceMetrics":[{"scopeMetrics":[{"metrics":[{"name":"q","summary":{"dataPoints":[{}]}}]}]}]}`, http.StatusBadRequest},
+			{"another media type", "application/cbor", export, http.StatusUnsupportedMediaType},
+		} {
+			rr := post(router, "/v1/metrics", tc.contentType, key, []byte(tc.body))
+			if rr.Code != tc.status {
+				t.Errorf("expected status %d for %s, got %d: %s", tc.status, tc.name, rr.Code, rr.Body)
+			}
+		}
+		if len(mb.Messages) != 0 {
+			t.Errorf("expected nothing to be published, got %v", mb.Messages)
+		}
+	})
+
+	t.Run("should replay a retried export", func(t *testing.T) {
+		router, mb, _ := newLimitedTestRouter(Options{Idempotency: idempotency.NewMemory(10), IdempotencyWindow: time.Hour})
+		headers := map[string]string{"x-api-key": "key1", "Idempotency-Key": "export-2"}
+		first := post(router, "/v1/metrics", "application/json", headers, []byte(export))
+		if first.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", first.Code)
+		}
+		delete(mb.Messages, "stream1")
 
+		rr := post(router, "/v1/metrics", "application/json", headers, []byte(export))
+		if rr.Code != http.StatusOK || rr.Header().Get("Idempotent-Replayed") != "true" || rr.Body.String() != first.Body.String() {
+			t.Errorf("expected the first response replayed, got %d: %s", rr.Code, rr.Body)
+		}
+		if _, ok := mb.Messages["stream1"]; ok {
+			t.Error("expected the retry not to be published")
+		}
 	})
 }
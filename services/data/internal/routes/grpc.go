@@ -0,0 +1,185 @@
+package routes
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/RaghibA/iot-telemetry/pkg/grpcserver"
+	"github.com/RaghibA/iot-telemetry/pkg/httpserver"
+	"github.com/RaghibA/iot-telemetry/pkg/logging"
+	"github.com/RaghibA/iot-telemetry/pkg/models"
+	"github.com/RaghibA/iot-telemetry/pkg/payload"
+	"github.com/RaghibA/iot-telemetry/pkg/telemetrypb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// apiKeyMetadata is the gRPC metadata carrying the API key, like the x-api-key header.
+const apiKeyMetadata = "x-api-key"
+
+// maxRejections bounds the rejections a SendStream response describes.
+const maxRejections = 10
+
+// ingestServer serves telemetrypb.IngestService with the checks and publishing of /event.
+type ingestServer struct {
+	telemetrypb.UnimplementedIngestServiceServer
+	h *Handler
+}
+
+// IngestService returns the gRPC ingestion API, authenticated with AuthenticateGRPC.
+// Params: None
+// Returns:
+// - telemetrypb.IngestServiceServer: the service implementation
+func (h *Handler) IngestService() telemetrypb.IngestServiceServer {
+	return &ingestServer{h: h}
+}
+
+// AuthenticateGRPC checks the API key in the x-api-key metadata of a call, so streams with
+// an unknown key are refused before their first reading. The key is looked up once per
+// call or stream, and each reading's device is checked against it as it is sent.
+// Params:
+// - ctx: context.Context - the call context
+// Returns:
+// - context.Context: a context carrying the API key
+// - error: an UNAUTHENTICATED status if the key is missing or unknown
+func (h *Handler) AuthenticateGRPC(ctx context.Context) (context.Context, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	keys := md.Get(apiKeyMetadata)
+	if len(keys) == 0 || keys[0] == "" {
+		h.logger.WarnContext(ctx, "no api key in metadata")
+		return nil, status.Errorf(codes.Unauthenticated, "Provide api key in '%s' metadata", apiKeyMetadata)
+	}
+
+	rec := httpserver.NewRecorder()
+	apiKey := h.resolveAPIKey(rec, grpcRequest(ctx), keys[0])
+	if apiKey == nil {
+		return nil, grpcserver.HTTPError(rec.Status, rec.Body.String())
+	}
+	logging.SetUserID(ctx, apiKey.UserID)
+	return context.WithValue(ctx, apiKeyContextKey{}, apiKey), nil
+}
+
+// Send publishes one reading.
+func (s *ingestServer) Send(ctx context.Context, req *telemetrypb.SendRequest) (*telemetrypb.SendResponse, error) {
+	rec := s.h.sendReading(ctx, req)
+	if rec.Status >= http.StatusBadRequest {
+		if retryAfter := rec.Header().Get("Retry-After"); retryAfter != "" {
+			_ = grpc.SetTrailer(ctx, metadata.Pairs("retry-after", retryAfter))
+		}
+		return nil, grpcserver.HTTPError(rec.Status, rec.Body.String())
+	}
+	return &telemetrypb.SendResponse{Replayed: rec.Header().Get(replayedHeader) == "true"}, nil
+}
+
+// SendStream publishes readings as they arrive. Rejected readings are counted and the
+// stream goes on, while server errors end it, so the client retries from there.
+func (s *ingestServer) SendStream(stream grpc.ClientStreamingServer[telemetrypb.SendRequest, telemetrypb.SendStreamResponse]) error {
+	ctx := stream.Context()
+	resp := &telemetrypb.SendStreamResponse{}
+	for index := int64(0); ; index++ {
+		req, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return stream.SendAndClose(resp)
+		}
+		if err != nil {
+			return err
+		}
+
+		rec := s.h.sendReading(ctx, req)
+		switch {
+		case rec.Status >= http.StatusInternalServerError:
+			return status.Errorf(grpcserver.Code(rec.Status), "reading %d: %s, %d readings before it were accepted", index, strings.TrimSpace(rec.Body.String()), resp.Accepted)
+		case rec.Status >= http.StatusBadRequest:
+			resp.Rejected++
+			if len(resp.Rejections) < maxRejections {
+				resp.Rejections = append(resp.Rejections, &telemetrypb.Rejection{
+					Index:   index,
+					Code:    int32(grpcserver.Code(rec.Status)),
+					Message: strings.TrimSpace(rec.Body.String()),
+				})
+			}
+		default:
+			resp.Accepted++
+		}
+	}
+}
+
+// sendReading checks and publishes a reading as /event does, recording the response the
+// HTTP route would have written.
+// Params:
+// - ctx: context.Context - the call context, carrying the API key
+// - req: *telemetrypb.SendRequest - the reading
+// Returns:
+// - *httpserver.Recorder: the response
+func (h *Handler) sendReading(ctx context.Context, req *telemetrypb.SendRequest) *httpserver.Recorder {
+	receivedAt := time.Now().UTC()
+	rec := httpserver.NewRecorder()
+
+	ev := &event{
+		contentType: req.GetContentType(),
+		deviceId:    req.GetDeviceId(),
+		data:        req.GetData(),
+		messageId:   req.GetMessageId(),
+	}
+	if ev.contentType == "" {
+		ev.contentType = defaultContentType
+	}
+	if !payload.Supported(ev.contentType) {
+		h.logger.WarnContext(ctx, "unsupported content type", "content_type", ev.contentType)
+		http.Error(rec, fmt.Sprintf("Unsupported content_type %q, send %s, %s, %s or %s", ev.contentType, payload.JSON, payload.CBOR, payload.MsgPack, payload.Protobuf), http.StatusUnsupportedMediaType)
+		return rec
+	}
+	// the JSON of /event is checked as its body is decoded
+	if ev.contentType == payload.JSON && !json.Valid(ev.data) {
+		h.logger.WarnContext(ctx, "invalid payload", "content_type", ev.contentType)
+		http.Error(rec, "Invalid payload: data is not valid JSON", http.StatusBadRequest)
+		return rec
+	}
+	if ev.deviceId == "" {
+		h.logger.WarnContext(ctx, "no device id in request")
+		http.Error(rec, "Provide device_id", http.StatusBadRequest)
+		return rec
+	}
+	if req.Timestamp != nil {
+		if err := req.Timestamp.CheckValid(); err != nil {
+			h.logger.WarnContext(ctx, "invalid timestamp", "err", err)
+			http.Error(rec, "timestamp is out of range", http.StatusBadRequest)
+			return rec
+		}
+		timestamp := req.Timestamp.AsTime()
+		ev.timestamp = &timestamp
+	}
+
+	h.sendEvent(rec, grpcRequest(ctx), receivedAt, ev)
+	return rec
+}
+
+// grpcRequest stands in for the HTTP request of a call in the checks shared with the HTTP
+// routes. It carries the call context, the API key, the peer address and the forwarding
+// headers a proxy sent as metadata, which are trusted as for HTTP.
+func grpcRequest(ctx context.Context) *http.Request {
+	method, _ := grpc.Method(ctx)
+	r, _ := http.NewRequestWithContext(ctx, http.MethodPost, method, nil)
+	if p, ok := peer.FromContext(ctx); ok {
+		r.RemoteAddr = p.Addr.String()
+	}
+	if apiKey, ok := ctx.Value(apiKeyContextKey{}).(*models.ApiKey); ok {
+		r.Header.Set(apiKeyMetadata, apiKey.APIKey)
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, header := range []string{"X-Forwarded-For", "X-Real-IP"} {
+		if values := md.Get(header); len(values) > 0 {
+			r.Header[header] = values
+		}
+	}
+	return r
+}
@@ -0,0 +1,218 @@
+package routes
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/RaghibA/iot-telemetry/pkg/broker"
+	"github.com/RaghibA/iot-telemetry/pkg/config"
+	"github.com/RaghibA/iot-telemetry/pkg/grpcserver"
+	"github.com/RaghibA/iot-telemetry/pkg/payload"
+	"github.com/RaghibA/iot-telemetry/pkg/telemetrypb"
+	"github.com/RaghibA/iot-telemetry/services/data/internal/idempotency"
+	"github.com/RaghibA/iot-telemetry/services/data/internal/store"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// newTestIngestClient serves the ingestion API of newTestRouter's handler on a local port
+// and dials it.
+func newTestIngestClient(t *testing.T) (telemetrypb.IngestServiceClient, *broker.MockBroker) {
+	t.Helper()
+	return newTestIngestClientWithStore(t, newTestStore())
+}
+
+// newTestIngestClientWithStore is newTestIngestClient backed by dataStore.
+func newTestIngestClientWithStore(t *testing.T, dataStore *store.MockStore) (telemetrypb.IngestServiceClient, *broker.MockBroker) {
+	t.Helper()
+	mb := broker.NewMockBroker()
+	handler := NewDataHandler(dataStore, testLogger, mb, Options{
+		MaxFutureSkew:     time.Minute,
+		MaxEventAge:       time.Hour,
+		MaxDepth:          4,
+		MaxKeys:           8,
+		Idempotency:       idempotency.NewMemory(100),
+		IdempotencyWindow: time.Hour,
+	})
+
+	cfg := config.Default()
+	cfg.Server.GRPCAddr = "127.0.0.1:0"
+	srv, err := grpcserver.New(cfg, testLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Register(&telemetrypb.IngestService_ServiceDesc, handler.IngestService(), handler.AuthenticateGRPC)
+	if err := srv.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(srv.Stop)
+
+	conn, err := grpc.NewClient(srv.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return telemetrypb.NewIngestServiceClient(conn), mb
+}
+
+func withApiKey(apiKey string) context.Context {
+	return metadata.AppendToOutgoingContext(context.Background(), apiKeyMetadata, apiKey)
+}
+
+func TestGRPCSend(t *testing.T) {
+
+	t.Run("should publish a reading", func(t *testing.T) {
+		client, mb := newTestIngestClient(t)
+		next := subscribe(t, mb, "stream1")
+
+		timestamp := time.Now().Add(-time.Minute).UTC().Truncate(time.Millisecond)
+		resp, err := client.Send(withApiKey("key1"), &telemetrypb.SendRequest{
+			DeviceId:  "device1",
+			Data:      []byte(`{"temp":21.5}`),
+			Timestamp: timestamppb.New(timestamp),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Replayed {
+			t.Error("expected a first send not to be replayed")
+		}
+
+		msg := next(1)[0]
+		if string(msg.Value) != `{"temp":21.5}` {
+			t.Errorf("expected the reading's data, got %s", msg.Value)
+		}
+		if msg.Headers[broker.ContentTypeHeader] != payload.JSON {
+			t.Errorf("expected JSON content type, got %q", msg.Headers[broker.ContentTypeHeader])
+		}
+		if got := msg.Headers[broker.EventTimeHeader]; got != timestamp.Format(time.RFC3339Nano) {
+			t.Errorf("expected event time %v, got %q", timestamp, got)
+		}
+	})
+
+	t.Run("should refuse calls without a known api key", func(t *testing.T) {
+		client, _ := newTestIngestClient(t)
+		req := &telemetrypb.SendRequest{DeviceId: "device1", Data: []byte(`{"temp":21.5}`)}
+
+		if _, err := client.Send(context.Background(), req); status.Code(err) != codes.Unauthenticated {
+			t.Errorf("expected Unauthenticated without a key, got %v", err)
+		}
+		if _, err := client.Send(withApiKey("unknown"), req); status.Code(err) != codes.Unauthenticated {
+			t.Errorf("expected Unauthenticated with an unknown key, got %v", err)
+		}
+		if _, err := client.Send(withApiKey("key2"), req); status.Code(err) != codes.Unauthenticated {
+			t.Errorf("expected Unauthenticated for another user's device, got %v", err)
+		}
+	})
+
+	t.Run("should reject invalid readings", func(t *testing.T) {
+		client, _ := newTestIngestClient(t)
+
+		cases := map[string]*telemetrypb.SendRequest{
+			"no device":           {Data: []byte(`{"temp":21.5}`)},
+			"invalid data":        {DeviceId: "device1", Data: []byte(`{"temp":`)},
+			"unknown format":      {DeviceId: "device1", Data: []byte(`temp=21.5`), ContentType: "text/plain"},
+			"timestamp in future": {DeviceId: "device1", Data: []byte(`{"temp":21.5}`), Timestamp: timestamppb.New(time.Now().Add(time.Hour))},
+		}
+		for name, req := range cases {
+			if _, err := client.Send(withApiKey("key1"), req); status.Code(err) != codes.InvalidArgument {
+				t.Errorf("%s: expected InvalidArgument, got %v", name, err)
+			}
+		}
+	})
+
+	t.Run("should replay a resent message id", func(t *testing.T) {
+		client, _ := newTestIngestClient(t)
+		req := &telemetrypb.SendRequest{DeviceId: "device1", Data: []byte(`{"temp":21.5}`), MessageId: "msg-1"}
+
+		if _, err := client.Send(withApiKey("key1"), req); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Send(withApiKey("key1"), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !resp.Replayed {
+			t.Error("expected the resend to be replayed")
+		}
+	})
+}
+
+func TestGRPCSendStream(t *testing.T) {
+
+	t.Run("should count accepted and rejected readings", func(t *testing.T) {
+		client, mb := newTestIngestClient(t)
+		next := subscribe(t, mb, "stream1")
+
+		stream, err := client.SendStream(withApiKey("key1"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, req := range []*telemetrypb.SendRequest{
+			{DeviceId: "device1", Data: []byte(`{"temp":21.5}`)},
+			{DeviceId: "device1", Data: []byte(`{"temp":`)},
+			{DeviceId: "device1", Data: []byte(`{"temp":22}`)},
+		} {
+			if err := stream.Send(req); err != nil {
+				t.Fatal(err)
+			}
+		}
+		resp, err := stream.CloseAndRecv()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.Accepted != 2 || resp.Rejected != 1 {
+			t.Errorf("expected 2 accepted and 1 rejected, got %d and %d", resp.Accepted, resp.Rejected)
+		}
+		if len(resp.Rejections) != 1 || resp.Rejections[0].Index != 1 || codes.Code(resp.Rejections[0].Code) != codes.InvalidArgument {
+			t.Errorf("expected reading 1 rejected as invalid, got %v", resp.Rejections)
+		}
+		if msgs := next(2); string(msgs[1].Value) != `{"temp":22}` {
+			t.Errorf("expected the readings after the rejection to be published, got %s", msgs[1].Value)
+		}
+	})
+
+	t.Run("should look up the api key once per stream", func(t *testing.T) {
+		dataStore := newTestStore()
+		client, _ := newTestIngestClientWithStore(t, dataStore)
+
+		stream, err := client.SendStream(withApiKey("key1"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 5; i++ {
+			if err := stream.Send(&telemetrypb.SendRequest{DeviceId: "device1", Data: []byte(`{"temp":21.5}`)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		resp, err := stream.CloseAndRecv()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.Accepted != 5 {
+			t.Errorf("expected 5 accepted, got %d", resp.Accepted)
+		}
+		if got := dataStore.ApiKeyLookups.Load(); got != 1 {
+			t.Errorf("expected 1 api key lookup, got %d", got)
+		}
+	})
+
+	t.Run("should refuse streams without a known api key", func(t *testing.T) {
+		client, _ := newTestIngestClient(t)
+
+		stream, err := client.SendStream(withApiKey("unknown"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := stream.CloseAndRecv(); status.Code(err) != codes.Unauthenticated {
+			t.Errorf("expected Unauthenticated, got %v", err)
+		}
+	})
+}
@@ -1,49 +1,189 @@
 package server
 
 import (
-	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 
+	"github.com/RaghibA/iot-telemetry/db"
+	"github.com/RaghibA/iot-telemetry/pkg/broker"
 	"github.com/RaghibA/iot-telemetry/pkg/config"
-	"github.com/RaghibA/iot-telemetry/pkg/kafka"
+	"github.com/RaghibA/iot-telemetry/pkg/grpcserver"
+	"github.com/RaghibA/iot-telemetry/pkg/health"
+	"github.com/RaghibA/iot-telemetry/pkg/httpserver"
+	"github.com/RaghibA/iot-telemetry/pkg/logging"
+	"github.com/RaghibA/iot-telemetry/pkg/models"
+	"github.com/RaghibA/iot-telemetry/pkg/telemetrypb"
+	"github.com/RaghibA/iot-telemetry/pkg/tracing"
+	"github.com/RaghibA/iot-telemetry/services/data/internal/coap"
+	"github.com/RaghibA/iot-telemetry/services/data/internal/idempotency"
 	"github.com/RaghibA/iot-telemetry/services/data/internal/monitoring"
+	"github.com/RaghibA/iot-telemetry/services/data/internal/ratelimit"
 	"github.com/RaghibA/iot-telemetry/services/data/internal/routes"
 	"github.com/RaghibA/iot-telemetry/services/data/internal/store"
+	"github.com/RaghibA/iot-telemetry/services/data/internal/wal"
 	"github.com/gorilla/mux"
-	"github.com/jackc/pgx/v5"
 )
 
 type TelemetryServer struct {
-	addr        string
-	db          *pgx.Conn
-	logger      *log.Logger
-	kafkaClient kafka.KafkaClient
+	config *config.Config
+	db     db.DB
+	logger *slog.Logger
+	broker broker.Broker
 }
 
-func NewDataServer(config *config.DataConfig, db *pgx.Conn, logger *log.Logger, kafkaClient kafka.KafkaClient) *TelemetryServer {
-	addr := fmt.Sprintf("%s:%s", config.HOST, config.PORT)
+func NewDataServer(cfg *config.Config, db db.DB, logger *slog.Logger, broker broker.Broker) *TelemetryServer {
 	return &TelemetryServer{
-		addr:        addr,
-		db:          db,
-		logger:      logger,
-		kafkaClient: kafkaClient,
+		config: cfg,
+		db:     db,
+		logger: logger,
+		broker: broker,
 	}
 }
 
 func (s *TelemetryServer) Run() error {
+	router := mux.NewRouter()
+	router.Use(tracing.Middleware("data-service"))
+	router.Use(logging.Middleware(s.logger))
+	router.Use(httpserver.LimitBody(s.config.Limits))
+	grpcServer, err := grpcserver.New(s.config, s.logger)
+	if err != nil {
+		return err
+	}
+	ingestBroker, stopWAL, err := StartWAL(s.broker, s.config, s.logger)
+	if err != nil {
+		return err
+	}
+	defer stopWAL()
+	s.broker = ingestBroker
+	s.Routes(router, grpcServer)
+
+	router.Handle("/metrics", monitoring.PrometheusHandler()) // Expose metrics at /metrics
+
+	stopCoAP, err := StartCoAP(router, s.config, s.logger)
+	if err != nil {
+		return err
+	}
+	defer stopCoAP()
+	if err := grpcServer.Start(); err != nil {
+		return err
+	}
+	defer grpcServer.Stop()
+
+	srv := httpserver.New(s.config, router)
+	s.logger.Info("data server running", "addr", srv.Addr, "tls", s.config.TLS.Enabled())
+	return httpserver.ListenAndServe(s.config, srv)
+}
+
+// Routes registers the data service routes under /api/v1/data on router, and its gRPC
+// ingestion API on grpcServer. The caller is responsible for the tracing, logging and body
+// limit middlewares.
+// Params:
+// - router: *mux.Router - the router to register the routes on
+// - grpcServer: *grpcserver.Server - the gRPC server to register the API on
+// Returns: None
+func (s *TelemetryServer) Routes(router *mux.Router, grpcServer *grpcserver.Server) {
 	metrics := monitoring.NewMetrics()
 
-	router := mux.NewRouter()
 	subRouter := router.PathPrefix("/api/v1/data").Subrouter()
 	subRouter.Use(metrics.MetricMonitoring) // Apply middleware to only this subrouter
+	// devices on metered links may compress telemetry, the body limit applies to the compressed size
+	subRouter.Use(httpserver.Decompress(s.config.Ingest.MaxDecompressedBytes))
 
 	eventStore := store.NewEventStore(s.db, s.logger)
-	dataHandler := routes.NewDataHandler(eventStore, s.logger, s.kafkaClient)
+	idempotencyStore, err := idempotency.NewStore(s.config.Ingest, s.db, s.logger)
+	if err != nil {
+		// the Redis URL was validated with the config
+		s.logger.Error("idempotency store unavailable, keeping message ids in memory", "err", err)
+		idempotencyStore = idempotency.NewMemory(s.config.Ingest.IdempotencyCacheSize)
+	}
+	rateLimits, err := ratelimit.NewStore(s.config.Ingest)
+	if err != nil {
+		s.logger.Error("rate limit store unavailable, limiting per replica", "err", err)
+		rateLimits = ratelimit.NewMemory()
+	}
+	dataHandler := routes.NewDataHandler(eventStore, s.logger, s.broker, routes.Options{
+		MaxFutureSkew:     s.config.Ingest.MaxFutureSkew,
+		MaxEventAge:       s.config.Ingest.MaxEventAge,
+		MaxDepth:          s.config.Ingest.MaxDepth,
+		MaxKeys:           s.config.Ingest.MaxKeys,
+		MaxMeasurements:   s.config.Ingest.SenMLMaxMeasurements,
+		MaxLines:          s.config.Ingest.InfluxMaxLines,
+		MaxDataPoints:     s.config.Ingest.OTLPMaxDataPoints,
+		DeviceTag:         s.config.Ingest.InfluxDeviceTag,
+		TrustedProxies:    s.config.Server.TrustedProxyPrefixes(),
+		Idempotency:       idempotencyStore,
+		IdempotencyWindow: s.config.Ingest.IdempotencyWindow,
+		RateLimits:        rateLimits,
+		KeyLimit:          ratelimit.Limit{Rate: s.config.Ingest.KeyRate, Burst: s.config.Ingest.KeyBurst},
+		DeviceLimit:       ratelimit.Limit{Rate: s.config.Ingest.DeviceRate, Burst: s.config.Ingest.DeviceBurst},
+		Quotas:            s.config.Ingest.Quotas,
+		DefaultQuota:      models.Quota{DailyMessages: s.config.Ingest.DailyMessages, DailyBytes: s.config.Ingest.DailyBytes},
+		RateLimited:       metrics.RateLimited,
+	})
 	dataHandler.DataRoutes(subRouter)
+	grpcServer.Register(&telemetrypb.IngestService_ServiceDesc, dataHandler.IngestService(), dataHandler.AuthenticateGRPC)
 
-	router.Handle("/metrics", monitoring.PrometheusHandler()) // Expose metrics at /metrics
+	checker := health.NewChecker(s.config.Timeouts.Readiness)
+	checker.Add("database", s.db.Ping)
+	checker.Add("broker", s.broker.Ping)
+	subRouter.HandleFunc("/health/live", checker.LiveHandler).Methods(http.MethodGet)
+	subRouter.HandleFunc("/health/ready", checker.ReadyHandler).Methods(http.MethodGet)
+}
 
-	log.Printf("Data server running on %v", s.addr)
-	return http.ListenAndServe(s.addr, router)
+// StartCoAP starts the CoAP listener of constrained devices when ingest.coapAddr is set,
+// forwarding their telemetry to the data routes served by handler.
+// Params:
+// - handler: http.Handler - the router the data routes are registered on
+// - cfg: *config.Config - the service configuration
+// - logger: *slog.Logger - the logger instance
+// Returns:
+// - func(): stops the listener, a no-op if it was not started
+// - error: error if the address cannot be listened on
+func StartCoAP(handler http.Handler, cfg *config.Config, logger *slog.Logger) (func(), error) {
+	if cfg.Ingest.CoAPAddr == "" {
+		return func() {}, nil
+	}
+	srv := coap.NewServer(handler, logger, coap.Options{
+		Prefix:           "/api/v1/data",
+		MaxBodyBytes:     cfg.Ingest.CoAPMaxBodyBytes,
+		BlockwiseTimeout: cfg.Ingest.CoAPBlockwiseTimeout,
+	})
+	if err := srv.Start(cfg.Ingest.CoAPAddr); err != nil {
+		return nil, err
+	}
+	logger.Info("coap listener running", "addr", srv.Addr())
+	return srv.Stop, nil
+}
+
+// StartWAL buffers telemetry in the write-ahead log in ingest.walDir while the broker is
+// unavailable, and replays it in the background once the broker recovers.
+// Params:
+// - b: broker.Broker - the broker telemetry is published to
+// - cfg: *config.Config - the service configuration
+// - logger: *slog.Logger - the logger instance
+// Returns:
+// - broker.Broker: the broker the data routes publish to, b itself if no directory is set
+// - func(): stops the replay and closes the log, a no-op if it was not opened
+// - error: error if the log cannot be opened
+func StartWAL(b broker.Broker, cfg *config.Config, logger *slog.Logger) (broker.Broker, func(), error) {
+	if cfg.Ingest.WALDir == "" {
+		return b, func() {}, nil
+	}
+	log, err := wal.Open(cfg.Ingest.WALDir, wal.Options{
+		Sync:         cfg.Ingest.WALSync,
+		SyncInterval: cfg.Ingest.WALSyncInterval,
+		SegmentBytes: cfg.Ingest.WALSegmentBytes,
+		MaxBytes:     cfg.Ingest.WALMaxBytes,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	metrics := monitoring.NewMetrics()
+	forwarder := wal.NewForwarder(b, log, logger, wal.ForwarderOptions{Depth: metrics.WALDepth, Bytes: metrics.WALBytes})
+	logger.Info("write-ahead log opened", "dir", cfg.Ingest.WALDir, "sync", cfg.Ingest.WALSync, "depth", log.Depth())
+	return forwarder, func() {
+		if err := forwarder.Stop(); err != nil {
+			logger.Error("failed to close the write-ahead log", "err", err)
+		}
+	}, nil
 }
@@ -0,0 +1,97 @@
+package store
+
+import (
+	"context"
+	"sync/atomic"
+
+	"github.com/RaghibA/iot-telemetry/pkg/models"
+	"github.com/jackc/pgx/v5"
+)
+
+type MockStore struct {
+	ApiKeys map[string]*models.ApiKey
+	Devices map[string]*models.Device
+	// Quotas are the quotas of users, who get the defaults if absent.
+	Quotas map[string]models.Quota
+	// Usage is the number of messages counted per user and day, keyed by "user/day".
+	Usage map[string]int64
+	// Schemas are the Protobuf schemas of devices.
+	Schemas map[string]*models.DeviceSchema
+	// ApiKeyLookups counts the calls to GetApiKey.
+	ApiKeyLookups atomic.Int64
+	Err           error
+}
+
+func NewMockStore() *MockStore {
+	return &MockStore{
+		ApiKeys: make(map[string]*models.ApiKey),
+		Devices: make(map[string]*models.Device),
+		Quotas:  make(map[string]models.Quota),
+		Usage:   make(map[string]int64),
+		Schemas: make(map[string]*models.DeviceSchema),
+		Err:     nil,
+	}
+}
+
+func (s *MockStore) GetApiKey(ctx context.Context, key string) (*models.ApiKey, error) {
+	s.ApiKeyLookups.Add(1)
+	if s.Err != nil {
+		return nil, s.Err
+	}
+
+	apiKey, exists := s.ApiKeys[key]
+	if !exists {
+		return nil, pgx.ErrNoRows
+	}
+	return apiKey, nil
+}
+
+func (s *MockStore) GetDeviceByDeviceId(ctx context.Context, deviceId string) (*models.Device, error) {
+	if s.Err != nil {
+		return nil, s.Err
+	}
+
+	device, exists := s.Devices[deviceId]
+	if !exists {
+		return nil, pgx.ErrNoRows
+	}
+	return device, nil
+}
+
+func (s *MockStore) GetQuota(ctx context.Context, userId string, defaults models.Quota) (models.Quota, error) {
+	if s.Err != nil {
+		return models.Quota{}, s.Err
+	}
+
+	quota, exists := s.Quotas[userId]
+	if !exists {
+		return defaults, nil
+	}
+	return quota, nil
+}
+
+// AddUsage only enforces the message quota.
+func (s *MockStore) AddUsage(ctx context.Context, userId string, day string, messages int64, bytes int64, quota models.Quota) (bool, error) {
+	if s.Err != nil {
+		return false, s.Err
+	}
+
+	key := userId + "/" + day
+	if quota.DailyMessages > 0 && s.Usage[key]+messages > quota.DailyMessages {
+		return false, nil
+	}
+	s.Usage[key] += messages
+	return true, nil
+}
+
+func (s *MockStore) GetDeviceSchema(ctx context.Context, deviceId string) (*models.DeviceSchema, error) {
+	if s.Err != nil {
+		return nil, s.Err
+	}
+
+	schema, exists := s.Schemas[deviceId]
+	if !exists {
+		return nil, pgx.ErrNoRows
+	}
+	return schema, nil
+}
@@ -2,8 +2,13 @@ package store
 
 import (
 	"context"
-	"log"
+	"errors"
+	"log/slog"
+	"math"
+	"sync"
+	"time"
 
+	"github.com/RaghibA/iot-telemetry/db"
 	"github.com/RaghibA/iot-telemetry/pkg/models"
 	"github.com/jackc/pgx/v5"
 )
@@ -11,14 +16,23 @@ import (
 type EventStore interface {
 	GetApiKey(ctx context.Context, key string) (*models.ApiKey, error)
 	GetDeviceByDeviceId(ctx context.Context, deviceId string) (*models.Device, error)
+	GetQuota(ctx context.Context, userId string, defaults models.Quota) (models.Quota, error)
+	AddUsage(ctx context.Context, userId string, day string, messages int64, bytes int64, quota models.Quota) (bool, error)
+	GetDeviceSchema(ctx context.Context, deviceId string) (*models.DeviceSchema, error)
 }
 
+// pruneInterval is how often AddUsage deletes the usage of past days.
+const pruneInterval = time.Minute
+
 type store struct {
-	db     *pgx.Conn
-	logger *log.Logger
+	db     db.DB
+	logger *slog.Logger
+
+	mu        sync.Mutex
+	lastPrune time.Time
 }
 
-func NewEventStore(db *pgx.Conn, logger *log.Logger) *store {
+func NewEventStore(db db.DB, logger *slog.Logger) *store {
 	return &store{db: db, logger: logger}
 }
 
@@ -60,3 +74,118 @@ func (s *store) GetDeviceByDeviceId(ctx context.Context, deviceId string) (*mode
 
 	return &device, nil
 }
+
+// GetQuota returns the daily quota of a user: their own limits, else their plan's, else
+// the defaults.
+// Params:
+// - ctx: context.Context - the request context
+// - userId: string - the user ID
+// - defaults: models.Quota - the quota of users without limits of their own or a plan
+// Returns:
+// - models.Quota: the user's quota
+// - error: the database error
+func (s *store) GetQuota(ctx context.Context, userId string, defaults models.Quota) (models.Quota, error) {
+	var quota models.Quota
+
+	queryString := `
+		SELECT COALESCE(q.daily_messages, p.daily_messages, $2), COALESCE(q.daily_bytes, p.daily_bytes, $3)
+		FROM user_quotas q LEFT JOIN plans p ON p.plan_id = q.plan_id
+		WHERE q.user_id = $1
+	`
+	err := s.db.QueryRow(ctx, queryString, userId, defaults.DailyMessages, defaults.DailyBytes).Scan(
+		&quota.DailyMessages,
+		&quota.DailyBytes,
+	)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return defaults, nil
+	}
+	if err != nil {
+		return models.Quota{}, err
+	}
+
+	return quota, nil
+}
+
+// AddUsage counts messages of the given total size against a user's usage for a day,
+// unless they would exceed their quota. The usage of days before it is deleted.
+// Params:
+// - ctx: context.Context - the request context
+// - userId: string - the user ID
+// - day: string - the UTC day, as YYYY-MM-DD
+// - messages: int64 - the number of messages
+// - bytes: int64 - the total payload size
+// - quota: models.Quota - the user's quota
+// Returns:
+// - bool: true if the messages were counted, false if they exceed the quota
+// - error: the database error
+func (s *store) AddUsage(ctx context.Context, userId string, day string, messages int64, bytes int64, quota models.Quota) (bool, error) {
+	maxMessages, maxBytes := quota.DailyMessages, quota.DailyBytes
+	if maxMessages == 0 {
+		maxMessages = math.MaxInt64
+	}
+	if maxBytes == 0 {
+		maxBytes = math.MaxInt64
+	}
+	if messages > maxMessages || bytes > maxBytes {
+		return false, nil
+	}
+	s.prune(ctx, day)
+
+	// a single statement so concurrent requests on several replicas cannot overshoot
+	queryString := `
+		INSERT INTO quota_usage (user_id, day, messages, bytes) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (user_id, day) DO UPDATE SET
+			messages = quota_usage.messages + excluded.messages,
+			bytes = quota_usage.bytes + excluded.bytes
+		WHERE quota_usage.messages <= $5 - excluded.messages AND quota_usage.bytes <= $6 - excluded.bytes
+	`
+	tag, err := s.db.Exec(ctx, queryString, userId, day, messages, bytes, maxMessages, maxBytes)
+	if err != nil {
+		return false, err
+	}
+
+	return tag.RowsAffected() == 1, nil
+}
+
+// prune deletes the usage of days before day, at most once per pruneInterval. Days are
+// YYYY-MM-DD, so they sort as text.
+func (s *store) prune(ctx context.Context, day string) {
+	s.mu.Lock()
+	if time.Since(s.lastPrune) < pruneInterval {
+		s.mu.Unlock()
+		return
+	}
+	s.lastPrune = time.Now()
+	s.mu.Unlock()
+
+	if _, err := s.db.Exec(ctx, `DELETE FROM quota_usage WHERE day < $1`, day); err != nil {
+		s.logger.WarnContext(ctx, "failed to prune quota usage", "err", err)
+	}
+}
+
+// GetDeviceSchema returns the Protobuf schema registered for a device.
+// Params:
+// - ctx: context.Context - the request context
+// - deviceId: string - the device ID
+// Returns:
+// - *models.DeviceSchema: the device's schema
+// - error: pgx.ErrNoRows if the device has no schema, or the database error
+func (s *store) GetDeviceSchema(ctx context.Context, deviceId string) (*models.DeviceSchema, error) {
+	var schema models.DeviceSchema
+
+	queryString := `
+		SELECT device_id, message_type, descriptor_set, updated_at FROM device_schemas WHERE device_id=$1
+	`
+
+	err := s.db.QueryRow(ctx, queryString, deviceId).Scan(
+		&schema.DeviceID,
+		&schema.MessageType,
+		&schema.DescriptorSet,
+		&schema.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &schema, nil
+}
@@ -0,0 +1,186 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/RaghibA/iot-telemetry/db/sqlite"
+	"github.com/RaghibA/iot-telemetry/pkg/models"
+	"github.com/jackc/pgx/v5"
+)
+
+func newTestStore(t *testing.T) *store {
+	t.Helper()
+	d, err := sqlite.Open(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { d.Close() })
+	if err := d.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	for _, userId := range []string{"user-1", "user-2"} {
+		if _, err := d.Exec(ctx, `INSERT INTO users (user_id, username, password, email) VALUES ($1, $1, 'x', $1)`, userId); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return NewEventStore(d, slog.New(slog.NewTextHandler(io.Discard, nil)))
+}
+
+func TestGetQuota(t *testing.T) {
+	ctx := context.Background()
+	defaults := models.Quota{DailyMessages: 100, DailyBytes: 1000}
+
+	t.Run("should prefer the user's limits, then the plan's, then the defaults", func(t *testing.T) {
+		s := newTestStore(t)
+		for _, q := range []string{
+			`INSERT INTO plans (plan_id, daily_messages, daily_bytes) VALUES ('pro', 5000, 50000)`,
+			`INSERT INTO user_quotas (user_id, plan_id, daily_messages) VALUES ('user-1', 'pro', 7000)`,
+		} {
+			if _, err := s.db.Exec(ctx, q); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		quota, err := s.GetQuota(ctx, "user-1", defaults)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if quota != (models.Quota{DailyMessages: 7000, DailyBytes: 50000}) {
+			t.Errorf("expected the user's messages and the plan's bytes, got %+v", quota)
+		}
+
+		quota, err = s.GetQuota(ctx, "user-2", defaults)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if quota != defaults {
+			t.Errorf("expected the defaults, got %+v", quota)
+		}
+	})
+}
+
+func TestAddUsage(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("should count messages until the message quota", func(t *testing.T) {
+		s := newTestStore(t)
+		quota := models.Quota{DailyMessages: 2}
+		for i, want := range []bool{true, true, false} {
+			ok, err := s.AddUsage(ctx, "user-1", "2026-01-01", 1, 10, quota)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok != want {
+				t.Errorf("message %d: expected %t, got %t", i, want, ok)
+			}
+		}
+
+		if ok, err := s.AddUsage(ctx, "user-1", "2026-01-02", 1, 10, quota); err != nil || !ok {
+			t.Errorf("expected a new day to start afresh, got %t %v", ok, err)
+		}
+		if ok, err := s.AddUsage(ctx, "user-2", "2026-01-01", 1, 10, quota); err != nil || !ok {
+			t.Errorf("expected users to be counted apart, got %t %v", ok, err)
+		}
+	})
+
+	t.Run("should count several messages at once", func(t *testing.T) {
+		s := newTestStore(t)
+		quota := models.Quota{DailyMessages: 5}
+		for i, tc := range []struct {
+			messages int64
+			want     bool
+		}{{6, false}, {3, true}, {3, false}, {2, true}, {1, false}} {
+			ok, err := s.AddUsage(ctx, "user-1", "2026-01-01", tc.messages, 10, quota)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok != tc.want {
+				t.Errorf("request %d of %d messages: expected %t, got %t", i, tc.messages, tc.want, ok)
+			}
+		}
+	})
+
+	t.Run("should count bytes until the byte quota", func(t *testing.T) {
+		s := newTestStore(t)
+		quota := models.Quota{DailyBytes: 100}
+		for i, tc := range []struct {
+			bytes int64
+			want  bool
+		}{{150, false}, {60, true}, {50, false}, {40, true}, {1, false}} {
+			ok, err := s.AddUsage(ctx, "user-1", "2026-01-01", 1, tc.bytes, quota)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok != tc.want {
+				t.Errorf("message %d of %d bytes: expected %t, got %t", i, tc.bytes, tc.want, ok)
+			}
+		}
+	})
+
+	t.Run("should delete the usage of past days", func(t *testing.T) {
+		s := newTestStore(t)
+		for _, day := range []string{"2025-12-31", "2026-01-01", "2026-01-02"} {
+			s.lastPrune = time.Time{}
+			if _, err := s.AddUsage(ctx, "user-1", day, 1, 10, models.Quota{}); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		var days []string
+		rows, err := s.db.Query(ctx, `SELECT day FROM quota_usage`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var day string
+			if err := rows.Scan(&day); err != nil {
+				t.Fatal(err)
+			}
+			days = append(days, day)
+		}
+		if len(days) != 1 || days[0] != "2026-01-02" {
+			t.Errorf("expected only the usage of 2026-01-02 to be kept, got %v", days)
+		}
+	})
+}
+
+func TestGetDeviceSchema(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("should return the device's schema and ErrNoRows without one", func(t *testing.T) {
+		s := newTestStore(t)
+		for _, q := range []string{
+			`INSERT INTO devices (device_id, user_id, device_name, topic_name) VALUES ('device-1', 'user-1', 'd1', 't1')`,
+			`INSERT INTO devices (device_id, user_id, device_name, topic_name) VALUES ('device-2', 'user-1', 'd2', 't2')`,
+		} {
+			if _, err := s.db.Exec(ctx, q); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := s.db.Exec(ctx, `INSERT INTO device_schemas (device_id, message_type, descriptor_set) VALUES ($1, $2, $3)`, "device-1", "sensors.v1.Reading", []byte{0x0a, 0x00}); err != nil {
+			t.Fatal(err)
+		}
+
+		schema, err := s.GetDeviceSchema(ctx, "device-1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if schema.MessageType != "sensors.v1.Reading" || !bytes.Equal(schema.DescriptorSet, []byte{0x0a, 0x00}) {
+			t.Errorf("unexpected schema %+v", schema)
+		}
+
+		if _, err := s.GetDeviceSchema(ctx, "device-2"); !errors.Is(err, pgx.ErrNoRows) {
+			t.Errorf("expected pgx.ErrNoRows, got %v", err)
+		}
+	})
+}
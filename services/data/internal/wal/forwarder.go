@@ -0,0 +1,259 @@
+package wal
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/RaghibA/iot-telemetry/pkg/broker"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	defaultMinBackoff = time.Second
+	defaultMaxBackoff = 30 * time.Second
+)
+
+// ForwarderOptions configures a Forwarder.
+type ForwarderOptions struct {
+	// Depth and Bytes, if set, report the number of buffered messages and the size of the log.
+	Depth prometheus.Gauge
+	Bytes prometheus.Gauge
+	// MinBackoff and MaxBackoff bound the wait between attempts to publish the oldest
+	// buffered message, which doubles while the broker is unavailable. They default to 1s
+	// and 30s.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+// Forwarder is a broker whose publishes fall back to a Log when the broker fails, and
+// succeed once the message is buffered. A background replayer publishes buffered messages
+// in order. New messages are buffered behind them until the log is drained, so a device's
+// messages keep their order across an outage. Buffered messages keep the request ID and
+// trace context they were published with, and are replayed in that trace.
+type Forwarder struct {
+	broker.Broker
+	log    *Log
+	logger *slog.Logger
+	opts   ForwarderOptions
+
+	// mu is held for reading by appends and for writing when the log is found drained, so
+	// no publish skips the log while it still holds messages. It is not held while
+	// publishing to the broker, so a slow broker does not hold up the replayer and every
+	// publish waiting behind it.
+	mu        sync.RWMutex
+	buffering atomic.Bool
+
+	wake    chan struct{}
+	ctx     context.Context
+	cancel  context.CancelFunc
+	stopped chan struct{}
+}
+
+// NewForwarder wraps a broker with a log and starts replaying the messages the log holds.
+// Params:
+// - b: broker.Broker - the broker messages are published to
+// - log: *Log - the log buffering messages, closed by Stop
+// - logger: *slog.Logger - the logger instance
+// - opts: ForwarderOptions - the metrics and replay backoff
+// Returns:
+// - *Forwarder: the forwarder, stopped with Stop
+func NewForwarder(b broker.Broker, log *Log, logger *slog.Logger, opts ForwarderOptions) *Forwarder {
+	if opts.MinBackoff <= 0 {
+		opts.MinBackoff = defaultMinBackoff
+	}
+	if opts.MaxBackoff < opts.MinBackoff {
+		opts.MaxBackoff = max(defaultMaxBackoff, opts.MinBackoff)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	f := &Forwarder{
+		Broker:  b,
+		log:     log,
+		logger:  logger,
+		opts:    opts,
+		wake:    make(chan struct{}, 1),
+		ctx:     ctx,
+		cancel:  cancel,
+		stopped: make(chan struct{}),
+	}
+	if depth := log.Depth(); depth > 0 {
+		logger.Warn("replaying buffered telemetry", "depth", depth)
+		f.buffering.Store(true)
+	}
+	f.report()
+
+	go f.replay()
+	return f
+}
+
+// Publish publishes a message to the broker, or appends it to the log if the broker fails
+// or the log holds older messages. Buffered messages are given offset 0.
+// Params:
+// - ctx: context.Context - the request context
+// - stream: string - the stream to publish to
+// - msg: broker.Message - the message
+// Returns:
+// - uint64: the offset of the message, 0 if it was buffered
+// - error: broker.ErrStreamNotFound for unknown streams, or error if the log is full
+func (f *Forwarder) Publish(ctx context.Context, stream string, msg broker.Message) (uint64, error) {
+	if !f.buffering.Load() {
+		offset, err := f.Broker.Publish(ctx, stream, msg)
+		// a missing stream would fail again on replay, and a cancelled request says nothing
+		// about the broker
+		if err == nil || errors.Is(err, broker.ErrStreamNotFound) || ctx.Err() != nil {
+			return offset, err
+		}
+		return 0, f.append(ctx, stream, msg, err)
+	}
+	return 0, f.append(ctx, stream, msg, nil)
+}
+
+// append buffers a message in the log, switching publishes to the log if the broker
+// failed.
+// Params:
+// - ctx: context.Context - the request context
+// - stream: string - the stream to publish to
+// - msg: broker.Message - the message
+// - cause: error - the broker error, nil if publishes were already buffered
+// Returns:
+// - error: ErrFull if the log is full, or the write error
+func (f *Forwarder) append(ctx context.Context, stream string, msg broker.Message, cause error) error {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	// set under mu, so the log is not found drained before the message is appended
+	if f.buffering.CompareAndSwap(false, true) {
+		f.logger.WarnContext(ctx, "broker unavailable, buffering telemetry in the write-ahead log", "err", cause)
+	}
+
+	// the broker did not get the message, so the trace context it would have carried is
+	// kept in the log for the replay
+	msg.Stream = stream
+	msg.Headers = broker.InjectHeaders(ctx, msg.Headers)
+	if err := f.log.Append(msg); err != nil {
+		return err
+	}
+	f.report()
+	select {
+	case f.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Ping reports the broker as usable while messages can be buffered, so a broker outage
+// does not take the service out of rotation.
+// Params:
+// - ctx: context.Context - the check context
+// Returns:
+// - error: error if the broker is unavailable and the log is full
+func (f *Forwarder) Ping(ctx context.Context) error {
+	err := f.Broker.Ping(ctx)
+	if err != nil && f.log.Full() {
+		return errors.Join(err, ErrFull)
+	}
+	return nil
+}
+
+// Stop stops the replayer, waiting for a publish in progress, and closes the log. Messages
+// left in the log are replayed when it is opened again.
+// Params: None
+// Returns:
+// - error: error if the log cannot be flushed
+func (f *Forwarder) Stop() error {
+	f.cancel()
+	<-f.stopped
+	return f.log.Close()
+}
+
+// replay publishes buffered messages in order, retrying the oldest with a growing backoff
+// while the broker fails.
+func (f *Forwarder) replay() {
+	defer close(f.stopped)
+	backoff := f.opts.MinBackoff
+	for {
+		msg, ok, err := f.log.Next()
+		if err != nil {
+			f.logger.Error("failed to read the write-ahead log", "err", err)
+			f.report()
+			if !f.sleep(f.opts.MinBackoff) {
+				return
+			}
+			continue
+		}
+		if !ok {
+			if !f.drained() {
+				continue
+			}
+			select {
+			case <-f.wake:
+				continue
+			case <-f.ctx.Done():
+				return
+			}
+		}
+
+		_, err = f.Broker.Publish(broker.ContextFromHeaders(f.ctx, msg.Headers), msg.Stream, msg)
+		switch {
+		case errors.Is(err, broker.ErrStreamNotFound):
+			f.logger.Warn("dropped buffered telemetry of a deleted stream", "stream", msg.Stream)
+		case err != nil:
+			if f.ctx.Err() != nil {
+				return
+			}
+			f.logger.Warn("replay of buffered telemetry failed, retrying", "stream", msg.Stream, "retry_in", backoff, "err", err)
+			if !f.sleep(backoff) {
+				return
+			}
+			backoff = min(2*backoff, f.opts.MaxBackoff)
+			continue
+		}
+		backoff = f.opts.MinBackoff
+
+		if err := f.log.Commit(); err != nil {
+			f.logger.Error("failed to remove replayed telemetry from the write-ahead log", "err", err)
+		}
+		f.report()
+	}
+}
+
+// sleep waits for d, returning false if the forwarder is stopped first.
+func (f *Forwarder) sleep(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-f.ctx.Done():
+		return false
+	}
+}
+
+// drained switches publishes back to the broker once the log is empty.
+// Params: None
+// Returns:
+// - bool: false if messages were appended since the log was read
+func (f *Forwarder) drained() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.log.Depth() > 0 {
+		return false
+	}
+	if f.buffering.Swap(false) {
+		f.logger.Info("write-ahead log drained, publishing telemetry to the broker")
+	}
+	return true
+}
+
+// report updates the log metrics.
+func (f *Forwarder) report() {
+	if f.opts.Depth != nil {
+		f.opts.Depth.Set(float64(f.log.Depth()))
+	}
+	if f.opts.Bytes != nil {
+		f.opts.Bytes.Set(float64(f.log.Bytes()))
+	}
+}
@@ -0,0 +1,295 @@
+package wal
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/RaghibA/iot-telemetry/pkg/broker"
+	"github.com/RaghibA/iot-telemetry/pkg/broker/memory"
+	"github.com/RaghibA/iot-telemetry/pkg/logging"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var testLogger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+var errUnavailable = errors.New("broker unavailable")
+
+// flakyBroker is a memory broker whose publishes fail while it is down.
+type flakyBroker struct {
+	broker.Broker
+	mu   sync.Mutex
+	down bool
+}
+
+func (b *flakyBroker) setDown(down bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.down = down
+}
+
+func (b *flakyBroker) Publish(ctx context.Context, stream string, msg broker.Message) (uint64, error) {
+	b.mu.Lock()
+	down := b.down
+	b.mu.Unlock()
+	if down {
+		return 0, errUnavailable
+	}
+	return b.Broker.Publish(ctx, stream, msg)
+}
+
+func (b *flakyBroker) Ping(ctx context.Context) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.down {
+		return errUnavailable
+	}
+	return nil
+}
+
+// blockingBroker is a memory broker whose publishes wait until release is closed.
+type blockingBroker struct {
+	broker.Broker
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (b *blockingBroker) Publish(ctx context.Context, stream string, msg broker.Message) (uint64, error) {
+	b.entered <- struct{}{}
+	<-b.release
+	return b.Broker.Publish(ctx, stream, msg)
+}
+
+// newTestForwarder forwards to a flaky broker with stream1, returning a subscription to it
+// and the depth gauge.
+func newTestForwarder(t *testing.T, opts Options) (*Forwarder, *flakyBroker, broker.Subscription, prometheus.Gauge) {
+	t.Helper()
+	b := &flakyBroker{Broker: memory.New(memory.DefaultCapacity)}
+	t.Cleanup(func() { b.Close() })
+	if err := b.CreateStream(context.Background(), "stream1"); err != nil {
+		t.Fatal(err)
+	}
+	sub, err := b.Subscribe(context.Background(), "stream1", broker.SubscribeOptions{Start: broker.StartOldest})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sub.Close() })
+
+	l, err := Open(t.TempDir(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	depth := prometheus.NewGauge(prometheus.GaugeOpts{Name: "test_wal_depth"})
+	f := NewForwarder(b, l, testLogger, ForwarderOptions{Depth: depth, MinBackoff: time.Millisecond, MaxBackoff: 10 * time.Millisecond})
+	t.Cleanup(func() { f.Stop() })
+	return f, b, sub, depth
+}
+
+// receive reads n messages, checking they are the test messages from first.
+func receive(t *testing.T, sub broker.Subscription, first int, n int) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for i := first; i < first+n; i++ {
+		msg, err := sub.Next(ctx)
+		if err != nil {
+			t.Fatalf("expected message %d, got %v", i, err)
+		}
+		if want := testMessage(i); string(msg.Value) != string(want.Value) {
+			t.Fatalf("expected %s, got %s", want.Value, msg.Value)
+		}
+	}
+}
+
+func publish(t *testing.T, f *Forwarder, first int, n int) {
+	t.Helper()
+	for i := first; i < first+n; i++ {
+		if _, err := f.Publish(context.Background(), "stream1", testMessage(i)); err != nil {
+			t.Fatalf("publish %d: %v", i, err)
+		}
+	}
+}
+
+func TestForwarder(t *testing.T) {
+
+	t.Run("should publish to the broker while it is available", func(t *testing.T) {
+		f, _, sub, depth := newTestForwarder(t, testOptions())
+
+		publish(t, f, 0, 3)
+		receive(t, sub, 0, 3)
+		if got := testutil.ToFloat64(depth); got != 0 {
+			t.Errorf("expected nothing buffered, got depth %v", got)
+		}
+	})
+
+	t.Run("should buffer while the broker is down and replay in order", func(t *testing.T) {
+		f, b, sub, depth := newTestForwarder(t, testOptions())
+
+		b.setDown(true)
+		publish(t, f, 0, 5)
+		if got := testutil.ToFloat64(depth); got != 5 {
+			t.Errorf("expected depth 5, got %v", got)
+		}
+		if err := f.Ping(context.Background()); err != nil {
+			t.Errorf("expected the forwarder to be ready while it can buffer, got %v", err)
+		}
+
+		b.setDown(false)
+		// published behind the buffered messages, not ahead of them
+		publish(t, f, 5, 5)
+		receive(t, sub, 0, 10)
+
+		deadline := time.Now().Add(5 * time.Second)
+		for f.buffering.Load() && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		if f.buffering.Load() || testutil.ToFloat64(depth) != 0 {
+			t.Fatalf("expected the log to be drained, got depth %v", testutil.ToFloat64(depth))
+		}
+		publish(t, f, 10, 1)
+		receive(t, sub, 10, 1)
+	})
+
+	t.Run("should keep the trace context and request id of buffered messages", func(t *testing.T) {
+		otel.SetTracerProvider(sdktrace.NewTracerProvider())
+		otel.SetTextMapPropagator(propagation.TraceContext{})
+
+		b := &flakyBroker{Broker: memory.New(memory.DefaultCapacity)}
+		defer b.Close()
+		b.CreateStream(context.Background(), "stream1")
+		sub, err := b.Subscribe(context.Background(), "stream1", broker.SubscribeOptions{Start: broker.StartOldest})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer sub.Close()
+		l, err := Open(t.TempDir(), testOptions())
+		if err != nil {
+			t.Fatal(err)
+		}
+		// wrapping the instrumented broker, as the data service does
+		f := NewForwarder(broker.Instrument(b, "memory"), l, testLogger, ForwarderOptions{MinBackoff: time.Millisecond})
+		defer f.Stop()
+
+		ctx, span := otel.Tracer("test").Start(logging.WithRequestID(context.Background(), "req-123"), "ingest")
+		defer span.End()
+		b.setDown(true)
+		if _, err := f.Publish(ctx, "stream1", testMessage(0)); err != nil {
+			t.Fatal(err)
+		}
+		b.setDown(false)
+
+		nextCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		msg, err := sub.Next(nextCtx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.Headers[broker.RequestIDHeader] != "req-123" {
+			t.Errorf("expected the request id header, got %v", msg.Headers)
+		}
+		producer := trace.SpanContextFromContext(otel.GetTextMapPropagator().Extract(context.Background(), propagation.MapCarrier(msg.Headers)))
+		if producer.TraceID() != span.SpanContext().TraceID() {
+			t.Errorf("expected the replayed message in the ingest trace, got traceparent %q", msg.Headers["traceparent"])
+		}
+	})
+
+	t.Run("should not hold up the replayer while a publish waits on the broker", func(t *testing.T) {
+		b := &blockingBroker{Broker: memory.New(memory.DefaultCapacity), entered: make(chan struct{}), release: make(chan struct{})}
+		defer b.Close()
+		b.CreateStream(context.Background(), "stream1")
+		l, err := Open(t.TempDir(), testOptions())
+		if err != nil {
+			t.Fatal(err)
+		}
+		f := NewForwarder(b, l, testLogger, ForwarderOptions{})
+		defer f.Stop()
+
+		published := make(chan error, 1)
+		go func() {
+			_, err := f.Publish(context.Background(), "stream1", testMessage(0))
+			published <- err
+		}()
+		<-b.entered
+
+		done := make(chan bool, 1)
+		go func() { done <- f.drained() }()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Error("expected the log to be found drained while the publish waits")
+		}
+
+		close(b.release)
+		if err := <-published; err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("should replay messages left by a previous run", func(t *testing.T) {
+		dir := t.TempDir()
+		l, err := Open(dir, testOptions())
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 3; i++ {
+			if err := l.Append(testMessage(i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		l.Close()
+
+		b := &flakyBroker{Broker: memory.New(memory.DefaultCapacity)}
+		defer b.Close()
+		b.CreateStream(context.Background(), "stream1")
+		sub, err := b.Subscribe(context.Background(), "stream1", broker.SubscribeOptions{Start: broker.StartOldest})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer sub.Close()
+
+		l, err = Open(dir, testOptions())
+		if err != nil {
+			t.Fatal(err)
+		}
+		f := NewForwarder(b, l, testLogger, ForwarderOptions{MinBackoff: time.Millisecond})
+		defer f.Stop()
+		publish(t, f, 3, 1)
+		receive(t, sub, 0, 4)
+	})
+
+	t.Run("should not buffer messages to unknown streams", func(t *testing.T) {
+		f, _, _, depth := newTestForwarder(t, testOptions())
+
+		if _, err := f.Publish(context.Background(), "unknown", testMessage(0)); !errors.Is(err, broker.ErrStreamNotFound) {
+			t.Errorf("expected ErrStreamNotFound, got %v", err)
+		}
+		if got := testutil.ToFloat64(depth); got != 0 {
+			t.Errorf("expected nothing buffered, got depth %v", got)
+		}
+	})
+
+	t.Run("should fail publishes and readiness once the log is full", func(t *testing.T) {
+		f, b, _, _ := newTestForwarder(t, Options{SegmentBytes: 256, MaxBytes: 256})
+
+		b.setDown(true)
+		var err error
+		for i := 0; i < 10 && err == nil; i++ {
+			_, err = f.Publish(context.Background(), "stream1", testMessage(i))
+		}
+		if !errors.Is(err, ErrFull) {
+			t.Errorf("expected ErrFull, got %v", err)
+		}
+		if err := f.Ping(context.Background()); err == nil {
+			t.Error("expected the forwarder not to be ready")
+		}
+	})
+}
@@ -0,0 +1,578 @@
+// Package wal buffers telemetry on local disk while the broker is unavailable. Messages are
+// appended to a write-ahead log of segment files and acknowledged, then published in order
+// once the broker recovers.
+package wal
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/RaghibA/iot-telemetry/pkg/broker"
+	"github.com/RaghibA/iot-telemetry/pkg/config"
+)
+
+const (
+	segmentExt = ".wal"
+	cursorName = "cursor"
+	// headerSize is the length and CRC-32C of a record, written before its data
+	headerSize = 8
+)
+
+var (
+	// ErrFull is returned by Append when the log has reached its size cap.
+	ErrFull = errors.New("wal: full")
+	// ErrClosed is returned by Append after Close.
+	ErrClosed = errors.New("wal: closed")
+	// errCorrupt is returned by Next for a record that fails its checksum.
+	errCorrupt = errors.New("wal: corrupt record")
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Options configures a Log.
+type Options struct {
+	// Sync is when appends are flushed to disk: config.WALSyncAlways before Append returns,
+	// config.WALSyncInterval every SyncInterval, or config.WALSyncNone, left to the OS.
+	Sync         string
+	SyncInterval time.Duration
+	// SegmentBytes is the size at which a new segment file is started.
+	SegmentBytes int64
+	// MaxBytes caps the size of the segment files, appends beyond it fail with ErrFull.
+	MaxBytes int64
+}
+
+// segment is a file of records, named after its ID.
+type segment struct {
+	id   uint64
+	size int64
+	// records is the number of unread records
+	records int64
+}
+
+// record is the stored form of a message.
+type record struct {
+	Stream    string            `json:"stream"`
+	Key       string            `json:"key,omitempty"`
+	Value     []byte            `json:"value"`
+	Headers   map[string]string `json:"headers,omitempty"`
+	Timestamp time.Time         `json:"timestamp"`
+}
+
+// Log is a write-ahead log of messages, appended by any goroutine and read in order by one.
+// Records are read with Next and removed with Commit, and the position of the reader is
+// kept in a cursor file, so a restart resumes after the last committed record. A record
+// may be read again after a crash, so messages are forwarded at least once.
+type Log struct {
+	dir  string
+	opts Options
+
+	mu sync.Mutex
+	// segments are the files on disk, oldest first. The last one is appended to while
+	// active is open.
+	segments []segment
+	active   *os.File
+	reader   *os.File
+	readerID uint64
+	cursor   *os.File
+	// offset is the position of the next record in the first segment
+	offset int64
+	// next is the position after the record returned by Next, 0 if none is pending
+	next   int64
+	lastID uint64
+	depth  int64
+	bytes  int64
+	dirty  bool
+	// full is set when an append is refused, until a segment is removed
+	full   bool
+	closed bool
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// Open opens the log in dir, creating it if needed. Records after the cursor are kept, and
+// a record torn by a crash during its append is cut off with the rest of its segment.
+// Params:
+// - dir: string - the directory of the segment files
+// - opts: Options - the sync policy and size limits
+// Returns:
+// - *Log: the log
+// - error: error if the directory or its files cannot be read
+func Open(dir string, opts Options) (*Log, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("wal: %w", err)
+	}
+	l := &Log{dir: dir, opts: opts, stop: make(chan struct{})}
+
+	cursor, err := os.OpenFile(filepath.Join(dir, cursorName), os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("wal: %w", err)
+	}
+	l.cursor = cursor
+	var pos [16]byte
+	var headID uint64
+	var headOffset int64
+	if _, err := io.ReadFull(cursor, pos[:]); err == nil {
+		headID = binary.BigEndian.Uint64(pos[:8])
+		headOffset = int64(binary.BigEndian.Uint64(pos[8:]))
+	}
+	l.lastID = headID
+
+	ids, err := l.segmentIDs()
+	if err != nil {
+		cursor.Close()
+		return nil, err
+	}
+	for _, id := range ids {
+		l.lastID = max(l.lastID, id)
+		var start int64
+		switch {
+		case id < headID:
+			// read before a crash kept it from being removed
+			if err := os.Remove(l.path(id)); err != nil {
+				cursor.Close()
+				return nil, fmt.Errorf("wal: %w", err)
+			}
+			continue
+		case id == headID:
+			start = headOffset
+		}
+
+		size, count, err := scan(l.path(id), start)
+		if err != nil {
+			cursor.Close()
+			return nil, err
+		}
+		if count == 0 {
+			if err := os.Remove(l.path(id)); err != nil {
+				cursor.Close()
+				return nil, fmt.Errorf("wal: %w", err)
+			}
+			continue
+		}
+		if len(l.segments) == 0 {
+			l.offset = start
+		}
+		l.segments = append(l.segments, segment{id: id, size: size, records: count})
+		l.depth += count
+		l.bytes += size
+	}
+	if err := l.writeCursor(); err != nil {
+		cursor.Close()
+		return nil, err
+	}
+
+	if opts.Sync == config.WALSyncInterval {
+		l.wg.Add(1)
+		go l.syncEvery(opts.SyncInterval)
+	}
+	return l, nil
+}
+
+// Append adds a message to the end of the log. Appends after a restart start a new segment.
+// Params:
+// - msg: broker.Message - the message, with its Stream set
+// Returns:
+// - error: ErrFull if the log is at its size cap, or the write error
+func (l *Log) Append(msg broker.Message) error {
+	data, err := json.Marshal(record{Stream: msg.Stream, Key: msg.Key, Value: msg.Value, Headers: msg.Headers, Timestamp: msg.Timestamp})
+	if err != nil {
+		return fmt.Errorf("wal: encode: %w", err)
+	}
+	buf := make([]byte, headerSize+len(data))
+	binary.BigEndian.PutUint32(buf[:4], uint32(len(data)))
+	binary.BigEndian.PutUint32(buf[4:8], crc32.Checksum(data, crcTable))
+	copy(buf[headerSize:], data)
+	n := int64(len(buf))
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return ErrClosed
+	}
+	if l.bytes+n > l.opts.MaxBytes {
+		l.full = true
+		return ErrFull
+	}
+	if l.active == nil || l.segments[len(l.segments)-1].size+n > l.opts.SegmentBytes {
+		if err := l.roll(); err != nil {
+			return err
+		}
+	}
+
+	tail := &l.segments[len(l.segments)-1]
+	if _, err := l.active.Write(buf); err != nil {
+		// drop a partial record so later appends stay readable
+		l.active.Truncate(tail.size)
+		return fmt.Errorf("wal: append: %w", err)
+	}
+	tail.size += n
+	tail.records++
+	l.bytes += n
+	l.depth++
+
+	switch l.opts.Sync {
+	case config.WALSyncAlways:
+		if err := l.active.Sync(); err != nil {
+			return fmt.Errorf("wal: sync: %w", err)
+		}
+	case config.WALSyncInterval:
+		l.dirty = true
+	}
+	return nil
+}
+
+// Next returns the oldest record of the log without removing it, which Commit does once it
+// is forwarded. Calling Next again before Commit returns the same record.
+// Params: None
+// Returns:
+// - broker.Message: the message
+// - bool: false if the log is empty
+// - error: error if the record cannot be read. A corrupt record is dropped with the rest
+// of its segment.
+func (l *Log) Next() (broker.Message, bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return broker.Message{}, false, ErrClosed
+	}
+
+	for {
+		if len(l.segments) == 0 {
+			return broker.Message{}, false, nil
+		}
+		if l.offset < l.segments[0].size {
+			break
+		}
+		if len(l.segments) == 1 {
+			// read up to the segment being appended to
+			return broker.Message{}, false, nil
+		}
+		if err := l.removeHead(); err != nil {
+			return broker.Message{}, false, err
+		}
+	}
+
+	head := l.segments[0]
+	if l.reader == nil || l.readerID != head.id {
+		if l.reader != nil {
+			l.reader.Close()
+		}
+		f, err := os.Open(l.path(head.id))
+		if err != nil {
+			l.reader = nil
+			return broker.Message{}, false, fmt.Errorf("wal: %w", err)
+		}
+		l.reader, l.readerID = f, head.id
+	}
+
+	l.next = 0
+	data, err := readRecord(l.reader, l.offset, head.size)
+	if err != nil {
+		// nothing after a bad record can be trusted to start at a record boundary
+		l.depth -= head.records
+		l.segments[0].records = 0
+		l.offset = head.size
+		return broker.Message{}, false, err
+	}
+	end := l.offset + headerSize + int64(len(data))
+	var rec record
+	if err := json.Unmarshal(data, &rec); err != nil {
+		l.depth--
+		l.segments[0].records--
+		l.offset = end
+		return broker.Message{}, false, fmt.Errorf("wal: decode: %w", err)
+	}
+	l.next = end
+	return broker.Message{Stream: rec.Stream, Key: rec.Key, Value: rec.Value, Headers: rec.Headers, Timestamp: rec.Timestamp}, true, nil
+}
+
+// Commit removes the record returned by the last Next call. Drained segments are deleted.
+// Params: None
+// Returns:
+// - error: error if a segment cannot be deleted or the cursor cannot be saved
+func (l *Log) Commit() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.next == 0 {
+		return nil
+	}
+	l.offset, l.next = l.next, 0
+	l.segments[0].records--
+	l.depth--
+
+	if l.depth == 0 {
+		// the log is drained, start over with an empty segment on the next append
+		for len(l.segments) > 0 {
+			if err := l.removeHead(); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return l.writeCursor()
+}
+
+// Depth returns the number of records in the log.
+func (l *Log) Depth() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.depth
+}
+
+// Bytes returns the size of the segment files, which counts against Options.MaxBytes.
+func (l *Log) Bytes() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.bytes
+}
+
+// Full reports whether an append was refused since the last segment was removed.
+func (l *Log) Full() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.full
+}
+
+// Close flushes the segment being appended to and closes the log.
+// Params: None
+// Returns:
+// - error: error if the segment cannot be flushed
+func (l *Log) Close() error {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return nil
+	}
+	l.closed = true
+	close(l.stop)
+	l.mu.Unlock()
+	l.wg.Wait()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var errs []error
+	if l.active != nil {
+		if l.opts.Sync != config.WALSyncNone {
+			errs = append(errs, l.active.Sync())
+		}
+		errs = append(errs, l.active.Close())
+	}
+	if l.reader != nil {
+		errs = append(errs, l.reader.Close())
+	}
+	errs = append(errs, l.cursor.Close())
+	return errors.Join(errs...)
+}
+
+// roll starts a new segment to append to.
+func (l *Log) roll() error {
+	if l.active != nil {
+		if l.opts.Sync != config.WALSyncNone {
+			if err := l.active.Sync(); err != nil {
+				return fmt.Errorf("wal: sync: %w", err)
+			}
+		}
+		l.active.Close()
+		l.active = nil
+	}
+
+	id := l.lastID + 1
+	f, err := os.OpenFile(l.path(id), os.O_WRONLY|os.O_CREATE|os.O_EXCL|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("wal: %w", err)
+	}
+	if l.opts.Sync == config.WALSyncAlways {
+		// the new file must survive a crash along with its records
+		if err := syncDir(l.dir); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	l.lastID = id
+	l.active = f
+	l.segments = append(l.segments, segment{id: id})
+	if len(l.segments) == 1 {
+		l.offset = 0
+		return l.writeCursor()
+	}
+	return nil
+}
+
+// removeHead deletes the first segment, which has been read.
+func (l *Log) removeHead() error {
+	head := l.segments[0]
+	if l.reader != nil && l.readerID == head.id {
+		l.reader.Close()
+		l.reader = nil
+	}
+	if len(l.segments) == 1 && l.active != nil {
+		l.active.Close()
+		l.active = nil
+	}
+	if err := os.Remove(l.path(head.id)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("wal: %w", err)
+	}
+	l.segments = l.segments[1:]
+	l.bytes -= head.size
+	l.full = false
+	l.offset = 0
+	return l.writeCursor()
+}
+
+// writeCursor saves the position of the next record, so it is not forwarded again after a
+// restart. It is not synced: a lost update only forwards records again.
+func (l *Log) writeCursor() error {
+	var pos [16]byte
+	if len(l.segments) > 0 {
+		binary.BigEndian.PutUint64(pos[:8], l.segments[0].id)
+		binary.BigEndian.PutUint64(pos[8:], uint64(l.offset))
+	} else {
+		binary.BigEndian.PutUint64(pos[:8], l.lastID+1)
+	}
+	if _, err := l.cursor.WriteAt(pos[:], 0); err != nil {
+		return fmt.Errorf("wal: save cursor: %w", err)
+	}
+	return nil
+}
+
+// syncEvery flushes appends to disk every interval, for config.WALSyncInterval.
+func (l *Log) syncEvery(interval time.Duration) {
+	defer l.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			l.mu.Lock()
+			if l.dirty && l.active != nil {
+				l.active.Sync()
+				l.dirty = false
+			}
+			l.mu.Unlock()
+		case <-l.stop:
+			return
+		}
+	}
+}
+
+func (l *Log) path(id uint64) string {
+	return filepath.Join(l.dir, fmt.Sprintf("%020d%s", id, segmentExt))
+}
+
+// segmentIDs lists the segments in the directory, oldest first.
+func (l *Log) segmentIDs() ([]uint64, error) {
+	entries, err := os.ReadDir(l.dir)
+	if err != nil {
+		return nil, fmt.Errorf("wal: %w", err)
+	}
+	var ids []uint64
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), segmentExt)
+		if !ok || entry.IsDir() {
+			continue
+		}
+		id, err := strconv.ParseUint(name, 10, 64)
+		if err != nil {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	return ids, nil
+}
+
+// scan counts the records of a segment from start, cutting the file off after the last
+// whole record.
+// Params:
+// - path: string - the segment file
+// - start: int64 - the offset of the first unread record
+// Returns:
+// - int64: the size of the segment after the last whole record
+// - int64: the number of records from start
+// - error: error if the file cannot be read or truncated
+func scan(path string, start int64) (int64, int64, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return 0, 0, fmt.Errorf("wal: %w", err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return 0, 0, fmt.Errorf("wal: %w", err)
+	}
+	size := info.Size()
+	if start > size {
+		return size, 0, nil
+	}
+
+	var count int64
+	end := start
+	for end < size {
+		data, err := readRecord(f, end, size)
+		if err != nil {
+			break
+		}
+		end += headerSize + int64(len(data))
+		count++
+	}
+	if end < size {
+		if err := f.Truncate(end); err != nil {
+			return 0, 0, fmt.Errorf("wal: truncate torn record: %w", err)
+		}
+	}
+	return end, count, nil
+}
+
+// readRecord reads and checks the record at offset.
+// Params:
+// - f: *os.File - the segment
+// - offset: int64 - the offset of the record
+// - size: int64 - the size of the segment
+// Returns:
+// - []byte: the record data
+// - error: errCorrupt if the record is incomplete or fails its checksum
+func readRecord(f *os.File, offset int64, size int64) ([]byte, error) {
+	var header [headerSize]byte
+	if size-offset < headerSize {
+		return nil, errCorrupt
+	}
+	if _, err := f.ReadAt(header[:], offset); err != nil {
+		return nil, fmt.Errorf("wal: read: %w", err)
+	}
+	length := int64(binary.BigEndian.Uint32(header[:4]))
+	if length > size-offset-headerSize {
+		return nil, errCorrupt
+	}
+	data := make([]byte, length)
+	if _, err := f.ReadAt(data, offset+headerSize); err != nil {
+		return nil, fmt.Errorf("wal: read: %w", err)
+	}
+	if crc32.Checksum(data, crcTable) != binary.BigEndian.Uint32(header[4:]) {
+		return nil, errCorrupt
+	}
+	return data, nil
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("wal: %w", err)
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("wal: sync: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,212 @@
+package wal
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/RaghibA/iot-telemetry/pkg/broker"
+	"github.com/RaghibA/iot-telemetry/pkg/config"
+)
+
+func testOptions() Options {
+	return Options{Sync: config.WALSyncAlways, SegmentBytes: 256, MaxBytes: 1 << 20}
+}
+
+func openLog(t *testing.T, dir string, opts Options) *Log {
+	t.Helper()
+	l, err := Open(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	return l
+}
+
+func testMessage(i int) broker.Message {
+	return broker.Message{
+		Stream:    "stream1",
+		Key:       "device1",
+		Value:     []byte(fmt.Sprintf(`{"n":%d}`, i)),
+		Headers:   map[string]string{broker.ContentTypeHeader: "application/json"},
+		Timestamp: time.Date(2026, 3, 1, 12, 0, i, 0, time.UTC),
+	}
+}
+
+// drain reads and commits n records, checking they are the test messages from first.
+func drain(t *testing.T, l *Log, first int, n int) {
+	t.Helper()
+	for i := first; i < first+n; i++ {
+		msg, ok, err := l.Next()
+		if err != nil || !ok {
+			t.Fatalf("record %d: expected a record, got %v %v", i, ok, err)
+		}
+		want := testMessage(i)
+		if msg.Stream != want.Stream || msg.Key != want.Key || string(msg.Value) != string(want.Value) ||
+			msg.Headers[broker.ContentTypeHeader] != "application/json" || !msg.Timestamp.Equal(want.Timestamp) {
+			t.Fatalf("record %d: expected %+v, got %+v", i, want, msg)
+		}
+		if err := l.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func segmentFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	files, err := filepath.Glob(filepath.Join(dir, "*"+segmentExt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestLog(t *testing.T) {
+
+	t.Run("should read records in order across segments", func(t *testing.T) {
+		dir := t.TempDir()
+		l := openLog(t, dir, testOptions())
+
+		for i := 0; i < 10; i++ {
+			if err := l.Append(testMessage(i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if l.Depth() != 10 {
+			t.Errorf("expected depth 10, got %d", l.Depth())
+		}
+		if files := segmentFiles(t, dir); len(files) < 2 {
+			t.Errorf("expected the records to span segments, got %v", files)
+		}
+
+		drain(t, l, 0, 10)
+		if _, ok, err := l.Next(); ok || err != nil {
+			t.Errorf("expected an empty log, got %v %v", ok, err)
+		}
+		if l.Depth() != 0 || l.Bytes() != 0 {
+			t.Errorf("expected an empty log, got depth %d and %d bytes", l.Depth(), l.Bytes())
+		}
+		if files := segmentFiles(t, dir); len(files) != 0 {
+			t.Errorf("expected drained segments to be removed, got %v", files)
+		}
+	})
+
+	t.Run("should return the same record until it is committed", func(t *testing.T) {
+		l := openLog(t, t.TempDir(), testOptions())
+		for i := 0; i < 2; i++ {
+			if err := l.Append(testMessage(i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		first, _, _ := l.Next()
+		again, _, _ := l.Next()
+		if string(first.Value) != string(again.Value) {
+			t.Errorf("expected the same record, got %s and %s", first.Value, again.Value)
+		}
+		if err := l.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		drain(t, l, 1, 1)
+	})
+
+	t.Run("should resume after the committed records when reopened", func(t *testing.T) {
+		dir := t.TempDir()
+		l, err := Open(dir, testOptions())
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 6; i++ {
+			if err := l.Append(testMessage(i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		drain(t, l, 0, 4)
+		if err := l.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		l = openLog(t, dir, testOptions())
+		if l.Depth() != 2 {
+			t.Fatalf("expected 2 records left, got %d", l.Depth())
+		}
+		if err := l.Append(testMessage(6)); err != nil {
+			t.Fatal(err)
+		}
+		drain(t, l, 4, 3)
+	})
+
+	t.Run("should cut off a record torn by a crash", func(t *testing.T) {
+		dir := t.TempDir()
+		l, err := Open(dir, Options{Sync: config.WALSyncNone, SegmentBytes: 1 << 20, MaxBytes: 1 << 20})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 2; i++ {
+			if err := l.Append(testMessage(i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		l.Close()
+
+		files := segmentFiles(t, dir)
+		f, err := os.OpenFile(files[len(files)-1], os.O_WRONLY|os.O_APPEND, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write([]byte{0, 0, 1, 0, 0xde, 0xad, '{', '"'})
+		f.Close()
+
+		l = openLog(t, dir, testOptions())
+		if l.Depth() != 2 {
+			t.Fatalf("expected the 2 whole records, got %d", l.Depth())
+		}
+		if err := l.Append(testMessage(2)); err != nil {
+			t.Fatal(err)
+		}
+		drain(t, l, 0, 3)
+	})
+
+	t.Run("should refuse records over the size cap", func(t *testing.T) {
+		l := openLog(t, t.TempDir(), Options{Sync: config.WALSyncNone, SegmentBytes: 256, MaxBytes: 512})
+
+		var err error
+		appended := 0
+		for ; appended < 100; appended++ {
+			if err = l.Append(testMessage(appended)); err != nil {
+				break
+			}
+		}
+		if !errors.Is(err, ErrFull) {
+			t.Fatalf("expected ErrFull, got %v", err)
+		}
+		if l.Bytes() > 512 {
+			t.Errorf("expected at most 512 bytes, got %d", l.Bytes())
+		}
+
+		drain(t, l, 0, appended)
+		if err := l.Append(testMessage(appended)); err != nil {
+			t.Errorf("expected room once drained, got %v", err)
+		}
+	})
+
+	t.Run("should flush appends on an interval", func(t *testing.T) {
+		dir := t.TempDir()
+		l, err := Open(dir, Options{Sync: config.WALSyncInterval, SyncInterval: time.Millisecond, SegmentBytes: 1 << 20, MaxBytes: 1 << 20})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := l.Append(testMessage(0)); err != nil {
+			t.Fatal(err)
+		}
+		if err := l.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		l = openLog(t, dir, testOptions())
+		drain(t, l, 0, 1)
+	})
+}
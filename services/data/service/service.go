@@ -0,0 +1,56 @@
+// Package service exposes the data service routes so they can be mounted next to the
+// other services by the all-in-one binary.
+package service
+
+import (
+	"log/slog"
+	"net/http"
+
+	"github.com/RaghibA/iot-telemetry/db"
+	"github.com/RaghibA/iot-telemetry/pkg/broker"
+	"github.com/RaghibA/iot-telemetry/pkg/config"
+	"github.com/RaghibA/iot-telemetry/pkg/grpcserver"
+	"github.com/RaghibA/iot-telemetry/services/data/internal/server"
+	"github.com/gorilla/mux"
+)
+
+// Routes registers the data service routes under /api/v1/data on router, and its gRPC
+// ingestion API on grpcServer.
+// Params:
+// - router: *mux.Router - the router to register the routes on
+// - grpcServer: *grpcserver.Server - the gRPC server to register the API on
+// - cfg: *config.Config - the service configuration
+// - db: db.DB - the database
+// - logger: *slog.Logger - the logger instance
+// - broker: broker.Broker - the message broker instance
+// Returns: None
+func Routes(router *mux.Router, grpcServer *grpcserver.Server, cfg *config.Config, db db.DB, logger *slog.Logger, broker broker.Broker) {
+	server.NewDataServer(cfg, db, logger, broker).Routes(router, grpcServer)
+}
+
+// StartCoAP starts the CoAP listener when ingest.coapAddr is set, forwarding telemetry to
+// the data routes registered on handler.
+// Params:
+// - handler: http.Handler - the router the data routes are registered on
+// - cfg: *config.Config - the service configuration
+// - logger: *slog.Logger - the logger instance
+// Returns:
+// - func(): stops the listener
+// - error: error if the address cannot be listened on
+func StartCoAP(handler http.Handler, cfg *config.Config, logger *slog.Logger) (func(), error) {
+	return server.StartCoAP(handler, cfg, logger)
+}
+
+// StartWAL buffers telemetry in the write-ahead log when ingest.walDir is set, so it is
+// acknowledged while the broker is unavailable and published once it recovers.
+// Params:
+// - b: broker.Broker - the broker telemetry is published to
+// - cfg: *config.Config - the service configuration
+// - logger: *slog.Logger - the logger instance
+// Returns:
+// - broker.Broker: the broker to pass to Routes
+// - func(): stops the replay and closes the log
+// - error: error if the log cannot be opened
+func StartWAL(b broker.Broker, cfg *config.Config, logger *slog.Logger) (broker.Broker, func(), error) {
+	return server.StartWAL(b, cfg, logger)
+}